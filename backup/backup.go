@@ -0,0 +1,539 @@
+// Package backup implements incremental backups of raw disk images.
+//
+// A repository holds the backups of one disk image. Each backup records
+// the SHA-256 hash of every block of the image in its manifest and stores
+// the zstd-compressed blocks that are not part of the backup it is based
+// on, so nightly backups only write the blocks that changed since the
+// previous night. Any backup in a chain can be restored to a raw image,
+// and verified without restoring it.
+//
+// Backups read the disk image while holding a shared lock, so they fail
+// while a virtual machine writes to it. To back up a running virtual
+// machine, pause it, clone its disk with (*vz.VirtualMachine).CloneDiskImage,
+// resume it and back up the clone.
+//
+// A repository in dir is laid out as
+//
+//	dir/<id>/manifest.json
+//	dir/<id>/blocks
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mac-vz/vz/diskimage"
+	"github.com/rs/xid"
+)
+
+var (
+	// ErrNotFound is returned when a backup does not exist.
+	ErrNotFound = errors.New("backup: no such backup")
+
+	// ErrCorrupt is returned when a stored block does not match its hash.
+	ErrCorrupt = errors.New("backup: corrupt block")
+
+	// ErrHasChildren is returned when deleting a backup other backups are
+	// based on.
+	ErrHasChildren = errors.New("backup: backup has incremental children")
+)
+
+// DefaultBlockSize is the block size of new backup chains.
+const DefaultBlockSize = 1 << 20
+
+const (
+	manifestName = "manifest.json"
+	blocksName   = "blocks"
+)
+
+// Backup is the manifest of a backup.
+type Backup struct {
+	ID string `json:"id"`
+
+	// Parent is the ID of the backup this one is an increment of, or empty
+	// for a full backup.
+	Parent string `json:"parent,omitempty"`
+
+	Created   time.Time `json:"created"`
+	Size      int64     `json:"size"`
+	BlockSize int64     `json:"blockSize"`
+
+	// Hashes are the hex SHA-256 hashes of the blocks of the image, empty
+	// for blocks of zeros.
+	Hashes []string `json:"hashes"`
+
+	// Stored are the blocks stored in this backup, in the order they
+	// appear in its blocks file.
+	Stored []Block `json:"stored"`
+}
+
+// Block is a compressed block stored in a backup.
+type Block struct {
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// StoredBytes returns the compressed size of the blocks stored in b.
+func (b *Backup) StoredBytes() int64 {
+	var n int64
+	for _, s := range b.Stored {
+		n += s.Length
+	}
+	return n
+}
+
+// Repository is a directory of backups of a disk image.
+type Repository struct {
+	dir string
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// Open opens the backup repository in dir, creating it if needed.
+func Open(dir string) (*Repository, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	return &Repository{dir: dir, enc: enc, dec: dec}, nil
+}
+
+// Close releases the resources of the repository.
+func (r *Repository) Close() error {
+	r.dec.Close()
+	return r.enc.Close()
+}
+
+// lock locks the repository. Backups and deletions take an exclusive
+// lock, restores and verification a shared one.
+func (r *Repository) lock(exclusive bool) (*diskimage.Lock, error) {
+	return diskimage.LockFile(filepath.Join(r.dir, "lock"), exclusive)
+}
+
+// Option is an option for Backup.
+type Option func(o *options)
+
+type options struct {
+	full      bool
+	blockSize int64
+}
+
+// WithFull makes a full backup instead of an increment of the latest one.
+func WithFull() Option {
+	return func(o *options) {
+		o.full = true
+	}
+}
+
+// WithBlockSize sets the block size of a full backup, a multiple of 4096.
+// Smaller blocks make increments smaller and manifests larger. It
+// defaults to DefaultBlockSize. Increments use the block size of their
+// parent.
+func WithBlockSize(n int64) Option {
+	return func(o *options) {
+		o.blockSize = n
+	}
+}
+
+// Get returns the backup id.
+func (r *Repository) Get(id string) (*Backup, error) {
+	if id == "" || filepath.Base(id) != id || id[0] == '.' {
+		return nil, fmt.Errorf("%q: %w", id, ErrNotFound)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, id, manifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%q: %w", id, ErrNotFound)
+		}
+		return nil, err
+	}
+	b := &Backup{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("backup: %s: %w", id, err)
+	}
+	return b, nil
+}
+
+// List returns the backups in the repository, oldest first.
+func (r *Repository) List() ([]*Backup, error) {
+	entries, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []*Backup
+	for _, e := range entries {
+		if !e.IsDir() || e.Name()[0] == '.' {
+			continue
+		}
+		b, err := r.Get(e.Name())
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, b)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Created.Before(backups[j].Created)
+	})
+	return backups, nil
+}
+
+// Latest returns the most recent backup, or nil if there is none.
+func (r *Repository) Latest() (*Backup, error) {
+	backups, err := r.List()
+	if err != nil || len(backups) == 0 {
+		return nil, err
+	}
+	return backups[len(backups)-1], nil
+}
+
+// Chain returns backup id followed by the backups it is based on, ending
+// with a full backup.
+func (r *Repository) Chain(id string) ([]*Backup, error) {
+	var chain []*Backup
+	seen := make(map[string]bool)
+	for id != "" {
+		if seen[id] {
+			return nil, fmt.Errorf("backup: cycle in chain at %s", id)
+		}
+		seen[id] = true
+		b, err := r.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, b)
+		id = b.Parent
+	}
+	return chain, nil
+}
+
+// Backup backs up the raw disk image at path. Unless WithFull is given,
+// the backup is an increment of the latest backup in the repository and
+// only stores the blocks that are not stored in its chain.
+func (r *Repository) Backup(path string, opts ...Option) (*Backup, error) {
+	o := &options{blockSize: DefaultBlockSize}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.blockSize <= 0 || o.blockSize%4096 != 0 {
+		return nil, fmt.Errorf("backup: invalid block size %d", o.blockSize)
+	}
+	repoLock, err := r.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer repoLock.Unlock()
+	lock, err := diskimage.LockFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backup{
+		ID:        xid.New().String(),
+		Created:   time.Now().UTC(),
+		Size:      fi.Size(),
+		BlockSize: o.blockSize,
+	}
+	// Blocks already stored in the chain of the parent are not stored again.
+	have := make(map[string]bool)
+	if !o.full {
+		parent, err := r.Latest()
+		if err != nil {
+			return nil, err
+		}
+		if parent != nil {
+			_, idx, err := r.index(parent.ID)
+			if err != nil {
+				return nil, err
+			}
+			b.Parent = parent.ID
+			b.BlockSize = parent.BlockSize
+			for h := range idx {
+				have[h] = true
+			}
+		}
+	}
+
+	tmp, err := ioutil.TempDir(r.dir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	out, err := os.Create(filepath.Join(tmp, blocksName))
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	extents, err := diskimage.DataExtents(f)
+	if err != nil {
+		return nil, err
+	}
+	n := (b.Size + b.BlockSize - 1) / b.BlockSize
+	b.Hashes = make([]string, n)
+	buf := make([]byte, b.BlockSize)
+	var pos int64
+	for i := int64(0); i < n; i++ {
+		off := i * b.BlockSize
+		p := buf
+		if rest := b.Size - off; rest < int64(len(p)) {
+			p = p[:rest]
+		}
+		// Blocks entirely inside holes are zero without reading them.
+		for len(extents) > 0 && extents[0].Offset+extents[0].Length <= off {
+			extents = extents[1:]
+		}
+		if len(extents) == 0 || extents[0].Offset >= off+int64(len(p)) {
+			continue
+		}
+		if _, err := f.ReadAt(p, off); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if isZero(p) {
+			continue
+		}
+		sum := sha256.Sum256(p)
+		h := hex.EncodeToString(sum[:])
+		b.Hashes[i] = h
+		if have[h] {
+			continue
+		}
+		have[h] = true
+		data := r.enc.EncodeAll(p, nil)
+		if _, err := out.Write(data); err != nil {
+			return nil, err
+		}
+		b.Stored = append(b.Stored, Block{Hash: h, Offset: pos, Length: int64(len(data))})
+		pos += int64(len(data))
+	}
+	if err := out.Sync(); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, manifestName), data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, filepath.Join(r.dir, b.ID)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// location is where a block is stored.
+type location struct {
+	id string
+	Block
+}
+
+// index maps the hashes of the blocks of backup id to where they are
+// stored in its chain.
+func (r *Repository) index(id string) (*Backup, map[string]location, error) {
+	chain, err := r.Chain(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx := make(map[string]location)
+	for _, b := range chain {
+		for _, s := range b.Stored {
+			if _, ok := idx[s.Hash]; !ok {
+				idx[s.Hash] = location{b.ID, s}
+			}
+		}
+	}
+	return chain[0], idx, nil
+}
+
+// blockReader reads blocks from the blocks files of a chain.
+type blockReader struct {
+	r     *Repository
+	idx   map[string]location
+	files map[string]*os.File
+}
+
+// read returns the verified block with hash h.
+func (br *blockReader) read(h string) ([]byte, error) {
+	loc, ok := br.idx[h]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w: not stored in chain", h, ErrCorrupt)
+	}
+	f, ok := br.files[loc.id]
+	if !ok {
+		var err error
+		if f, err = os.Open(filepath.Join(br.r.dir, loc.id, blocksName)); err != nil {
+			return nil, err
+		}
+		br.files[loc.id] = f
+	}
+	compressed := make([]byte, loc.Length)
+	if _, err := f.ReadAt(compressed, loc.Offset); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s: %w: truncated", h, ErrCorrupt)
+		}
+		return nil, err
+	}
+	data, err := br.r.dec.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %v", h, ErrCorrupt, err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != h {
+		return nil, fmt.Errorf("%s: %w", h, ErrCorrupt)
+	}
+	return data, nil
+}
+
+func (br *blockReader) close() {
+	for _, f := range br.files {
+		f.Close()
+	}
+}
+
+// Restore writes the disk image as it was at backup id to a new sparse
+// raw file at path.
+func (r *Repository) Restore(id, path string) (err error) {
+	lock, err := r.lock(false)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	b, idx, err := r.index(id)
+	if err != nil {
+		return err
+	}
+	br := &blockReader{r: r, idx: idx, files: make(map[string]*os.File)}
+	defer br.close()
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if err := out.Truncate(b.Size); err != nil {
+		return err
+	}
+	for i, h := range b.Hashes {
+		if h == "" {
+			continue
+		}
+		data, err := br.read(h)
+		if err != nil {
+			return err
+		}
+		off := int64(i) * b.BlockSize
+		if off+int64(len(data)) > b.Size {
+			return fmt.Errorf("backup: %s: block %d exceeds the image", id, i)
+		}
+		if _, err := out.WriteAt(data, off); err != nil {
+			return err
+		}
+	}
+	return out.Sync()
+}
+
+// Verify checks that every block of backup id is stored in its chain and
+// matches its hash, without restoring it.
+func (r *Repository) Verify(id string) error {
+	lock, err := r.lock(false)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	b, idx, err := r.index(id)
+	if err != nil {
+		return err
+	}
+	br := &blockReader{r: r, idx: idx, files: make(map[string]*os.File)}
+	defer br.close()
+	verified := make(map[string]bool)
+	for _, h := range b.Hashes {
+		if h == "" || verified[h] {
+			continue
+		}
+		if _, err := br.read(h); err != nil {
+			return err
+		}
+		verified[h] = true
+	}
+	return nil
+}
+
+// Delete removes backup id. Backups that other backups are based on
+// cannot be deleted.
+func (r *Repository) Delete(id string) error {
+	lock, err := r.lock(true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if _, err := r.Get(id); err != nil {
+		return err
+	}
+	backups, err := r.List()
+	if err != nil {
+		return err
+	}
+	for _, b := range backups {
+		if b.Parent == id {
+			return fmt.Errorf("%s: %w", id, ErrHasChildren)
+		}
+	}
+	return os.RemoveAll(filepath.Join(r.dir, id))
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
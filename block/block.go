@@ -0,0 +1,119 @@
+// Package block defines the block device backends that disks served from
+// Go, for example by the nbd package, are stored in.
+package block
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrReadOnly is returned when writing to a read-only backend.
+	ErrReadOnly = errors.New("block: backend is read-only")
+
+	// ErrClosed is returned when using a closed backend.
+	ErrClosed = errors.New("block: backend is closed")
+
+	// ErrSlowZero is returned for ZeroFast requests when zeroing the
+	// range would not be faster than writing zeros to it.
+	ErrSlowZero = errors.New("block: zeroing is not faster than writing zeros")
+)
+
+// Backend is the storage of a block device.
+//
+// Backends must be safe for concurrent use. Requests are validated by the
+// caller, so offsets and lengths are always within Size.
+type Backend interface {
+	// ReadAt and WriteAt transfer data like io.ReaderAt and io.WriterAt.
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+
+	// WriteZeroes sets length bytes from off to zero, deallocating the
+	// storage behind them where possible.
+	WriteZeroes(off, length int64) error
+
+	// Trim tells the backend that length bytes from off are no longer in
+	// use. Their contents are unspecified afterwards.
+	Trim(off, length int64) error
+
+	// Flush makes all completed writes durable.
+	Flush() error
+
+	// Size returns the size of the device in bytes.
+	Size() int64
+
+	// ReadOnly reports whether writes are refused with ErrReadOnly.
+	ReadOnly() bool
+
+	Close() error
+}
+
+// ZeroFlags modify how WriteZeroes zeroes a range.
+type ZeroFlags int
+
+const (
+	// ZeroNoHole keeps the storage behind the range allocated, so later
+	// writes to it cannot fail for lack of space.
+	ZeroNoHole ZeroFlags = 1 << iota
+
+	// ZeroFast fails the request with ErrSlowZero, possibly before
+	// anything is zeroed, unless the backend zeroes the range faster than
+	// writing zeros would, for example by deallocating storage.
+	ZeroFast
+)
+
+// Zeroer is implemented by backends that zero ranges as ZeroFlags ask.
+type Zeroer interface {
+	ZeroRange(off, length int64, flags ZeroFlags) error
+}
+
+// WriteZeroes zeroes length bytes of b from off as flags ask. Backends that
+// do not implement Zeroer are zeroed with their WriteZeroes method, or by
+// writing zeros with ZeroNoHole, and fail ZeroFast requests.
+func WriteZeroes(b Backend, off, length int64, flags ZeroFlags) error {
+	if z, ok := b.(Zeroer); ok {
+		return z.ZeroRange(off, length, flags)
+	}
+	switch {
+	case flags&ZeroFast != 0:
+		return ErrSlowZero
+	case flags&ZeroNoHole != 0:
+		return ZeroFill(b, off, length)
+	}
+	return b.WriteZeroes(off, length)
+}
+
+// zeroChunk is the size of the buffer ZeroFill writes with.
+const zeroChunk = 1 << 20
+
+// ZeroFill zeroes length bytes of w from off by writing zeros. It is the
+// WriteZeroes implementation of backends that cannot deallocate storage.
+func ZeroFill(w interface {
+	WriteAt(p []byte, off int64) (int, error)
+}, off, length int64) error {
+	n := int64(zeroChunk)
+	if length < n {
+		n = length
+	}
+	zeros := make([]byte, n)
+	for length > 0 {
+		if length < n {
+			n = length
+		}
+		if _, err := w.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+// CheckRange validates that length bytes from off lie within a backend of
+// the given size.
+func CheckRange(off, length, size int64) error {
+	if off < 0 || length < 0 || off > size || length > size-off {
+		return fmt.Errorf("block: range %d+%d is outside of the device of %d bytes", off, length, size)
+	}
+	return nil
+}
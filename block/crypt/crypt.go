@@ -0,0 +1,386 @@
+// Package crypt implements a block backend that stores a disk encrypted at
+// rest with AES-256-XTS.
+//
+// An encrypted disk image starts with a small header holding up to eight
+// key slots. Each slot wraps the random master key under a key derived
+// from a passphrase with Argon2id or scrypt, so passphrases can be added,
+// removed and changed without touching the data. Rekey replaces the
+// master key itself and re-encrypts the whole disk offline.
+//
+// Sectors that were never written or were zeroed are stored as holes and
+// read as zeros, which reveals which parts of the disk are in use, like
+// dm-crypt with discards enabled.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mac-vz/vz/block"
+	"github.com/mac-vz/vz/diskimage"
+	"golang.org/x/crypto/xts"
+)
+
+var (
+	// ErrNotEncrypted is returned when opening a file that is not an
+	// encrypted disk image.
+	ErrNotEncrypted = errors.New("crypt: not an encrypted disk image")
+
+	// ErrBadPassphrase is returned when no key slot opens with the passphrase.
+	ErrBadPassphrase = errors.New("crypt: wrong passphrase")
+
+	// ErrNoFreeSlot is returned when adding a passphrase to a disk image
+	// whose key slots are all in use.
+	ErrNoFreeSlot = errors.New("crypt: no free key slot")
+
+	// ErrLastSlot is returned when removing the only passphrase.
+	ErrLastSlot = errors.New("crypt: cannot remove the last passphrase")
+)
+
+// Disk is an encrypted disk image opened as a block backend.
+type Disk struct {
+	mu       sync.RWMutex
+	f        *os.File
+	lock     *diskimage.Lock
+	hdr      header
+	xts      *xts.Cipher
+	readOnly bool
+
+	// Options used by Create.
+	sectorSize uint32
+	kdf        KDF
+}
+
+var (
+	_ block.Backend = (*Disk)(nil)
+	_ block.Zeroer  = (*Disk)(nil)
+)
+
+// Option is an option for Create and Open.
+type Option func(d *Disk)
+
+// WithSectorSize sets the encryption sector size of a new disk image,
+// 512 or 4096 bytes. It defaults to 4096, which is faster; guests must use
+// at least that logical block size for writes to stay sector aligned.
+func WithSectorSize(n uint32) Option {
+	return func(d *Disk) {
+		d.sectorSize = n
+	}
+}
+
+// WithKDF sets the key derivation function protecting the passphrase of a
+// new disk image. It defaults to DefaultKDF.
+func WithKDF(kdf KDF) Option {
+	return func(d *Disk) {
+		d.kdf = kdf
+	}
+}
+
+// WithReadOnly opens the disk image read-only.
+func WithReadOnly() Option {
+	return func(d *Disk) {
+		d.readOnly = true
+	}
+}
+
+// Create creates an encrypted disk image of size bytes at path, protected
+// by passphrase.
+func Create(path string, size int64, passphrase []byte, opts ...Option) (*Disk, error) {
+	d := &Disk{sectorSize: 4096, kdf: DefaultKDF}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.sectorSize != 512 && d.sectorSize != 4096 {
+		return nil, fmt.Errorf("crypt: invalid sector size %d", d.sectorSize)
+	}
+	if size <= 0 || size%int64(d.sectorSize) != 0 {
+		return nil, fmt.Errorf("crypt: size %d is not a multiple of the sector size %d", size, d.sectorSize)
+	}
+	d.hdr = header{
+		Version:    version,
+		Cipher:     cipherAESXTSPlain64,
+		SectorSize: d.sectorSize,
+		DataOffset: headerSize,
+		Size:       uint64(size),
+	}
+	if _, err := rand.Read(d.hdr.UUID[:]); err != nil {
+		return nil, err
+	}
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := d.hdr.seal(0, key, passphrase, d.kdf); err != nil {
+		return nil, err
+	}
+	if err := d.setKey(key); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	d.f = f
+	fail := func(err error) (*Disk, error) {
+		d.lock.Unlock()
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if d.lock, err = diskimage.LockFile(path, true); err != nil {
+		return fail(err)
+	}
+	if err := f.Truncate(int64(d.hdr.DataOffset) + size); err != nil {
+		return fail(err)
+	}
+	if _, err := f.WriteAt(d.hdr.encode(), 0); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	return d, nil
+}
+
+// Open opens the encrypted disk image at path with passphrase.
+func Open(path string, passphrase []byte, opts ...Option) (*Disk, error) {
+	d := &Disk{}
+	for _, opt := range opts {
+		opt(d)
+	}
+	lock, err := diskimage.LockFile(path, !d.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	flag := os.O_RDWR
+	if d.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	d.f, d.lock = f, lock
+	if err := d.unlock(passphrase); err != nil {
+		f.Close()
+		lock.Unlock()
+		return nil, err
+	}
+	return d, nil
+}
+
+// unlock reads the header and unwraps the master key.
+func (d *Disk) unlock(passphrase []byte) error {
+	if err := readHeader(d.f, &d.hdr); err != nil {
+		return err
+	}
+	key, _, err := d.hdr.unseal(passphrase)
+	if err != nil {
+		return err
+	}
+	return d.setKey(key)
+}
+
+func readHeader(f *os.File, h *header) error {
+	b := make([]byte, headerSize)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		if err == io.EOF {
+			return ErrNotEncrypted
+		}
+		return err
+	}
+	return h.decode(b)
+}
+
+func (d *Disk) setKey(key []byte) error {
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return err
+	}
+	d.xts = c
+	return nil
+}
+
+// UUID returns the unique identifier of the disk image.
+func (d *Disk) UUID() [16]byte {
+	return d.hdr.UUID
+}
+
+// ReadAt implements block.Backend.
+func (d *Disk) ReadAt(p []byte, off int64) (int, error) {
+	if err := block.CheckRange(off, int64(len(p)), d.Size()); err != nil {
+		return 0, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ss := int64(d.hdr.SectorSize)
+	start := off / ss * ss
+	end := (off + int64(len(p)) + ss - 1) / ss * ss
+	if start == off && end == off+int64(len(p)) {
+		// Aligned reads are decrypted in place.
+		return len(p), d.readSectors(p, off)
+	}
+	buf := make([]byte, end-start)
+	if err := d.readSectors(buf, start); err != nil {
+		return 0, err
+	}
+	copy(p, buf[off-start:])
+	return len(p), nil
+}
+
+// readSectors reads and decrypts whole sectors at off.
+func (d *Disk) readSectors(p []byte, off int64) error {
+	if _, err := d.f.ReadAt(p, int64(d.hdr.DataOffset)+off); err != nil && err != io.EOF {
+		return err
+	}
+	ss := int(d.hdr.SectorSize)
+	for i := 0; i < len(p); i += ss {
+		sector := p[i : i+ss]
+		if isZero(sector) {
+			continue
+		}
+		d.xts.Decrypt(sector, sector, uint64(off/int64(ss))+uint64(i/ss))
+	}
+	return nil
+}
+
+// WriteAt implements block.Backend. Writes that are not sector aligned
+// read, modify and rewrite the sectors at their ends.
+func (d *Disk) WriteAt(p []byte, off int64) (int, error) {
+	if d.readOnly {
+		return 0, block.ErrReadOnly
+	}
+	if err := block.CheckRange(off, int64(len(p)), d.Size()); err != nil {
+		return 0, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ss := int64(d.hdr.SectorSize)
+	start := off / ss * ss
+	end := (off + int64(len(p)) + ss - 1) / ss * ss
+	buf := make([]byte, end-start)
+	if start != off {
+		if err := d.readSectors(buf[:ss], start); err != nil {
+			return 0, err
+		}
+	}
+	if last := end - ss; end != off+int64(len(p)) && (last != start || start == off) {
+		if err := d.readSectors(buf[last-start:], last); err != nil {
+			return 0, err
+		}
+	}
+	copy(buf[off-start:], p)
+	for i := int64(0); i < int64(len(buf)); i += ss {
+		d.xts.Encrypt(buf[i:i+ss], buf[i:i+ss], uint64((start+i)/ss))
+	}
+	if _, err := d.f.WriteAt(buf, int64(d.hdr.DataOffset)+start); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteZeroes implements block.Backend. Whole sectors are turned into
+// holes, which read as zeros.
+func (d *Disk) WriteZeroes(off, length int64) error {
+	return d.ZeroRange(off, length, 0)
+}
+
+// ZeroRange implements block.Zeroer. Only whole sectors turned into holes
+// count as fast; zeros stored otherwise have to be encrypted like any
+// data, and with block.ZeroNoHole they are.
+func (d *Disk) ZeroRange(off, length int64, flags block.ZeroFlags) error {
+	if d.readOnly {
+		return block.ErrReadOnly
+	}
+	if err := block.CheckRange(off, length, d.Size()); err != nil {
+		return err
+	}
+	fast := flags&block.ZeroFast != 0
+	ss := int64(d.hdr.SectorSize)
+	start := (off + ss - 1) / ss * ss
+	end := (off + length) / ss * ss
+	if start >= end || flags&block.ZeroNoHole != 0 {
+		if fast {
+			return block.ErrSlowZero
+		}
+		return block.ZeroFill(d, off, length)
+	}
+	if err := d.punch(start, end, fast); err != nil {
+		return err
+	}
+	if err := block.ZeroFill(d, off, start-off); err != nil {
+		return err
+	}
+	return block.ZeroFill(d, end, off+length-end)
+}
+
+// punch turns the whole sectors from start to end into holes, failing
+// with block.ErrSlowZero if fast is set and the file cannot hold holes.
+func (d *Disk) punch(start, end int64, fast bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pos := int64(d.hdr.DataOffset) + start
+	if err := diskimage.PunchHole(d.f, pos, end-start); err != nil {
+		if fast {
+			return block.ErrSlowZero
+		}
+		// Stored zeros read as zeros as well.
+		return block.ZeroFill(d.f, pos, end-start)
+	}
+	return nil
+}
+
+// Trim implements block.Backend. Whole sectors in the range are zeroed.
+func (d *Disk) Trim(off, length int64) error {
+	if d.readOnly {
+		return block.ErrReadOnly
+	}
+	ss := int64(d.hdr.SectorSize)
+	start := (off + ss - 1) / ss * ss
+	end := (off + length) / ss * ss
+	if start >= end {
+		return nil
+	}
+	return d.WriteZeroes(start, end-start)
+}
+
+// Flush implements block.Backend.
+func (d *Disk) Flush() error {
+	if d.readOnly {
+		return nil
+	}
+	return d.f.Sync()
+}
+
+// Size implements block.Backend.
+func (d *Disk) Size() int64 {
+	return int64(d.hdr.Size)
+}
+
+// ReadOnly implements block.Backend.
+func (d *Disk) ReadOnly() bool {
+	return d.readOnly
+}
+
+// Close closes the disk image.
+func (d *Disk) Close() error {
+	err := d.f.Close()
+	d.lock.Unlock()
+	return err
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,263 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	magic      = "VZCRYPT\x00"
+	version    = 1
+	headerSize = 4096
+
+	// cipherAESXTSPlain64 is AES-256 in XTS mode with the little-endian
+	// sector number as tweak, like dm-crypt's aes-xts-plain64.
+	cipherAESXTSPlain64 = 1
+	masterKeySize       = 64
+
+	fixedSize = 64
+	numSlots  = 8
+	slotSize  = 160
+
+	kdfArgon2id = 1
+	kdfScrypt   = 2
+
+	saltSize       = 32
+	wrappingKeyLen = 32
+
+	// maxKDFMemory bounds the memory key derivation may use, like the
+	// limit of LUKS2, so a crafted header cannot exhaust the memory of
+	// the host when unlocking.
+	maxKDFMemory = 4 << 30
+
+	// maxScryptP bounds the parallelization of scrypt, which x/crypto
+	// computes sequentially.
+	maxScryptP = 16
+)
+
+// header is the first block of an encrypted disk image, stored
+// little-endian. The fixed fields are authenticated by every key slot.
+type header struct {
+	Version    uint32
+	Cipher     uint32
+	SectorSize uint32
+	DataOffset uint64
+	Size       uint64
+	UUID       [16]byte
+	Slots      [numSlots]slot
+}
+
+// slot holds the master key wrapped with AES-256-GCM under a key derived
+// from a passphrase.
+type slot struct {
+	Active  bool
+	KDF     uint32
+	Params  [3]uint32
+	Salt    [saltSize]byte
+	Nonce   [12]byte
+	Wrapped [masterKeySize + 16]byte
+}
+
+func (h *header) encode() []byte {
+	b := make([]byte, headerSize)
+	h.encodeFixed(b)
+	for i := range h.Slots {
+		s := &h.Slots[i]
+		p := b[fixedSize+i*slotSize:]
+		if !s.Active {
+			continue
+		}
+		binary.LittleEndian.PutUint32(p, 1)
+		binary.LittleEndian.PutUint32(p[4:], s.KDF)
+		for j, v := range s.Params {
+			binary.LittleEndian.PutUint32(p[8+4*j:], v)
+		}
+		copy(p[20:], s.Salt[:])
+		copy(p[52:], s.Nonce[:])
+		copy(p[64:], s.Wrapped[:])
+	}
+	return b
+}
+
+func (h *header) encodeFixed(b []byte) {
+	copy(b, magic)
+	binary.LittleEndian.PutUint32(b[8:], h.Version)
+	binary.LittleEndian.PutUint32(b[12:], h.Cipher)
+	binary.LittleEndian.PutUint32(b[16:], h.SectorSize)
+	binary.LittleEndian.PutUint32(b[20:], masterKeySize)
+	binary.LittleEndian.PutUint64(b[24:], h.DataOffset)
+	binary.LittleEndian.PutUint64(b[32:], h.Size)
+	copy(b[40:], h.UUID[:])
+}
+
+func (h *header) decode(b []byte) error {
+	if len(b) < headerSize || string(b[:8]) != magic {
+		return ErrNotEncrypted
+	}
+	h.Version = binary.LittleEndian.Uint32(b[8:])
+	h.Cipher = binary.LittleEndian.Uint32(b[12:])
+	h.SectorSize = binary.LittleEndian.Uint32(b[16:])
+	h.DataOffset = binary.LittleEndian.Uint64(b[24:])
+	h.Size = binary.LittleEndian.Uint64(b[32:])
+	copy(h.UUID[:], b[40:])
+	if h.Version != version {
+		return fmt.Errorf("crypt: unsupported version %d", h.Version)
+	}
+	if h.Cipher != cipherAESXTSPlain64 || binary.LittleEndian.Uint32(b[20:]) != masterKeySize {
+		return fmt.Errorf("crypt: unsupported cipher %d", h.Cipher)
+	}
+	if h.SectorSize != 512 && h.SectorSize != 4096 {
+		return fmt.Errorf("crypt: unsupported sector size %d", h.SectorSize)
+	}
+	if h.DataOffset < headerSize || h.Size%uint64(h.SectorSize) != 0 {
+		return ErrNotEncrypted
+	}
+	for i := range h.Slots {
+		s := &h.Slots[i]
+		p := b[fixedSize+i*slotSize:]
+		s.Active = binary.LittleEndian.Uint32(p) == 1
+		s.KDF = binary.LittleEndian.Uint32(p[4:])
+		for j := range s.Params {
+			s.Params[j] = binary.LittleEndian.Uint32(p[8+4*j:])
+		}
+		copy(s.Salt[:], p[20:])
+		copy(s.Nonce[:], p[52:])
+		copy(s.Wrapped[:], p[64:])
+		// The slots are not authenticated before a key is derived from
+		// their parameters.
+		if s.Active {
+			if err := (KDF{kind: s.KDF, params: s.Params}).validate(); err != nil {
+				return fmt.Errorf("%w in key slot %d", err, i)
+			}
+		}
+	}
+	return nil
+}
+
+// KDF selects how key slots derive keys from passphrases. Derivation may
+// use at most 4 GiB of memory.
+type KDF struct {
+	kind   uint32
+	params [3]uint32
+}
+
+// Argon2id derives keys with Argon2id using time passes over memory KiB
+// of memory with threads lanes.
+func Argon2id(time, memory uint32, threads uint8) KDF {
+	return KDF{kind: kdfArgon2id, params: [3]uint32{time, memory, uint32(threads)}}
+}
+
+// Scrypt derives keys with scrypt using the cost parameters N = 2^logN,
+// r and p.
+func Scrypt(logN, r, p uint32) KDF {
+	return KDF{kind: kdfScrypt, params: [3]uint32{logN, r, p}}
+}
+
+// DefaultKDF is Argon2id with the parameters recommended by RFC 9106 for
+// memory-constrained environments: 3 passes over 64 MiB with 4 lanes.
+var DefaultKDF = Argon2id(3, 64<<10, 4)
+
+// validate checks that the parameters are usable and keep derivation
+// within maxKDFMemory.
+func (k KDF) validate() error {
+	switch k.kind {
+	case kdfArgon2id:
+		time, memory, threads := k.params[0], uint64(k.params[1]), k.params[2]
+		if time == 0 || threads == 0 || threads > 255 || memory < 8*uint64(threads) || memory<<10 > maxKDFMemory {
+			return errors.New("crypt: invalid Argon2id parameters")
+		}
+	case kdfScrypt:
+		logN, r, p := k.params[0], uint64(k.params[1]), k.params[2]
+		if logN == 0 || logN > 30 || r == 0 || p == 0 || p > maxScryptP || 128*r > maxKDFMemory>>logN {
+			return errors.New("crypt: invalid scrypt parameters")
+		}
+	default:
+		return fmt.Errorf("crypt: unknown key derivation function %d", k.kind)
+	}
+	return nil
+}
+
+func (k KDF) derive(passphrase []byte, salt []byte) ([]byte, error) {
+	if err := k.validate(); err != nil {
+		return nil, err
+	}
+	if k.kind == kdfArgon2id {
+		return argon2.IDKey(passphrase, salt, k.params[0], k.params[1], uint8(k.params[2]), wrappingKeyLen), nil
+	}
+	return scrypt.Key(passphrase, salt, 1<<k.params[0], int(k.params[1]), int(k.params[2]), wrappingKeyLen)
+}
+
+// slotAEAD returns the cipher wrapping the master key in slot i, and its
+// additional data binding the slot to the header.
+func (h *header) slotAEAD(i int, passphrase []byte) (cipher.AEAD, []byte, error) {
+	s := &h.Slots[i]
+	key, err := KDF{kind: s.KDF, params: s.Params}.derive(passphrase, s.Salt[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	ad := make([]byte, fixedSize+1)
+	h.encodeFixed(ad)
+	ad[fixedSize] = byte(i)
+	return aead, ad, nil
+}
+
+// seal wraps key into slot i with a key derived from passphrase.
+func (h *header) seal(i int, key, passphrase []byte, kdf KDF) error {
+	s := &h.Slots[i]
+	*s = slot{Active: true, KDF: kdf.kind, Params: kdf.params}
+	if _, err := rand.Read(s.Salt[:]); err != nil {
+		return err
+	}
+	if _, err := rand.Read(s.Nonce[:]); err != nil {
+		return err
+	}
+	aead, ad, err := h.slotAEAD(i, passphrase)
+	if err != nil {
+		return err
+	}
+	aead.Seal(s.Wrapped[:0], s.Nonce[:], key, ad)
+	return nil
+}
+
+// unseal returns the master key and the slot it was unwrapped from.
+func (h *header) unseal(passphrase []byte) ([]byte, int, error) {
+	for i := range h.Slots {
+		if !h.Slots[i].Active {
+			continue
+		}
+		aead, ad, err := h.slotAEAD(i, passphrase)
+		if err != nil {
+			return nil, 0, err
+		}
+		s := &h.Slots[i]
+		if key, err := aead.Open(nil, s.Nonce[:], s.Wrapped[:], ad); err == nil {
+			return key, i, nil
+		}
+	}
+	return nil, 0, ErrBadPassphrase
+}
+
+// freeSlot returns the index of an unused slot.
+func (h *header) freeSlot() (int, error) {
+	for i := range h.Slots {
+		if !h.Slots[i].Active {
+			return i, nil
+		}
+	}
+	return 0, ErrNoFreeSlot
+}
@@ -0,0 +1,209 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"os"
+
+	"github.com/mac-vz/vz/diskimage"
+)
+
+// updateHeader applies fn to the header of the disk image at path while
+// holding an exclusive lock, then writes the header back.
+func updateHeader(path string, fn func(h *header) error) error {
+	lock, err := diskimage.LockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var h header
+	if err := readHeader(f, &h); err != nil {
+		return err
+	}
+	if err := fn(&h); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(h.encode(), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// slotOptions returns the Disk that opts configure. Its kdf is zero
+// unless WithKDF was given.
+func slotOptions(opts []Option) *Disk {
+	d := &Disk{}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// AddPassphrase adds newPassphrase to the encrypted disk image at path,
+// which must be unlocked with an existing passphrase. WithKDF selects the
+// key derivation function of the new key slot.
+func AddPassphrase(path string, passphrase, newPassphrase []byte, opts ...Option) error {
+	kdf := DefaultKDF
+	if d := slotOptions(opts); d.kdf.kind != 0 {
+		kdf = d.kdf
+	}
+	return updateHeader(path, func(h *header) error {
+		key, _, err := h.unseal(passphrase)
+		if err != nil {
+			return err
+		}
+		i, err := h.freeSlot()
+		if err != nil {
+			return err
+		}
+		return h.seal(i, key, newPassphrase, kdf)
+	})
+}
+
+// RemovePassphrase removes passphrase from the encrypted disk image at
+// path. The last passphrase cannot be removed.
+func RemovePassphrase(path string, passphrase []byte) error {
+	return updateHeader(path, func(h *header) error {
+		_, i, err := h.unseal(passphrase)
+		if err != nil {
+			return err
+		}
+		active := 0
+		for _, s := range h.Slots {
+			if s.Active {
+				active++
+			}
+		}
+		if active == 1 {
+			return ErrLastSlot
+		}
+		h.Slots[i] = slot{}
+		return nil
+	})
+}
+
+// ChangePassphrase replaces passphrase with newPassphrase in the encrypted
+// disk image at path. The key slot keeps its key derivation function
+// unless WithKDF is given.
+func ChangePassphrase(path string, passphrase, newPassphrase []byte, opts ...Option) error {
+	d := slotOptions(opts)
+	return updateHeader(path, func(h *header) error {
+		key, i, err := h.unseal(passphrase)
+		if err != nil {
+			return err
+		}
+		kdf := d.kdf
+		if kdf.kind == 0 {
+			kdf = KDF{kind: h.Slots[i].KDF, params: h.Slots[i].Params}
+		}
+		return h.seal(i, key, newPassphrase, kdf)
+	})
+}
+
+// Rekey replaces the master key of the encrypted disk image at path and
+// re-encrypts all data with the new key, for example after the old key
+// may have been exposed. Only passphrase can unlock the image afterwards;
+// all other key slots are removed.
+//
+// The image is rewritten to a temporary file next to it, which replaces
+// the original when complete, so an interrupted Rekey leaves the original
+// intact.
+func Rekey(path string, passphrase []byte, opts ...Option) (err error) {
+	lock, err := diskimage.LockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	src := &Disk{readOnly: true}
+	if src.f, err = os.Open(path); err != nil {
+		return err
+	}
+	defer src.f.Close()
+	if err := readHeader(src.f, &src.hdr); err != nil {
+		return err
+	}
+	oldKey, i, err := src.hdr.unseal(passphrase)
+	if err != nil {
+		return err
+	}
+	if err := src.setKey(oldKey); err != nil {
+		return err
+	}
+
+	kdf := KDF{kind: src.hdr.Slots[i].KDF, params: src.hdr.Slots[i].Params}
+	if d := slotOptions(opts); d.kdf.kind != 0 {
+		kdf = d.kdf
+	}
+	dst := &Disk{hdr: src.hdr}
+	dst.hdr.Slots = [numSlots]slot{}
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if err := dst.hdr.seal(0, key, passphrase, kdf); err != nil {
+		return err
+	}
+	if err := dst.setKey(key); err != nil {
+		return err
+	}
+
+	fi, err := src.f.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".rekey"
+	if dst.f, err = os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	defer func() {
+		dst.f.Close()
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if err := dst.f.Truncate(int64(dst.hdr.DataOffset + dst.hdr.Size)); err != nil {
+		return err
+	}
+
+	ss := int(src.hdr.SectorSize)
+	buf := make([]byte, 1<<20)
+	for off := int64(0); off < src.Size(); off += int64(len(buf)) {
+		n := len(buf)
+		if rest := src.Size() - off; rest < int64(n) {
+			n = int(rest)
+		}
+		p := buf[:n]
+		if err := src.readSectors(p, off); err != nil {
+			return err
+		}
+		// Runs of non-zero sectors are written at once, zero sectors are
+		// left as holes.
+		run := -1
+		for j := 0; j <= n; j += ss {
+			if j < n && !isZero(p[j:j+ss]) {
+				dst.xts.Encrypt(p[j:j+ss], p[j:j+ss], uint64(off+int64(j))/uint64(ss))
+				if run < 0 {
+					run = j
+				}
+				continue
+			}
+			if run >= 0 {
+				if _, err := dst.f.WriteAt(p[run:j], int64(dst.hdr.DataOffset)+off+int64(run)); err != nil {
+					return err
+				}
+				run = -1
+			}
+		}
+	}
+	if _, err := dst.f.WriteAt(dst.hdr.encode(), 0); err != nil {
+		return err
+	}
+	if err := dst.f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,117 @@
+package block
+
+import (
+	"os"
+
+	"github.com/mac-vz/vz/diskimage"
+)
+
+// File is a backend storing the device in a raw disk image file.
+type File struct {
+	f        *os.File
+	lock     *diskimage.Lock
+	size     int64
+	readOnly bool
+}
+
+var (
+	_ Backend = (*File)(nil)
+	_ Zeroer  = (*File)(nil)
+)
+
+// OpenFile opens the raw disk image at path as a backend.
+//
+// Like a virtual machine attaching the image, the backend holds a shared
+// lock on read-only images and an exclusive lock on writable ones until it
+// is closed, so it fails with diskimage.ErrInUse while the image is in use.
+func OpenFile(path string, readOnly bool) (*File, error) {
+	lock, err := diskimage.LockFile(path, !readOnly)
+	if err != nil {
+		return nil, err
+	}
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		lock.Unlock()
+		return nil, err
+	}
+	return &File{f: f, lock: lock, size: fi.Size(), readOnly: readOnly}, nil
+}
+
+// ReadAt implements Backend.
+func (b *File) ReadAt(p []byte, off int64) (int, error) {
+	return b.f.ReadAt(p, off)
+}
+
+// WriteAt implements Backend.
+func (b *File) WriteAt(p []byte, off int64) (int, error) {
+	if b.readOnly {
+		return 0, ErrReadOnly
+	}
+	return b.f.WriteAt(p, off)
+}
+
+// WriteZeroes implements Backend by punching a hole into the file where
+// the file system supports it.
+func (b *File) WriteZeroes(off, length int64) error {
+	return b.ZeroRange(off, length, 0)
+}
+
+// ZeroRange implements Zeroer. Only punching a hole counts as fast.
+func (b *File) ZeroRange(off, length int64, flags ZeroFlags) error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	if flags&ZeroNoHole == 0 {
+		if err := diskimage.PunchHole(b.f, off, length); err == nil {
+			return nil
+		}
+	}
+	if flags&ZeroFast != 0 {
+		return ErrSlowZero
+	}
+	return ZeroFill(b.f, off, length)
+}
+
+// Trim implements Backend by punching a hole into the file, if possible.
+func (b *File) Trim(off, length int64) error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	diskimage.PunchHole(b.f, off, length)
+	return nil
+}
+
+// Flush implements Backend.
+func (b *File) Flush() error {
+	if b.readOnly {
+		return nil
+	}
+	return b.f.Sync()
+}
+
+// Size implements Backend.
+func (b *File) Size() int64 {
+	return b.size
+}
+
+// ReadOnly implements Backend.
+func (b *File) ReadOnly() bool {
+	return b.readOnly
+}
+
+// Close closes the file and releases its lock.
+func (b *File) Close() error {
+	err := b.f.Close()
+	b.lock.Unlock()
+	return err
+}
@@ -0,0 +1,152 @@
+package block
+
+import "sync"
+
+// memoryChunk is the allocation unit of Memory backends.
+const memoryChunk = 64 << 10
+
+// Memory is a sparse backend held in memory. Only chunks that were written
+// with non-zero data use memory.
+type Memory struct {
+	mu     sync.RWMutex
+	chunks map[int64][]byte
+	size   int64
+}
+
+var (
+	_ Backend = (*Memory)(nil)
+	_ Zeroer  = (*Memory)(nil)
+)
+
+// NewMemory returns an empty in-memory backend of size bytes.
+func NewMemory(size int64) *Memory {
+	return &Memory{chunks: map[int64][]byte{}, size: size}
+}
+
+// ReadAt implements Backend.
+func (m *Memory) ReadAt(p []byte, off int64) (int, error) {
+	if err := CheckRange(off, int64(len(p)), m.size); err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for n := 0; n < len(p); {
+		pos := off + int64(n)
+		chunk, at := m.chunks[pos/memoryChunk], pos%memoryChunk
+		l := len(p) - n
+		if rest := int(memoryChunk - at); l > rest {
+			l = rest
+		}
+		if chunk != nil {
+			copy(p[n:n+l], chunk[at:])
+		} else {
+			for i := n; i < n+l; i++ {
+				p[i] = 0
+			}
+		}
+		n += l
+	}
+	return len(p), nil
+}
+
+// WriteAt implements Backend.
+func (m *Memory) WriteAt(p []byte, off int64) (int, error) {
+	if err := CheckRange(off, int64(len(p)), m.size); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for n := 0; n < len(p); {
+		pos := off + int64(n)
+		idx, at := pos/memoryChunk, pos%memoryChunk
+		l := len(p) - n
+		if rest := int(memoryChunk - at); l > rest {
+			l = rest
+		}
+		chunk := m.chunks[idx]
+		if chunk == nil {
+			if isZero(p[n : n+l]) {
+				n += l
+				continue
+			}
+			chunk = make([]byte, memoryChunk)
+			m.chunks[idx] = chunk
+		}
+		copy(chunk[at:], p[n:n+l])
+		n += l
+	}
+	return len(p), nil
+}
+
+// WriteZeroes implements Backend, releasing chunks that become all zeros.
+func (m *Memory) WriteZeroes(off, length int64) error {
+	if err := CheckRange(off, length, m.size); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for end := off + length; off < end; {
+		idx, at := off/memoryChunk, off%memoryChunk
+		l := end - off
+		if rest := memoryChunk - at; l > rest {
+			l = rest
+		}
+		if chunk := m.chunks[idx]; chunk != nil {
+			if l == memoryChunk {
+				delete(m.chunks, idx)
+			} else {
+				for i := at; i < at+l; i++ {
+					chunk[i] = 0
+				}
+				if isZero(chunk) {
+					delete(m.chunks, idx)
+				}
+			}
+		}
+		off += l
+	}
+	return nil
+}
+
+// ZeroRange implements Zeroer. Zeroing memory is always fast, and chunks
+// are allocated on write regardless of ZeroNoHole.
+func (m *Memory) ZeroRange(off, length int64, flags ZeroFlags) error {
+	return m.WriteZeroes(off, length)
+}
+
+// Trim implements Backend. Trimmed ranges read as zeros.
+func (m *Memory) Trim(off, length int64) error {
+	return m.WriteZeroes(off, length)
+}
+
+// Flush implements Backend.
+func (m *Memory) Flush() error {
+	return nil
+}
+
+// Size implements Backend.
+func (m *Memory) Size() int64 {
+	return m.size
+}
+
+// ReadOnly implements Backend.
+func (m *Memory) ReadOnly() bool {
+	return false
+}
+
+// Close releases the memory of the backend.
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	m.chunks = map[int64][]byte{}
+	m.mu.Unlock()
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
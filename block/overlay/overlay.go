@@ -0,0 +1,555 @@
+// Package overlay implements a copy-on-write block backend layered on top
+// of a read-only base backend.
+//
+// Writes go to a sparse delta file in clusters, and an allocation bitmap
+// records which clusters the delta holds. Reads of other clusters fall
+// through to the base. Because the base can itself be an overlay, overlays
+// can be stacked like qcow2 backing chains, without leaving the raw format
+// for the base image.
+package overlay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mac-vz/vz/block"
+	"github.com/mac-vz/vz/diskimage"
+)
+
+var (
+	// ErrNotOverlay is returned when opening a file that is not a delta file.
+	ErrNotOverlay = errors.New("overlay: not an overlay delta file")
+
+	// ErrBaseMismatch is returned when the base passed to Open does not
+	// have the size the overlay was created with.
+	ErrBaseMismatch = errors.New("overlay: base does not match the overlay")
+)
+
+const (
+	magic              = "VZOVRLAY"
+	version            = 1
+	headerSize         = 4096
+	defaultClusterSize = 64 << 10
+)
+
+// header is the first block of a delta file, stored little-endian.
+type header struct {
+	Magic        [8]byte
+	Version      uint32
+	ClusterSize  uint32
+	Size         uint64
+	BitmapOffset uint64
+	DataOffset   uint64
+}
+
+// Overlay is a copy-on-write block backend.
+type Overlay struct {
+	mu   sync.RWMutex
+	base block.Backend
+	f    *os.File
+	lock *diskimage.Lock
+	hdr  header
+
+	// bitmap has a bit set for every cluster stored in the delta file.
+	// dirty is set when it has changed since it was last written.
+	bitmap   []byte
+	dirty    bool
+	readOnly bool
+}
+
+var (
+	_ block.Backend = (*Overlay)(nil)
+	_ block.Zeroer  = (*Overlay)(nil)
+)
+
+// Option is an option for Create and Open.
+type Option func(o *Overlay)
+
+// WithClusterSize sets the copy-on-write granularity of a new overlay. It
+// must be a power of two of at least 4096 bytes and defaults to 64 KiB.
+func WithClusterSize(n uint32) Option {
+	return func(o *Overlay) {
+		o.hdr.ClusterSize = n
+	}
+}
+
+// WithReadOnly opens the overlay read-only, for example to use it as the
+// base of another overlay.
+func WithReadOnly() Option {
+	return func(o *Overlay) {
+		o.readOnly = true
+	}
+}
+
+// Create creates a delta file at path for an overlay on top of base.
+func Create(path string, base block.Backend, opts ...Option) (*Overlay, error) {
+	o := &Overlay{base: base}
+	o.hdr.ClusterSize = defaultClusterSize
+	for _, opt := range opts {
+		opt(o)
+	}
+	cs := o.hdr.ClusterSize
+	if cs < 4096 || cs&(cs-1) != 0 {
+		return nil, fmt.Errorf("overlay: invalid cluster size %d", cs)
+	}
+	copy(o.hdr.Magic[:], magic)
+	o.hdr.Version = version
+	o.hdr.Size = uint64(base.Size())
+	o.hdr.BitmapOffset = headerSize
+	o.bitmap = make([]byte, (o.clusters()+7)/8)
+	o.hdr.DataOffset = roundUp(headerSize+uint64(len(o.bitmap)), uint64(cs))
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	o.f = f
+	if err := o.init(path); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return o, nil
+}
+
+// init locks and formats a new delta file.
+func (o *Overlay) init(path string) error {
+	lock, err := diskimage.LockFile(path, true)
+	if err != nil {
+		return err
+	}
+	o.lock = lock
+	if err := o.f.Truncate(int64(o.hdr.DataOffset + o.hdr.Size)); err != nil {
+		lock.Unlock()
+		return err
+	}
+	buf := make([]byte, headerSize)
+	o.hdr.encode(buf)
+	if _, err := o.f.WriteAt(buf, 0); err != nil {
+		lock.Unlock()
+		return err
+	}
+	if err := o.f.Sync(); err != nil {
+		lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Open opens the delta file at path on top of base, which must be the
+// backend, or a copy of it, that the overlay was created on.
+func Open(path string, base block.Backend, opts ...Option) (*Overlay, error) {
+	o := &Overlay{base: base}
+	for _, opt := range opts {
+		opt(o)
+	}
+	lock, err := diskimage.LockFile(path, !o.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	flag := os.O_RDWR
+	if o.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	o.f, o.lock = f, lock
+	if err := o.load(); err != nil {
+		f.Close()
+		lock.Unlock()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return o, nil
+}
+
+// load reads the header and bitmap of the delta file.
+func (o *Overlay) load() error {
+	buf := make([]byte, headerSize)
+	if _, err := o.f.ReadAt(buf, 0); err != nil {
+		if err == io.EOF {
+			return ErrNotOverlay
+		}
+		return err
+	}
+	o.hdr.decode(buf)
+	if string(o.hdr.Magic[:]) != magic {
+		return ErrNotOverlay
+	}
+	if o.hdr.Version != version {
+		return fmt.Errorf("overlay: unsupported version %d", o.hdr.Version)
+	}
+	if cs := o.hdr.ClusterSize; cs < 4096 || cs&(cs-1) != 0 {
+		return fmt.Errorf("overlay: invalid cluster size %d", cs)
+	}
+	if uint64(o.base.Size()) != o.hdr.Size {
+		return fmt.Errorf("%w: base has %d bytes, overlay %d", ErrBaseMismatch, o.base.Size(), o.hdr.Size)
+	}
+	o.bitmap = make([]byte, (o.clusters()+7)/8)
+	if o.hdr.BitmapOffset+uint64(len(o.bitmap)) > o.hdr.DataOffset {
+		return ErrNotOverlay
+	}
+	_, err := o.f.ReadAt(o.bitmap, int64(o.hdr.BitmapOffset))
+	return err
+}
+
+func (h *header) encode(b []byte) {
+	copy(b, h.Magic[:])
+	binary.LittleEndian.PutUint32(b[8:], h.Version)
+	binary.LittleEndian.PutUint32(b[12:], h.ClusterSize)
+	binary.LittleEndian.PutUint64(b[16:], h.Size)
+	binary.LittleEndian.PutUint64(b[24:], h.BitmapOffset)
+	binary.LittleEndian.PutUint64(b[32:], h.DataOffset)
+}
+
+func (h *header) decode(b []byte) {
+	copy(h.Magic[:], b)
+	h.Version = binary.LittleEndian.Uint32(b[8:])
+	h.ClusterSize = binary.LittleEndian.Uint32(b[12:])
+	h.Size = binary.LittleEndian.Uint64(b[16:])
+	h.BitmapOffset = binary.LittleEndian.Uint64(b[24:])
+	h.DataOffset = binary.LittleEndian.Uint64(b[32:])
+}
+
+func roundUp(n, align uint64) uint64 {
+	return (n + align - 1) / align * align
+}
+
+// clusters returns the number of clusters of the device.
+func (o *Overlay) clusters() uint64 {
+	return roundUp(o.hdr.Size, uint64(o.hdr.ClusterSize)) / uint64(o.hdr.ClusterSize)
+}
+
+func (o *Overlay) allocated(c uint64) bool {
+	return o.bitmap[c/8]&(1<<(c%8)) != 0
+}
+
+func (o *Overlay) setAllocated(c uint64) {
+	o.bitmap[c/8] |= 1 << (c % 8)
+	o.dirty = true
+}
+
+// Base returns the backend below the overlay.
+func (o *Overlay) Base() block.Backend {
+	return o.base
+}
+
+// Allocated returns the number of bytes stored in the delta file.
+func (o *Overlay) Allocated() int64 {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	n := int64(0)
+	for c := uint64(0); c < o.clusters(); c++ {
+		if o.allocated(c) {
+			n += int64(o.hdr.ClusterSize)
+		}
+	}
+	return n
+}
+
+// ReadAt implements block.Backend.
+func (o *Overlay) ReadAt(p []byte, off int64) (int, error) {
+	if err := block.CheckRange(off, int64(len(p)), o.Size()); err != nil {
+		return 0, err
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	cs := int64(o.hdr.ClusterSize)
+	for n := 0; n < len(p); {
+		pos := off + int64(n)
+		c := uint64(pos / cs)
+		alloc := o.allocated(c)
+		// Extend the run over following clusters in the same state.
+		end := (int64(c) + 1) * cs
+		for end < off+int64(len(p)) && o.allocated(uint64(end/cs)) == alloc {
+			end += cs
+		}
+		l := int(end - pos)
+		if l > len(p)-n {
+			l = len(p) - n
+		}
+		var err error
+		if alloc {
+			_, err = o.f.ReadAt(p[n:n+l], int64(o.hdr.DataOffset)+pos)
+		} else {
+			_, err = o.base.ReadAt(p[n:n+l], pos)
+		}
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		n += l
+	}
+	return len(p), nil
+}
+
+// WriteAt implements block.Backend. Clusters written for the first time
+// are copied up from the base unless they are overwritten completely.
+func (o *Overlay) WriteAt(p []byte, off int64) (int, error) {
+	if o.readOnly {
+		return 0, block.ErrReadOnly
+	}
+	if err := block.CheckRange(off, int64(len(p)), o.Size()); err != nil {
+		return 0, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	cs := int64(o.hdr.ClusterSize)
+	first, last := uint64(off/cs), uint64((off+int64(len(p))-1)/cs)
+	for _, c := range []uint64{first, last} {
+		if len(p) == 0 || o.allocated(c) {
+			continue
+		}
+		start := int64(c) * cs
+		if off <= start && off+int64(len(p)) >= start+cs {
+			continue
+		}
+		if err := o.copyUp(c); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := o.f.WriteAt(p, int64(o.hdr.DataOffset)+off); err != nil {
+		return 0, err
+	}
+	for c := first; len(p) > 0 && c <= last; c++ {
+		if !o.allocated(c) {
+			o.setAllocated(c)
+		}
+	}
+	return len(p), nil
+}
+
+// copyUp copies cluster c from the base into the delta file.
+func (o *Overlay) copyUp(c uint64) error {
+	start := int64(c) * int64(o.hdr.ClusterSize)
+	n := int64(o.hdr.ClusterSize)
+	if rest := o.Size() - start; rest < n {
+		n = rest
+	}
+	buf := make([]byte, n)
+	if _, err := o.base.ReadAt(buf, start); err != nil && err != io.EOF {
+		return err
+	}
+	if _, err := o.f.WriteAt(buf, int64(o.hdr.DataOffset)+start); err != nil {
+		return err
+	}
+	o.setAllocated(c)
+	return nil
+}
+
+// WriteZeroes implements block.Backend. Whole clusters are recorded as
+// allocated holes in the delta file, so they take no space.
+func (o *Overlay) WriteZeroes(off, length int64) error {
+	return o.ZeroRange(off, length, 0)
+}
+
+// ZeroRange implements block.Zeroer. Only whole clusters turned into holes
+// count as fast; with block.ZeroNoHole the range is written with zeros.
+func (o *Overlay) ZeroRange(off, length int64, flags block.ZeroFlags) error {
+	if o.readOnly {
+		return block.ErrReadOnly
+	}
+	if err := block.CheckRange(off, length, o.Size()); err != nil {
+		return err
+	}
+	fast := flags&block.ZeroFast != 0
+	cs := int64(o.hdr.ClusterSize)
+	start := (off + cs - 1) / cs * cs
+	end := (off + length) / cs * cs
+	if off+length == o.Size() {
+		// The partial cluster at the end of the device counts as whole.
+		end = o.Size()
+	}
+	if start >= end || flags&block.ZeroNoHole != 0 {
+		if fast {
+			return block.ErrSlowZero
+		}
+		return block.ZeroFill(o, off, length)
+	}
+	if err := o.zeroClusters(start, end, fast); err != nil {
+		return err
+	}
+	if err := block.ZeroFill(o, off, start-off); err != nil {
+		return err
+	}
+	return block.ZeroFill(o, end, off+length-end)
+}
+
+// zeroClusters turns the clusters from start to end into allocated holes,
+// failing with block.ErrSlowZero if fast is set and the delta file cannot
+// hold holes.
+func (o *Overlay) zeroClusters(start, end int64, fast bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := diskimage.PunchHole(o.f, int64(o.hdr.DataOffset)+start, end-start); err != nil {
+		if fast {
+			return block.ErrSlowZero
+		}
+		if err := block.ZeroFill(o.f, int64(o.hdr.DataOffset)+start, end-start); err != nil {
+			return err
+		}
+	}
+	cs := int64(o.hdr.ClusterSize)
+	for c := uint64(start / cs); c < uint64((end+cs-1)/cs); c++ {
+		o.setAllocated(c)
+	}
+	return nil
+}
+
+// Trim implements block.Backend. Trimmed whole clusters read as zeros.
+func (o *Overlay) Trim(off, length int64) error {
+	if o.readOnly {
+		return block.ErrReadOnly
+	}
+	cs := int64(o.hdr.ClusterSize)
+	start := (off + cs - 1) / cs * cs
+	end := (off + length) / cs * cs
+	if start >= end {
+		return nil
+	}
+	return o.WriteZeroes(start, end-start)
+}
+
+// Flush implements block.Backend. Data is made durable before the bitmap
+// that refers to it.
+func (o *Overlay) Flush() error {
+	if o.readOnly {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.flush()
+}
+
+func (o *Overlay) flush() error {
+	if err := o.f.Sync(); err != nil {
+		return err
+	}
+	if !o.dirty {
+		return nil
+	}
+	if _, err := o.f.WriteAt(o.bitmap, int64(o.hdr.BitmapOffset)); err != nil {
+		return err
+	}
+	if err := o.f.Sync(); err != nil {
+		return err
+	}
+	o.dirty = false
+	return nil
+}
+
+// Size implements block.Backend.
+func (o *Overlay) Size() int64 {
+	return int64(o.hdr.Size)
+}
+
+// ReadOnly implements block.Backend.
+func (o *Overlay) ReadOnly() bool {
+	return o.readOnly
+}
+
+// Commit merges the clusters stored in the delta file into the base and
+// empties the overlay. The base must be writable. A commit interrupted by
+// a crash can be repeated.
+func (o *Overlay) Commit() error {
+	if o.readOnly {
+		return block.ErrReadOnly
+	}
+	if o.base.ReadOnly() {
+		return fmt.Errorf("overlay: committing: %w", block.ErrReadOnly)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	cs := int64(o.hdr.ClusterSize)
+	buf := make([]byte, cs)
+	for c := uint64(0); c < o.clusters(); c++ {
+		if !o.allocated(c) {
+			continue
+		}
+		start := int64(c) * cs
+		n := cs
+		if rest := o.Size() - start; rest < n {
+			n = rest
+		}
+		if _, err := o.f.ReadAt(buf[:n], int64(o.hdr.DataOffset)+start); err != nil && err != io.EOF {
+			return err
+		}
+		if isZero(buf[:n]) {
+			err := o.base.WriteZeroes(start, n)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := o.base.WriteAt(buf[:n], start); err != nil {
+			return err
+		}
+	}
+	if err := o.base.Flush(); err != nil {
+		return err
+	}
+	return o.discard()
+}
+
+// Discard throws away all changes stored in the overlay, so it reads like
+// its base again.
+func (o *Overlay) Discard() error {
+	if o.readOnly {
+		return block.ErrReadOnly
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.discard()
+}
+
+func (o *Overlay) discard() error {
+	for i := range o.bitmap {
+		o.bitmap[i] = 0
+	}
+	o.dirty = true
+	// The bitmap is cleared before the data is: a crash in between leaves
+	// an empty overlay with some space still in use.
+	if err := o.flush(); err != nil {
+		return err
+	}
+	if err := diskimage.PunchHole(o.f, int64(o.hdr.DataOffset), o.Size()); err != nil {
+		// Without hole punching the space is reclaimed by truncating.
+		if err := o.f.Truncate(int64(o.hdr.DataOffset)); err != nil {
+			return err
+		}
+		if err := o.f.Truncate(int64(o.hdr.DataOffset) + o.Size()); err != nil {
+			return err
+		}
+	}
+	return o.f.Sync()
+}
+
+// Close flushes the overlay and closes the delta file. The base is not
+// closed.
+func (o *Overlay) Close() error {
+	var err error
+	if !o.readOnly {
+		o.mu.Lock()
+		err = o.flush()
+		o.mu.Unlock()
+	}
+	if cerr := o.f.Close(); err == nil {
+		err = cerr
+	}
+	o.lock.Unlock()
+	return err
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package block
+
+import "os"
+
+// WriteRaw writes the contents of b to a new raw disk image at path, which
+// can be attached with vz.NewDiskImageStorageDeviceAttachment. Ranges of
+// zeros are left as holes.
+func WriteRaw(path string, b Backend) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	size := b.Size()
+	buf := make([]byte, zeroChunk)
+	for off := int64(0); off < size; {
+		n := int64(len(buf))
+		if rest := size - off; rest < n {
+			n = rest
+		}
+		if _, err := b.ReadAt(buf[:n], off); err != nil {
+			return err
+		}
+		if !isZero(buf[:n]) {
+			if _, err := f.WriteAt(buf[:n], off); err != nil {
+				return err
+			}
+		}
+		off += n
+	}
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,123 @@
+package throttle
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Registry exposes the statistics of named disks as metrics in the
+// Prometheus text exposition format.
+type Registry struct {
+	mu    sync.Mutex
+	disks map[string]*Backend
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{disks: map[string]*Backend{}}
+}
+
+// Register adds the disk b under name, replacing any disk of that name.
+func (r *Registry) Register(name string, b *Backend) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disks[name] = b
+}
+
+// Unregister removes the disk called name.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.disks, name)
+}
+
+// ServeHTTP serves the metrics of all registered disks.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// WriteTo writes the metrics of all registered disks to w.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.disks))
+	stats := map[string]Stats{}
+	for name, b := range r.disks {
+		names = append(names, name)
+		stats[name] = b.Stats()
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	cw := &countingWriter{w: w}
+	for _, op := range []struct {
+		name string
+		get  func(s *Stats) *OpStats
+	}{
+		{"read", func(s *Stats) *OpStats { return &s.Read }},
+		{"write", func(s *Stats) *OpStats { return &s.Write }},
+		{"write_zeroes", func(s *Stats) *OpStats { return &s.WriteZeroes }},
+		{"trim", func(s *Stats) *OpStats { return &s.Trim }},
+		{"flush", func(s *Stats) *OpStats { return &s.Flush }},
+	} {
+		metric := "vz_disk_" + op.name
+		cw.printf("# TYPE %s_ops_total counter\n", metric)
+		for _, name := range names {
+			s := stats[name]
+			cw.printf("%s_ops_total{disk=%q} %d\n", metric, name, op.get(&s).Ops)
+		}
+		if op.name != "flush" {
+			cw.printf("# TYPE %s_bytes_total counter\n", metric)
+			for _, name := range names {
+				s := stats[name]
+				cw.printf("%s_bytes_total{disk=%q} %d\n", metric, name, op.get(&s).Bytes)
+			}
+		}
+		cw.printf("# TYPE %s_errors_total counter\n", metric)
+		for _, name := range names {
+			s := stats[name]
+			cw.printf("%s_errors_total{disk=%q} %d\n", metric, name, op.get(&s).Errors)
+		}
+		cw.printf("# TYPE %s_latency_seconds histogram\n", metric)
+		for _, name := range names {
+			s := stats[name]
+			h := op.get(&s).Latency
+			cumulative := uint64(0)
+			for i, bound := range h.Bounds {
+				cumulative += h.Counts[i]
+				cw.printf("%s_latency_seconds_bucket{disk=%q,le=\"%g\"} %d\n", metric, name, bound.Seconds(), cumulative)
+			}
+			cw.printf("%s_latency_seconds_bucket{disk=%q,le=\"+Inf\"} %d\n", metric, name, h.Count)
+			cw.printf("%s_latency_seconds_sum{disk=%q} %g\n", metric, name, h.Sum.Seconds())
+			cw.printf("%s_latency_seconds_count{disk=%q} %d\n", metric, name, h.Count)
+		}
+	}
+	cw.printf("# TYPE vz_disk_throttled_total counter\n")
+	for _, name := range names {
+		cw.printf("vz_disk_throttled_total{disk=%q} %d\n", name, stats[name].Throttled)
+	}
+	cw.printf("# TYPE vz_disk_throttled_seconds_total counter\n")
+	for _, name := range names {
+		cw.printf("vz_disk_throttled_seconds_total{disk=%q} %g\n", name, stats[name].ThrottledTime.Seconds())
+	}
+	return cw.n, cw.err
+}
+
+// countingWriter remembers the first error and the bytes written.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) printf(format string, args ...interface{}) {
+	if cw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(cw.w, format, args...)
+	cw.n += int64(n)
+	cw.err = err
+}
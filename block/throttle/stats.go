@@ -0,0 +1,85 @@
+package throttle
+
+import "time"
+
+// Stats are the statistics of a Backend since it was created.
+type Stats struct {
+	Read        OpStats
+	Write       OpStats
+	WriteZeroes OpStats
+	Trim        OpStats
+	Flush       OpStats
+
+	// Throttled is the number of operations that were delayed by the
+	// limits, and ThrottledTime the total delay.
+	Throttled     uint64
+	ThrottledTime time.Duration
+}
+
+// OpStats are the statistics of one kind of operation. Bytes counts the
+// bytes transferred, or for trims and zeroing the bytes affected.
+type OpStats struct {
+	Ops     uint64
+	Bytes   uint64
+	Errors  uint64
+	Latency Histogram
+}
+
+// latencyBounds are the upper bounds of the latency histogram buckets,
+// from 16µs doubling up to about 1s.
+var latencyBounds = func() []time.Duration {
+	var bounds []time.Duration
+	for d := 16 * time.Microsecond; d < 2*time.Second; d *= 2 {
+		bounds = append(bounds, d)
+	}
+	return bounds
+}()
+
+// Histogram is a latency histogram.
+type Histogram struct {
+	// Counts[i] is the number of operations that took at most Bounds[i];
+	// the last element of Counts counts the slower ones.
+	Bounds []time.Duration
+	Counts []uint64
+
+	Count uint64
+	Sum   time.Duration
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+func (h *Histogram) init() {
+	h.Bounds = latencyBounds
+	h.Counts = make([]uint64, len(latencyBounds)+1)
+}
+
+func (h Histogram) clone() Histogram {
+	h.Counts = append([]uint64(nil), h.Counts...)
+	return h
+}
+
+func (s *Stats) ops() []*OpStats {
+	return []*OpStats{&s.Read, &s.Write, &s.WriteZeroes, &s.Trim, &s.Flush}
+}
+
+func (s *Stats) init() {
+	for _, op := range s.ops() {
+		op.Latency.init()
+	}
+}
+
+func (s *Stats) clone() Stats {
+	c := *s
+	for _, op := range c.ops() {
+		op.Latency = op.Latency.clone()
+	}
+	return c
+}
@@ -0,0 +1,231 @@
+// Package throttle implements a block backend middleware that limits the
+// I/O rate of a disk and records statistics about its use.
+package throttle
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mac-vz/vz/block"
+)
+
+// Limits are the I/O limits of a Backend. Zero values mean no limit.
+//
+// Rates are enforced with token buckets holding Burst worth of tokens, so
+// an idle disk can briefly exceed its rates.
+type Limits struct {
+	// IOPS limits read and write operations together; ReadIOPS and
+	// WriteIOPS limit them separately. Trims and zeroing count as writes.
+	IOPS      float64
+	ReadIOPS  float64
+	WriteIOPS float64
+
+	// BytesPerSecond limits the bandwidth of reads and writes together;
+	// ReadBytesPerSecond and WriteBytesPerSecond limit them separately.
+	BytesPerSecond      float64
+	ReadBytesPerSecond  float64
+	WriteBytesPerSecond float64
+
+	// Burst is how long a disk can run without limits after being idle.
+	// It defaults to one second.
+	Burst time.Duration
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newBucket(rate float64, burst time.Duration, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	capacity := rate * burst.Seconds()
+	return &bucket{rate: rate, capacity: capacity, tokens: capacity, last: now}
+}
+
+// take removes n tokens and returns how long the caller has to wait until
+// the bucket is no longer in debt. Requests larger than the bucket are
+// allowed, and delay the requests after them.
+func (b *bucket) take(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Backend is a block backend enforcing Limits on another backend.
+type Backend struct {
+	block.Backend
+
+	mu     sync.Mutex
+	limits Limits
+	ops    [3]*bucket // total, reads, writes
+	bytes  [3]*bucket
+	stats  Stats
+}
+
+var (
+	_ block.Backend = (*Backend)(nil)
+	_ block.Zeroer  = (*Backend)(nil)
+)
+
+// New returns a backend limiting the I/O of b.
+func New(b block.Backend, limits Limits) *Backend {
+	t := &Backend{Backend: b}
+	t.stats.init()
+	t.SetLimits(limits)
+	return t
+}
+
+// SetLimits changes the limits. Accumulated bursts are reset.
+func (t *Backend) SetLimits(limits Limits) {
+	if limits.Burst <= 0 {
+		limits.Burst = time.Second
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limits = limits
+	t.ops = [3]*bucket{
+		newBucket(limits.IOPS, limits.Burst, now),
+		newBucket(limits.ReadIOPS, limits.Burst, now),
+		newBucket(limits.WriteIOPS, limits.Burst, now),
+	}
+	t.bytes = [3]*bucket{
+		newBucket(limits.BytesPerSecond, limits.Burst, now),
+		newBucket(limits.ReadBytesPerSecond, limits.Burst, now),
+		newBucket(limits.WriteBytesPerSecond, limits.Burst, now),
+	}
+}
+
+// Limits returns the current limits.
+func (t *Backend) Limits() Limits {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limits
+}
+
+// Stats returns a snapshot of the statistics of the backend.
+func (t *Backend) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats.clone()
+}
+
+const (
+	dirRead  = 1
+	dirWrite = 2
+)
+
+// throttle waits until an operation in direction dir transferring n bytes
+// is allowed.
+func (t *Backend) throttle(dir int, n int64) {
+	t.mu.Lock()
+	now := time.Now()
+	var wait time.Duration
+	for _, b := range []*bucket{t.ops[0], t.ops[dir]} {
+		if d := b.take(now, 1); d > wait {
+			wait = d
+		}
+	}
+	if n > 0 {
+		for _, b := range []*bucket{t.bytes[0], t.bytes[dir]} {
+			if d := b.take(now, float64(n)); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		t.stats.Throttled++
+		t.stats.ThrottledTime += wait
+	}
+	t.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// record adds an operation to the statistics.
+func (t *Backend) record(op *OpStats, n int64, start time.Time, err error) {
+	d := time.Since(start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	op.Ops++
+	op.Bytes += uint64(n)
+	if err != nil {
+		op.Errors++
+	}
+	op.Latency.observe(d)
+}
+
+// ReadAt implements block.Backend.
+func (t *Backend) ReadAt(p []byte, off int64) (int, error) {
+	t.throttle(dirRead, int64(len(p)))
+	start := time.Now()
+	n, err := t.Backend.ReadAt(p, off)
+	t.record(&t.stats.Read, int64(n), start, err)
+	return n, err
+}
+
+// WriteAt implements block.Backend.
+func (t *Backend) WriteAt(p []byte, off int64) (int, error) {
+	t.throttle(dirWrite, int64(len(p)))
+	start := time.Now()
+	n, err := t.Backend.WriteAt(p, off)
+	t.record(&t.stats.Write, int64(n), start, err)
+	return n, err
+}
+
+// WriteZeroes implements block.Backend. Zeroing counts as a write
+// operation but transfers no bytes.
+func (t *Backend) WriteZeroes(off, length int64) error {
+	t.throttle(dirWrite, 0)
+	start := time.Now()
+	err := t.Backend.WriteZeroes(off, length)
+	t.record(&t.stats.WriteZeroes, length, start, err)
+	return err
+}
+
+// ZeroRange implements block.Zeroer, passing flags on to the limited
+// backend.
+func (t *Backend) ZeroRange(off, length int64, flags block.ZeroFlags) error {
+	t.throttle(dirWrite, 0)
+	start := time.Now()
+	err := block.WriteZeroes(t.Backend, off, length, flags)
+	if errors.Is(err, block.ErrSlowZero) {
+		// A declined request zeroed nothing and is no error.
+		return err
+	}
+	t.record(&t.stats.WriteZeroes, length, start, err)
+	return err
+}
+
+// Trim implements block.Backend. Trims count as write operations but
+// transfer no bytes.
+func (t *Backend) Trim(off, length int64) error {
+	t.throttle(dirWrite, 0)
+	start := time.Now()
+	err := t.Backend.Trim(off, length)
+	t.record(&t.stats.Trim, length, start, err)
+	return err
+}
+
+// Flush implements block.Backend. Flushes are not throttled.
+func (t *Backend) Flush() error {
+	start := time.Now()
+	err := t.Backend.Flush()
+	t.record(&t.stats.Flush, 0, start, err)
+	return err
+}
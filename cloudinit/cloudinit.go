@@ -0,0 +1,185 @@
+// Package cloudinit generates seed disks for the cloud-init NoCloud data
+// source from typed meta-data, user-data and network configuration.
+//
+// A seed is written as an ISO 9660 or FAT image labelled "cidata" and
+// attached read-only next to the root disk:
+//
+//	seed := &cloudinit.Seed{
+//		UserData: &cloudinit.UserData{Hostname: "dev", SSHAuthorizedKeys: keys},
+//		NetworkConfig: &cloudinit.NetworkConfig{Ethernets: []cloudinit.Ethernet{
+//			{Name: "eth0", MAC: mac, DHCP4: true},
+//		}},
+//	}
+//	seed.WriteISO("seed.iso")
+//	attachment, _ := vz.NewDiskImageStorageDeviceAttachment("seed.iso", true)
+//	vz.NewVirtioBlockDeviceConfiguration(attachment)
+//
+// The documents are written as JSON, which cloud-init parses as YAML.
+package cloudinit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mac-vz/vz/fat"
+	"github.com/mac-vz/vz/iso9660"
+)
+
+const (
+	// VolumeLabel identifies a NoCloud seed disk.
+	VolumeLabel = "cidata"
+
+	// KernelArgument selects the NoCloud data source, skipping the probing
+	// of other data sources.
+	KernelArgument = "ds=nocloud"
+)
+
+// MetaData identifies the instance.
+type MetaData struct {
+	// InstanceID changes whenever cloud-init should run its first boot
+	// modules again. It defaults to a hash of the seed contents.
+	InstanceID string `json:"instance-id"`
+
+	LocalHostname string `json:"local-hostname,omitempty"`
+}
+
+// Seed is the content of a NoCloud seed disk.
+type Seed struct {
+	MetaData      MetaData
+	UserData      *UserData
+	NetworkConfig *NetworkConfig
+}
+
+// marshal encodes v as an indented JSON document.
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Files returns the files of the seed by name: meta-data, user-data and,
+// if configured, network-config.
+func (s *Seed) Files() (map[string][]byte, error) {
+	files := map[string][]byte{}
+	userData := []byte("#cloud-config\n")
+	if s.UserData != nil {
+		b, err := marshal(s.UserData)
+		if err != nil {
+			return nil, err
+		}
+		userData = append(userData, b...)
+	}
+	files["user-data"] = userData
+	if s.NetworkConfig != nil {
+		b, err := marshal(s.NetworkConfig)
+		if err != nil {
+			return nil, err
+		}
+		files["network-config"] = b
+	}
+
+	meta := s.MetaData
+	if meta.InstanceID == "" {
+		h := sha256.New()
+		for _, name := range []string{"user-data", "network-config"} {
+			h.Write(files[name])
+		}
+		h.Write([]byte(meta.LocalHostname))
+		meta.InstanceID = "iid-" + hex.EncodeToString(h.Sum(nil))[:16]
+	}
+	b, err := marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	files["meta-data"] = b
+	return files, nil
+}
+
+// WriteISO writes the seed to a new ISO 9660 image at path. The image only
+// depends on the seed contents.
+func (s *Seed) WriteISO(path string) error {
+	files, err := s.Files()
+	if err != nil {
+		return err
+	}
+	w := iso9660.NewWriter(
+		iso9660.WithVolumeLabel(VolumeLabel),
+		iso9660.WithTimestamp(time.Unix(0, 0)),
+	)
+	if err := w.AddFiles(files); err != nil {
+		return err
+	}
+	return w.WriteFile(path)
+}
+
+// WriteFAT writes the seed to a new FAT image at path, for guests without
+// ISO 9660 support. The image only depends on the seed contents.
+func (s *Seed) WriteFAT(path string) (err error) {
+	files, err := s.Files()
+	if err != nil {
+		return err
+	}
+	size := int64(1 << 20)
+	for _, data := range files {
+		size += (int64(len(data)) + 4095) &^ 4095
+	}
+	size = (size + 1<<20 - 1) &^ (1<<20 - 1)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	// The volume ID is derived from the instance ID for reproducibility.
+	id := sha256.Sum256(files["meta-data"])
+	b, err := fat.NewBuilder(f, size,
+		fat.WithLabel(VolumeLabel),
+		fat.WithVolumeID(binary.LittleEndian.Uint32(id[:])),
+		fat.WithTimestamp(time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)),
+	)
+	if err != nil {
+		return err
+	}
+	if err := b.AddFiles(files); err != nil {
+		return err
+	}
+	if err := b.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// CommandLine returns the kernel command line cmdline with KernelArgument
+// appended, unless it already selects a data source.
+func CommandLine(cmdline string) string {
+	for _, arg := range strings.Fields(cmdline) {
+		if strings.HasPrefix(arg, "ds=") {
+			return cmdline
+		}
+	}
+	if cmdline == "" {
+		return KernelArgument
+	}
+	return cmdline + " " + KernelArgument
+}
@@ -0,0 +1,106 @@
+package cloudinit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// NetworkConfig is a version 2 network configuration, the netplan format.
+type NetworkConfig struct {
+	Ethernets []Ethernet
+}
+
+// Ethernet configures a network interface.
+type Ethernet struct {
+	// Name is the interface name, such as "eth0". When MAC is set the
+	// interface with that address is renamed to Name.
+	Name string
+
+	// MAC matches the address given to the device with SetMACAddress.
+	MAC net.HardwareAddr
+
+	DHCP4 bool
+	DHCP6 bool
+
+	// Addresses are static addresses in CIDR notation.
+	Addresses []string
+
+	Gateway4 string
+	Gateway6 string
+
+	Nameservers []string
+	Search      []string
+
+	MTU int
+}
+
+type ethernetJSON struct {
+	Match       *matchJSON       `json:"match,omitempty"`
+	SetName     string           `json:"set-name,omitempty"`
+	DHCP4       bool             `json:"dhcp4"`
+	DHCP6       bool             `json:"dhcp6,omitempty"`
+	Addresses   []string         `json:"addresses,omitempty"`
+	Routes      []routeJSON      `json:"routes,omitempty"`
+	Nameservers *nameserversJSON `json:"nameservers,omitempty"`
+	MTU         int              `json:"mtu,omitempty"`
+}
+
+type matchJSON struct {
+	MACAddress string `json:"macaddress"`
+}
+
+type routeJSON struct {
+	To  string `json:"to"`
+	Via string `json:"via"`
+}
+
+type nameserversJSON struct {
+	Addresses []string `json:"addresses,omitempty"`
+	Search    []string `json:"search,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (c *NetworkConfig) MarshalJSON() ([]byte, error) {
+	ethernets := map[string]ethernetJSON{}
+	for _, e := range c.Ethernets {
+		if e.Name == "" {
+			return nil, fmt.Errorf("cloudinit: ethernet %v without name", e.MAC)
+		}
+		if _, ok := ethernets[e.Name]; ok {
+			return nil, fmt.Errorf("cloudinit: duplicate ethernet %s", e.Name)
+		}
+		if e.MAC != nil && len(e.MAC) != 6 {
+			return nil, fmt.Errorf("cloudinit: ethernet %s: invalid MAC address %v", e.Name, e.MAC)
+		}
+		for _, a := range e.Addresses {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				return nil, fmt.Errorf("cloudinit: ethernet %s: %w", e.Name, err)
+			}
+		}
+		j := ethernetJSON{
+			DHCP4:     e.DHCP4,
+			DHCP6:     e.DHCP6,
+			Addresses: e.Addresses,
+			MTU:       e.MTU,
+		}
+		if e.MAC != nil {
+			j.Match = &matchJSON{MACAddress: e.MAC.String()}
+			j.SetName = e.Name
+		}
+		if e.Gateway4 != "" {
+			j.Routes = append(j.Routes, routeJSON{To: "0.0.0.0/0", Via: e.Gateway4})
+		}
+		if e.Gateway6 != "" {
+			j.Routes = append(j.Routes, routeJSON{To: "::/0", Via: e.Gateway6})
+		}
+		if len(e.Nameservers) > 0 || len(e.Search) > 0 {
+			j.Nameservers = &nameserversJSON{Addresses: e.Nameservers, Search: e.Search}
+		}
+		ethernets[e.Name] = j
+	}
+	return json.Marshal(struct {
+		Version   int                     `json:"version"`
+		Ethernets map[string]ethernetJSON `json:"ethernets"`
+	}{2, ethernets})
+}
@@ -0,0 +1,103 @@
+package cloudinit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"unicode/utf8"
+)
+
+// UserData is the cloud-config document applied by cloud-init on first
+// boot. Only commonly used modules are modelled.
+type UserData struct {
+	Hostname string `json:"hostname,omitempty"`
+	FQDN     string `json:"fqdn,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+
+	// Users replaces the distribution's default user unless one of them
+	// is named "default".
+	Users []User `json:"users,omitempty"`
+
+	// SSHAuthorizedKeys are installed for the default user.
+	SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty"`
+
+	PackageUpdate  bool     `json:"package_update,omitempty"`
+	PackageUpgrade bool     `json:"package_upgrade,omitempty"`
+	Packages       []string `json:"packages,omitempty"`
+
+	WriteFiles []WriteFile `json:"write_files,omitempty"`
+
+	// RunCmd are shell commands run late in the first boot.
+	RunCmd []string `json:"runcmd,omitempty"`
+}
+
+// User is an account created by cloud-init.
+type User struct {
+	Name   string   `json:"name"`
+	Gecos  string   `json:"gecos,omitempty"`
+	UID    int      `json:"uid,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	Shell  string   `json:"shell,omitempty"`
+
+	// Sudo is a sudoers rule such as "ALL=(ALL) NOPASSWD:ALL".
+	Sudo string `json:"sudo,omitempty"`
+
+	// HashedPassword is a crypt(3) hash. The password of users without
+	// one is locked.
+	HashedPassword string `json:"passwd,omitempty"`
+
+	SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (u User) MarshalJSON() ([]byte, error) {
+	type user User
+	return json.Marshal(struct {
+		user
+		LockPasswd bool `json:"lock_passwd"`
+	}{user(u), u.HashedPassword == ""})
+}
+
+// WriteFile is a file written by cloud-init.
+type WriteFile struct {
+	Path    string
+	Content []byte
+
+	// Permissions defaults to 0644.
+	Permissions fs.FileMode
+
+	// Owner is "user:group" and defaults to "root:root".
+	Owner string
+
+	// Append appends Content to an existing file.
+	Append bool
+}
+
+// MarshalJSON implements json.Marshaler. Content that is not UTF-8 text is
+// base64 encoded.
+func (f WriteFile) MarshalJSON() ([]byte, error) {
+	perm := f.Permissions.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	v := struct {
+		Path        string `json:"path"`
+		Content     string `json:"content"`
+		Encoding    string `json:"encoding,omitempty"`
+		Permissions string `json:"permissions"`
+		Owner       string `json:"owner,omitempty"`
+		Append      bool   `json:"append,omitempty"`
+	}{
+		Path:        f.Path,
+		Content:     string(f.Content),
+		Permissions: fmt.Sprintf("%#o", perm),
+		Owner:       f.Owner,
+		Append:      f.Append,
+	}
+	if !utf8.Valid(f.Content) {
+		v.Content = base64.StdEncoding.EncodeToString(f.Content)
+		v.Encoding = "b64"
+	}
+	return json.Marshal(v)
+}
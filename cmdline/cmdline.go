@@ -0,0 +1,171 @@
+// Package cmdline parses and edits Linux kernel command lines, so the
+// arguments needed by a root disk, an initrd or a data source can be
+// combined with the arguments a user passed.
+//
+//	c := cmdline.Parse("console=hvc0 root=/dev/vda rw quiet")
+//	c.Set("root", "/dev/vdb")
+//	c.Delete("rw")
+//	c.SetFlag("ro")
+//	vz.WithCommandLine(c.String())
+//
+// Arguments after "--" are passed to init and are never changed.
+package cmdline
+
+import "strings"
+
+// separator separates kernel arguments from the arguments of init.
+const separator = "--"
+
+// CommandLine is a kernel command line as a list of arguments, each a
+// flag such as "ro" or a "key=value" parameter.
+type CommandLine struct {
+	args []string
+}
+
+// Parse splits s into arguments. Whitespace inside double quotes does
+// not separate arguments, as for the kernel.
+func Parse(s string) *CommandLine {
+	c := &CommandLine{}
+	var arg strings.Builder
+	quoted, inArg := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+			arg.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if inArg {
+				c.args = append(c.args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			inArg = true
+			arg.WriteRune(r)
+		}
+	}
+	if inArg {
+		c.args = append(c.args, arg.String())
+	}
+	return c
+}
+
+// String returns the command line.
+func (c *CommandLine) String() string {
+	return strings.Join(c.args, " ")
+}
+
+// Args returns the arguments of the command line.
+func (c *CommandLine) Args() []string {
+	return append([]string(nil), c.args...)
+}
+
+// keyOf returns the key of the argument arg.
+func keyOf(arg string) string {
+	arg = strings.TrimPrefix(arg, `"`)
+	if i := strings.IndexByte(arg, '='); i >= 0 {
+		return arg[:i]
+	}
+	return strings.TrimSuffix(arg, `"`)
+}
+
+// valueOf returns the unquoted value of the argument arg.
+func valueOf(arg string) string {
+	i := strings.IndexByte(arg, '=')
+	if i < 0 {
+		return ""
+	}
+	return strings.ReplaceAll(arg[i+1:], `"`, "")
+}
+
+// kernelArgs returns the number of arguments before the separator.
+func (c *CommandLine) kernelArgs() int {
+	for i, arg := range c.args {
+		if arg == separator {
+			return i
+		}
+	}
+	return len(c.args)
+}
+
+// Get returns the value of the last parameter key, which the kernel and
+// most programs reading the command line use. ok reports whether the
+// parameter or flag is present; flags have an empty value.
+func (c *CommandLine) Get(key string) (value string, ok bool) {
+	for i := c.kernelArgs() - 1; i >= 0; i-- {
+		if keyOf(c.args[i]) == key {
+			return valueOf(c.args[i]), true
+		}
+	}
+	return "", false
+}
+
+// GetAll returns the values of all parameters key, in order. Some
+// parameters, such as console, may be given several times.
+func (c *CommandLine) GetAll(key string) []string {
+	var values []string
+	for _, arg := range c.args[:c.kernelArgs()] {
+		if keyOf(arg) == key {
+			values = append(values, valueOf(arg))
+		}
+	}
+	return values
+}
+
+// Set sets the parameter key to value in place of all its occurrences,
+// keeping the position of the first one. A value containing whitespace is
+// quoted.
+func (c *CommandLine) Set(key, value string) {
+	if strings.ContainsAny(value, " \t\n") {
+		value = `"` + value + `"`
+	}
+	c.replace(key, key+"="+value)
+}
+
+// SetFlag sets the flag key, such as "ro" or "quiet", replacing all
+// parameters of the same name.
+func (c *CommandLine) SetFlag(key string) {
+	c.replace(key, key)
+}
+
+// Add appends the parameter key with value, keeping earlier occurrences.
+func (c *CommandLine) Add(key, value string) {
+	if strings.ContainsAny(value, " \t\n") {
+		value = `"` + value + `"`
+	}
+	c.insert(c.kernelArgs(), key+"="+value)
+}
+
+// Delete removes all parameters and flags named key.
+func (c *CommandLine) Delete(key string) {
+	n := c.kernelArgs()
+	args := c.args[:0:0]
+	for i, arg := range c.args {
+		if i < n && keyOf(arg) == key {
+			continue
+		}
+		args = append(args, arg)
+	}
+	c.args = args
+}
+
+// replace puts arg at the position of the first argument named key, or
+// after the last kernel argument, and removes the others.
+func (c *CommandLine) replace(key, arg string) {
+	n := c.kernelArgs()
+	for i := 0; i < n; i++ {
+		if keyOf(c.args[i]) == key {
+			c.Delete(key)
+			c.insert(i, arg)
+			return
+		}
+	}
+	c.insert(n, arg)
+}
+
+func (c *CommandLine) insert(i int, arg string) {
+	c.args = append(c.args, "")
+	copy(c.args[i+1:], c.args[i:])
+	c.args[i] = arg
+}
@@ -30,8 +30,9 @@ import "runtime"
 //
 // see: https://developer.apple.com/documentation/virtualization/vzvirtualmachineconfiguration?language=objc
 type VirtualMachineConfiguration struct {
-	cpuCount   uint
-	memorySize uint64
+	cpuCount       uint
+	memorySize     uint64
+	storageDevices []StorageDeviceConfiguration
 	pointer
 }
 
@@ -138,6 +139,7 @@ func (v *VirtualMachineConfiguration) SetDirectorySharingDevices(cs []DirectoryS
 
 // SetStorageDevicesVirtualMachineConfiguration sets list of disk devices. Empty by default.
 func (v *VirtualMachineConfiguration) SetStorageDevicesVirtualMachineConfiguration(cs []StorageDeviceConfiguration) {
+	v.storageDevices = cs
 	ptrs := make([]NSObject, len(cs))
 	for i, val := range cs {
 		ptrs[i] = val
@@ -0,0 +1,168 @@
+package diskimage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// CloneDisk copies the raw disk image at src to dst, which must not exist.
+//
+// The cheapest mechanism available is used: a copy-on-write clone where
+// the file system supports it (clonefile on APFS, reflinks on Linux), or
+// else a sparse copy that only writes the data regions of src and leaves
+// holes in dst. Either way dst occupies little additional space until the
+// guest starts writing to it.
+//
+// CloneDisk takes a shared lock on src, so it fails with ErrInUse while a
+// virtual machine uses the image read-write.
+func CloneDisk(src, dst string) error {
+	lock, err := LockFile(src, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return lock.CloneDisk(dst)
+}
+
+// CloneDisk copies the locked disk image to dst like the CloneDisk
+// function, without taking another lock. It lets the holder of an
+// exclusive lock, such as a paused virtual machine, snapshot the image.
+func (l *Lock) CloneDisk(dst string) error {
+	if l == nil || l.f == nil {
+		return errors.New("diskimage: lock is not held")
+	}
+	src := l.f.Name()
+	err := cloneFile(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, errCloneUnsupported) {
+		return fmt.Errorf("diskimage: cloning %s: %w", src, err)
+	}
+	if err := sparseCopy(src, dst); err != nil {
+		return fmt.Errorf("diskimage: copying %s: %w", src, err)
+	}
+	return nil
+}
+
+// errCloneUnsupported is returned by cloneFile when src and dst cannot
+// share blocks, so a regular copy is needed.
+var errCloneUnsupported = errors.New("copy-on-write clones are not supported")
+
+// copyRange copies bytes [from, to) of in to out. Blocks of zeros are
+// skipped, so they stay holes in out.
+func copyRange(out io.WriterAt, in io.ReaderAt, from, to int64, buf []byte) error {
+	for off := from; off < to; {
+		n := len(buf)
+		if rest := to - off; rest < int64(n) {
+			n = int(rest)
+		}
+		n, err := in.ReadAt(buf[:n], off)
+		if err != nil && !(err == io.EOF && n > 0) {
+			return err
+		}
+		if !isZero(buf[:n]) {
+			if _, err := out.WriteAt(buf[:n], off); err != nil {
+				return err
+			}
+		}
+		off += int64(n)
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Extent is a range of a file.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// DataExtents returns the ranges of f that contain data, skipping its
+// holes. If the file system cannot report holes, the whole file is
+// returned as a single extent.
+func DataExtents(f *os.File) ([]Extent, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	var extents []Extent
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, unix.SEEK_DATA)
+		if err != nil {
+			if errors.Is(err, unix.ENXIO) {
+				// No data after off.
+				break
+			}
+			if errors.Is(err, unix.EINVAL) && off == 0 {
+				// SEEK_DATA is not supported.
+				return []Extent{{0, size}}, nil
+			}
+			return nil, err
+		}
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			hole = size
+		}
+		extents = append(extents, Extent{data, hole - data})
+		off = hole
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// sparseCopy copies src to a new file dst, skipping holes.
+func sparseCopy(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	extents, err := DataExtents(in)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<20)
+	for _, e := range extents {
+		if err := copyRange(out, in, e.Offset, e.Offset+e.Length, buf); err != nil {
+			return err
+		}
+	}
+	size := fi.Size()
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+	return out.Sync()
+}
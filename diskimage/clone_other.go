@@ -0,0 +1,8 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package diskimage
+
+func cloneFile(src, dst string) error {
+	return errCloneUnsupported
+}
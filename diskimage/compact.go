@@ -0,0 +1,194 @@
+package diskimage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/mac-vz/vz/ext4"
+	"github.com/mac-vz/vz/partition"
+)
+
+// compactBlock is the granularity at which CompactDisk detects zeros.
+const compactBlock = 4096
+
+// CompactDisk returns the unused space of the raw disk image at path to
+// the host by punching holes into the image file, and returns the number
+// of bytes reclaimed.
+//
+// Blocks that contain only zeros are deallocated. In addition, the blocks
+// that ext4 file systems on the disk (or on its GPT or MBR partitions)
+// mark as free are deallocated even if they still hold deleted data, so
+// they read as zeros afterwards. Other file systems have to zero their
+// free space from inside the guest, for example with fstrim.
+//
+// CompactDisk fails with ErrInUse while a virtual machine using the image is running.
+func CompactDisk(path string) (int64, error) {
+	lock, err := LockFile(path, true)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	before, err := allocated(f)
+	if err != nil {
+		return 0, err
+	}
+	if err := discardFreeBlocks(f); err != nil {
+		return 0, err
+	}
+	if err := punchZeros(f); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	after, err := allocated(f)
+	if err != nil {
+		return 0, err
+	}
+	if after > before {
+		return 0, nil
+	}
+	return before - after, nil
+}
+
+// allocated returns the number of bytes the host allocated for f.
+func allocated(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512, nil
+	}
+	return fi.Size(), nil
+}
+
+// discardFreeBlocks punches holes into the free blocks of the ext4 file
+// systems on the disk f.
+func discardFreeBlocks(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	type region struct {
+		name      string
+		off, size int64
+	}
+	var regions []region
+	table, err := partition.Read(f, fi.Size())
+	switch {
+	case err == nil:
+		for _, p := range table.Partitions {
+			off, n := table.Offset(p)
+			regions = append(regions, region{fmt.Sprintf("partition %d", p.Number), off, n})
+		}
+	case errors.Is(err, partition.ErrNoGPT):
+		mbr, err := partition.ReadMBR(f)
+		if err != nil && !errors.Is(err, partition.ErrNoMBR) {
+			return err
+		}
+		if mbr != nil && !mbr.IsProtective() {
+			for i, p := range mbr.Partitions {
+				if !p.IsEmpty() {
+					regions = append(regions, region{
+						fmt.Sprintf("partition %d", i+1),
+						int64(p.FirstLBA) * SectorSize,
+						int64(p.Sectors) * SectorSize,
+					})
+				}
+			}
+		}
+	default:
+		return err
+	}
+	if len(regions) == 0 {
+		regions = []region{{"disk", 0, fi.Size()}}
+	}
+
+	for _, r := range regions {
+		if r.off+r.size > fi.Size() {
+			continue
+		}
+		sec := partition.NewSection(f, r.off, r.size)
+		if !ext4.Probe(sec) {
+			continue
+		}
+		fsys, err := ext4.OpenReadOnly(sec)
+		if err != nil {
+			// Leave file systems this package cannot read alone.
+			continue
+		}
+		err = fsys.FreeRanges(func(off, length int64) error {
+			if off+length > r.size {
+				length = r.size - off
+			}
+			if length <= 0 {
+				return nil
+			}
+			return PunchHole(f, r.off+off, length)
+		})
+		if err != nil {
+			return fmt.Errorf("diskimage: discarding free blocks of %s: %w", r.name, err)
+		}
+	}
+	return nil
+}
+
+// punchZeros punches holes into the blocks of f that contain only zeros.
+func punchZeros(f *os.File) error {
+	extents, err := DataExtents(f)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<20)
+	for _, e := range extents {
+		// Runs of zero blocks are punched at once.
+		var run, runLen int64
+		flush := func() error {
+			if runLen == 0 {
+				return nil
+			}
+			err := PunchHole(f, run, runLen)
+			runLen = 0
+			return err
+		}
+		for off := e.Offset; off < e.Offset+e.Length; {
+			n := int64(len(buf))
+			if rest := e.Offset + e.Length - off; rest < n {
+				n = rest
+			}
+			if _, err := f.ReadAt(buf[:n], off); err != nil {
+				return err
+			}
+			for i := int64(0); i < n; i += compactBlock {
+				end := i + compactBlock
+				if end > n {
+					end = n
+				}
+				if !isZero(buf[i:end]) {
+					if err := flush(); err != nil {
+						return err
+					}
+					continue
+				}
+				if runLen == 0 {
+					run = off + i
+				}
+				runLen += end - i
+			}
+			off += n
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package diskimage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Ephemeral is a temporary writable clone of a disk image, which is thrown
+// away when it is no longer needed.
+//
+// Every ephemeral disk is accompanied by a lock file that its process keeps
+// locked while the disk exists. Disks left behind by processes that exited
+// without removing them are found by CollectEphemeral.
+type Ephemeral struct {
+	path string
+	lock *os.File
+}
+
+// EphemeralDir returns the default directory for ephemeral disks.
+func EphemeralDir() string {
+	return filepath.Join(os.TempDir(), "vz-ephemeral")
+}
+
+// NewEphemeral clones the disk image at base into dir, or EphemeralDir if
+// dir is empty. Leftovers of crashed processes in dir are removed first.
+func NewEphemeral(base, dir string) (*Ephemeral, error) {
+	if dir == "" {
+		dir = EphemeralDir()
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := CollectEphemeral(dir); err != nil {
+		return nil, err
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, hex.EncodeToString(id[:]))
+	lock, err := lockEphemeral(name + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	e := &Ephemeral{path: name + ".img", lock: lock}
+	if err := CloneDisk(base, e.path); err != nil {
+		e.Remove()
+		return nil, err
+	}
+	if err := os.Chmod(e.path, 0600); err != nil {
+		e.Remove()
+		return nil, err
+	}
+	return e, nil
+}
+
+// lockEphemeral creates and locks the lock file of an ephemeral disk.
+func lockEphemeral(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// CollectEphemeral may have removed the file before it was locked.
+	fi, err := f.Stat()
+	if err == nil {
+		var cur os.FileInfo
+		if cur, err = os.Stat(path); err == nil && !os.SameFile(fi, cur) {
+			err = os.ErrNotExist
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Path returns the path of the ephemeral disk image.
+func (e *Ephemeral) Path() string {
+	return e.path
+}
+
+// Remove deletes the ephemeral disk image. It is safe to call Remove more
+// than once.
+func (e *Ephemeral) Remove() error {
+	if e == nil || e.lock == nil {
+		return nil
+	}
+	err := os.Remove(e.path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	os.Remove(e.lock.Name())
+	e.lock.Close()
+	e.lock = nil
+	return err
+}
+
+// CollectEphemeral removes the ephemeral disks in dir, or EphemeralDir if
+// dir is empty, whose processes have exited.
+func CollectEphemeral(dir string) error {
+	if dir == "" {
+		dir = EphemeralDir()
+	}
+	ents, err := ioutil.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		if !strings.HasSuffix(ent.Name(), ".lock") {
+			continue
+		}
+		name := filepath.Join(dir, strings.TrimSuffix(ent.Name(), ".lock"))
+		f, err := os.Open(name + ".lock")
+		if err != nil {
+			continue
+		}
+		if unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB) == nil {
+			if err := os.Remove(name + ".img"); err != nil && !errors.Is(err, os.ErrNotExist) {
+				f.Close()
+				return err
+			}
+			os.Remove(name + ".lock")
+		}
+		f.Close()
+	}
+	return nil
+}
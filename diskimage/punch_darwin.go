@@ -0,0 +1,61 @@
+package diskimage
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fpunchhole is the argument of the F_PUNCHHOLE fcntl.
+type fpunchhole struct {
+	flags    uint32
+	reserved uint32
+	offset   int64
+	length   int64
+}
+
+// holeAlign is the alignment APFS requires for holes.
+const holeAlign = 4096
+
+// PunchHole deallocates length bytes of f from off, which read as zeros
+// afterwards. Unaligned head and tail bytes are overwritten with zeros.
+func PunchHole(f *os.File, off, length int64) error {
+	start := (off + holeAlign - 1) &^ (holeAlign - 1)
+	end := (off + length) &^ (holeAlign - 1)
+	if start >= end {
+		return zeroFill(f, off, length)
+	}
+	arg := fpunchhole{offset: start, length: end - start}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), unix.F_PUNCHHOLE, uintptr(unsafe.Pointer(&arg))); errno != 0 {
+		return errno
+	}
+	if err := zeroFill(f, off, start-off); err != nil {
+		return err
+	}
+	return zeroFill(f, end, off+length-end)
+}
+
+// zeroFill writes length zero bytes to f at off.
+func zeroFill(f *os.File, off, length int64) error {
+	if length <= 0 {
+		return nil
+	}
+	n := int64(1 << 20)
+	if length < n {
+		n = length
+	}
+	zeros := make([]byte, n)
+	for length > 0 {
+		if length < n {
+			n = length
+		}
+		if _, err := f.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package diskimage
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// PunchHole deallocates length bytes of f from off, which read as zeros
+// afterwards.
+func PunchHole(f *os.File, off, length int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, length)
+}
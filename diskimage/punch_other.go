@@ -0,0 +1,14 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package diskimage
+
+import (
+	"errors"
+	"os"
+)
+
+// PunchHole is not supported on this platform.
+func PunchHole(f *os.File, off, length int64) error {
+	return errors.New("diskimage: punching holes is not supported")
+}
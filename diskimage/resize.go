@@ -0,0 +1,124 @@
+package diskimage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mac-vz/vz/ext4"
+	"github.com/mac-vz/vz/partition"
+)
+
+// SectorSize is the granularity disk image sizes must be a multiple of.
+const SectorSize = 512
+
+// ErrShrink is returned when a disk image would become smaller.
+var ErrShrink = errors.New("diskimage: shrinking disk images is not supported")
+
+// ResizeDisk grows the raw disk image at path to newSize bytes.
+//
+// The image file is extended sparsely. If it holds a GUID partition table
+// the backup header is moved to the new end of the disk and the last
+// partition is extended to use the new space; if that partition (or the
+// whole unpartitioned disk) holds an ext4 file system, the file system is
+// grown offline as well. Other file systems are left as they are and
+// have to be grown from inside the guest.
+//
+// Whether the file system can grow is checked before the image is
+// changed. If growing fails later, the image file and its partition table
+// are restored to their old size. Resizing to the current size finishes a
+// resize that was interrupted.
+//
+// ResizeDisk fails with ErrInUse while a virtual machine using the image is running.
+func ResizeDisk(path string, newSize int64) (err error) {
+	if newSize%SectorSize != 0 {
+		return fmt.Errorf("diskimage: size %d is not a multiple of %d", newSize, SectorSize)
+	}
+	lock, err := LockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	oldSize := fi.Size()
+	if newSize < oldSize {
+		return ErrShrink
+	}
+
+	// Plan the new layout on a copy of the table, keeping the old one
+	// for rolling back, and check the file system before changing
+	// anything.
+	old, err := partition.Read(f, oldSize)
+	if err != nil && !errors.Is(err, partition.ErrNoGPT) {
+		return err
+	}
+	var (
+		table *partition.Table
+		last  *partition.Partition
+		fsys  ext4.Device = f
+		size              = newSize
+	)
+	if old != nil {
+		if table, err = partition.Read(f, oldSize); err != nil {
+			return err
+		}
+		if err := table.Relocate(newSize); err != nil {
+			return err
+		}
+		if last = table.Last(); last != nil {
+			if err := table.Resize(last.Number, 0); err != nil {
+				return err
+			}
+			sec := table.Section(f, last)
+			fsys, size = sec, sec.Size()
+		}
+	}
+	fsErr := func(err error) error {
+		if err != nil && last != nil {
+			return fmt.Errorf("diskimage: growing file system of partition %d: %w", last.Number, err)
+		}
+		return err
+	}
+	grow := (old == nil || last != nil) && ext4.Probe(fsys)
+	if grow {
+		if err := ext4.CheckGrow(fsys, size); err != nil {
+			return fsErr(err)
+		}
+	}
+
+	if err := f.Truncate(newSize); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		f.Truncate(oldSize)
+		if old != nil {
+			old.Write(f)
+		}
+	}()
+	if table != nil {
+		if err := table.ClearBackup(f, oldSize); err != nil {
+			return err
+		}
+		if err := table.Write(f); err != nil {
+			return err
+		}
+	}
+	if grow {
+		if err := ext4.Grow(fsys, size); err != nil {
+			return fsErr(err)
+		}
+	}
+	return f.Sync()
+}
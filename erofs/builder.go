@@ -0,0 +1,494 @@
+package erofs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// File mode type bits.
+const (
+	sIFMT   = 0xf000
+	sIFSOCK = 0xc000
+	sIFLNK  = 0xa000
+	sIFREG  = 0x8000
+	sIFBLK  = 0x6000
+	sIFDIR  = 0x4000
+	sIFCHR  = 0x2000
+	sIFIFO  = 0x1000
+	sISUID  = 0x0800
+	sISGID  = 0x0400
+	sISVTX  = 0x0200
+)
+
+// Option configures a Builder.
+type Option func(b *Builder)
+
+// WithUUID sets the file system UUID, used by root=UUID=…. It defaults to
+// all zeros.
+func WithUUID(uuid [16]byte) Option {
+	return func(b *Builder) {
+		b.uuid = uuid
+	}
+}
+
+// WithLabel sets the volume label, at most 16 bytes.
+func WithLabel(label string) Option {
+	return func(b *Builder) {
+		b.label = label
+	}
+}
+
+// WithTimestamp sets the build time of the image and the modification
+// time of objects added without one. It defaults to the Unix epoch, so
+// images are reproducible.
+func WithTimestamp(t time.Time) Option {
+	return func(b *Builder) {
+		b.now = t
+	}
+}
+
+// Entry describes a file system object added to a Builder.
+type Entry struct {
+	// Path is the slash-separated path of the object relative to the root
+	// of the file system. Missing parent directories are created.
+	Path string
+
+	// Mode holds the type and permission bits, including setuid, setgid
+	// and sticky bits.
+	Mode fs.FileMode
+
+	UID uint32
+	GID uint32
+
+	// ModTime defaults to the builder timestamp.
+	ModTime time.Time
+
+	// Size is the length of a regular file.
+	Size int64
+
+	// Linkname is the target of a symbolic link.
+	Linkname string
+
+	// Devmajor and Devminor identify character and block devices.
+	Devmajor uint32
+	Devminor uint32
+
+	// Xattrs maps full extended attribute names, e.g. "security.capability",
+	// to their values. The user, trusted and security namespaces and POSIX
+	// ACLs are stored.
+	Xattrs map[string][]byte
+}
+
+// node is a file system object of the tree being built. Hard links share
+// a node.
+type node struct {
+	mode     uint16
+	uid, gid uint32
+	mtime    time.Time
+	target   string
+	devmajor uint32
+	devminor uint32
+
+	// xattrs is the encoded inline xattr body, or nil.
+	xattrs []byte
+
+	// data locates the contents of a regular file, and of directories and
+	// symbolic links once laid out by Close.
+	data *fileData
+
+	// refs is the number of directory entries referencing the node.
+	refs     uint32
+	children map[string]*node
+
+	// Assigned by Close: the inode number, the number locating the inode
+	// in the metadata area and the entries of each directory block.
+	ino uint32
+	nid uint64
+	dir [][]dirent
+}
+
+// fileData locates the contents of a file, directory or symbolic link:
+// the blocks starting at blkaddr, followed by tail, the end of the data
+// that is stored inline after the inode.
+type fileData struct {
+	size    uint64
+	blkaddr uint32
+	tail    []byte
+}
+
+func newDirNode(now time.Time) *node {
+	return &node{
+		mode:     sIFDIR | 0755,
+		mtime:    now,
+		children: map[string]*node{},
+	}
+}
+
+func (n *node) isDir() bool {
+	return n.mode&sIFMT == sIFDIR
+}
+
+func (n *node) link(name string, child *node) {
+	n.children[name] = child
+	child.refs++
+}
+
+// sortedNames returns the names of the children of n in sorted order.
+func (n *node) sortedNames() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Builder writes a new EROFS image.
+//
+// File data is written while files are added, identical files being
+// stored once; the inodes and directories are written by Close. Objects
+// replaced or removed after being added keep their data in the image.
+type Builder struct {
+	w     io.WriterAt
+	uuid  [16]byte
+	label string
+	now   time.Time
+
+	root *node
+
+	// blocks is the number of blocks written so far and high the largest
+	// end ever written, past blocks when duplicate files were rolled back.
+	blocks uint32
+	high   uint32
+
+	files  map[[sha256.Size]byte]*fileData
+	size   int64
+	closed bool
+}
+
+// NewBuilder creates a Builder writing an image to w, starting at offset
+// zero.
+func NewBuilder(w io.WriterAt, opts ...Option) (*Builder, error) {
+	b := &Builder{
+		w:   w,
+		now: time.Unix(0, 0),
+		// The superblock is in the first block.
+		blocks: 1,
+		high:   1,
+		files:  map[[sha256.Size]byte]*fileData{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if len(b.label) > 16 {
+		return nil, fmt.Errorf("erofs: label %q longer than 16 bytes", b.label)
+	}
+	b.root = newDirNode(b.now)
+	b.root.refs = 1
+	return b, nil
+}
+
+// unixMode converts m to the Unix mode representation.
+func unixMode(m fs.FileMode) uint16 {
+	mode := uint16(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= sISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= sISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= sISVTX
+	}
+	switch {
+	case m.IsDir():
+		mode |= sIFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= sIFLNK
+	case m&fs.ModeCharDevice != 0:
+		mode |= sIFCHR
+	case m&fs.ModeDevice != 0:
+		mode |= sIFBLK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= sIFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= sIFSOCK
+	default:
+		mode |= sIFREG
+	}
+	return mode
+}
+
+// cleanPath normalizes p to a slash-separated path without leading slash.
+// The root directory is returned as the empty string.
+func cleanPath(p string) (string, error) {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	for _, elem := range strings.Split(p, "/") {
+		if len(elem) > maxNameLen {
+			return "", fmt.Errorf("erofs: file name %q too long", elem)
+		}
+	}
+	return p, nil
+}
+
+// lookupDir returns the directory node at the clean path p, creating
+// missing directories when create is true. Both "" and "." refer to the root.
+func (b *Builder) lookupDir(p string, create bool) (*node, error) {
+	dir := b.root
+	if p == "" || p == "." {
+		return dir, nil
+	}
+	for _, elem := range strings.Split(p, "/") {
+		child, ok := dir.children[elem]
+		if !ok {
+			if !create {
+				return nil, fmt.Errorf("erofs: %s: %w", p, fs.ErrNotExist)
+			}
+			child = newDirNode(b.now)
+			dir.link(elem, child)
+		}
+		if !child.isDir() {
+			return nil, fmt.Errorf("erofs: %s: not a directory", p)
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+func (b *Builder) setMeta(n *node, e *Entry) error {
+	attrs, err := encodeXattrs(e.Xattrs)
+	if err != nil {
+		return err
+	}
+	n.mode = unixMode(e.Mode)
+	n.uid, n.gid = e.UID, e.GID
+	n.mtime = e.ModTime
+	if n.mtime.IsZero() {
+		n.mtime = b.now
+	}
+	n.xattrs = attrs
+	return nil
+}
+
+// Add adds the object described by e. For regular files Size bytes of
+// content are read from r; r is ignored for all other types. An existing
+// object at the same path is replaced, except that adding a directory over
+// a directory only updates its metadata.
+func (b *Builder) Add(e *Entry, r io.Reader) error {
+	if b.closed {
+		return errors.New("erofs: builder is closed")
+	}
+	p, err := cleanPath(e.Path)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		if !e.Mode.IsDir() {
+			return errors.New("erofs: root must be a directory")
+		}
+		if err := b.setMeta(b.root, e); err != nil {
+			return fmt.Errorf("erofs: /: %w", err)
+		}
+		return nil
+	}
+	parent, err := b.lookupDir(path.Dir(p), true)
+	if err != nil {
+		return err
+	}
+	name := path.Base(p)
+	if old, ok := parent.children[name]; ok {
+		if old.isDir() && e.Mode.IsDir() {
+			if err := b.setMeta(old, e); err != nil {
+				return fmt.Errorf("erofs: %s: %w", p, err)
+			}
+			return nil
+		}
+		delete(parent.children, name)
+		unref(old)
+	}
+	n := &node{}
+	if err := b.setMeta(n, e); err != nil {
+		return fmt.Errorf("erofs: %s: %w", p, err)
+	}
+	switch n.mode & sIFMT {
+	case sIFDIR:
+		n.children = map[string]*node{}
+	case sIFREG:
+		if e.Size < 0 {
+			return fmt.Errorf("erofs: %s: negative size", p)
+		}
+		if n.data, err = b.writeData(n, r, e.Size); err != nil {
+			return fmt.Errorf("erofs: %s: %w", p, err)
+		}
+	case sIFLNK:
+		if len(e.Linkname) >= blockSize {
+			return fmt.Errorf("erofs: %s: symlink target too long", p)
+		}
+		n.target = e.Linkname
+	case sIFCHR, sIFBLK:
+		n.devmajor, n.devminor = e.Devmajor, e.Devminor
+	}
+	parent.link(name, n)
+	return nil
+}
+
+// Link adds a hard link at p to the existing non-directory object at target.
+func (b *Builder) Link(p, target string) error {
+	if b.closed {
+		return errors.New("erofs: builder is closed")
+	}
+	tp, err := cleanPath(target)
+	if err != nil {
+		return err
+	}
+	tdir, err := b.lookupDir(path.Dir(tp), false)
+	if err != nil {
+		return err
+	}
+	n, ok := tdir.children[path.Base(tp)]
+	if !ok || tp == "" {
+		return fmt.Errorf("erofs: link target %s: %w", target, fs.ErrNotExist)
+	}
+	if n.isDir() {
+		return fmt.Errorf("erofs: link target %s is a directory", target)
+	}
+	p, err = cleanPath(p)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return errors.New("erofs: cannot replace the root directory")
+	}
+	parent, err := b.lookupDir(path.Dir(p), true)
+	if err != nil {
+		return err
+	}
+	name := path.Base(p)
+	if old, ok := parent.children[name]; ok {
+		if old == n {
+			return nil
+		}
+		delete(parent.children, name)
+		unref(old)
+	}
+	parent.link(name, n)
+	return nil
+}
+
+// Remove removes the object at p, including all children of a directory.
+// Removing a path that does not exist is not an error.
+func (b *Builder) Remove(p string) error {
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return errors.New("erofs: cannot remove the root directory")
+	}
+	parent, err := b.lookupDir(path.Dir(p), false)
+	if err != nil {
+		return nil
+	}
+	name := path.Base(p)
+	if n, ok := parent.children[name]; ok {
+		delete(parent.children, name)
+		unref(n)
+	}
+	return nil
+}
+
+// unref drops a directory entry reference to n and, once it is no longer
+// referenced, to its children.
+func unref(n *node) {
+	n.refs--
+	if n.refs > 0 {
+		return
+	}
+	for name, child := range n.children {
+		delete(n.children, name)
+		unref(child)
+	}
+}
+
+// writeData writes the full blocks of size bytes from r and keeps the
+// tail to store it inline, unless it does not fit next to the inode of n.
+// A file identical to an earlier one reuses its data.
+func (b *Builder) writeData(n *node, r io.Reader, size int64) (*fileData, error) {
+	if size/blockSize >= 1<<32-int64(b.blocks) {
+		return nil, errors.New("image too large")
+	}
+	d := &fileData{size: uint64(size), blkaddr: b.blocks}
+	h := sha256.New()
+	const chunk = 256 * blockSize
+	buf := make([]byte, chunk)
+	full := size &^ (blockSize - 1)
+	for remaining := full; remaining > 0; {
+		want := int64(chunk)
+		if remaining < want {
+			want = remaining
+		}
+		if _, err := io.ReadFull(r, buf[:want]); err != nil {
+			return nil, err
+		}
+		h.Write(buf[:want])
+		if err := b.writeBlocks(buf[:want]); err != nil {
+			return nil, err
+		}
+		remaining -= want
+	}
+	tail := make([]byte, size-full)
+	if _, err := io.ReadFull(r, tail); err != nil {
+		return nil, err
+	}
+	h.Write(tail)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	if prev, ok := b.files[sum]; ok && prev.size == d.size && fitsInline(n, len(prev.tail)) {
+		b.blocks = d.blkaddr
+		return prev, nil
+	}
+	if len(tail) > 0 {
+		if fitsInline(n, len(tail)) {
+			d.tail = tail
+		} else {
+			if err := b.writeBlocks(pad(tail)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	b.files[sum] = d
+	return d, nil
+}
+
+// fitsInline reports whether n fits into a block with an inline tail of
+// n bytes, whatever the inode format.
+func fitsInline(n *node, tail int) bool {
+	return extendedInodeSize+len(n.xattrs)+tail <= blockSize
+}
+
+// pad pads p with zeros to a multiple of the block size.
+func pad(p []byte) []byte {
+	if n := len(p) % blockSize; n != 0 {
+		p = append(p, make([]byte, blockSize-n)...)
+	}
+	return p
+}
+
+// writeBlocks appends the blocks p to the image.
+func (b *Builder) writeBlocks(p []byte) error {
+	if _, err := b.w.WriteAt(p, int64(b.blocks)*blockSize); err != nil {
+		return err
+	}
+	b.blocks += uint32(len(p) / blockSize)
+	if b.blocks > b.high {
+		b.high = b.blocks
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Package erofs builds read-only EROFS images, for root disks of
+// immutable appliance virtual machines that favour fast random reads over
+// size.
+//
+// Data is stored uncompressed, the tails of small files and directories
+// packed into their inodes and identical files stored once; the package
+// squashfs builds smaller, compressed images. A Builder writes to any
+// io.WriterAt and the image only depends on the objects added and the
+// builder options, so builds are reproducible:
+//
+//	f, _ := os.Create("root.erofs")
+//	b, _ := erofs.NewBuilder(f, erofs.WithTimestamp(time.Unix(0, 0)))
+//	b.AddDirectory("rootfs")
+//	b.Close()
+//	f.Truncate(b.Size())
+//
+// Images need Linux 5.4 or later, built with CONFIG_EROFS_FS.
+package erofs
+
+import (
+	"github.com/mac-vz/vz/cmdline"
+)
+
+const (
+	magic          = 0xe0f5e1e2
+	superblockOff  = 1024
+	superblockSize = 128
+
+	blockBits = 12
+	blockSize = 1 << blockBits
+
+	compactInodeSize  = 32
+	extendedInodeSize = 64
+
+	// Inode formats: the version bit and the data layout.
+	formatExtended   = 1
+	layoutFlatPlain  = 0 << 1
+	layoutFlatInline = 2 << 1
+
+	direntSize = 12
+
+	maxNameLen = 255
+)
+
+// Directory entry file types.
+const (
+	ftRegular = iota + 1
+	ftDir
+	ftCharDev
+	ftBlockDev
+	ftFifo
+	ftSocket
+	ftSymlink
+)
+
+// CommandLine returns the kernel command line args with the arguments
+// mounting the EROFS image on the block device root, such as /dev/vda, as
+// the read-only root file system.
+func CommandLine(args, root string) string {
+	c := cmdline.Parse(args)
+	c.Set("root", root)
+	c.Set("rootfstype", "erofs")
+	c.Delete("rw")
+	c.SetFlag("ro")
+	return c.String()
+}
@@ -0,0 +1,286 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// dirent is a directory entry.
+type dirent struct {
+	name string
+	n    *node
+}
+
+// Close writes the directories, the inodes and the superblock. It does
+// not close the underlying writer.
+func (b *Builder) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	// Inodes are laid out breadth first, so the root inode comes first and
+	// its number fits into the superblock.
+	var nodes []*node
+	parents := map[*node]*node{b.root: b.root}
+	seen := map[*node]bool{b.root: true}
+	queue := []*node{b.root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		nodes = append(nodes, n)
+		for _, name := range n.sortedNames() {
+			child := n.children[name]
+			if seen[child] {
+				continue
+			}
+			seen[child] = true
+			if child.isDir() {
+				parents[child] = n
+			}
+			queue = append(queue, child)
+		}
+	}
+	if len(nodes) >= 1<<32 {
+		return errors.New("erofs: too many inodes")
+	}
+
+	for _, n := range nodes {
+		switch n.mode & sIFMT {
+		case sIFDIR:
+			if err := b.layoutDir(n, parents[n]); err != nil {
+				return err
+			}
+		case sIFLNK:
+			d := &fileData{size: uint64(len(n.target)), blkaddr: b.blocks}
+			if fitsInline(n, len(n.target)) {
+				d.tail = []byte(n.target)
+			} else if err := b.writeBlocks(pad([]byte(n.target))); err != nil {
+				return err
+			}
+			n.data = d
+		}
+	}
+
+	// Inode numbers reported to user space derive from the nid, and readdir
+	// skips entries with inode number zero, so the first slot stays unused.
+	metaBlk := b.blocks
+	pos := compactInodeSize
+	for i, n := range nodes {
+		n.ino = uint32(i + 1)
+		size := inodeSize(n, b) + len(n.xattrs)
+		if n.data != nil {
+			size += len(n.data.tail)
+		}
+		if pos%blockSize+size > blockSize {
+			pos = (pos + blockSize - 1) &^ (blockSize - 1)
+		}
+		n.nid = uint64(pos / compactInodeSize)
+		pos = (pos + size + compactInodeSize - 1) &^ (compactInodeSize - 1)
+	}
+	meta := make([]byte, (pos+blockSize-1)&^(blockSize-1))
+	for _, n := range nodes {
+		if n.isDir() {
+			if err := b.writeDir(n); err != nil {
+				return err
+			}
+		}
+		b.encodeInode(meta[n.nid*compactInodeSize:], n)
+	}
+	b.blocks = metaBlk
+	if err := b.writeBlocks(meta); err != nil {
+		return err
+	}
+	if b.high > b.blocks {
+		// Clear the data of duplicate files written past the end.
+		if _, err := b.w.WriteAt(make([]byte, int64(b.high-b.blocks)*blockSize), int64(b.blocks)*blockSize); err != nil {
+			return err
+		}
+	}
+
+	block := make([]byte, blockSize)
+	sb := block[superblockOff:]
+	le := binary.LittleEndian
+	le.PutUint32(sb[0:], magic)
+	sb[12] = blockBits
+	le.PutUint16(sb[14:], uint16(b.root.nid))
+	le.PutUint64(sb[16:], uint64(len(nodes)))
+	le.PutUint64(sb[24:], uint64(b.now.Unix()))
+	le.PutUint32(sb[32:], uint32(b.now.Nanosecond()))
+	le.PutUint32(sb[36:], b.blocks)
+	le.PutUint32(sb[40:], metaBlk)
+	copy(sb[48:], b.uuid[:])
+	copy(sb[64:80], b.label)
+	if _, err := b.w.WriteAt(block, 0); err != nil {
+		return err
+	}
+	b.size = int64(b.blocks) * blockSize
+	return nil
+}
+
+// Size returns the size of the image written by Close.
+func (b *Builder) Size() int64 {
+	return b.size
+}
+
+// layoutDir splits the entries of dir into directory blocks, reserves the
+// blocks and keeps the end of the last one inline if it fits.
+func (b *Builder) layoutDir(dir, parent *node) error {
+	ents := []dirent{{".", dir}, {"..", parent}}
+	for name, child := range dir.children {
+		ents = append(ents, dirent{name, child})
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].name < ents[j].name })
+	var blocks [][]dirent
+	used := blockSize
+	for _, e := range ents {
+		if used+direntSize+len(e.name) > blockSize {
+			blocks = append(blocks, nil)
+			used = 0
+		}
+		blocks[len(blocks)-1] = append(blocks[len(blocks)-1], e)
+		used += direntSize + len(e.name)
+	}
+	dir.dir = blocks
+	d := &fileData{size: uint64(len(blocks)-1)*blockSize + uint64(used), blkaddr: b.blocks}
+	full := uint32(len(blocks) - 1)
+	if fitsInline(dir, used) {
+		// The tail is filled in by writeDir.
+		d.tail = make([]byte, used)
+	} else {
+		full++
+	}
+	dir.data = d
+	if full > 1<<32-1-b.blocks {
+		return errors.New("erofs: image too large")
+	}
+	b.blocks += full
+	return nil
+}
+
+// writeDir encodes the directory blocks of dir, once all inode numbers
+// are known, and writes those not stored inline.
+func (b *Builder) writeDir(dir *node) error {
+	d := dir.data
+	for i, ents := range dir.dir {
+		if i == len(dir.dir)-1 && d.tail != nil {
+			encodeDirBlock(d.tail, ents)
+			break
+		}
+		block := make([]byte, blockSize)
+		encodeDirBlock(block, ents)
+		if _, err := b.w.WriteAt(block, (int64(d.blkaddr)+int64(i))*blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeDirBlock writes the entries ents and then their names to p.
+func encodeDirBlock(p []byte, ents []dirent) {
+	le := binary.LittleEndian
+	nameOff := direntSize * len(ents)
+	for i, e := range ents {
+		q := p[i*direntSize:]
+		le.PutUint64(q[0:], e.n.nid)
+		le.PutUint16(q[8:], uint16(nameOff))
+		q[10] = fileType(e.n.mode)
+		nameOff += copy(p[nameOff:], e.name)
+	}
+}
+
+func fileType(mode uint16) uint8 {
+	switch mode & sIFMT {
+	case sIFREG:
+		return ftRegular
+	case sIFDIR:
+		return ftDir
+	case sIFCHR:
+		return ftCharDev
+	case sIFBLK:
+		return ftBlockDev
+	case sIFIFO:
+		return ftFifo
+	case sIFSOCK:
+		return ftSocket
+	case sIFLNK:
+		return ftSymlink
+	}
+	return 0
+}
+
+// nlink returns the link count of n.
+func nlink(n *node) uint32 {
+	if !n.isDir() {
+		return n.refs
+	}
+	links := uint32(2)
+	for _, child := range n.children {
+		if child.isDir() {
+			links++
+		}
+	}
+	return links
+}
+
+// inodeSize returns the size of the inode of n: compact inodes store
+// neither 32 bit IDs and sizes nor times other than the build time.
+func inodeSize(n *node, b *Builder) int {
+	var size uint64
+	if n.data != nil {
+		size = n.data.size
+	}
+	if n.uid > 0xffff || n.gid > 0xffff || nlink(n) > 0xffff || size > 0xffffffff ||
+		n.mtime.Unix() != b.now.Unix() || n.mtime.Nanosecond() != b.now.Nanosecond() {
+		return extendedInodeSize
+	}
+	return compactInodeSize
+}
+
+// encodeInode writes the inode of n, its xattrs and inline data to p.
+func (b *Builder) encodeInode(p []byte, n *node) {
+	le := binary.LittleEndian
+	size := inodeSize(n, b)
+	format := uint16(layoutFlatPlain)
+	var (
+		dataSize uint64
+		u        uint32
+	)
+	switch n.mode & sIFMT {
+	case sIFREG, sIFDIR, sIFLNK:
+		dataSize, u = n.data.size, n.data.blkaddr
+		if n.data.tail != nil {
+			format = layoutFlatInline
+		}
+	case sIFCHR, sIFBLK:
+		u = n.devminor&0xff | n.devmajor<<8 | (n.devminor&^0xff)<<12
+	}
+	icount := uint16(0)
+	if n.xattrs != nil {
+		icount = uint16((len(n.xattrs)-xattrHeaderSize)/4 + 1)
+	}
+	if size == extendedInodeSize {
+		format |= formatExtended
+		le.PutUint64(p[8:], dataSize)
+		le.PutUint32(p[24:], n.uid)
+		le.PutUint32(p[28:], n.gid)
+		le.PutUint64(p[32:], uint64(n.mtime.Unix()))
+		le.PutUint32(p[40:], uint32(n.mtime.Nanosecond()))
+		le.PutUint32(p[44:], nlink(n))
+	} else {
+		le.PutUint16(p[6:], uint16(nlink(n)))
+		le.PutUint32(p[8:], uint32(dataSize))
+		le.PutUint16(p[24:], uint16(n.uid))
+		le.PutUint16(p[26:], uint16(n.gid))
+	}
+	le.PutUint16(p[0:], format)
+	le.PutUint16(p[2:], icount)
+	le.PutUint16(p[4:], n.mode)
+	le.PutUint32(p[16:], u)
+	le.PutUint32(p[20:], n.ino)
+	off := size + copy(p[size:], n.xattrs)
+	if n.data != nil {
+		copy(p[off:], n.data.tail)
+	}
+}
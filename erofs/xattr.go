@@ -0,0 +1,108 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Extended attribute name indexes.
+const (
+	xattrIndexUser         = 1
+	xattrIndexPOSIXAccess  = 2
+	xattrIndexPOSIXDefault = 3
+	xattrIndexTrusted      = 4
+	xattrIndexSecurity     = 6
+)
+
+// xattrHeaderSize is the size of the header of the inline xattr body.
+const xattrHeaderSize = 12
+
+var xattrPrefixes = []struct {
+	index  uint8
+	prefix string
+}{
+	{xattrIndexPOSIXAccess, "system.posix_acl_access"},
+	{xattrIndexPOSIXDefault, "system.posix_acl_default"},
+	{xattrIndexUser, "user."},
+	{xattrIndexTrusted, "trusted."},
+	{xattrIndexSecurity, "security."},
+}
+
+var errXattrTooLarge = errors.New("extended attributes do not fit into one block")
+
+// xattr is an extended attribute split into its name index and suffix.
+type xattr struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+// splitXattrName maps a full attribute name such as "user.foo" to its
+// on-disk index and suffix.
+func splitXattrName(name string) (uint8, string, error) {
+	for _, p := range xattrPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			suffix := name[len(p.prefix):]
+			if (p.index == xattrIndexPOSIXAccess || p.index == xattrIndexPOSIXDefault) && suffix != "" {
+				continue
+			}
+			return p.index, suffix, nil
+		}
+	}
+	return 0, "", fmt.Errorf("unsupported extended attribute namespace %q", name)
+}
+
+// storedXattr reports whether the attribute name is in a namespace EROFS
+// stores.
+func storedXattr(name string) bool {
+	_, _, err := splitXattrName(name)
+	return err == nil
+}
+
+// encodeXattrs returns the inline xattr body holding the attributes of m
+// in sorted order, or nil if m is empty. ACL values are stored in the
+// format of the xattr system calls.
+func encodeXattrs(m map[string][]byte) ([]byte, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	attrs := make([]xattr, 0, len(m))
+	for name, value := range m {
+		index, suffix, err := splitXattrName(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(suffix) > 0xff {
+			return nil, fmt.Errorf("extended attribute name %q too long", name)
+		}
+		attrs = append(attrs, xattr{index: index, name: suffix, value: value})
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		a, b := attrs[i], attrs[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		return a.name < b.name
+	})
+	p := make([]byte, xattrHeaderSize)
+	for _, a := range attrs {
+		var e [4]byte
+		e[0] = uint8(len(a.name))
+		e[1] = a.index
+		if len(a.value) > 0xffff {
+			return nil, errXattrTooLarge
+		}
+		binary.LittleEndian.PutUint16(e[2:], uint16(len(a.value)))
+		p = append(p, e[:]...)
+		p = append(p, a.name...)
+		p = append(p, a.value...)
+		p = append(p, make([]byte, (4-len(p)%4)%4)...)
+	}
+	if extendedInodeSize+len(p) > blockSize {
+		return nil, errXattrTooLarge
+	}
+	return p, nil
+}
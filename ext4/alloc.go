@@ -0,0 +1,173 @@
+package ext4
+
+// groupOf returns the block group holding block blk.
+func (sb *superblock) groupOf(blk uint64) uint32 {
+	return uint32((blk - uint64(sb.FirstDataBlock)) / uint64(sb.BlocksPerGroup))
+}
+
+// writeBlockBitmap stores the block bitmap of group g and its checksum.
+func (v *volume) writeBlockBitmap(g uint32, bm []byte) error {
+	d := &v.groups[g]
+	d.Flags &^= bgBlockUninit
+	v.sb.setBitmapChecksums(d, bm, nil)
+	return v.writeBlock(d.BlockBitmap, bm)
+}
+
+// writeInodeBitmap stores the inode bitmap of group g and its checksum.
+func (v *volume) writeInodeBitmap(g uint32, bm []byte) error {
+	d := &v.groups[g]
+	d.Flags &^= bgInodeUninit
+	v.sb.setBitmapChecksums(d, nil, bm)
+	return v.writeBlock(d.InodeBitmap, bm)
+}
+
+// allocBlocks allocates a run of at most n contiguous free blocks,
+// searching from goal onwards. Updated group descriptors and superblock
+// counters are written by the next flush.
+func (v *volume) allocBlocks(goal uint64, n uint32) (uint64, uint32, error) {
+	sb := v.sb
+	if goal < uint64(sb.FirstDataBlock) || goal >= sb.blocksCount() {
+		goal = uint64(sb.FirstDataBlock)
+	}
+	groups := uint32(len(v.groups))
+	first := sb.groupOf(goal)
+	// The goal group is visited twice, the second time from its start.
+	for i := uint32(0); i <= groups; i++ {
+		g := (first + i) % groups
+		d := &v.groups[g]
+		if d.FreeBlocks == 0 {
+			continue
+		}
+		bm, err := v.blockBitmap(g)
+		if err != nil {
+			return 0, 0, err
+		}
+		start := sb.groupFirstBlock(g)
+		bit := uint32(0)
+		if i == 0 {
+			bit = uint32(goal - start)
+		}
+		glen := sb.groupBlocks(g)
+		for ; bit < glen; bit++ {
+			if testBit(bm, bit) {
+				continue
+			}
+			run := uint32(0)
+			for bit+run < glen && run < n && !testBit(bm, bit+run) {
+				setBit(bm, bit+run)
+				run++
+			}
+			if err := v.writeBlockBitmap(g, bm); err != nil {
+				return 0, 0, err
+			}
+			d.FreeBlocks -= run
+			sb.setFreeBlocksCount(sb.freeBlocksCount() - uint64(run))
+			return start + uint64(bit), run, nil
+		}
+	}
+	return 0, 0, ErrNoSpace
+}
+
+// allocBlock allocates a single block near goal.
+func (v *volume) allocBlock(goal uint64) (uint64, error) {
+	blk, _, err := v.allocBlocks(goal, 1)
+	return blk, err
+}
+
+// freeBlocks releases n blocks starting at blk.
+func (v *volume) freeBlocks(blk, n uint64) error {
+	sb := v.sb
+	for n > 0 {
+		g := sb.groupOf(blk)
+		start := sb.groupFirstBlock(g)
+		bm, err := v.blockBitmap(g)
+		if err != nil {
+			return err
+		}
+		freed := uint32(0)
+		for ; n > 0 && blk < start+uint64(sb.groupBlocks(g)); blk, n = blk+1, n-1 {
+			if bit := uint32(blk - start); testBit(bm, bit) {
+				clearBit(bm, bit)
+				freed++
+			}
+		}
+		if err := v.writeBlockBitmap(g, bm); err != nil {
+			return err
+		}
+		v.groups[g].FreeBlocks += freed
+		sb.setFreeBlocksCount(sb.freeBlocksCount() + uint64(freed))
+	}
+	return nil
+}
+
+// freeExtents releases the blocks of exts.
+func (v *volume) freeExtents(exts []extent) error {
+	for _, e := range exts {
+		if err := v.freeBlocks(e.physical, uint64(e.length)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocInode allocates an inode, preferring group goal.
+func (v *volume) allocInode(goal uint32, dir bool) (uint32, error) {
+	sb := v.sb
+	groups := uint32(len(v.groups))
+	ipg := sb.InodesPerGroup
+	for i := uint32(0); i < groups; i++ {
+		g := (goal + i) % groups
+		d := &v.groups[g]
+		if d.FreeInodes == 0 {
+			continue
+		}
+		bm, err := v.inodeBitmap(g)
+		if err != nil {
+			return 0, err
+		}
+		for bit := uint32(0); bit < ipg; bit++ {
+			ino := g*ipg + bit + 1
+			if ino < sb.firstIno() || testBit(bm, bit) {
+				continue
+			}
+			setBit(bm, bit)
+			if err := v.writeInodeBitmap(g, bm); err != nil {
+				return 0, err
+			}
+			d.FreeInodes--
+			if dir {
+				d.UsedDirs++
+			}
+			if sb.hasGroupCsum() && bit >= ipg-d.ItableUnused {
+				d.ItableUnused = ipg - bit - 1
+			}
+			sb.FreeInodesCount--
+			return ino, nil
+		}
+	}
+	return 0, ErrNoSpace
+}
+
+// freeInode releases inode ino.
+func (v *volume) freeInode(ino uint32, dir bool) error {
+	g := (ino - 1) / v.sb.InodesPerGroup
+	bm, err := v.inodeBitmap(g)
+	if err != nil {
+		return err
+	}
+	bit := (ino - 1) % v.sb.InodesPerGroup
+	if !testBit(bm, bit) {
+		return nil
+	}
+	clearBit(bm, bit)
+	if err := v.writeInodeBitmap(g, bm); err != nil {
+		return err
+	}
+	d := &v.groups[g]
+	d.FreeInodes++
+	if dir {
+		d.UsedDirs--
+	}
+	v.sb.FreeInodesCount++
+	return nil
+}
@@ -0,0 +1,165 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Block map slots of an inode without extents.
+const (
+	directBlocks = 12
+	indBlock     = 12
+	dindBlock    = 13
+	tindBlock    = 14
+)
+
+// blockMap is the mapping of the blocks of an inode: its data extents and
+// the metadata blocks (extent tree or indirect blocks) describing them.
+type blockMap struct {
+	exts []extent
+	meta []uint64
+}
+
+// mapBlocks reads the block map of inode ino. Uninitialized extents are
+// included; see extent.uninit.
+func (v *volume) mapBlocks(ino uint32, in *inode) (*blockMap, error) {
+	if in.Flags&inodeFlagInline != 0 {
+		return nil, fmt.Errorf("inode %d: inline data: %w", ino, ErrUnsupported)
+	}
+	m := &blockMap{}
+	if in.Flags&inodeFlagExtents != 0 {
+		var root [60]byte
+		for i, w := range in.Block {
+			binary.LittleEndian.PutUint32(root[i*4:], w)
+		}
+		return m, v.walkExtents(ino, root[:], 0, m)
+	}
+	var logical uint32
+	for i := 0; i < directBlocks; i++ {
+		if blk := in.Block[i]; blk != 0 {
+			m.exts = appendExtent(m.exts, logical, uint64(blk))
+		}
+		logical++
+	}
+	apb := uint32(v.bs / 4)
+	for level, slot := range []int{indBlock, dindBlock, tindBlock} {
+		span := apb
+		for i := 0; i < level; i++ {
+			span *= apb
+		}
+		if blk := in.Block[slot]; blk != 0 {
+			if err := v.walkIndirect(uint64(blk), level, logical, m); err != nil {
+				return nil, err
+			}
+		}
+		logical += span
+	}
+	return m, nil
+}
+
+// walkIndirect adds the blocks mapped by the indirect block blk, which
+// covers the logical blocks starting at logical, to m.
+func (v *volume) walkIndirect(blk uint64, level int, logical uint32, m *blockMap) error {
+	if blk >= v.sb.blocksCount() {
+		return fmt.Errorf("ext4: indirect block %d out of range", blk)
+	}
+	b, err := v.readBlock(blk)
+	if err != nil {
+		return err
+	}
+	m.meta = append(m.meta, blk)
+	apb := uint32(v.bs / 4)
+	span := uint32(1)
+	for i := 0; i < level; i++ {
+		span *= apb
+	}
+	for i := uint32(0); i < apb; i++ {
+		child := uint64(binary.LittleEndian.Uint32(b[i*4:]))
+		if child == 0 {
+			continue
+		}
+		if level == 0 {
+			m.exts = appendExtent(m.exts, logical+i, child)
+			continue
+		}
+		if err := v.walkIndirect(child, level-1, logical+i*span, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkExtents adds the extents of the extent tree node b to m.
+func (v *volume) walkExtents(ino uint32, b []byte, level int, m *blockMap) error {
+	le := binary.LittleEndian
+	if le.Uint16(b[0:]) != extentMagic {
+		return fmt.Errorf("ext4: inode %d: bad extent header", ino)
+	}
+	entries := int(le.Uint16(b[2:]))
+	depth := int(le.Uint16(b[6:]))
+	if level > 5 || extentHeaderSize+entries*extentEntrySize > len(b) {
+		return fmt.Errorf("ext4: inode %d: corrupt extent tree", ino)
+	}
+	for i := 0; i < entries; i++ {
+		e := b[extentHeaderSize+i*extentEntrySize:]
+		if depth == 0 {
+			x := extent{
+				logical:  le.Uint32(e[0:]),
+				physical: uint64(le.Uint16(e[6:]))<<32 | uint64(le.Uint32(e[8:])),
+				length:   uint32(le.Uint16(e[4:])),
+			}
+			if x.length > maxExtentLen {
+				x.length -= maxExtentLen
+				x.uninit = true
+			}
+			m.exts = append(m.exts, x)
+			continue
+		}
+		blk := uint64(le.Uint16(e[8:]))<<32 | uint64(le.Uint32(e[4:]))
+		child, err := v.readBlock(blk)
+		if err != nil {
+			return err
+		}
+		m.meta = append(m.meta, blk)
+		if err := v.walkExtents(ino, child, level+1, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// physical returns the physical block holding logical block l, or 0 for a
+// hole or an uninitialized extent.
+func (m *blockMap) physical(l uint32) uint64 {
+	for _, e := range m.exts {
+		if l >= e.logical && l < e.logical+e.length {
+			if e.uninit {
+				return 0
+			}
+			return e.physical + uint64(l-e.logical)
+		}
+	}
+	return 0
+}
+
+// readData reads the first size bytes of the file described by m.
+func (v *volume) readData(m *blockMap, size uint64) ([]byte, error) {
+	data := make([]byte, size)
+	for _, e := range m.exts {
+		if e.uninit {
+			continue
+		}
+		off := uint64(e.logical) * uint64(v.bs)
+		if off >= size {
+			continue
+		}
+		n := uint64(e.length) * uint64(v.bs)
+		if off+n > size {
+			n = size - off
+		}
+		if _, err := v.dev.ReadAt(data[off:off+n], int64(e.physical)*v.bs); err != nil {
+			return nil, fmt.Errorf("ext4: reading block %d: %w", e.physical, err)
+		}
+	}
+	return data, nil
+}
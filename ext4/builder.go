@@ -0,0 +1,390 @@
+package ext4
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"time"
+)
+
+const (
+	defaultBlockSize  = 4096
+	defaultInodeRatio = 16384
+	builderInodeSize  = 256
+	lostFoundIno      = 11
+	lostFoundSize     = 16384
+	reservedPercent   = 5
+)
+
+// ErrNoSpace is returned when the data added to a Builder does not fit into the image.
+var ErrNoSpace = errors.New("ext4: no space left in image")
+
+// BuilderOption configures a Builder.
+type BuilderOption func(b *Builder)
+
+// WithBlockSize sets the block size of the file system: 1024, 2048 or 4096 bytes.
+// The default is 4096.
+func WithBlockSize(size int) BuilderOption {
+	return func(b *Builder) {
+		b.blockSize = int64(size)
+	}
+}
+
+// WithInodeCount sets the number of inodes of the file system. The default
+// is one inode per 16KiB of image size.
+func WithInodeCount(n uint32) BuilderOption {
+	return func(b *Builder) {
+		b.inodeCount = n
+	}
+}
+
+// WithUUID sets the file system UUID. By default a random UUID is used.
+func WithUUID(uuid [16]byte) BuilderOption {
+	return func(b *Builder) {
+		b.uuid = uuid
+	}
+}
+
+// WithLabel sets the volume label, at most 16 bytes long.
+func WithLabel(label string) BuilderOption {
+	return func(b *Builder) {
+		b.label = label
+	}
+}
+
+// WithTimestamp sets the creation time recorded in the superblock and used
+// for files without timestamps. Together with WithUUID it makes the output
+// reproducible.
+func WithTimestamp(t time.Time) BuilderOption {
+	return func(b *Builder) {
+		b.now = t
+	}
+}
+
+// WithJournal enables or disables the journal. Journaling is enabled by default.
+func WithJournal(enabled bool) BuilderOption {
+	return func(b *Builder) {
+		b.journal = enabled
+	}
+}
+
+// WithJournalBlocks sets the size of the journal in blocks. By default it
+// is picked from the file system size like mke2fs does.
+func WithJournalBlocks(n uint32) BuilderOption {
+	return func(b *Builder) {
+		b.journalBlocks = n
+	}
+}
+
+// Builder writes a new ext4 file system to a device.
+//
+// File data is written to the device while files are added; the inodes,
+// directories and allocation metadata are written by Close. A Builder needs
+// neither root privileges nor mke2fs, so images can be built from
+// unprivileged processes on any host.
+type Builder struct {
+	dev  Device
+	size int64
+
+	blockSize     int64
+	inodeCount    uint32
+	uuid          [16]byte
+	label         string
+	now           time.Time
+	journal       bool
+	journalBlocks uint32
+
+	sb     *superblock
+	groups []groupDesc
+	alloc  *allocator
+
+	root        *node
+	layer       int
+	journalExts []extent
+	closed      bool
+}
+
+// NewBuilder creates a Builder writing a file system of size bytes to dev.
+// The device must be at least size bytes long; previous contents are ignored.
+func NewBuilder(dev Device, size int64, opts ...BuilderOption) (*Builder, error) {
+	b := &Builder{
+		dev:       dev,
+		size:      size,
+		blockSize: defaultBlockSize,
+		now:       time.Now(),
+		journal:   true,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.uuid == [16]byte{} {
+		if _, err := rand.Read(b.uuid[:]); err != nil {
+			return nil, err
+		}
+		b.uuid[6] = (b.uuid[6] & 0x0f) | 0x40
+		b.uuid[8] = (b.uuid[8] & 0x3f) | 0x80
+	}
+	if len(b.label) > 16 {
+		return nil, fmt.Errorf("ext4: label %q longer than 16 bytes", b.label)
+	}
+	if err := b.layout(); err != nil {
+		return nil, err
+	}
+	b.root = newDirNode(0755, b.now)
+	b.root.refs = 1
+	lf := newDirNode(0700, b.now)
+	lf.ino = lostFoundIno
+	b.root.link("lost+found", lf)
+	if b.journal {
+		if err := b.allocJournal(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// layout computes the file system geometry, like mke2fs, and reserves the
+// blocks used by the group metadata.
+func (b *Builder) layout() error {
+	bs := b.blockSize
+	if bs != 1024 && bs != 2048 && bs != 4096 {
+		return fmt.Errorf("ext4: unsupported block size %d", bs)
+	}
+	sb := &superblock{
+		LogBlockSize:     uint32(bits.Len64(uint64(bs)) - 11),
+		Magic:            superblockMagic,
+		State:            stateValid,
+		Errors:           1,
+		RevLevel:         1,
+		FirstIno:         lostFoundIno,
+		InodeSize:        builderInodeSize,
+		MaxMntCount:      0xffff,
+		FeatureCompat:    featureCompatExtAttr | featureCompatResizeInode | featureCompatDirIndex,
+		FeatureIncompat:  featureIncompatFiletype | featureIncompatExtents | featureIncompat64Bit,
+		FeatureROCompat:  featureROCompatSparseSuper | featureROCompatLargeFile | featureROCompatHugeFile | featureROCompatDirNlink | featureROCompatExtraIsize | featureROCompatMetadataCsum,
+		UUID:             b.uuid,
+		DescSize:         64,
+		DefHashVersion:   1,      // half_md4
+		DefaultMountOpts: 0x000c, // user_xattr, acl
+		MinExtraIsize:    inodeExtraSize,
+		WantExtraIsize:   inodeExtraSize,
+		Flags:            0x0001, // signed directory hash
+		ChecksumType:     1,      // crc32c
+		MkfsTime:         uint32(b.now.Unix()),
+		Wtime:            uint32(b.now.Unix()),
+		Lastcheck:        uint32(b.now.Unix()),
+		BlocksPerGroup:   uint32(bs * 8),
+		ClustersPerGroup: uint32(bs * 8),
+	}
+	sb.LogClusterSize = sb.LogBlockSize
+	copy(sb.VolumeName[:], b.label)
+	seed := sha256.Sum256(b.uuid[:])
+	for i := range sb.HashSeed {
+		sb.HashSeed[i] = binary.LittleEndian.Uint32(seed[i*4:])
+	}
+	if bs == 1024 {
+		sb.FirstDataBlock = 1
+	}
+	blocks := uint64(b.size / bs)
+	if blocks > 1<<48 {
+		blocks = 1 << 48
+	}
+	sb.setBlocksCount(blocks)
+
+	// Drop a trailing group too small to hold its metadata and some data.
+	itbFor := func(ipg uint32) uint32 {
+		return uint32((uint64(ipg)*builderInodeSize + uint64(bs) - 1) / uint64(bs))
+	}
+	var ipg uint32
+	for {
+		if blocks < uint64(sb.FirstDataBlock)+64 {
+			return fmt.Errorf("ext4: image of %d bytes is too small", b.size)
+		}
+		groups := sb.groupCount()
+		inodes := uint64(b.inodeCount)
+		if inodes == 0 {
+			inodes = uint64(b.size / defaultInodeRatio)
+		}
+		if inodes < 64 {
+			inodes = 64
+		}
+		perBlock := uint64(bs / builderInodeSize)
+		ipg = uint32((inodes + uint64(groups) - 1) / uint64(groups))
+		ipg = uint32((uint64(ipg) + perBlock - 1) / perBlock * perBlock)
+		if ipg%8 != 0 {
+			ipg = (ipg + 7) &^ 7
+		}
+		if ipg > uint32(bs*8) {
+			return fmt.Errorf("ext4: %d inodes do not fit into %d block groups", inodes, groups)
+		}
+		if uint64(ipg)*uint64(groups) > 0xffffffff {
+			return fmt.Errorf("ext4: too many inodes")
+		}
+		sb.InodesPerGroup = ipg
+		sb.InodesCount = ipg * groups
+		sb.ReservedGdtBlocks = uint16(b.reservedGdtBlocks(sb))
+		last := groups - 1
+		if uint64(sb.groupBlocks(last)) >= uint64(sb.superOverhead(last)+2+itbFor(ipg)+minGroupFreeBlocks) {
+			break
+		}
+		if groups == 1 {
+			return fmt.Errorf("ext4: image of %d bytes is too small for %d inodes", b.size, sb.InodesCount)
+		}
+		blocks = sb.groupFirstBlock(last)
+		sb.setBlocksCount(blocks)
+	}
+	sb.setRBlocksCount(blocks * reservedPercent / 100)
+	b.sb = sb
+
+	groups := sb.groupCount()
+	itb := sb.inodeTableBlocks()
+	b.alloc = newAllocator(blocks)
+	if sb.FirstDataBlock > 0 {
+		b.alloc.mark(0, uint64(sb.FirstDataBlock))
+	}
+	b.groups = make([]groupDesc, groups)
+	for g := uint32(0); g < groups; g++ {
+		start := sb.groupFirstBlock(g)
+		over := uint64(sb.superOverhead(g))
+		b.groups[g] = groupDesc{
+			BlockBitmap: start + over,
+			InodeBitmap: start + over + 1,
+			InodeTable:  start + over + 2,
+		}
+		b.alloc.mark(start, over+2+uint64(itb))
+	}
+	return nil
+}
+
+// reservedGdtBlocks returns the number of descriptor blocks to reserve so
+// the file system can grow to 1024 times its size, as mke2fs does.
+func (b *Builder) reservedGdtBlocks(sb *superblock) uint32 {
+	maxBlocks := uint64(0xffffffff)
+	if sb.blocksCount() < maxBlocks/1024 {
+		maxBlocks = sb.blocksCount() * 1024
+	}
+	rsvGroups := (maxBlocks - uint64(sb.FirstDataBlock) + uint64(sb.BlocksPerGroup) - 1) / uint64(sb.BlocksPerGroup)
+	perBlock := uint64(b.blockSize) / uint64(sb.descSize())
+	rsv := (rsvGroups+perBlock-1)/perBlock - uint64(sb.groupDescBlocks(sb.groupCount()))
+	if max := uint64(b.blockSize / 4); rsv > max {
+		rsv = max
+	}
+	return uint32(rsv)
+}
+
+func (b *Builder) allocJournal() error {
+	n := b.journalBlocks
+	if n == 0 {
+		n = defaultJournalBlocks(b.sb.blocksCount())
+	}
+	if n == 0 {
+		b.journal = false
+		return nil
+	}
+	if n < 1024 {
+		return fmt.Errorf("ext4: journal of %d blocks is too small", n)
+	}
+	var exts []extent
+	for logical := uint32(0); logical < n; {
+		start, length, err := b.alloc.allocRun(uint64(n - logical))
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < length; i++ {
+			exts = appendExtent(exts, logical, start+i)
+			logical++
+		}
+	}
+	if err := b.writeBlock(exts[0].physical, b.sb.journalSuperblock(n)); err != nil {
+		return err
+	}
+	b.journalBlocks = n
+	b.journalExts = exts
+	return nil
+}
+
+func (b *Builder) writeBlock(blk uint64, data []byte) error {
+	if _, err := b.dev.WriteAt(data, int64(blk)*b.blockSize); err != nil {
+		return fmt.Errorf("ext4: writing block %d: %w", blk, err)
+	}
+	return nil
+}
+
+// allocator hands out free blocks of the image being built.
+type allocator struct {
+	used   []uint64
+	blocks uint64
+	free   uint64
+	cursor uint64
+}
+
+func newAllocator(blocks uint64) *allocator {
+	return &allocator{
+		used:   make([]uint64, (blocks+63)/64),
+		blocks: blocks,
+		free:   blocks,
+	}
+}
+
+func (a *allocator) isUsed(blk uint64) bool {
+	return a.used[blk/64]&(1<<(blk%64)) != 0
+}
+
+// mark marks n blocks starting at blk as used.
+func (a *allocator) mark(blk, n uint64) {
+	for i := blk; i < blk+n && i < a.blocks; i++ {
+		if !a.isUsed(i) {
+			a.used[i/64] |= 1 << (i % 64)
+			a.free--
+		}
+	}
+}
+
+// release returns n blocks starting at blk to the free pool.
+func (a *allocator) release(blk, n uint64) {
+	for i := blk; i < blk+n; i++ {
+		if a.isUsed(i) {
+			a.used[i/64] &^= 1 << (i % 64)
+			a.free++
+		}
+	}
+}
+
+// allocRun allocates the next run of at most max contiguous free blocks.
+func (a *allocator) allocRun(max uint64) (start, n uint64, err error) {
+	if a.free == 0 {
+		return 0, 0, ErrNoSpace
+	}
+	for scanned := uint64(0); scanned < a.blocks; scanned++ {
+		if a.cursor >= a.blocks {
+			a.cursor = 0
+		}
+		if a.used[a.cursor/64] == ^uint64(0) {
+			next := (a.cursor/64 + 1) * 64
+			scanned += next - a.cursor - 1
+			a.cursor = next
+			continue
+		}
+		if a.isUsed(a.cursor) {
+			a.cursor++
+			continue
+		}
+		start = a.cursor
+		for a.cursor < a.blocks && n < max && !a.isUsed(a.cursor) {
+			a.cursor++
+			n++
+		}
+		a.mark(start, n)
+		return start, n, nil
+	}
+	return 0, 0, ErrNoSpace
+}
+
+// allocBlock allocates a single block.
+func (a *allocator) allocBlock() (uint64, error) {
+	blk, _, err := a.allocRun(1)
+	return blk, err
+}
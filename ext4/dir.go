@@ -0,0 +1,89 @@
+package ext4
+
+import "encoding/binary"
+
+// Directory entry file types.
+const (
+	ftUnknown  = 0
+	ftRegular  = 1
+	ftDir      = 2
+	ftCharDev  = 3
+	ftBlockDev = 4
+	ftFifo     = 5
+	ftSocket   = 6
+	ftSymlink  = 7
+
+	dirTailSize     = 12
+	dirTailFileType = 0xde
+	maxNameLen      = 255
+)
+
+// dirent is a directory entry.
+type dirent struct {
+	ino   uint32
+	name  string
+	ftype uint8
+}
+
+func direntLen(nameLen int) int {
+	return (8 + nameLen + 3) &^ 3
+}
+
+// encodeDirBlocks packs ents into directory blocks of size bs. When csum
+// is true each block ends with a checksum tail, which still needs to be
+// filled in with setDirChecksum.
+func encodeDirBlocks(ents []dirent, bs int, csum bool) [][]byte {
+	space := bs
+	if csum {
+		space -= dirTailSize
+	}
+	var blocks [][]byte
+	var b []byte
+	off, last := 0, -1
+	finish := func() {
+		if b == nil {
+			return
+		}
+		if last >= 0 {
+			binary.LittleEndian.PutUint16(b[last+4:], uint16(space-last))
+		} else {
+			binary.LittleEndian.PutUint16(b[4:], uint16(space))
+		}
+		if csum {
+			t := b[space:]
+			binary.LittleEndian.PutUint16(t[4:], dirTailSize)
+			t[7] = dirTailFileType
+		}
+		blocks = append(blocks, b)
+		b = nil
+	}
+	for _, e := range ents {
+		n := direntLen(len(e.name))
+		if b == nil || off+n > space {
+			finish()
+			b = make([]byte, bs)
+			off, last = 0, -1
+		}
+		binary.LittleEndian.PutUint32(b[off:], e.ino)
+		binary.LittleEndian.PutUint16(b[off+4:], uint16(n))
+		b[off+6] = uint8(len(e.name))
+		b[off+7] = e.ftype
+		copy(b[off+8:], e.name)
+		last = off
+		off += n
+	}
+	if b == nil {
+		b = make([]byte, bs)
+	}
+	finish()
+	return blocks
+}
+
+// setDirChecksum stores the checksum of directory block b of inode ino in its tail.
+func (sb *superblock) setDirChecksum(ino, generation uint32, b []byte) {
+	if !sb.hasROCompat(featureROCompatMetadataCsum) {
+		return
+	}
+	off := len(b) - dirTailSize
+	binary.LittleEndian.PutUint32(b[off+8:], crc32c(sb.inodeCsumSeed(ino, generation), b[:off]))
+}
@@ -0,0 +1,157 @@
+package ext4
+
+import "encoding/binary"
+
+const (
+	extentMagic      = 0xf30a
+	extentHeaderSize = 12
+	extentEntrySize  = 12
+	extentRootMax    = 4
+	maxExtentLen     = 32768
+)
+
+// extent maps length logical blocks starting at logical to physical blocks.
+type extent struct {
+	logical  uint32
+	physical uint64
+	length   uint32
+
+	// uninit marks preallocated blocks that read as zeros.
+	uninit bool
+}
+
+// appendExtent appends a mapping of one block to exts, merging it into the
+// last extent when contiguous.
+func appendExtent(exts []extent, logical uint32, physical uint64) []extent {
+	if n := len(exts); n > 0 {
+		last := &exts[n-1]
+		if last.length < maxExtentLen &&
+			last.logical+last.length == logical &&
+			last.physical+uint64(last.length) == physical {
+			last.length++
+			return exts
+		}
+	}
+	return append(exts, extent{logical: logical, physical: physical, length: 1})
+}
+
+func putExtentHeader(b []byte, entries, max, depth int) {
+	le := binary.LittleEndian
+	le.PutUint16(b[0:], extentMagic)
+	le.PutUint16(b[2:], uint16(entries))
+	le.PutUint16(b[4:], uint16(max))
+	le.PutUint16(b[6:], uint16(depth))
+	le.PutUint32(b[8:], 0)
+}
+
+func putExtentLeaf(b []byte, e extent) {
+	le := binary.LittleEndian
+	length := e.length
+	if e.uninit {
+		length += maxExtentLen
+	}
+	le.PutUint32(b[0:], e.logical)
+	le.PutUint16(b[4:], uint16(length))
+	le.PutUint16(b[6:], uint16(e.physical>>32))
+	le.PutUint32(b[8:], uint32(e.physical))
+}
+
+func putExtentIndex(b []byte, logical uint32, blk uint64) {
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], logical)
+	le.PutUint32(b[4:], uint32(blk))
+	le.PutUint16(b[8:], uint16(blk>>32))
+	le.PutUint16(b[10:], 0)
+}
+
+// extentNode is an encoded extent tree block waiting to be written.
+type extentNode struct {
+	blk  uint64
+	data []byte
+}
+
+// buildExtentTree encodes exts into the 60 byte i_block area of an inode,
+// allocating tree blocks with alloc when the extents do not fit into the
+// inode. It returns the i_block contents and the tree blocks, which still
+// need their checksums set with setExtentChecksum before being written.
+func buildExtentTree(exts []extent, bs int64, alloc func() (uint64, error)) ([60]byte, []extentNode, error) {
+	var root [60]byte
+	perBlock := int((bs - extentHeaderSize) / extentEntrySize)
+
+	type entry struct {
+		logical uint32
+		blk     uint64
+	}
+	if len(exts) <= extentRootMax {
+		putExtentHeader(root[:], len(exts), extentRootMax, 0)
+		for i, e := range exts {
+			putExtentLeaf(root[extentHeaderSize+i*extentEntrySize:], e)
+		}
+		return root, nil, nil
+	}
+
+	var nodes []extentNode
+	var level []entry
+	for i := 0; i < len(exts); i += perBlock {
+		end := i + perBlock
+		if end > len(exts) {
+			end = len(exts)
+		}
+		blk, err := alloc()
+		if err != nil {
+			return root, nil, err
+		}
+		b := make([]byte, bs)
+		putExtentHeader(b, end-i, perBlock, 0)
+		for j, e := range exts[i:end] {
+			putExtentLeaf(b[extentHeaderSize+j*extentEntrySize:], e)
+		}
+		nodes = append(nodes, extentNode{blk: blk, data: b})
+		level = append(level, entry{logical: exts[i].logical, blk: blk})
+	}
+	depth := 1
+	for len(level) > extentRootMax {
+		var next []entry
+		for i := 0; i < len(level); i += perBlock {
+			end := i + perBlock
+			if end > len(level) {
+				end = len(level)
+			}
+			blk, err := alloc()
+			if err != nil {
+				return root, nil, err
+			}
+			b := make([]byte, bs)
+			putExtentHeader(b, end-i, perBlock, depth)
+			for j, e := range level[i:end] {
+				putExtentIndex(b[extentHeaderSize+j*extentEntrySize:], e.logical, e.blk)
+			}
+			nodes = append(nodes, extentNode{blk: blk, data: b})
+			next = append(next, entry{logical: level[i].logical, blk: blk})
+		}
+		level = next
+		depth++
+	}
+	putExtentHeader(root[:], len(level), extentRootMax, depth)
+	for i, e := range level {
+		putExtentIndex(root[extentHeaderSize+i*extentEntrySize:], e.logical, e.blk)
+	}
+	return root, nodes, nil
+}
+
+// inodeCsumSeed returns the checksum seed of blocks owned by an inode.
+func (sb *superblock) inodeCsumSeed(ino, generation uint32) uint32 {
+	crc := crc32c(sb.csumSeed(), le32(ino))
+	return crc32c(crc, le32(generation))
+}
+
+// setExtentChecksum stores the checksum of the extent tree block b of
+// inode ino in its tail.
+func (sb *superblock) setExtentChecksum(ino, generation uint32, b []byte) {
+	if !sb.hasROCompat(featureROCompatMetadataCsum) {
+		return
+	}
+	max := int(binary.LittleEndian.Uint16(b[4:]))
+	off := extentHeaderSize + max*extentEntrySize
+	binary.LittleEndian.PutUint32(b[off:], crc32c(sb.inodeCsumSeed(ino, generation), b[:off]))
+}
@@ -0,0 +1,407 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxLinks is the highest link count of a directory before dir_nlink
+// switches to a link count of 1.
+const maxLinks = 65000
+
+// Close lays out the directories, writes all inodes and the allocation
+// metadata and finishes the file system. The Builder cannot be used afterwards.
+func (b *Builder) Close() error {
+	if b.closed {
+		return errors.New("ext4: builder is closed")
+	}
+	b.closed = true
+	sb := b.sb
+
+	if _, ok := b.root.children["lost+found"]; !ok {
+		lf := newDirNode(0700, b.now)
+		lf.ino = lostFoundIno
+		b.root.link("lost+found", lf)
+	}
+
+	// Number the inodes breadth-first in name order.
+	b.root.ino = rootIno
+	inodes := map[uint32]*node{rootIno: b.root}
+	parents := map[*node]*node{b.root: b.root}
+	next := uint32(lostFoundIno + 1)
+	queue := []*node{b.root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		for _, name := range dir.sortedNames() {
+			child := dir.children[name]
+			if child.ino == 0 {
+				child.ino = next
+				next++
+			}
+			if _, seen := inodes[child.ino]; seen {
+				continue
+			}
+			inodes[child.ino] = child
+			if child.isDir() {
+				parents[child] = dir
+				queue = append(queue, child)
+			}
+		}
+	}
+	if next-1 > sb.InodesCount {
+		return fmt.Errorf("ext4: %d inodes needed but the file system has %d", next-1, sb.InodesCount)
+	}
+
+	raw := make(map[uint32][]byte, len(inodes)+2)
+	for ino := uint32(1); ino < next; ino++ {
+		n, ok := inodes[ino]
+		if !ok {
+			continue
+		}
+		if n.isDir() {
+			if err := b.writeDir(n, parents[n]); err != nil {
+				return err
+			}
+		}
+		in, err := b.encodeInode(n)
+		if err != nil {
+			return err
+		}
+		raw[ino] = in
+	}
+	if sb.ReservedGdtBlocks > 0 {
+		in, err := b.resizeInode()
+		if err != nil {
+			return err
+		}
+		raw[resizeIno] = in
+	}
+	if b.journal {
+		in, err := b.journalInode()
+		if err != nil {
+			return err
+		}
+		raw[journalIno] = in
+	}
+	return b.writeMetadata(raw)
+}
+
+// writeDir encodes the entries of dir, writes them to newly allocated blocks
+// and records them as the extents of dir.
+func (b *Builder) writeDir(dir, parent *node) error {
+	ents := []dirent{
+		{ino: dir.ino, name: ".", ftype: ftDir},
+		{ino: parent.ino, name: "..", ftype: ftDir},
+	}
+	for _, name := range dir.sortedNames() {
+		child := dir.children[name]
+		ents = append(ents, dirent{ino: child.ino, name: name, ftype: child.fileType()})
+	}
+	csum := b.sb.hasROCompat(featureROCompatMetadataCsum)
+	blocks := encodeDirBlocks(ents, int(b.blockSize), csum)
+	if dir.ino == lostFoundIno {
+		for int64(len(blocks))*b.blockSize < lostFoundSize {
+			blocks = append(blocks, encodeDirBlocks(nil, int(b.blockSize), csum)...)
+		}
+	}
+	dir.exts = nil
+	for logical := 0; logical < len(blocks); {
+		start, n, err := b.alloc.allocRun(uint64(len(blocks) - logical))
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			blk := blocks[logical]
+			b.sb.setDirChecksum(dir.ino, 0, blk)
+			if err := b.writeBlock(start+i, blk); err != nil {
+				return err
+			}
+			dir.exts = appendExtent(dir.exts, uint32(logical), start+i)
+			logical++
+		}
+	}
+	dir.size = uint64(len(blocks)) * uint64(b.blockSize)
+	return nil
+}
+
+// encodeTime splits t into the ext4 seconds field and the extra field
+// holding the epoch bits and nanoseconds.
+func encodeTime(t time.Time) (uint32, uint32) {
+	s := t.Unix()
+	epoch := uint32((s-int64(int32(s)))>>32) & 3
+	return uint32(s), epoch | uint32(t.Nanosecond())<<2
+}
+
+// blockCount returns the number of data blocks mapped by exts.
+func blockCount(exts []extent) uint64 {
+	var n uint64
+	for _, e := range exts {
+		n += uint64(e.length)
+	}
+	return n
+}
+
+// newInode returns an inode with the common fields of a builder inode set.
+func (b *Builder) newInode(mode uint16, t time.Time) *inode {
+	in := &inode{Mode: mode, ExtraIsize: inodeExtraSize}
+	in.Atime, in.AtimeExtra = encodeTime(t)
+	in.Mtime, in.MtimeExtra = encodeTime(t)
+	in.Ctime, in.CtimeExtra = encodeTime(t)
+	in.Crtime, in.CrtimeExtra = encodeTime(b.now)
+	return in
+}
+
+// setExtents stores exts in in, writing extent tree blocks if needed, and
+// returns the number of tree blocks.
+func (b *Builder) setExtents(ino uint32, in *inode, exts []extent) (uint64, error) {
+	root, nodes, err := buildExtentTree(exts, b.blockSize, b.alloc.allocBlock)
+	if err != nil {
+		return 0, err
+	}
+	for _, nd := range nodes {
+		b.sb.setExtentChecksum(ino, 0, nd.data)
+		if err := b.writeBlock(nd.blk, nd.data); err != nil {
+			return 0, err
+		}
+	}
+	for i := range in.Block {
+		in.Block[i] = binary.LittleEndian.Uint32(root[i*4:])
+	}
+	in.Flags |= inodeFlagExtents
+	return uint64(len(nodes)), nil
+}
+
+// encodeInode builds the raw on-disk inode of n.
+func (b *Builder) encodeInode(n *node) ([]byte, error) {
+	sb := b.sb
+	in := b.newInode(n.mode, n.mtime)
+	in.Atime, in.AtimeExtra = encodeTime(n.atime)
+	in.Ctime, in.CtimeExtra = encodeTime(n.ctime)
+	in.setUID(n.uid)
+	in.setGID(n.gid)
+	in.setSize(n.size)
+	in.LinksCount = uint16(n.refs)
+	blocks := blockCount(n.exts)
+
+	switch n.mode & sIFMT {
+	case sIFDIR:
+		links := uint32(2)
+		for _, child := range n.children {
+			if child.isDir() {
+				links++
+			}
+		}
+		if links > maxLinks {
+			links = 1
+		}
+		in.LinksCount = uint16(links)
+	case sIFLNK:
+		in.setSize(uint64(len(n.target)))
+		if len(n.exts) == 0 {
+			var buf [60]byte
+			copy(buf[:], n.target)
+			for i := range in.Block {
+				in.Block[i] = binary.LittleEndian.Uint32(buf[i*4:])
+			}
+		}
+	case sIFCHR, sIFBLK:
+		if n.devmajor < 256 && n.devminor < 256 {
+			in.Block[0] = n.devmajor<<8 | n.devminor
+		} else {
+			in.Block[1] = n.devminor&0xff | n.devmajor<<8 | (n.devminor&^0xff)<<12
+		}
+	}
+	if n.mode&sIFMT == sIFREG || n.mode&sIFMT == sIFDIR || len(n.exts) > 0 {
+		tree, err := b.setExtents(n.ino, in, n.exts)
+		if err != nil {
+			return nil, err
+		}
+		blocks += tree
+	}
+
+	rawIn := make([]byte, sb.inodeSize())
+	if len(n.xattrs) > 0 {
+		ibody := rawIn[inodeGoodOldSize+inodeExtraSize:]
+		if err := encodeXattrs(ibody[4:], n.xattrs, 0); err == nil {
+			binary.LittleEndian.PutUint32(ibody, xattrMagic)
+		} else {
+			for i := range ibody {
+				ibody[i] = 0
+			}
+			blk, err := b.alloc.allocBlock()
+			if err != nil {
+				return nil, err
+			}
+			data, err := sb.encodeXattrBlock(n.xattrs, blk)
+			if err != nil {
+				return nil, err
+			}
+			if err := b.writeBlock(blk, data); err != nil {
+				return nil, err
+			}
+			in.setFileACL(blk)
+			blocks++
+		}
+	}
+	in.setBlocks(sb, blocks*uint64(b.blockSize/512))
+	in.encode(rawIn)
+	return rawIn, nil
+}
+
+// resizeInode builds the resize inode reserving descriptor blocks for
+// growing the file system, the way mke2fs lays it out.
+func (b *Builder) resizeInode() ([]byte, error) {
+	sb := b.sb
+	dind, err := b.alloc.allocBlock()
+	if err != nil {
+		return nil, err
+	}
+	apb := uint64(b.blockSize / 4)
+	descBlocks := uint64(sb.groupDescBlocks(sb.groupCount()))
+	base := uint64(sb.FirstDataBlock) + 1
+	var backups []uint32
+	for g := uint32(1); g < sb.groupCount(); g++ {
+		if sb.groupHasSuper(g) {
+			backups = append(backups, g)
+		}
+	}
+	dbuf := make([]byte, b.blockSize)
+	for j := uint64(0); j < uint64(sb.ReservedGdtBlocks); j++ {
+		pblk := base + descBlocks + j
+		binary.LittleEndian.PutUint32(dbuf[((descBlocks+j)%apb)*4:], uint32(pblk))
+		ind := make([]byte, b.blockSize)
+		for k, g := range backups {
+			binary.LittleEndian.PutUint32(ind[k*4:], uint32(pblk+uint64(g)*uint64(sb.BlocksPerGroup)))
+		}
+		if err := b.writeBlock(pblk, ind); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.writeBlock(dind, dbuf); err != nil {
+		return nil, err
+	}
+	in := b.newInode(sIFREG|0600, b.now)
+	in.LinksCount = 1
+	in.Block[13] = uint32(dind)
+	in.setSize((apb*apb + apb + 12) * uint64(b.blockSize))
+	r := uint64(sb.ReservedGdtBlocks)
+	in.setBlocks(sb, (1+r+r*uint64(len(backups)))*uint64(b.blockSize/512))
+	raw := make([]byte, sb.inodeSize())
+	in.encode(raw)
+	return raw, nil
+}
+
+// journalInode builds the inode of the internal journal and records its
+// block map backup in the superblock.
+func (b *Builder) journalInode() ([]byte, error) {
+	sb := b.sb
+	in := b.newInode(sIFREG|0600, b.now)
+	in.LinksCount = 1
+	in.setSize(uint64(b.journalBlocks) * uint64(b.blockSize))
+	tree, err := b.setExtents(journalIno, in, b.journalExts)
+	if err != nil {
+		return nil, err
+	}
+	in.setBlocks(sb, (uint64(b.journalBlocks)+tree)*uint64(b.blockSize/512))
+	sb.FeatureCompat |= featureCompatHasJournal
+	sb.JournalInum = journalIno
+	sb.JnlBackupType = jnlBackupBlocks
+	copy(sb.JnlBlocks[:15], in.Block[:])
+	sb.JnlBlocks[15] = in.SizeHigh
+	sb.JnlBlocks[16] = in.SizeLo
+	raw := make([]byte, sb.inodeSize())
+	in.encode(raw)
+	return raw, nil
+}
+
+// writeMetadata writes the inode tables, bitmaps, group descriptors and superblocks.
+func (b *Builder) writeMetadata(raw map[uint32][]byte) error {
+	sb := b.sb
+	bs := b.blockSize
+	ipg := sb.InodesPerGroup
+	isz := sb.inodeSize()
+	var freeBlocks uint64
+	var freeInodes uint32
+	for g := range b.groups {
+		d := &b.groups[g]
+		first := uint32(g)*ipg + 1
+
+		// Inode table up to the last used inode of the group.
+		used := uint32(0)
+		ibm := make([]byte, bs)
+		var dirs uint32
+		for i := uint32(0); i < ipg; i++ {
+			ino := first + i
+			if _, ok := raw[ino]; ok || ino < sb.firstIno() {
+				setBit(ibm, i)
+				used = i + 1
+			}
+		}
+		if used > 0 {
+			perBlock := uint32(bs) / uint32(isz)
+			tblocks := (used + perBlock - 1) / perBlock
+			table := make([]byte, int64(tblocks)*bs)
+			for i := uint32(0); i < tblocks*perBlock && i < ipg; i++ {
+				ino := first + i
+				if r, ok := raw[ino]; ok {
+					sb.setInodeChecksum(ino, r)
+					copy(table[int(i)*isz:], r)
+					if decodeInode(r).Mode&sIFMT == sIFDIR {
+						dirs++
+					}
+				}
+			}
+			if err := b.writeBlock(d.InodeTable, table); err != nil {
+				return err
+			}
+		}
+		var inUse uint32
+		for i := uint32(0); i < ipg; i++ {
+			if testBit(ibm, i) {
+				inUse++
+			}
+		}
+		for i := ipg; i < uint32(bs*8); i++ {
+			setBit(ibm, i)
+		}
+
+		start := sb.groupFirstBlock(uint32(g))
+		glen := sb.groupBlocks(uint32(g))
+		bbm := make([]byte, bs)
+		var usedBlocks uint32
+		for i := uint32(0); i < glen; i++ {
+			if b.alloc.isUsed(start + uint64(i)) {
+				setBit(bbm, i)
+				usedBlocks++
+			}
+		}
+		for i := glen; i < uint32(bs*8); i++ {
+			setBit(bbm, i)
+		}
+
+		d.FreeBlocks = glen - usedBlocks
+		d.FreeInodes = ipg - inUse
+		d.UsedDirs = dirs
+		d.ItableUnused = ipg - used
+		d.Flags = 0
+		if used == 0 {
+			d.Flags |= bgInodeUninit
+		}
+		sb.setBitmapChecksums(d, bbm, ibm)
+		if err := b.writeBlock(d.BlockBitmap, bbm); err != nil {
+			return err
+		}
+		if err := b.writeBlock(d.InodeBitmap, ibm); err != nil {
+			return err
+		}
+		freeBlocks += uint64(d.FreeBlocks)
+		freeInodes += d.FreeInodes
+	}
+	sb.setFreeBlocksCount(freeBlocks)
+	sb.FreeInodesCount = freeInodes
+	v := &volume{dev: b.dev, sb: sb, groups: b.groups, bs: bs}
+	return v.flush(true)
+}
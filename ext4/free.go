@@ -0,0 +1,38 @@
+package ext4
+
+// FreeRanges calls fn for each run of blocks the block bitmaps of the file
+// system mark as free, with its offset and length in bytes from the start
+// of the device. Free blocks hold no data the file system will read, so
+// they can be discarded.
+func (f *FS) FreeRanges(fn func(off, length int64) error) error {
+	v := f.v
+	var start, n uint64
+	flush := func() error {
+		if n == 0 {
+			return nil
+		}
+		err := fn(int64(start)*v.bs, int64(n)*v.bs)
+		n = 0
+		return err
+	}
+	for g := range v.groups {
+		bm, err := v.blockBitmap(uint32(g))
+		if err != nil {
+			return err
+		}
+		first := v.sb.groupFirstBlock(uint32(g))
+		for i := uint32(0); i < v.sb.groupBlocks(uint32(g)); i++ {
+			if testBit(bm, i) {
+				if err := flush(); err != nil {
+					return err
+				}
+				continue
+			}
+			if n == 0 {
+				start = first + uint64(i)
+			}
+			n++
+		}
+	}
+	return flush()
+}
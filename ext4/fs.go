@@ -0,0 +1,603 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxSymlinks is the number of symbolic links followed while resolving a
+// path before giving up.
+const maxSymlinks = 40
+
+// ErrReadOnly is returned when modifying a file system opened with OpenReadOnly.
+var ErrReadOnly = errors.New("ext4: file system is read-only")
+
+// FS is an ext4 file system accessed in process, without mounting it.
+//
+// Paths are slash-separated and relative to the root of the file system;
+// a leading slash is optional. Symbolic links are resolved inside the file
+// system, so absolute link targets never escape to the host.
+//
+// Modifications bypass the journal and are written through immediately.
+// The device must not be in use by anything else, in particular a running
+// guest, while the FS is open.
+type FS struct {
+	v        *volume
+	readOnly bool
+}
+
+// Open opens the file system on dev for reading and writing. Transactions
+// left in the journal by an unclean shutdown are replayed to dev first.
+func Open(dev Device) (*FS, error) {
+	v, err := openVolume(dev)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.checkWritable(); err != nil {
+		return nil, err
+	}
+	if v.sb.hasIncompat(featureIncompatRecover) {
+		r, err := v.replayJournal()
+		if err != nil {
+			return nil, err
+		}
+		for blk, data := range r.blocks {
+			if err := v.writeBlock(blk, data); err != nil {
+				return nil, err
+			}
+		}
+		if err := v.writeBlock(r.sbBlock, r.sb); err != nil {
+			return nil, err
+		}
+		// The journal may have rewritten the superblock and descriptors.
+		if v, err = openVolume(dev); err != nil {
+			return nil, err
+		}
+		v.sb.FeatureIncompat &^= featureIncompatRecover
+		if err := v.flush(false); err != nil {
+			return nil, err
+		}
+	}
+	return &FS{v: v}, nil
+}
+
+// OpenReadOnly opens the file system on r for reading. Transactions left
+// in the journal are applied in memory; r is never written to.
+func OpenReadOnly(r io.ReaderAt) (*FS, error) {
+	dev := &overlayDevice{r: r}
+	v, err := openVolume(dev)
+	if err != nil {
+		return nil, err
+	}
+	if v.sb.hasIncompat(featureIncompatRecover) {
+		jr, err := v.replayJournal()
+		if err != nil {
+			return nil, err
+		}
+		dev.bs = v.bs
+		dev.blocks = jr.blocks
+		if v, err = openVolume(dev); err != nil {
+			return nil, err
+		}
+		v.sb.FeatureIncompat &^= featureIncompatRecover
+	}
+	return &FS{v: v, readOnly: true}, nil
+}
+
+// overlayDevice is a read-only Device presenting blocks replayed from the
+// journal over the underlying storage.
+type overlayDevice struct {
+	r      io.ReaderAt
+	bs     int64
+	blocks map[uint64][]byte
+}
+
+func (d *overlayDevice) ReadAt(p []byte, off int64) (int, error) {
+	if len(d.blocks) == 0 {
+		return d.r.ReadAt(p, off)
+	}
+	n := 0
+	for n < len(p) {
+		blk := uint64((off + int64(n)) / d.bs)
+		boff := (off + int64(n)) % d.bs
+		chunk := d.bs - boff
+		if rest := int64(len(p) - n); chunk > rest {
+			chunk = rest
+		}
+		if data, ok := d.blocks[blk]; ok {
+			copy(p[n:n+int(chunk)], data[boff:])
+		} else if _, err := d.r.ReadAt(p[n:n+int(chunk)], off+int64(n)); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+	}
+	return n, nil
+}
+
+func (d *overlayDevice) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// checkWritable reports whether the features of the file system allow
+// modifying it in place.
+func (v *volume) checkWritable() error {
+	sb := v.sb
+	if f := sb.FeatureIncompat &^ (featureIncompatWriteable | featureIncompatMetaBG | featureIncompatRecover); f != 0 {
+		return fmt.Errorf("incompatible features %#x: %w", f, ErrUnsupported)
+	}
+	if !sb.hasIncompat(featureIncompatExtents) {
+		return fmt.Errorf("no extents: %w", ErrUnsupported)
+	}
+	const known = featureROCompatSparseSuper | featureROCompatLargeFile | featureROCompatHugeFile |
+		featureROCompatGdtCsum | featureROCompatDirNlink | featureROCompatExtraIsize |
+		featureROCompatMetadataCsum | featureROCompatProject | featureROCompatOrphanPresent
+	if f := sb.FeatureROCompat &^ known; f != 0 {
+		return fmt.Errorf("read-only features %#x: %w", f, ErrUnsupported)
+	}
+	return nil
+}
+
+// Inode holds the ext4 attributes of a file. The Sys method of the
+// fs.FileInfo values returned by an FS returns an *Inode.
+type Inode struct {
+	Ino        uint32
+	Links      uint32
+	UID        uint32
+	GID        uint32
+	AccessTime time.Time
+	ChangeTime time.Time
+	Devmajor   uint32
+	Devminor   uint32
+
+	// Blocks is the allocated space in 512 byte units.
+	Blocks uint64
+}
+
+type fileInfo struct {
+	name string
+	in   *inode
+	sys  *Inode
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.in.size()) }
+func (fi *fileInfo) Mode() fs.FileMode  { return fileMode(fi.in.Mode) }
+func (fi *fileInfo) ModTime() time.Time { return decodeTime(fi.in.Mtime, fi.in.MtimeExtra) }
+func (fi *fileInfo) IsDir() bool        { return fi.in.Mode&sIFMT == sIFDIR }
+func (fi *fileInfo) Sys() interface{}   { return fi.sys }
+
+func (f *FS) newFileInfo(name string, ino uint32, in *inode) *fileInfo {
+	major, minor := in.device()
+	return &fileInfo{
+		name: name,
+		in:   in,
+		sys: &Inode{
+			Ino:        ino,
+			Links:      uint32(in.LinksCount),
+			UID:        in.uid(),
+			GID:        in.gid(),
+			AccessTime: decodeTime(in.Atime, in.AtimeExtra),
+			ChangeTime: decodeTime(in.Ctime, in.CtimeExtra),
+			Devmajor:   major,
+			Devminor:   minor,
+			Blocks:     in.blocks(f.v.sb),
+		},
+	}
+}
+
+// decodeTime is the inverse of encodeTime.
+func decodeTime(sec, extra uint32) time.Time {
+	s := int64(int32(sec)) + int64(extra&3)<<32
+	return time.Unix(s, int64(extra>>2))
+}
+
+// fileMode converts an ext4 i_mode to an fs.FileMode.
+func fileMode(mode uint16) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	if mode&sISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&sISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&sISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	switch mode & sIFMT {
+	case sIFDIR:
+		m |= fs.ModeDir
+	case sIFLNK:
+		m |= fs.ModeSymlink
+	case sIFCHR:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case sIFBLK:
+		m |= fs.ModeDevice
+	case sIFIFO:
+		m |= fs.ModeNamedPipe
+	case sIFSOCK:
+		m |= fs.ModeSocket
+	}
+	return m
+}
+
+// device decodes the device number of a character or block device inode.
+func (in *inode) device() (major, minor uint32) {
+	if in.Mode&sIFMT != sIFCHR && in.Mode&sIFMT != sIFBLK {
+		return 0, 0
+	}
+	if b := in.Block[0]; b != 0 {
+		return b >> 8 & 0xff, b & 0xff
+	}
+	b := in.Block[1]
+	return b & 0xfff00 >> 8, b&0xff | b>>12&0xfff00
+}
+
+// hasData reports whether the block map of the inode maps data blocks.
+// Devices, fifos, sockets and fast symlinks keep other data in i_block.
+func (in *inode) hasData() bool {
+	switch in.Mode & sIFMT {
+	case sIFREG, sIFDIR:
+		return true
+	case sIFLNK:
+		return in.size() > maxFastSymlink
+	}
+	return false
+}
+
+// splitPath splits name into its elements, dropping empty and "." elements.
+func splitPath(name string) []string {
+	var elems []string
+	for _, elem := range strings.Split(name, "/") {
+		if elem != "" && elem != "." {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// walk resolves name to an inode. Symbolic links in the last element are
+// only followed when follow is true.
+func (f *FS) walk(name string, follow bool) (uint32, *inode, error) {
+	ino := uint32(rootIno)
+	in, err := f.v.readInode(ino)
+	if err != nil {
+		return 0, nil, err
+	}
+	elems := splitPath(name)
+	links := 0
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+		if in.Mode&sIFMT != sIFDIR {
+			return 0, nil, syscall.ENOTDIR
+		}
+		child, err := f.v.lookup(ino, in, elem)
+		if err != nil {
+			return 0, nil, err
+		}
+		cin, err := f.v.readInode(child)
+		if err != nil {
+			return 0, nil, err
+		}
+		if cin.Mode&sIFMT == sIFLNK && (follow || len(elems) > 0) {
+			if links++; links > maxSymlinks {
+				return 0, nil, syscall.ELOOP
+			}
+			target, err := f.v.readlink(child, cin)
+			if err != nil {
+				return 0, nil, err
+			}
+			if strings.HasPrefix(target, "/") {
+				ino = rootIno
+				if in, err = f.v.readInode(ino); err != nil {
+					return 0, nil, err
+				}
+			}
+			elems = append(splitPath(target), elems...)
+			continue
+		}
+		ino, in = child, cin
+	}
+	return ino, in, nil
+}
+
+// lookup returns the inode number of the entry name in directory dir.
+func (v *volume) lookup(ino uint32, dir *inode, name string) (uint32, error) {
+	var found uint32
+	err := v.scanDir(ino, dir, func(blk uint64, b []byte, off int, d dirent) bool {
+		if d.ino != 0 && d.name == name {
+			found = d.ino
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if found == 0 {
+		return 0, fs.ErrNotExist
+	}
+	return found, nil
+}
+
+// scanDir calls fn for every entry of directory ino, including unused
+// entries, until fn returns false. fn receives the directory block holding
+// the entry and the entry's offset in it.
+func (v *volume) scanDir(ino uint32, dir *inode, fn func(blk uint64, b []byte, off int, d dirent) bool) error {
+	m, err := v.mapBlocks(ino, dir)
+	if err != nil {
+		return err
+	}
+	nblocks := uint32((dir.size() + uint64(v.bs) - 1) / uint64(v.bs))
+	for l := uint32(0); l < nblocks; l++ {
+		blk := m.physical(l)
+		if blk == 0 {
+			continue
+		}
+		b, err := v.readBlock(blk)
+		if err != nil {
+			return err
+		}
+		for off := 0; off+8 <= len(b); {
+			d, recLen, err := decodeDirent(b[off:], int(v.bs))
+			if err != nil {
+				return fmt.Errorf("ext4: directory %d block %d: %w", ino, l, err)
+			}
+			if !fn(blk, b, off, d) {
+				return nil
+			}
+			off += recLen
+		}
+	}
+	return nil
+}
+
+// decodeDirent decodes the directory entry at the start of b and returns
+// it with its record length.
+func decodeDirent(b []byte, bs int) (dirent, int, error) {
+	le := binary.LittleEndian
+	recLen := int(le.Uint16(b[4:]))
+	if recLen == 0 || recLen == 65535 {
+		recLen = bs
+	}
+	nameLen := int(b[6])
+	if recLen < 8 || recLen > len(b) || recLen%4 != 0 || 8+nameLen > recLen {
+		return dirent{}, 0, errors.New("corrupt directory entry")
+	}
+	return dirent{
+		ino:   le.Uint32(b[0:]),
+		name:  string(b[8 : 8+nameLen]),
+		ftype: b[7],
+	}, recLen, nil
+}
+
+// readlink returns the target of the symbolic link ino.
+func (v *volume) readlink(ino uint32, in *inode) (string, error) {
+	size := in.size()
+	if !in.hasData() {
+		var buf [60]byte
+		for i, w := range in.Block {
+			binary.LittleEndian.PutUint32(buf[i*4:], w)
+		}
+		return string(buf[:size]), nil
+	}
+	if size > uint64(v.bs) {
+		return "", fmt.Errorf("ext4: symlink %d too long", ino)
+	}
+	m, err := v.mapBlocks(ino, in)
+	if err != nil {
+		return "", err
+	}
+	data, err := v.readData(m, size)
+	return string(data), err
+}
+
+func baseName(name string) string {
+	elems := splitPath(name)
+	if len(elems) == 0 {
+		return "/"
+	}
+	return elems[len(elems)-1]
+}
+
+// Stat returns a FileInfo describing the named file, following symbolic links.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	ino, in, err := f.walk(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return f.newFileInfo(baseName(name), ino, in), nil
+}
+
+// Lstat returns a FileInfo describing the named file. A symbolic link is
+// described itself rather than the file it refers to.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	ino, in, err := f.walk(name, false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return f.newFileInfo(baseName(name), ino, in), nil
+}
+
+// Readlink returns the target of the named symbolic link.
+func (f *FS) Readlink(name string) (string, error) {
+	ino, in, err := f.walk(name, false)
+	if err == nil && in.Mode&sIFMT != sIFLNK {
+		err = fs.ErrInvalid
+	}
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	target, err := f.v.readlink(ino, in)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+// ReadFile returns the contents of the named regular file.
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	ino, in, err := f.walk(name, true)
+	if err == nil {
+		switch in.Mode & sIFMT {
+		case sIFREG:
+		case sIFDIR:
+			err = syscall.EISDIR
+		default:
+			err = fs.ErrInvalid
+		}
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	m, err := f.v.mapBlocks(ino, in)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	data, err := f.v.readData(m, in.size())
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// dirEntry is an fs.DirEntry read from a directory.
+type dirEntry struct {
+	f     *FS
+	name  string
+	ino   uint32
+	ftype uint8
+}
+
+func (e *dirEntry) Name() string { return e.name }
+func (e *dirEntry) IsDir() bool  { return e.Type().IsDir() }
+
+func (e *dirEntry) Type() fs.FileMode {
+	switch e.ftype {
+	case ftRegular:
+		return 0
+	case ftDir:
+		return fs.ModeDir
+	case ftCharDev:
+		return fs.ModeDevice | fs.ModeCharDevice
+	case ftBlockDev:
+		return fs.ModeDevice
+	case ftFifo:
+		return fs.ModeNamedPipe
+	case ftSocket:
+		return fs.ModeSocket
+	case ftSymlink:
+		return fs.ModeSymlink
+	}
+	// Without the filetype feature the type is only known from the inode.
+	in, err := e.f.v.readInode(e.ino)
+	if err != nil {
+		return 0
+	}
+	return fileMode(in.Mode).Type()
+}
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	in, err := e.f.v.readInode(e.ino)
+	if err != nil {
+		return nil, err
+	}
+	return e.f.newFileInfo(e.name, e.ino, in), nil
+}
+
+// ReadDir returns the entries of the named directory sorted by name,
+// without "." and "..".
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	ino, in, err := f.walk(name, true)
+	if err == nil && in.Mode&sIFMT != sIFDIR {
+		err = syscall.ENOTDIR
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	var ents []fs.DirEntry
+	err = f.v.scanDir(ino, in, func(blk uint64, b []byte, off int, d dirent) bool {
+		if d.ino != 0 && d.name != "." && d.name != ".." {
+			ents = append(ents, &dirEntry{f: f, name: d.name, ino: d.ino, ftype: d.ftype})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+	return ents, nil
+}
+
+// Open opens the named file for reading, implementing fs.FS. Names must
+// satisfy fs.ValidPath.
+func (f *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	fi, err := f.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	file := &file{fi: fi}
+	if fi.IsDir() {
+		if file.ents, err = f.ReadDir(name); err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	if fi.Mode().IsRegular() {
+		data, err := f.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		file.r = strings.NewReader(string(data))
+	}
+	return file, nil
+}
+
+// file is an open file of an FS. Contents are read at open time.
+type file struct {
+	fi   fs.FileInfo
+	r    io.Reader
+	ents []fs.DirEntry
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.fi, nil }
+func (f *file) Close() error               { return nil }
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.fi.Name(), Err: fs.ErrInvalid}
+	}
+	return f.r.Read(p)
+}
+
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.fi.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.fi.Name(), Err: syscall.ENOTDIR}
+	}
+	if n <= 0 {
+		ents := f.ents
+		f.ents = nil
+		return ents, nil
+	}
+	if len(f.ents) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.ents) {
+		n = len(f.ents)
+	}
+	ents := f.ents[:n]
+	f.ents = f.ents[n:]
+	return ents, nil
+}
+
+var _ fs.ReadDirFS = (*FS)(nil)
@@ -0,0 +1,183 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Block group flags.
+const (
+	bgInodeUninit = 0x0001
+	bgBlockUninit = 0x0002
+	bgInodeZeroed = 0x0004
+)
+
+// groupDesc is the decoded form of a block group descriptor with the
+// split lo/hi fields combined.
+type groupDesc struct {
+	BlockBitmap     uint64
+	InodeBitmap     uint64
+	InodeTable      uint64
+	FreeBlocks      uint32
+	FreeInodes      uint32
+	UsedDirs        uint32
+	Flags           uint16
+	ExcludeBitmap   uint64
+	BlockBitmapCsum uint32
+	InodeBitmapCsum uint32
+	ItableUnused    uint32
+	Checksum        uint16
+}
+
+func decodeGroupDesc(b []byte) groupDesc {
+	le := binary.LittleEndian
+	d := groupDesc{
+		BlockBitmap:     uint64(le.Uint32(b[0x0:])),
+		InodeBitmap:     uint64(le.Uint32(b[0x4:])),
+		InodeTable:      uint64(le.Uint32(b[0x8:])),
+		FreeBlocks:      uint32(le.Uint16(b[0xc:])),
+		FreeInodes:      uint32(le.Uint16(b[0xe:])),
+		UsedDirs:        uint32(le.Uint16(b[0x10:])),
+		Flags:           le.Uint16(b[0x12:]),
+		ExcludeBitmap:   uint64(le.Uint32(b[0x14:])),
+		BlockBitmapCsum: uint32(le.Uint16(b[0x18:])),
+		InodeBitmapCsum: uint32(le.Uint16(b[0x1a:])),
+		ItableUnused:    uint32(le.Uint16(b[0x1c:])),
+		Checksum:        le.Uint16(b[0x1e:]),
+	}
+	if len(b) >= 64 {
+		d.BlockBitmap |= uint64(le.Uint32(b[0x20:])) << 32
+		d.InodeBitmap |= uint64(le.Uint32(b[0x24:])) << 32
+		d.InodeTable |= uint64(le.Uint32(b[0x28:])) << 32
+		d.FreeBlocks |= uint32(le.Uint16(b[0x2c:])) << 16
+		d.FreeInodes |= uint32(le.Uint16(b[0x2e:])) << 16
+		d.UsedDirs |= uint32(le.Uint16(b[0x30:])) << 16
+		d.ItableUnused |= uint32(le.Uint16(b[0x32:])) << 16
+		d.ExcludeBitmap |= uint64(le.Uint32(b[0x34:])) << 32
+		d.BlockBitmapCsum |= uint32(le.Uint16(b[0x38:])) << 16
+		d.InodeBitmapCsum |= uint32(le.Uint16(b[0x3a:])) << 16
+	}
+	return d
+}
+
+// encode writes d into b, which is either 32 or 64 (or more) bytes long.
+func (d *groupDesc) encode(b []byte) {
+	le := binary.LittleEndian
+	le.PutUint32(b[0x0:], uint32(d.BlockBitmap))
+	le.PutUint32(b[0x4:], uint32(d.InodeBitmap))
+	le.PutUint32(b[0x8:], uint32(d.InodeTable))
+	le.PutUint16(b[0xc:], uint16(d.FreeBlocks))
+	le.PutUint16(b[0xe:], uint16(d.FreeInodes))
+	le.PutUint16(b[0x10:], uint16(d.UsedDirs))
+	le.PutUint16(b[0x12:], d.Flags)
+	le.PutUint32(b[0x14:], uint32(d.ExcludeBitmap))
+	le.PutUint16(b[0x18:], uint16(d.BlockBitmapCsum))
+	le.PutUint16(b[0x1a:], uint16(d.InodeBitmapCsum))
+	le.PutUint16(b[0x1c:], uint16(d.ItableUnused))
+	le.PutUint16(b[0x1e:], d.Checksum)
+	if len(b) >= 64 {
+		le.PutUint32(b[0x20:], uint32(d.BlockBitmap>>32))
+		le.PutUint32(b[0x24:], uint32(d.InodeBitmap>>32))
+		le.PutUint32(b[0x28:], uint32(d.InodeTable>>32))
+		le.PutUint16(b[0x2c:], uint16(d.FreeBlocks>>16))
+		le.PutUint16(b[0x2e:], uint16(d.FreeInodes>>16))
+		le.PutUint16(b[0x30:], uint16(d.UsedDirs>>16))
+		le.PutUint16(b[0x32:], uint16(d.ItableUnused>>16))
+		le.PutUint32(b[0x34:], uint32(d.ExcludeBitmap>>32))
+		le.PutUint16(b[0x38:], uint16(d.BlockBitmapCsum>>16))
+		le.PutUint16(b[0x3a:], uint16(d.InodeBitmapCsum>>16))
+	}
+}
+
+// groupDescChecksum computes the checksum of the descriptor of group g.
+func (sb *superblock) groupDescChecksum(g uint32, d *groupDesc) uint16 {
+	b := make([]byte, sb.descSize())
+	dd := *d
+	dd.Checksum = 0
+	dd.encode(b)
+	if sb.hasROCompat(featureROCompatMetadataCsum) {
+		crc := crc32c(sb.csumSeed(), le32(g))
+		crc = crc32c(crc, b)
+		return uint16(crc)
+	}
+	if sb.hasROCompat(featureROCompatGdtCsum) {
+		crc := crc16(0xffff, sb.UUID[:])
+		crc = crc16(crc, le32(g))
+		crc = crc16(crc, b[:0x1e])
+		if len(b) > 0x20 {
+			crc = crc16(crc, b[0x20:])
+		}
+		return crc
+	}
+	return 0
+}
+
+// setBitmapChecksums updates the bitmap checksums stored in d.
+func (sb *superblock) setBitmapChecksums(d *groupDesc, blockBitmap, inodeBitmap []byte) {
+	if !sb.hasROCompat(featureROCompatMetadataCsum) {
+		return
+	}
+	mask := uint32(0xffff)
+	if sb.descSize() >= 64 {
+		mask = 0xffffffff
+	}
+	if blockBitmap != nil {
+		d.BlockBitmapCsum = crc32c(sb.csumSeed(), blockBitmap[:sb.ClustersPerGroup/8]) & mask
+	}
+	if inodeBitmap != nil {
+		d.InodeBitmapCsum = crc32c(sb.csumSeed(), inodeBitmap[:sb.InodesPerGroup/8]) & mask
+	}
+}
+
+// groupDescLocation returns the block holding descriptor block i of the
+// primary group descriptor table, honouring meta_bg.
+func (sb *superblock) groupDescLocation(i uint32) uint64 {
+	sbBlock := uint64(sb.FirstDataBlock)
+	if !sb.hasIncompat(featureIncompatMetaBG) || i < sb.FirstMetaBg {
+		return sbBlock + 1 + uint64(i)
+	}
+	perBlock := uint32(sb.blockSize()) / uint32(sb.descSize())
+	g := i * perBlock
+	blk := sb.groupFirstBlock(g)
+	if sb.groupHasSuper(g) {
+		blk++
+	}
+	return blk
+}
+
+// readGroupDescs reads all block group descriptors of the file system.
+func readGroupDescs(dev Device, sb *superblock) ([]groupDesc, error) {
+	bs := sb.blockSize()
+	n := sb.groupCount()
+	ds := sb.descSize()
+	blocks := sb.groupDescBlocks(n)
+	buf := make([]byte, bs)
+	groups := make([]groupDesc, 0, n)
+	for i := uint32(0); i < blocks; i++ {
+		if _, err := dev.ReadAt(buf, int64(sb.groupDescLocation(i))*bs); err != nil {
+			return nil, fmt.Errorf("ext4: reading group descriptors: %w", err)
+		}
+		for off := 0; off+ds <= int(bs) && uint32(len(groups)) < n; off += ds {
+			d := decodeGroupDesc(buf[off : off+ds])
+			g := uint32(len(groups))
+			if sb.hasGroupCsum() && sb.groupDescChecksum(g, &d) != d.Checksum {
+				return nil, fmt.Errorf("group descriptor %d: %w", g, ErrChecksum)
+			}
+			groups = append(groups, d)
+		}
+	}
+	return groups, nil
+}
+
+// encodeGroupDescs encodes groups into a descriptor table of whole blocks,
+// updating each descriptor checksum.
+func encodeGroupDescs(sb *superblock, groups []groupDesc) []byte {
+	ds := sb.descSize()
+	blocks := sb.groupDescBlocks(uint32(len(groups)))
+	buf := make([]byte, int64(blocks)*sb.blockSize())
+	for g := range groups {
+		groups[g].Checksum = sb.groupDescChecksum(uint32(g), &groups[g])
+		groups[g].encode(buf[g*ds : (g+1)*ds])
+	}
+	return buf
+}
@@ -0,0 +1,44 @@
+package ext4
+
+import (
+	"bytes"
+	"io"
+)
+
+// Info describes an ext2, ext3 or ext4 file system.
+type Info struct {
+	// Type is "ext2", "ext3" or "ext4", the way blkid reports it.
+	Type       string
+	UUID       [16]byte
+	Label      string
+	BlockSize  int64
+	Blocks     uint64
+	FreeBlocks uint64
+	FreeInodes uint32
+}
+
+// ReadInfo reads the superblock of the file system on dev. It works for
+// file systems using features this package cannot open as well.
+func ReadInfo(dev io.ReaderAt) (*Info, error) {
+	sb, err := readSuperblock(dev, superblockOffset)
+	if err != nil {
+		return nil, err
+	}
+	typ := "ext2"
+	switch {
+	case sb.FeatureIncompat&^(featureIncompatFiletype|featureIncompatRecover|featureIncompatMetaBG) != 0,
+		sb.FeatureROCompat&^(featureROCompatSparseSuper|featureROCompatLargeFile) != 0:
+		typ = "ext4"
+	case sb.hasCompat(featureCompatHasJournal):
+		typ = "ext3"
+	}
+	return &Info{
+		Type:       typ,
+		UUID:       sb.UUID,
+		Label:      string(bytes.TrimRight(sb.VolumeName[:], "\x00")),
+		BlockSize:  sb.blockSize(),
+		Blocks:     sb.blocksCount(),
+		FreeBlocks: sb.freeBlocksCount(),
+		FreeInodes: sb.FreeInodesCount,
+	}, nil
+}
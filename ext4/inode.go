@@ -0,0 +1,194 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Special inode numbers.
+const (
+	rootIno    = 2
+	journalIno = 8
+	resizeIno  = 7
+)
+
+// Inode flags.
+const (
+	inodeFlagIndex     = 0x1000
+	inodeFlagHugeFile  = 0x40000
+	inodeFlagExtents   = 0x80000
+	inodeFlagEAInode   = 0x200000
+	inodeFlagInline    = 0x10000000
+	inodeGoodOldSize   = 128
+	inodeExtraSize     = 32
+	inodeCsumHiEndSize = 4
+)
+
+// inode is the on-disk layout of an ext4 inode including the extra fields
+// of large inodes.
+type inode struct {
+	Mode        uint16
+	UID         uint16
+	SizeLo      uint32
+	Atime       uint32
+	Ctime       uint32
+	Mtime       uint32
+	Dtime       uint32
+	GID         uint16
+	LinksCount  uint16
+	BlocksLo    uint32
+	Flags       uint32
+	Version     uint32
+	Block       [15]uint32
+	Generation  uint32
+	FileACLLo   uint32
+	SizeHigh    uint32
+	ObsoFaddr   uint32
+	BlocksHigh  uint16
+	FileACLHigh uint16
+	UIDHigh     uint16
+	GIDHigh     uint16
+	ChecksumLo  uint16
+	Reserved    uint16
+	ExtraIsize  uint16
+	ChecksumHi  uint16
+	CtimeExtra  uint32
+	MtimeExtra  uint32
+	AtimeExtra  uint32
+	Crtime      uint32
+	CrtimeExtra uint32
+	VersionHi   uint32
+	Projid      uint32
+}
+
+// decodeInode decodes the raw on-disk inode b.
+func decodeInode(b []byte) *inode {
+	// Fields beyond i_extra_isize belong to in-inode extended attributes.
+	n := inodeGoodOldSize
+	if len(b) > inodeGoodOldSize {
+		n += int(binary.LittleEndian.Uint16(b[0x80:]))
+	}
+	if n > len(b) {
+		n = len(b)
+	}
+	buf := make([]byte, inodeGoodOldSize+inodeExtraSize)
+	copy(buf, b[:n])
+	in := &inode{}
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, in)
+	return in
+}
+
+// encode writes in into the raw on-disk inode b, leaving any bytes past
+// i_extra_isize untouched.
+func (in *inode) encode(b []byte) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, in)
+	n := inodeGoodOldSize
+	if len(b) > inodeGoodOldSize {
+		n += int(in.ExtraIsize)
+	}
+	if n > len(b) {
+		n = len(b)
+	}
+	copy(b[:n], buf.Bytes())
+}
+
+func (in *inode) size() uint64 {
+	return uint64(in.SizeLo) | uint64(in.SizeHigh)<<32
+}
+
+func (in *inode) setSize(n uint64) {
+	in.SizeLo = uint32(n)
+	in.SizeHigh = uint32(n >> 32)
+}
+
+func (in *inode) fileACL() uint64 {
+	return uint64(in.FileACLLo) | uint64(in.FileACLHigh)<<32
+}
+
+func (in *inode) setFileACL(blk uint64) {
+	in.FileACLLo = uint32(blk)
+	in.FileACLHigh = uint16(blk >> 32)
+}
+
+// blocks returns i_blocks in 512 byte units.
+func (in *inode) blocks(sb *superblock) uint64 {
+	n := uint64(in.BlocksLo)
+	if sb.hasROCompat(featureROCompatHugeFile) {
+		n |= uint64(in.BlocksHigh) << 32
+		if in.Flags&inodeFlagHugeFile != 0 {
+			n *= uint64(sb.blockSize() / 512)
+		}
+	}
+	return n
+}
+
+// setBlocks sets i_blocks from a count of 512 byte units.
+func (in *inode) setBlocks(sb *superblock, n uint64) {
+	in.Flags &^= inodeFlagHugeFile
+	in.BlocksLo = uint32(n)
+	in.BlocksHigh = uint16(n >> 32)
+	if n>>48 != 0 && sb.hasROCompat(featureROCompatHugeFile) {
+		in.Flags |= inodeFlagHugeFile
+		n /= uint64(sb.blockSize() / 512)
+		in.BlocksLo = uint32(n)
+		in.BlocksHigh = uint16(n >> 32)
+	}
+}
+
+func (in *inode) uid() uint32 { return uint32(in.UID) | uint32(in.UIDHigh)<<16 }
+func (in *inode) gid() uint32 { return uint32(in.GID) | uint32(in.GIDHigh)<<16 }
+
+func (in *inode) setUID(id uint32) {
+	in.UID = uint16(id)
+	in.UIDHigh = uint16(id >> 16)
+}
+
+func (in *inode) setGID(id uint32) {
+	in.GID = uint16(id)
+	in.GIDHigh = uint16(id >> 16)
+}
+
+// inodeChecksum computes the metadata_csum checksum of the raw inode b.
+func (sb *superblock) inodeChecksum(ino uint32, b []byte) uint32 {
+	in := decodeInode(b)
+	raw := make([]byte, len(b))
+	copy(raw, b)
+	raw[0x7c], raw[0x7d] = 0, 0
+	hasHi := len(raw) > inodeGoodOldSize && in.ExtraIsize >= inodeCsumHiEndSize
+	if hasHi {
+		raw[0x82], raw[0x83] = 0, 0
+	}
+	crc := crc32c(sb.csumSeed(), le32(ino))
+	crc = crc32c(crc, le32(in.Generation))
+	crc = crc32c(crc, raw)
+	if !hasHi {
+		crc &= 0xffff
+	}
+	return crc
+}
+
+// setInodeChecksum stores the checksum of the raw inode b in place.
+func (sb *superblock) setInodeChecksum(ino uint32, b []byte) {
+	if !sb.hasROCompat(featureROCompatMetadataCsum) {
+		return
+	}
+	crc := sb.inodeChecksum(ino, b)
+	binary.LittleEndian.PutUint16(b[0x7c:], uint16(crc))
+	if len(b) > inodeGoodOldSize && binary.LittleEndian.Uint16(b[0x80:]) >= inodeCsumHiEndSize {
+		binary.LittleEndian.PutUint16(b[0x82:], uint16(crc>>16))
+	}
+}
+
+// verifyInodeChecksum reports whether the checksum of raw inode b is valid.
+func (sb *superblock) verifyInodeChecksum(ino uint32, b []byte) bool {
+	if !sb.hasROCompat(featureROCompatMetadataCsum) {
+		return true
+	}
+	in := decodeInode(b)
+	want := uint32(in.ChecksumLo)
+	if len(b) > inodeGoodOldSize && in.ExtraIsize >= inodeCsumHiEndSize {
+		want |= uint32(in.ChecksumHi) << 16
+	}
+	return sb.inodeChecksum(ino, b) == want
+}
@@ -0,0 +1,267 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	jbd2Magic             = 0xc03b3998
+	jbd2SuperblockV2      = 4
+	jbd2FeatureIncompat64 = 0x2
+	jbd2FeatureCsumV2     = 0x8
+	jbd2FeatureCsumV3     = 0x10
+	jbd2ChecksumCRC32C    = 4
+	jnlBackupBlocks       = 1
+)
+
+// Journal block types.
+const (
+	jbd2Descriptor = 1
+	jbd2Commit     = 2
+	jbd2Revoke     = 5
+)
+
+// Journal block tag flags.
+const (
+	jbd2TagEscape   = 0x1
+	jbd2TagSameUUID = 0x2
+	jbd2TagLast     = 0x8
+)
+
+// defaultJournalBlocks returns the journal size mke2fs picks for a file
+// system of the given number of blocks, or 0 if it is too small for a journal.
+func defaultJournalBlocks(blocks uint64) uint32 {
+	switch {
+	case blocks < 2048:
+		return 0
+	case blocks < 32768:
+		return 1024
+	case blocks < 256*1024:
+		return 4096
+	case blocks < 512*1024:
+		return 8192
+	case blocks < 4096*1024:
+		return 16384
+	case blocks < 8192*1024:
+		return 32768
+	case blocks < 16384*1024:
+		return 65536
+	case blocks < 32768*1024:
+		return 131072
+	}
+	return 262144
+}
+
+// journalSuperblock encodes the superblock of an empty internal journal of
+// n blocks. Unlike the rest of ext4 the journal is big-endian.
+func (sb *superblock) journalSuperblock(n uint32) []byte {
+	b := make([]byte, sb.blockSize())
+	be := binary.BigEndian
+	be.PutUint32(b[0x0:], jbd2Magic)
+	be.PutUint32(b[0x4:], jbd2SuperblockV2)
+	be.PutUint32(b[0xc:], uint32(sb.blockSize()))
+	be.PutUint32(b[0x10:], n)
+	be.PutUint32(b[0x14:], 1) // first log block
+	be.PutUint32(b[0x18:], 1) // sequence
+	var incompat uint32
+	if sb.hasIncompat(featureIncompat64Bit) {
+		incompat |= jbd2FeatureIncompat64
+	}
+	if sb.hasROCompat(featureROCompatMetadataCsum) {
+		incompat |= jbd2FeatureCsumV3
+		b[0x50] = jbd2ChecksumCRC32C
+	}
+	be.PutUint32(b[0x28:], incompat)
+	copy(b[0x30:], sb.UUID[:])
+	be.PutUint32(b[0x40:], 1) // users
+	copy(b[0x100:], sb.UUID[:])
+	if incompat&jbd2FeatureCsumV3 != 0 {
+		be.PutUint32(b[0xfc:], crc32c(^uint32(0), b[:1024]))
+	}
+	return b
+}
+
+// journalTx is a committed journal transaction.
+type journalTx struct {
+	seq    uint32
+	writes []journalWrite
+}
+
+// journalWrite is a file system block logged in a transaction.
+type journalWrite struct {
+	blk    uint64
+	jblk   uint32
+	escape bool
+}
+
+// journalReplay holds the outcome of scanning the journal for recovery.
+type journalReplay struct {
+	// blocks maps file system blocks to their contents after replaying
+	// all committed transactions.
+	blocks map[uint64][]byte
+
+	// sb is the journal superblock updated to describe an empty journal,
+	// to be written to block sbBlock once blocks are in place.
+	sb      []byte
+	sbBlock uint64
+}
+
+// replayJournal reads the committed transactions of the internal journal.
+func (v *volume) replayJournal() (*journalReplay, error) {
+	jin, err := v.readInode(v.sb.JournalInum)
+	if err != nil {
+		return nil, err
+	}
+	m, err := v.mapBlocks(v.sb.JournalInum, jin)
+	if err != nil {
+		return nil, err
+	}
+	readJ := func(l uint32) ([]byte, error) {
+		blk := m.physical(l)
+		if blk == 0 {
+			return nil, fmt.Errorf("ext4: journal block %d is not mapped", l)
+		}
+		return v.readBlock(blk)
+	}
+	jsb, err := readJ(0)
+	if err != nil {
+		return nil, err
+	}
+	be := binary.BigEndian
+	if be.Uint32(jsb) != jbd2Magic {
+		return nil, fmt.Errorf("ext4: bad journal superblock")
+	}
+	if int64(be.Uint32(jsb[0xc:])) != v.bs {
+		return nil, fmt.Errorf("ext4: journal block size: %w", ErrUnsupported)
+	}
+	maxLen := be.Uint32(jsb[0x10:])
+	first := be.Uint32(jsb[0x14:])
+	seq := be.Uint32(jsb[0x18:])
+	start := be.Uint32(jsb[0x1c:])
+	incompat := be.Uint32(jsb[0x28:])
+	r := &journalReplay{blocks: map[uint64][]byte{}, sb: jsb, sbBlock: m.physical(0)}
+	if start == 0 {
+		return r, nil
+	}
+
+	tagSize := 8
+	if incompat&jbd2FeatureIncompat64 != 0 {
+		tagSize += 4
+	}
+	tail := 0
+	if incompat&(jbd2FeatureCsumV2|jbd2FeatureCsumV3) != 0 {
+		tail = 4
+	}
+	if incompat&jbd2FeatureCsumV3 != 0 {
+		tagSize = 16
+	}
+	next := func(l uint32) uint32 {
+		l++
+		if l >= maxLen {
+			l = first
+		}
+		return l
+	}
+
+	var txs []journalTx
+	revoked := map[uint64]uint32{}
+	tx := journalTx{seq: seq}
+	var txRevokes []uint64
+	for l, scanned := start, uint32(0); scanned < maxLen; scanned++ {
+		b, err := readJ(l)
+		if err != nil {
+			return nil, err
+		}
+		if be.Uint32(b) != jbd2Magic || be.Uint32(b[8:]) != tx.seq {
+			break
+		}
+		switch be.Uint32(b[4:]) {
+		case jbd2Descriptor:
+			for off := 12; off+tagSize <= len(b)-tail; {
+				t := b[off:]
+				var w journalWrite
+				var flags uint32
+				if tagSize == 16 {
+					w.blk = uint64(be.Uint32(t[0:])) | uint64(be.Uint32(t[8:]))<<32
+					flags = be.Uint32(t[4:])
+				} else {
+					w.blk = uint64(be.Uint32(t[0:]))
+					flags = uint32(be.Uint16(t[6:]))
+					if tagSize == 12 {
+						w.blk |= uint64(be.Uint32(t[8:])) << 32
+					}
+				}
+				l = next(l)
+				scanned++
+				w.jblk = l
+				w.escape = flags&jbd2TagEscape != 0
+				tx.writes = append(tx.writes, w)
+				off += tagSize
+				if flags&jbd2TagSameUUID == 0 {
+					off += 16
+				}
+				if flags&jbd2TagLast != 0 {
+					break
+				}
+			}
+		case jbd2Commit:
+			txs = append(txs, tx)
+			for _, blk := range txRevokes {
+				if s, ok := revoked[blk]; !ok || s < tx.seq {
+					revoked[blk] = tx.seq
+				}
+			}
+			tx = journalTx{seq: tx.seq + 1}
+			txRevokes = nil
+		case jbd2Revoke:
+			size := 4
+			if incompat&jbd2FeatureIncompat64 != 0 {
+				size = 8
+			}
+			count := int(be.Uint32(b[12:]))
+			if count > len(b) {
+				count = len(b)
+			}
+			for off := 16; off+size <= count; off += size {
+				if size == 8 {
+					txRevokes = append(txRevokes, be.Uint64(b[off:]))
+				} else {
+					txRevokes = append(txRevokes, uint64(be.Uint32(b[off:])))
+				}
+			}
+		default:
+			scanned = maxLen
+			continue
+		}
+		l = next(l)
+	}
+
+	for _, tx := range txs {
+		for _, w := range tx.writes {
+			if s, ok := revoked[w.blk]; ok && s >= tx.seq {
+				continue
+			}
+			if w.blk >= v.sb.blocksCount() {
+				return nil, fmt.Errorf("ext4: journal block %d out of range", w.blk)
+			}
+			data, err := readJ(w.jblk)
+			if err != nil {
+				return nil, err
+			}
+			if w.escape {
+				be.PutUint32(data, jbd2Magic)
+			}
+			r.blocks[w.blk] = data
+		}
+	}
+
+	// Like jbd2, skip a sequence number so stale blocks never look current.
+	be.PutUint32(jsb[0x18:], tx.seq+1)
+	be.PutUint32(jsb[0x1c:], 0)
+	if incompat&(jbd2FeatureCsumV2|jbd2FeatureCsumV3) != 0 {
+		be.PutUint32(jsb[0xfc:], 0)
+		be.PutUint32(jsb[0xfc:], crc32c(^uint32(0), jsb[:1024]))
+	}
+	return r, nil
+}
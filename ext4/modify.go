@@ -0,0 +1,736 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// writable returns an error when f was opened read-only.
+func (f *FS) writable() error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// commit writes the superblock and group descriptors after a modification.
+func (f *FS) commit() error {
+	f.v.sb.Wtime = uint32(f.v.now().Unix())
+	return f.v.flush(false)
+}
+
+// walkParent resolves the directory containing name and returns it with
+// the last element of name.
+func (f *FS) walkParent(name string) (uint32, *inode, string, error) {
+	elems := splitPath(name)
+	if len(elems) == 0 {
+		return 0, nil, "", fs.ErrInvalid
+	}
+	base := elems[len(elems)-1]
+	if base == ".." {
+		return 0, nil, "", fs.ErrInvalid
+	}
+	if len(base) > maxNameLen {
+		return 0, nil, "", syscall.ENAMETOOLONG
+	}
+	dir := "/"
+	for _, elem := range elems[:len(elems)-1] {
+		dir += elem + "/"
+	}
+	ino, in, err := f.walk(dir, true)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	if in.Mode&sIFMT != sIFDIR {
+		return 0, nil, "", syscall.ENOTDIR
+	}
+	return ino, in, base, nil
+}
+
+// inodeGroup returns the block group of inode ino.
+func (v *volume) inodeGroup(ino uint32) uint32 {
+	return (ino - 1) / v.sb.InodesPerGroup
+}
+
+// newInode allocates an inode near the directory parent and returns it
+// initialized with mode and the current time.
+func (f *FS) newInode(parent uint32, mode uint16) (uint32, *inode, error) {
+	ino, err := f.v.allocInode(f.v.inodeGroup(parent), mode&sIFMT == sIFDIR)
+	if err != nil {
+		return 0, nil, err
+	}
+	in := &inode{Mode: mode, LinksCount: 1}
+	if f.v.sb.inodeSize() > inodeGoodOldSize {
+		in.ExtraIsize = inodeExtraSize
+	}
+	now := f.v.now()
+	in.Atime, in.AtimeExtra = encodeTime(now)
+	in.Ctime, in.CtimeExtra = encodeTime(now)
+	in.Mtime, in.MtimeExtra = encodeTime(now)
+	in.Crtime, in.CrtimeExtra = encodeTime(now)
+	in.Flags = inodeFlagExtents
+	var root [60]byte
+	putExtentHeader(root[:], 0, extentRootMax, 0)
+	for i := range in.Block {
+		in.Block[i] = binary.LittleEndian.Uint32(root[i*4:])
+	}
+	return ino, in, nil
+}
+
+// writeNewInode writes a newly allocated inode, clearing whatever the
+// inode table held in its slot before.
+func (v *volume) writeNewInode(ino uint32, in *inode) error {
+	b := make([]byte, v.sb.inodeSize())
+	in.encode(b)
+	return v.writeInodeRaw(ino, b)
+}
+
+// SetTime makes later modifications record t as the current time, so
+// the same modifications of the same file system give the same result.
+func (f *FS) SetTime(t time.Time) {
+	f.v.clock = t
+}
+
+// now returns the time recorded by modifications.
+func (v *volume) now() time.Time {
+	if v.clock.IsZero() {
+		return time.Now()
+	}
+	return v.clock
+}
+
+// touch sets the modification and change time of in to now.
+func (v *volume) touch(in *inode) {
+	now := v.now()
+	in.Mtime, in.MtimeExtra = encodeTime(now)
+	in.Ctime, in.CtimeExtra = encodeTime(now)
+}
+
+// setExtents replaces the block map of inode ino with exts, writing a new
+// extent tree. Blocks of the previous block map are not released.
+func (v *volume) setExtents(ino uint32, in *inode, exts []extent) error {
+	goal := v.groups[v.inodeGroup(ino)].InodeTable
+	if len(exts) > 0 {
+		goal = exts[len(exts)-1].physical
+	}
+	root, nodes, err := buildExtentTree(exts, v.bs, func() (uint64, error) {
+		return v.allocBlock(goal)
+	})
+	if err != nil {
+		return err
+	}
+	for _, nd := range nodes {
+		v.sb.setExtentChecksum(ino, in.Generation, nd.data)
+		if err := v.writeBlock(nd.blk, nd.data); err != nil {
+			return err
+		}
+	}
+	for i := range in.Block {
+		in.Block[i] = binary.LittleEndian.Uint32(root[i*4:])
+	}
+	in.Flags |= inodeFlagExtents
+	blocks := uint64(len(nodes))
+	for _, e := range exts {
+		blocks += uint64(e.length)
+	}
+	if in.fileACL() != 0 {
+		blocks++
+	}
+	in.setBlocks(v.sb, blocks*uint64(v.bs/512))
+	return nil
+}
+
+// writeData allocates blocks for data, writes it and makes it the
+// content of inode ino. The previous blocks are released afterwards, so
+// the old content survives a failed write.
+func (v *volume) writeData(ino uint32, in *inode, data []byte) error {
+	old, err := v.mapBlocks(ino, in)
+	if err != nil {
+		return err
+	}
+	var exts []extent
+	release := func() {
+		v.freeExtents(exts)
+	}
+	goal := v.groups[v.inodeGroup(ino)].InodeTable
+	total := uint32((int64(len(data)) + v.bs - 1) / v.bs)
+	for logical := uint32(0); logical < total; {
+		want := total - logical
+		if want > maxExtentLen {
+			want = maxExtentLen
+		}
+		blk, n, err := v.allocBlocks(goal, want)
+		if err != nil {
+			release()
+			return err
+		}
+		exts = append(exts, extent{logical: logical, physical: blk, length: n})
+		chunk := make([]byte, int64(n)*v.bs)
+		copy(chunk, data[int64(logical)*v.bs:])
+		if _, err := v.dev.WriteAt(chunk, int64(blk)*v.bs); err != nil {
+			release()
+			return fmt.Errorf("ext4: writing block %d: %w", blk, err)
+		}
+		logical += n
+		goal = blk + uint64(n)
+	}
+	if err := v.setExtents(ino, in, exts); err != nil {
+		release()
+		return err
+	}
+	in.setSize(uint64(len(data)))
+	if err := v.freeExtents(old.exts); err != nil {
+		return err
+	}
+	for _, blk := range old.meta {
+		if err := v.freeBlocks(blk, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseInode frees the blocks, extended attribute block and inode
+// number of an inode whose last link was removed.
+func (v *volume) releaseInode(ino uint32, in *inode) error {
+	if in.hasData() {
+		m, err := v.mapBlocks(ino, in)
+		if err != nil {
+			return err
+		}
+		if err := v.freeExtents(m.exts); err != nil {
+			return err
+		}
+		for _, blk := range m.meta {
+			if err := v.freeBlocks(blk, 1); err != nil {
+				return err
+			}
+		}
+	}
+	if blk := in.fileACL(); blk != 0 {
+		if err := v.releaseXattrBlock(blk); err != nil {
+			return err
+		}
+		in.setFileACL(0)
+	}
+	in.LinksCount = 0
+	in.Dtime = uint32(v.now().Unix())
+	in.setBlocks(v.sb, 0)
+	if err := v.writeInode(ino, in); err != nil {
+		return err
+	}
+	return v.freeInode(ino, in.Mode&sIFMT == sIFDIR)
+}
+
+// releaseXattrBlock drops a reference to a shared extended attribute block.
+func (v *volume) releaseXattrBlock(blk uint64) error {
+	b, err := v.readBlock(blk)
+	if err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	if le.Uint32(b) != xattrMagic {
+		return fmt.Errorf("ext4: bad extended attribute block %d", blk)
+	}
+	refs := le.Uint32(b[4:])
+	if refs <= 1 {
+		return v.freeBlocks(blk, 1)
+	}
+	le.PutUint32(b[4:], refs-1)
+	v.sb.setXattrBlockChecksum(b, blk)
+	return v.writeBlock(blk, b)
+}
+
+// putDirent encodes d with record length recLen at the start of b.
+func putDirent(b []byte, d dirent, recLen int) {
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], d.ino)
+	le.PutUint16(b[4:], uint16(recLen))
+	b[6] = uint8(len(d.name))
+	b[7] = d.ftype
+	copy(b[8:], d.name)
+}
+
+// addEntry adds d to directory ino, using free space in an existing
+// block or appending a new block.
+func (v *volume) addEntry(ino uint32, dir *inode, d dirent) error {
+	if dir.Flags&inodeFlagIndex != 0 {
+		if err := v.unindexDir(ino, dir); err != nil {
+			return err
+		}
+	}
+	if !v.sb.hasIncompat(featureIncompatFiletype) {
+		d.ftype = ftUnknown
+	}
+	csum := v.sb.hasROCompat(featureROCompatMetadataCsum)
+	space := int(v.bs)
+	if csum {
+		space -= dirTailSize
+	}
+	need := direntLen(len(d.name))
+	var (
+		found   bool
+		werr    error
+		lastBlk uint64
+	)
+	err := v.scanDir(ino, dir, func(blk uint64, b []byte, off int, e dirent) bool {
+		lastBlk = blk
+		if off >= space {
+			return true
+		}
+		recLen := int(binary.LittleEndian.Uint16(b[off+4:]))
+		used := 0
+		if e.ino != 0 {
+			used = direntLen(len(e.name))
+		}
+		if recLen-used < need {
+			return true
+		}
+		if used > 0 {
+			binary.LittleEndian.PutUint16(b[off+4:], uint16(used))
+		}
+		putDirent(b[off+used:], d, recLen-used)
+		v.sb.setDirChecksum(ino, dir.Generation, b)
+		werr = v.writeBlock(blk, b)
+		found = true
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if found || werr != nil {
+		return werr
+	}
+
+	m, err := v.mapBlocks(ino, dir)
+	if err != nil {
+		return err
+	}
+	blk, err := v.allocBlock(lastBlk + 1)
+	if err != nil {
+		return err
+	}
+	b := encodeDirBlocks([]dirent{d}, int(v.bs), csum)[0]
+	v.sb.setDirChecksum(ino, dir.Generation, b)
+	if err := v.writeBlock(blk, b); err != nil {
+		return err
+	}
+	logical := uint32(dir.size() / uint64(v.bs))
+	if err := v.setExtents(ino, dir, appendExtent(m.exts, logical, blk)); err != nil {
+		return err
+	}
+	for _, mb := range m.meta {
+		if err := v.freeBlocks(mb, 1); err != nil {
+			return err
+		}
+	}
+	dir.setSize(dir.size() + uint64(v.bs))
+	return v.writeInode(ino, dir)
+}
+
+// unindexDir turns a hash tree indexed directory into a linear one by
+// emptying its index blocks, so entries can be added without maintaining
+// the index. e2fsck -D rebuilds the index if desired.
+func (v *volume) unindexDir(ino uint32, dir *inode) error {
+	m, err := v.mapBlocks(ino, dir)
+	if err != nil {
+		return err
+	}
+	csum := v.sb.hasROCompat(featureROCompatMetadataCsum)
+	nblocks := uint32(dir.size() / uint64(v.bs))
+	for l := uint32(0); l < nblocks; l++ {
+		blk := m.physical(l)
+		if blk == 0 {
+			continue
+		}
+		b, err := v.readBlock(blk)
+		if err != nil {
+			return err
+		}
+		le := binary.LittleEndian
+		var ents []dirent
+		switch {
+		case l == 0:
+			// The index root follows "." and "..".
+			ents = []dirent{
+				{ino: le.Uint32(b[0:]), name: ".", ftype: ftDir},
+				{ino: le.Uint32(b[12:]), name: "..", ftype: ftDir},
+			}
+		case le.Uint32(b[0:]) == 0 && int64(le.Uint16(b[4:])) == v.bs:
+			// An interior index node, or an empty leaf.
+		default:
+			continue
+		}
+		if !v.sb.hasIncompat(featureIncompatFiletype) {
+			for i := range ents {
+				ents[i].ftype = ftUnknown
+			}
+		}
+		nb := encodeDirBlocks(ents, int(v.bs), csum)[0]
+		v.sb.setDirChecksum(ino, dir.Generation, nb)
+		if err := v.writeBlock(blk, nb); err != nil {
+			return err
+		}
+	}
+	dir.Flags &^= inodeFlagIndex
+	return v.writeInode(ino, dir)
+}
+
+// removeEntry removes the entry name from directory ino.
+func (v *volume) removeEntry(ino uint32, dir *inode, name string) error {
+	var (
+		found bool
+		werr  error
+		prev  = -1
+		pblk  uint64
+	)
+	err := v.scanDir(ino, dir, func(blk uint64, b []byte, off int, e dirent) bool {
+		if blk != pblk {
+			prev, pblk = -1, blk
+		}
+		if e.ino == 0 || e.name != name {
+			prev = off
+			return true
+		}
+		le := binary.LittleEndian
+		if prev >= 0 {
+			recLen := le.Uint16(b[prev+4:]) + le.Uint16(b[off+4:])
+			le.PutUint16(b[prev+4:], recLen)
+		} else {
+			le.PutUint32(b[off:], 0)
+		}
+		v.sb.setDirChecksum(ino, dir.Generation, b)
+		werr = v.writeBlock(blk, b)
+		found = true
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fs.ErrNotExist
+	}
+	return werr
+}
+
+// isEmptyDir reports whether directory ino holds no entries besides "." and "..".
+func (v *volume) isEmptyDir(ino uint32, dir *inode) (bool, error) {
+	empty := true
+	err := v.scanDir(ino, dir, func(blk uint64, b []byte, off int, e dirent) bool {
+		if e.ino != 0 && e.name != "." && e.name != ".." {
+			empty = false
+			return false
+		}
+		return true
+	})
+	return empty, err
+}
+
+// WriteFile writes data to the named file, creating it with permissions
+// perm if necessary. An existing file keeps its permissions and owner.
+// Symbolic links are followed.
+func (f *FS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if err := f.writeFile(name, data, perm); err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *FS) writeFile(name string, data []byte, perm fs.FileMode) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	v := f.v
+	ino, in, err := f.walk(name, true)
+	switch {
+	case err == nil:
+		switch in.Mode & sIFMT {
+		case sIFREG:
+		case sIFDIR:
+			return syscall.EISDIR
+		default:
+			return fs.ErrInvalid
+		}
+		if err := v.writeData(ino, in, data); err != nil {
+			return err
+		}
+		v.touch(in)
+		if err := v.writeInode(ino, in); err != nil {
+			return err
+		}
+		return f.commit()
+	case err != fs.ErrNotExist:
+		return err
+	}
+
+	dino, dir, base, err := f.walkParent(name)
+	if err != nil {
+		return err
+	}
+	if _, err := v.lookup(dino, dir, base); err == nil {
+		// A dangling symbolic link.
+		return fs.ErrNotExist
+	}
+	ino, in, err = f.newInode(dino, unixMode(perm&^fs.ModeType))
+	if err != nil {
+		return err
+	}
+	if err := v.writeData(ino, in, data); err != nil {
+		v.freeInode(ino, false)
+		return err
+	}
+	if err := v.writeNewInode(ino, in); err != nil {
+		return err
+	}
+	if err := v.addEntry(dino, dir, dirent{ino: ino, name: base, ftype: ftRegular}); err != nil {
+		return err
+	}
+	v.touch(dir)
+	if err := v.writeInode(dino, dir); err != nil {
+		return err
+	}
+	return f.commit()
+}
+
+// Mkdir creates a new directory with permissions perm.
+func (f *FS) Mkdir(name string, perm fs.FileMode) error {
+	if err := f.mkdir(name, perm); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *FS) mkdir(name string, perm fs.FileMode) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	v := f.v
+	dino, dir, base, err := f.walkParent(name)
+	if err != nil {
+		return err
+	}
+	if _, err := v.lookup(dino, dir, base); err == nil {
+		return fs.ErrExist
+	}
+	ino, in, err := f.newInode(dino, unixMode(perm&^fs.ModeType|fs.ModeDir))
+	if err != nil {
+		return err
+	}
+	blk, err := v.allocBlock(v.groups[v.inodeGroup(ino)].InodeTable)
+	if err != nil {
+		v.freeInode(ino, true)
+		return err
+	}
+	ft := uint8(ftDir)
+	if !v.sb.hasIncompat(featureIncompatFiletype) {
+		ft = ftUnknown
+	}
+	b := encodeDirBlocks([]dirent{
+		{ino: ino, name: ".", ftype: ft},
+		{ino: dino, name: "..", ftype: ft},
+	}, int(v.bs), v.sb.hasROCompat(featureROCompatMetadataCsum))[0]
+	v.sb.setDirChecksum(ino, in.Generation, b)
+	if err := v.writeBlock(blk, b); err != nil {
+		return err
+	}
+	if err := v.setExtents(ino, in, []extent{{physical: blk, length: 1}}); err != nil {
+		return err
+	}
+	in.LinksCount = 2
+	in.setSize(uint64(v.bs))
+	if err := v.writeNewInode(ino, in); err != nil {
+		return err
+	}
+	if err := v.addEntry(dino, dir, dirent{ino: ino, name: base, ftype: ftDir}); err != nil {
+		return err
+	}
+	switch {
+	case dir.LinksCount == 1:
+	case dir.LinksCount >= maxLinks && v.sb.hasROCompat(featureROCompatDirNlink):
+		dir.LinksCount = 1
+	case dir.LinksCount >= maxLinks:
+		return syscall.EMLINK
+	default:
+		dir.LinksCount++
+	}
+	v.touch(dir)
+	if err := v.writeInode(dino, dir); err != nil {
+		return err
+	}
+	return f.commit()
+}
+
+// Symlink creates newname as a symbolic link to oldname.
+func (f *FS) Symlink(oldname, newname string) error {
+	if err := f.symlink(oldname, newname); err != nil {
+		return &fs.PathError{Op: "symlink", Path: newname, Err: err}
+	}
+	return nil
+}
+
+func (f *FS) symlink(oldname, newname string) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if oldname == "" {
+		return fs.ErrInvalid
+	}
+	if int64(len(oldname)) >= f.v.bs {
+		return syscall.ENAMETOOLONG
+	}
+	v := f.v
+	dino, dir, base, err := f.walkParent(newname)
+	if err != nil {
+		return err
+	}
+	if _, err := v.lookup(dino, dir, base); err == nil {
+		return fs.ErrExist
+	}
+	ino, in, err := f.newInode(dino, sIFLNK|0777)
+	if err != nil {
+		return err
+	}
+	if len(oldname) <= maxFastSymlink {
+		// Short targets are stored in place of the block map.
+		var buf [60]byte
+		copy(buf[:], oldname)
+		for i := range in.Block {
+			in.Block[i] = binary.LittleEndian.Uint32(buf[i*4:])
+		}
+		in.Flags &^= inodeFlagExtents
+		in.setSize(uint64(len(oldname)))
+	} else if err := v.writeData(ino, in, []byte(oldname)); err != nil {
+		v.freeInode(ino, false)
+		return err
+	}
+	if err := v.writeNewInode(ino, in); err != nil {
+		return err
+	}
+	ft := uint8(ftSymlink)
+	if !v.sb.hasIncompat(featureIncompatFiletype) {
+		ft = ftUnknown
+	}
+	if err := v.addEntry(dino, dir, dirent{ino: ino, name: base, ftype: ft}); err != nil {
+		return err
+	}
+	v.touch(dir)
+	if err := v.writeInode(dino, dir); err != nil {
+		return err
+	}
+	return f.commit()
+}
+
+// Remove removes the named file or empty directory. A symbolic link is
+// removed itself rather than its target.
+func (f *FS) Remove(name string) error {
+	if err := f.remove(name); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *FS) remove(name string) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	v := f.v
+	dino, dir, base, err := f.walkParent(name)
+	if err != nil {
+		return err
+	}
+	if base == "." {
+		return fs.ErrInvalid
+	}
+	ino, err := v.lookup(dino, dir, base)
+	if err != nil {
+		return err
+	}
+	in, err := v.readInode(ino)
+	if err != nil {
+		return err
+	}
+	isDir := in.Mode&sIFMT == sIFDIR
+	if isDir {
+		empty, err := v.isEmptyDir(ino, in)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return syscall.ENOTEMPTY
+		}
+	}
+	if err := v.removeEntry(dino, dir, base); err != nil {
+		return err
+	}
+	if isDir {
+		if dir.LinksCount > 2 {
+			dir.LinksCount--
+		}
+		in.LinksCount = 0
+	} else if in.LinksCount > 0 {
+		in.LinksCount--
+	}
+	v.touch(dir)
+	if err := v.writeInode(dino, dir); err != nil {
+		return err
+	}
+	if in.LinksCount == 0 {
+		if err := v.releaseInode(ino, in); err != nil {
+			return err
+		}
+	} else {
+		v.touch(in)
+		if err := v.writeInode(ino, in); err != nil {
+			return err
+		}
+	}
+	return f.commit()
+}
+
+// Chmod changes the permission bits of the named file, including the
+// setuid, setgid and sticky bits. Symbolic links are followed.
+func (f *FS) Chmod(name string, mode fs.FileMode) error {
+	return f.setattr("chmod", name, func(in *inode) {
+		in.Mode = in.Mode&sIFMT | unixMode(mode&^fs.ModeType)&^sIFMT
+	})
+}
+
+// Chown changes the owner and group of the named file. An id of -1 leaves
+// it unchanged. Symbolic links are followed.
+func (f *FS) Chown(name string, uid, gid int) error {
+	return f.setattr("chown", name, func(in *inode) {
+		if uid != -1 {
+			in.setUID(uint32(uid))
+		}
+		if gid != -1 {
+			in.setGID(uint32(gid))
+		}
+	})
+}
+
+// setattr applies fn to the inode of the named file.
+func (f *FS) setattr(op, name string, fn func(in *inode)) error {
+	err := f.writable()
+	var (
+		ino uint32
+		in  *inode
+	)
+	if err == nil {
+		ino, in, err = f.walk(name, true)
+	}
+	if err == nil {
+		fn(in)
+		in.Ctime, in.CtimeExtra = encodeTime(f.v.now())
+		err = f.v.writeInode(ino, in)
+	}
+	if err == nil {
+		err = f.commit()
+	}
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// minGroupFreeBlocks is the smallest number of free blocks a new trailing
+// group must provide besides its own metadata, as in resize2fs.
+const minGroupFreeBlocks = 50
+
+// ErrShrink is returned by Grow when the requested size is smaller than the file system.
+var ErrShrink = errors.New("ext4: shrinking is not supported")
+
+// Grow enlarges the unmounted file system on dev so it fills size bytes.
+//
+// The last block group is extended and new block groups are appended with
+// their bitmaps and inode tables stored inside the group. Group descriptor
+// blocks needed for the new groups are taken from the reserved descriptor
+// blocks of the resize inode, the same way the kernel grows a mounted
+// file system. A trailing group too small to be useful is left out, so the
+// file system may end slightly before size.
+//
+// The file system must have been cleanly unmounted and must not need
+// journal recovery.
+func Grow(dev Device, size int64) error {
+	v, err := openVolume(dev)
+	if err != nil {
+		return err
+	}
+	sb := v.sb
+	oldBlocks := sb.blocksCount()
+	newBlocks, err := v.growTarget(size)
+	if err != nil || newBlocks == oldBlocks {
+		return err
+	}
+	oldGroups := uint32(len(v.groups))
+	itb := sb.inodeTableBlocks()
+	newGroups := groupCount(newBlocks, sb.FirstDataBlock, sb.BlocksPerGroup)
+	oldDescBlocks := sb.groupDescBlocks(oldGroups)
+	extraDesc := sb.groupDescBlocks(newGroups) - oldDescBlocks
+
+	// Extend the old last group up to the new end or a full group.
+	lastGroup := oldGroups - 1
+	oldLen := sb.groupBlocks(lastGroup)
+	bitmap, err := v.blockBitmap(lastGroup)
+	if err != nil {
+		return err
+	}
+	sb.setBlocksCount(newBlocks)
+	newLen := sb.groupBlocks(lastGroup)
+	addedFree := uint64(newLen - oldLen)
+	if newLen > oldLen {
+		for i := oldLen; i < newLen; i++ {
+			clearBit(bitmap, i)
+		}
+		d := &v.groups[lastGroup]
+		d.FreeBlocks += newLen - oldLen
+		d.Flags &^= bgBlockUninit
+		sb.setBitmapChecksums(d, bitmap, nil)
+		if err := v.writeBlock(d.BlockBitmap, bitmap); err != nil {
+			return err
+		}
+	}
+
+	// Turn reserved descriptor blocks into descriptor blocks. Their
+	// backups in other groups become descriptor backups in place.
+	if sb.hasCompat(featureCompatResizeInode) && sb.ReservedGdtBlocks > 0 {
+		if err := v.updateResizeInode(oldDescBlocks, extraDesc, newGroups); err != nil {
+			return err
+		}
+	}
+
+	// Append new groups with their metadata at the start of each group.
+	var addedInodes, addedOverhead uint64
+	for g := oldGroups; g < newGroups; g++ {
+		start := sb.groupFirstBlock(g)
+		glen := sb.groupBlocks(g)
+		over := sb.superOverhead(g)
+		used := over + 2 + itb
+		d := groupDesc{
+			BlockBitmap: start + uint64(over),
+			InodeBitmap: start + uint64(over) + 1,
+			InodeTable:  start + uint64(over) + 2,
+			FreeBlocks:  glen - used,
+			FreeInodes:  sb.InodesPerGroup,
+		}
+		bbm := make([]byte, v.bs)
+		for i := uint32(0); i < used; i++ {
+			setBit(bbm, i)
+		}
+		for i := glen; i < uint32(v.bs*8); i++ {
+			setBit(bbm, i)
+		}
+		ibm := make([]byte, v.bs)
+		for i := sb.InodesPerGroup; i < uint32(v.bs*8); i++ {
+			setBit(ibm, i)
+		}
+		if sb.hasGroupCsum() {
+			d.Flags = bgInodeUninit
+			d.ItableUnused = sb.InodesPerGroup
+		} else if err := v.zeroBlocks(d.InodeTable, uint64(itb)); err != nil {
+			return err
+		}
+		sb.setBitmapChecksums(&d, bbm, ibm)
+		if err := v.writeBlock(d.BlockBitmap, bbm); err != nil {
+			return err
+		}
+		if err := v.writeBlock(d.InodeBitmap, ibm); err != nil {
+			return err
+		}
+		v.groups = append(v.groups, d)
+		addedFree += uint64(d.FreeBlocks)
+		addedInodes += uint64(sb.InodesPerGroup)
+		addedOverhead += uint64(used)
+	}
+
+	sb.InodesCount += uint32(addedInodes)
+	sb.FreeInodesCount += uint32(addedInodes)
+	sb.setFreeBlocksCount(sb.freeBlocksCount() + addedFree)
+	hi, lo := bits.Mul64(sb.rBlocksCount(), newBlocks)
+	if hi < oldBlocks {
+		r, _ := bits.Div64(hi, lo, oldBlocks)
+		sb.setRBlocksCount(r)
+	}
+	if sb.OverheadClusters != 0 {
+		sb.OverheadClusters += uint32(addedOverhead)
+	}
+	return v.flush(true)
+}
+
+// CheckGrow reports the error Grow would return for growing the file
+// system on dev to size bytes without changing anything, so the device
+// does not have to be enlarged before knowing whether the file system can
+// follow.
+func CheckGrow(dev Device, size int64) error {
+	v, err := openVolume(dev)
+	if err != nil {
+		return err
+	}
+	_, err = v.growTarget(size)
+	return err
+}
+
+// growTarget returns the number of blocks Grow enlarges the file system to
+// for size bytes, which is the current number if there is nothing to do,
+// after checking that growing is possible.
+func (v *volume) growTarget(size int64) (uint64, error) {
+	sb := v.sb
+	oldBlocks := sb.blocksCount()
+	newBlocks := uint64(size / v.bs)
+	if !sb.hasIncompat(featureIncompat64Bit) && newBlocks > 0xffffffff {
+		newBlocks = 0xffffffff
+	}
+	if newBlocks < oldBlocks {
+		return 0, ErrShrink
+	}
+
+	oldGroups := uint32(len(v.groups))
+	itb := sb.inodeTableBlocks()
+	for newBlocks > oldBlocks {
+		n := groupCount(newBlocks, sb.FirstDataBlock, sb.BlocksPerGroup)
+		if n == oldGroups {
+			break
+		}
+		last := n - 1
+		rest := newBlocks - sb.groupFirstBlock(last)
+		if rest >= uint64(sb.superOverhead(last)+2+itb+minGroupFreeBlocks) {
+			break
+		}
+		newBlocks = sb.groupFirstBlock(last)
+	}
+	if newBlocks <= oldBlocks {
+		return oldBlocks, nil
+	}
+
+	if sb.State&stateValid == 0 || sb.State&stateErrors != 0 || sb.hasIncompat(featureIncompatRecover) {
+		return 0, ErrNotClean
+	}
+	if f := sb.FeatureIncompat &^ featureIncompatResizeable; f != 0 {
+		return 0, fmt.Errorf("growing with incompatible features %#x: %w", f, ErrUnsupported)
+	}
+	if sb.hasCompat(featureCompatSparseSuper2) {
+		return 0, fmt.Errorf("growing with sparse_super2: %w", ErrUnsupported)
+	}
+	newGroups := groupCount(newBlocks, sb.FirstDataBlock, sb.BlocksPerGroup)
+	extraDesc := sb.groupDescBlocks(newGroups) - sb.groupDescBlocks(oldGroups)
+	if extraDesc > 0 && (!sb.hasCompat(featureCompatResizeInode) || extraDesc > uint32(sb.ReservedGdtBlocks)) {
+		return 0, fmt.Errorf("ext4: growing to %d blocks needs %d more group descriptor blocks but only %d are reserved: %w",
+			newBlocks, extraDesc, sb.ReservedGdtBlocks, ErrUnsupported)
+	}
+	if uint64(sb.InodesCount)+uint64(newGroups-oldGroups)*uint64(sb.InodesPerGroup) > 0xffffffff {
+		return 0, fmt.Errorf("ext4: growing to %d blocks exceeds the inode limit", newBlocks)
+	}
+	return newBlocks, nil
+}
+
+// updateResizeInode hands extra reserved descriptor blocks starting at
+// descriptor block first over to the group descriptor table and records
+// the reserved block backups of all backup groups up to groups in the
+// remaining indirect blocks of the resize inode.
+func (v *volume) updateResizeInode(first, extra, groups uint32) error {
+	sb := v.sb
+	in, err := v.readInode(resizeIno)
+	if err != nil {
+		return err
+	}
+	dindBlk := uint64(in.Block[13])
+	if dindBlk == 0 {
+		return fmt.Errorf("ext4: resize inode has no double indirect block")
+	}
+	dind, err := v.readBlock(dindBlk)
+	if err != nil {
+		return err
+	}
+	apb := uint32(v.bs / 4)
+	base := uint64(sb.FirstDataBlock) + 1
+	for i := first; i < first+extra; i++ {
+		off := (i % apb) * 4
+		if uint64(binary.LittleEndian.Uint32(dind[off:])) != base+uint64(i) {
+			return fmt.Errorf("ext4: resize inode does not reference reserved descriptor block %d", i)
+		}
+		binary.LittleEndian.PutUint32(dind[off:], 0)
+	}
+	sb.ReservedGdtBlocks -= uint16(extra)
+
+	var backups []uint32
+	for g := uint32(1); g < groups; g++ {
+		if sb.groupHasSuper(g) {
+			backups = append(backups, g)
+		}
+	}
+	if uint32(len(backups)) > apb {
+		return fmt.Errorf("ext4: too many backup groups for the resize inode")
+	}
+	descBlocks := first + extra
+	for j := uint32(0); j < uint32(sb.ReservedGdtBlocks); j++ {
+		pblk := base + uint64(descBlocks+j)
+		ind := make([]byte, v.bs)
+		for k, g := range backups {
+			blk := pblk + uint64(g)*uint64(sb.BlocksPerGroup)
+			binary.LittleEndian.PutUint32(ind[k*4:], uint32(blk))
+		}
+		if err := v.writeBlock(pblk, ind); err != nil {
+			return err
+		}
+	}
+	if err := v.writeBlock(dindBlk, dind); err != nil {
+		return err
+	}
+	r := uint64(sb.ReservedGdtBlocks)
+	in.setBlocks(sb, (1+r+r*uint64(len(backups)))*uint64(v.bs/512))
+	return v.writeInode(resizeIno, in)
+}
+
+// zeroBlocks overwrites n blocks starting at blk with zeros.
+func (v *volume) zeroBlocks(blk, n uint64) error {
+	const chunk = 256
+	buf := make([]byte, v.bs*chunk)
+	for n > 0 {
+		c := n
+		if c > chunk {
+			c = chunk
+		}
+		if _, err := v.dev.WriteAt(buf[:int64(c)*v.bs], int64(blk)*v.bs); err != nil {
+			return fmt.Errorf("ext4: zeroing blocks: %w", err)
+		}
+		blk += c
+		n -= c
+	}
+	return nil
+}
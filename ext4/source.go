@@ -0,0 +1,226 @@
+package ext4
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whiteout names used by OCI image layers.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// paxXattrPrefix prefixes extended attributes in PAX headers.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// AddDirectory adds the contents of the host directory root, preserving
+// modes, ownership, timestamps, hard links, device nodes and extended
+// attributes. Ownership of device nodes and files not owned by the caller
+// is only preserved as far as the host reports it.
+func (b *Builder) AddDirectory(root string) error {
+	type fileID struct{ dev, ino uint64 }
+	links := map[fileID]string{}
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		e := &Entry{
+			Path:    rel,
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			e.UID, e.GID = st.Uid, st.Gid
+			if !info.IsDir() && st.Nlink > 1 {
+				id := fileID{uint64(st.Dev), uint64(st.Ino)}
+				if target, ok := links[id]; ok {
+					return b.Link(rel, target)
+				}
+				links[id] = rel
+			}
+			if info.Mode()&os.ModeDevice != 0 {
+				e.Devmajor = unix.Major(uint64(st.Rdev))
+				e.Devminor = unix.Minor(uint64(st.Rdev))
+			}
+		}
+		if e.Xattrs, err = listXattrs(p); err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if e.Linkname, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return b.Add(e, f)
+		}
+		return b.Add(e, nil)
+	})
+}
+
+// listXattrs returns the extended attributes of the file at p without
+// following symbolic links.
+func listXattrs(p string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size == 0 {
+		// File systems without xattr support have nothing to copy.
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(p, buf)
+	if err != nil {
+		return nil, fmt.Errorf("ext4: listing xattrs of %s: %w", p, err)
+	}
+	attrs := map[string][]byte{}
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(p, name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("ext4: reading xattr %s of %s: %w", name, p, err)
+		}
+		value := make([]byte, vsize)
+		if vsize > 0 {
+			if vsize, err = unix.Lgetxattr(p, name, value); err != nil {
+				return nil, fmt.Errorf("ext4: reading xattr %s of %s: %w", name, p, err)
+			}
+		}
+		attrs[name] = value[:vsize]
+	}
+	return attrs, nil
+}
+
+// AddTar adds the contents of a tar archive, which may be compressed with
+// gzip or bzip2. Entries replace objects added earlier at the same path.
+func (b *Builder) AddTar(r io.Reader) error {
+	return b.addTar(r, false)
+}
+
+// AddLayer applies an OCI image layer on top of the objects added so far.
+// Whiteout entries remove files of earlier layers and opaque whiteouts
+// hide the earlier contents of a directory. Layers must be added in order,
+// starting with the base layer.
+func (b *Builder) AddLayer(r io.Reader) error {
+	b.layer++
+	return b.addTar(r, true)
+}
+
+// decompress detects gzip and bzip2 compressed streams.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	}
+	return br, nil
+}
+
+func (b *Builder) addTar(r io.Reader, layer bool) error {
+	r, err := decompress(r)
+	if err != nil {
+		return fmt.Errorf("ext4: %w", err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("ext4: reading tar: %w", err)
+		}
+		name := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(name)
+		if layer && strings.HasPrefix(base, whiteoutPrefix) {
+			if err := b.whiteout(dir, base); err != nil {
+				return err
+			}
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			if err := b.Link(name, hdr.Linkname); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeSymlink,
+			tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		default:
+			continue
+		}
+		e := &Entry{
+			Path:       name,
+			Mode:       hdr.FileInfo().Mode(),
+			UID:        uint32(hdr.Uid),
+			GID:        uint32(hdr.Gid),
+			ModTime:    hdr.ModTime,
+			AccessTime: hdr.AccessTime,
+			ChangeTime: hdr.ChangeTime,
+			Size:       hdr.Size,
+			Linkname:   hdr.Linkname,
+			Devmajor:   uint32(hdr.Devmajor),
+			Devminor:   uint32(hdr.Devminor),
+		}
+		for k, v := range hdr.PAXRecords {
+			if strings.HasPrefix(k, paxXattrPrefix) {
+				if e.Xattrs == nil {
+					e.Xattrs = map[string][]byte{}
+				}
+				e.Xattrs[strings.TrimPrefix(k, paxXattrPrefix)] = []byte(v)
+			}
+		}
+		if err := b.Add(e, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// whiteout handles the whiteout entry base in dir.
+func (b *Builder) whiteout(dir, base string) error {
+	if base != whiteoutOpaque {
+		return b.Remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+	}
+	p, err := cleanPath(dir)
+	if err != nil {
+		return err
+	}
+	d, err := b.lookupDir(p, true)
+	if err != nil {
+		return err
+	}
+	for name, child := range d.children {
+		if child.layer < b.layer {
+			delete(d.children, name)
+			b.unref(child)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+// Package ext4 reads, writes and resizes ext4 file system images without
+// mounting them.
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	superblockOffset = 1024
+	superblockSize   = 1024
+	superblockMagic  = 0xef53
+)
+
+// Compatible feature flags.
+const (
+	featureCompatDirPrealloc  = 0x0001
+	featureCompatHasJournal   = 0x0004
+	featureCompatExtAttr      = 0x0008
+	featureCompatResizeInode  = 0x0010
+	featureCompatDirIndex     = 0x0020
+	featureCompatSparseSuper2 = 0x0200
+)
+
+// Incompatible feature flags.
+const (
+	featureIncompatFiletype    = 0x0002
+	featureIncompatRecover     = 0x0004
+	featureIncompatJournalDev  = 0x0008
+	featureIncompatMetaBG      = 0x0010
+	featureIncompatExtents     = 0x0040
+	featureIncompat64Bit       = 0x0080
+	featureIncompatMMP         = 0x0100
+	featureIncompatFlexBG      = 0x0200
+	featureIncompatEAInode     = 0x0400
+	featureIncompatDirData     = 0x1000
+	featureIncompatCsumSeed    = 0x2000
+	featureIncompatLargeDir    = 0x4000
+	featureIncompatInlineData  = 0x8000
+	featureIncompatEncrypt     = 0x10000
+	featureIncompatCasefold    = 0x20000
+	featureIncompatSupported   = featureIncompatFiletype | featureIncompatRecover | featureIncompatMetaBG | featureIncompatExtents | featureIncompat64Bit | featureIncompatFlexBG | featureIncompatCsumSeed | featureIncompatLargeDir | featureIncompatMMP | featureIncompatInlineData | featureIncompatEncrypt | featureIncompatCasefold | featureIncompatEAInode
+	featureIncompatWriteable   = featureIncompatFiletype | featureIncompatExtents | featureIncompat64Bit | featureIncompatFlexBG | featureIncompatCsumSeed | featureIncompatLargeDir
+	featureIncompatResizeable  = featureIncompatWriteable | featureIncompatInlineData | featureIncompatEncrypt | featureIncompatCasefold | featureIncompatEAInode
+	featureIncompatUnsupported = ^uint32(featureIncompatSupported)
+)
+
+// Read-only compatible feature flags.
+const (
+	featureROCompatSparseSuper   = 0x0001
+	featureROCompatLargeFile     = 0x0002
+	featureROCompatHugeFile      = 0x0008
+	featureROCompatGdtCsum       = 0x0010
+	featureROCompatDirNlink      = 0x0020
+	featureROCompatExtraIsize    = 0x0040
+	featureROCompatQuota         = 0x0100
+	featureROCompatBigalloc      = 0x0200
+	featureROCompatMetadataCsum  = 0x0400
+	featureROCompatReadonly      = 0x1000
+	featureROCompatProject       = 0x2000
+	featureROCompatVerity        = 0x8000
+	featureROCompatOrphanPresent = 0x10000
+)
+
+const (
+	stateValid  = 0x0001
+	stateErrors = 0x0002
+)
+
+// superblock is the on-disk layout of the ext4 superblock.
+type superblock struct {
+	InodesCount       uint32
+	BlocksCountLo     uint32
+	RBlocksCountLo    uint32
+	FreeBlocksCountLo uint32
+	FreeInodesCount   uint32
+	FirstDataBlock    uint32
+	LogBlockSize      uint32
+	LogClusterSize    uint32
+	BlocksPerGroup    uint32
+	ClustersPerGroup  uint32
+	InodesPerGroup    uint32
+	Mtime             uint32
+	Wtime             uint32
+	MntCount          uint16
+	MaxMntCount       uint16
+	Magic             uint16
+	State             uint16
+	Errors            uint16
+	MinorRevLevel     uint16
+	Lastcheck         uint32
+	Checkinterval     uint32
+	CreatorOS         uint32
+	RevLevel          uint32
+	DefResuid         uint16
+	DefResgid         uint16
+	FirstIno          uint32
+	InodeSize         uint16
+	BlockGroupNr      uint16
+	FeatureCompat     uint32
+	FeatureIncompat   uint32
+	FeatureROCompat   uint32
+	UUID              [16]byte
+	VolumeName        [16]byte
+	LastMounted       [64]byte
+	AlgorithmBitmap   uint32
+	PreallocBlocks    uint8
+	PreallocDirBlocks uint8
+	ReservedGdtBlocks uint16
+	JournalUUID       [16]byte
+	JournalInum       uint32
+	JournalDev        uint32
+	LastOrphan        uint32
+	HashSeed          [4]uint32
+	DefHashVersion    uint8
+	JnlBackupType     uint8
+	DescSize          uint16
+	DefaultMountOpts  uint32
+	FirstMetaBg       uint32
+	MkfsTime          uint32
+	JnlBlocks         [17]uint32
+	BlocksCountHi     uint32
+	RBlocksCountHi    uint32
+	FreeBlocksCountHi uint32
+	MinExtraIsize     uint16
+	WantExtraIsize    uint16
+	Flags             uint32
+	RaidStride        uint16
+	MmpInterval       uint16
+	MmpBlock          uint64
+	RaidStripeWidth   uint32
+	LogGroupsPerFlex  uint8
+	ChecksumType      uint8
+	EncryptionLevel   uint8
+	ReservedPad       uint8
+	KbytesWritten     uint64
+	SnapshotInum      uint32
+	SnapshotID        uint32
+	SnapshotRBlocks   uint64
+	SnapshotList      uint32
+	ErrorCount        uint32
+	FirstErrorTime    uint32
+	FirstErrorIno     uint32
+	FirstErrorBlock   uint64
+	FirstErrorFunc    [32]byte
+	FirstErrorLine    uint32
+	LastErrorTime     uint32
+	LastErrorIno      uint32
+	LastErrorLine     uint32
+	LastErrorBlock    uint64
+	LastErrorFunc     [32]byte
+	MountOpts         [64]byte
+	UsrQuotaInum      uint32
+	GrpQuotaInum      uint32
+	OverheadClusters  uint32
+	BackupBgs         [2]uint32
+	EncryptAlgos      [4]uint8
+	EncryptPwSalt     [16]byte
+	LpfIno            uint32
+	PrjQuotaInum      uint32
+	ChecksumSeed      uint32
+	TimeHi            [8]uint8
+	Encoding          uint16
+	EncodingFlags     uint16
+	OrphanFileInum    uint32
+	Reserved          [94]uint32
+	Checksum          uint32
+}
+
+var (
+	// ErrNotExt4 is returned when a device does not hold an ext2/3/4 superblock.
+	ErrNotExt4 = errors.New("ext4: bad superblock magic")
+
+	// ErrUnsupported is returned for file systems using features this package cannot handle.
+	ErrUnsupported = errors.New("ext4: unsupported file system feature")
+
+	// ErrNotClean is returned when the file system was not cleanly unmounted
+	// or has a journal that needs recovery.
+	ErrNotClean = errors.New("ext4: file system is not clean")
+
+	// ErrChecksum is returned when on-disk metadata fails checksum verification.
+	ErrChecksum = errors.New("ext4: checksum mismatch")
+)
+
+// Probe reports whether dev holds an ext2, ext3 or ext4 file system.
+func Probe(dev io.ReaderAt) bool {
+	_, err := readSuperblock(dev, superblockOffset)
+	return err == nil
+}
+
+func readSuperblock(r io.ReaderAt, off int64) (*superblock, error) {
+	buf := make([]byte, superblockSize)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil, fmt.Errorf("ext4: reading superblock: %w", err)
+	}
+	sb := &superblock{}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, sb); err != nil {
+		return nil, err
+	}
+	if sb.Magic != superblockMagic {
+		return nil, ErrNotExt4
+	}
+	if sb.hasROCompat(featureROCompatMetadataCsum) && sb.checksum() != sb.Checksum {
+		return nil, fmt.Errorf("superblock: %w", ErrChecksum)
+	}
+	if sb.LogBlockSize > 6 || sb.BlocksPerGroup == 0 || sb.InodesPerGroup == 0 {
+		return nil, fmt.Errorf("ext4: corrupt superblock geometry")
+	}
+	return sb, nil
+}
+
+func (sb *superblock) bytes() []byte {
+	var buf bytes.Buffer
+	buf.Grow(superblockSize)
+	binary.Write(&buf, binary.LittleEndian, sb)
+	return buf.Bytes()
+}
+
+func (sb *superblock) checksum() uint32 {
+	b := sb.bytes()
+	return crc32c(^uint32(0), b[:superblockSize-4])
+}
+
+// updateChecksum recomputes the superblock checksum when metadata_csum is enabled.
+func (sb *superblock) updateChecksum() {
+	if sb.hasROCompat(featureROCompatMetadataCsum) {
+		sb.Checksum = sb.checksum()
+	}
+}
+
+func (sb *superblock) hasCompat(f uint32) bool   { return sb.FeatureCompat&f != 0 }
+func (sb *superblock) hasIncompat(f uint32) bool { return sb.FeatureIncompat&f != 0 }
+func (sb *superblock) hasROCompat(f uint32) bool { return sb.FeatureROCompat&f != 0 }
+
+func (sb *superblock) blockSize() int64 {
+	return 1024 << sb.LogBlockSize
+}
+
+func (sb *superblock) blocksCount() uint64 {
+	n := uint64(sb.BlocksCountLo)
+	if sb.hasIncompat(featureIncompat64Bit) {
+		n |= uint64(sb.BlocksCountHi) << 32
+	}
+	return n
+}
+
+func (sb *superblock) setBlocksCount(n uint64) {
+	sb.BlocksCountLo = uint32(n)
+	if sb.hasIncompat(featureIncompat64Bit) {
+		sb.BlocksCountHi = uint32(n >> 32)
+	}
+}
+
+func (sb *superblock) rBlocksCount() uint64 {
+	n := uint64(sb.RBlocksCountLo)
+	if sb.hasIncompat(featureIncompat64Bit) {
+		n |= uint64(sb.RBlocksCountHi) << 32
+	}
+	return n
+}
+
+func (sb *superblock) setRBlocksCount(n uint64) {
+	sb.RBlocksCountLo = uint32(n)
+	if sb.hasIncompat(featureIncompat64Bit) {
+		sb.RBlocksCountHi = uint32(n >> 32)
+	}
+}
+
+func (sb *superblock) freeBlocksCount() uint64 {
+	n := uint64(sb.FreeBlocksCountLo)
+	if sb.hasIncompat(featureIncompat64Bit) {
+		n |= uint64(sb.FreeBlocksCountHi) << 32
+	}
+	return n
+}
+
+func (sb *superblock) setFreeBlocksCount(n uint64) {
+	sb.FreeBlocksCountLo = uint32(n)
+	if sb.hasIncompat(featureIncompat64Bit) {
+		sb.FreeBlocksCountHi = uint32(n >> 32)
+	}
+}
+
+func (sb *superblock) descSize() int {
+	if sb.hasIncompat(featureIncompat64Bit) && sb.DescSize >= 64 {
+		return int(sb.DescSize)
+	}
+	return 32
+}
+
+func (sb *superblock) inodeSize() int {
+	if sb.RevLevel == 0 {
+		return 128
+	}
+	return int(sb.InodeSize)
+}
+
+func (sb *superblock) firstIno() uint32 {
+	if sb.RevLevel == 0 {
+		return 11
+	}
+	return sb.FirstIno
+}
+
+func (sb *superblock) groupCount() uint32 {
+	return groupCount(sb.blocksCount(), sb.FirstDataBlock, sb.BlocksPerGroup)
+}
+
+func groupCount(blocks uint64, first, perGroup uint32) uint32 {
+	return uint32((blocks - uint64(first) + uint64(perGroup) - 1) / uint64(perGroup))
+}
+
+// groupDescBlocks returns the number of blocks used by the group descriptor table for n groups.
+func (sb *superblock) groupDescBlocks(n uint32) uint32 {
+	perBlock := uint32(sb.blockSize()) / uint32(sb.descSize())
+	return (n + perBlock - 1) / perBlock
+}
+
+// csumSeed returns the seed for metadata checksums.
+func (sb *superblock) csumSeed() uint32 {
+	if sb.hasIncompat(featureIncompatCsumSeed) {
+		return sb.ChecksumSeed
+	}
+	return crc32c(^uint32(0), sb.UUID[:])
+}
+
+// hasGroupCsum reports whether group descriptors carry checksums.
+func (sb *superblock) hasGroupCsum() bool {
+	return sb.hasROCompat(featureROCompatMetadataCsum) || sb.hasROCompat(featureROCompatGdtCsum)
+}
+
+// groupHasSuper reports whether group g holds a backup of the superblock and group descriptors.
+func (sb *superblock) groupHasSuper(g uint32) bool {
+	if g == 0 {
+		return true
+	}
+	if sb.hasCompat(featureCompatSparseSuper2) {
+		return g == sb.BackupBgs[0] || g == sb.BackupBgs[1]
+	}
+	if g == 1 || !sb.hasROCompat(featureROCompatSparseSuper) {
+		return true
+	}
+	if g&1 == 0 {
+		return false
+	}
+	return isPower(g, 3) || isPower(g, 5) || isPower(g, 7)
+}
+
+func isPower(n, base uint32) bool {
+	for n > 1 {
+		if n%base != 0 {
+			return false
+		}
+		n /= base
+	}
+	return n == 1
+}
+
+// groupFirstBlock returns the first block of group g.
+func (sb *superblock) groupFirstBlock(g uint32) uint64 {
+	return uint64(sb.FirstDataBlock) + uint64(g)*uint64(sb.BlocksPerGroup)
+}
+
+// groupBlocks returns the number of blocks in group g, which is smaller
+// than BlocksPerGroup for the last group.
+func (sb *superblock) groupBlocks(g uint32) uint32 {
+	start := sb.groupFirstBlock(g)
+	if rest := sb.blocksCount() - start; rest < uint64(sb.BlocksPerGroup) {
+		return uint32(rest)
+	}
+	return sb.BlocksPerGroup
+}
+
+// inodeTableBlocks returns the number of blocks used by the inode table of one group.
+func (sb *superblock) inodeTableBlocks() uint32 {
+	n := uint64(sb.InodesPerGroup) * uint64(sb.inodeSize())
+	return uint32((n + uint64(sb.blockSize()) - 1) / uint64(sb.blockSize()))
+}
+
+// superOverhead returns the number of blocks at the start of group g used
+// by the superblock and group descriptor backups, including reserved
+// descriptor blocks.
+func (sb *superblock) superOverhead(g uint32) uint32 {
+	var n uint32
+	if sb.groupHasSuper(g) {
+		n = 1
+	}
+	perBlock := uint32(sb.blockSize()) / uint32(sb.descSize())
+	if !sb.hasIncompat(featureIncompatMetaBG) || g/perBlock < sb.FirstMetaBg {
+		if n == 0 {
+			return 0
+		}
+		old := sb.groupDescBlocks(sb.groupCount()) + uint32(sb.ReservedGdtBlocks)
+		if sb.hasIncompat(featureIncompatMetaBG) {
+			old = sb.FirstMetaBg
+		}
+		return n + old
+	}
+	if rel := g % perBlock; rel == 0 || rel == 1 || rel == perBlock-1 {
+		n++
+	}
+	return n
+}
+
+func init() {
+	if n := binary.Size(superblock{}); n != superblockSize {
+		panic(fmt.Sprintf("ext4: superblock layout is %d bytes", n))
+	}
+}
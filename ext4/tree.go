@@ -0,0 +1,479 @@
+package ext4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// File mode type bits.
+const (
+	sIFMT   = 0xf000
+	sIFSOCK = 0xc000
+	sIFLNK  = 0xa000
+	sIFREG  = 0x8000
+	sIFBLK  = 0x6000
+	sIFDIR  = 0x4000
+	sIFCHR  = 0x2000
+	sIFIFO  = 0x1000
+	sISUID  = 0x0800
+	sISGID  = 0x0400
+	sISVTX  = 0x0200
+)
+
+// maxFastSymlink is the longest symlink target stored inside the inode.
+const maxFastSymlink = 59
+
+// Entry describes a file system object added to a Builder.
+type Entry struct {
+	// Path is the slash-separated path of the object relative to the root
+	// of the file system. Missing parent directories are created.
+	Path string
+
+	// Mode holds the type and permission bits, including setuid, setgid
+	// and sticky bits.
+	Mode fs.FileMode
+
+	UID uint32
+	GID uint32
+
+	// ModTime is used for AccessTime and ChangeTime when they are zero.
+	// A zero ModTime is replaced by the builder timestamp.
+	ModTime    time.Time
+	AccessTime time.Time
+	ChangeTime time.Time
+
+	// Size is the length of a regular file.
+	Size int64
+
+	// Linkname is the target of a symbolic link.
+	Linkname string
+
+	// Devmajor and Devminor identify character and block devices.
+	Devmajor uint32
+	Devminor uint32
+
+	// Xattrs maps full extended attribute names, e.g. "security.capability",
+	// to their values.
+	Xattrs map[string][]byte
+}
+
+// node is a file system object of the tree being built. Hard links share a node.
+type node struct {
+	ino      uint32
+	mode     uint16
+	uid, gid uint32
+	atime    time.Time
+	mtime    time.Time
+	ctime    time.Time
+	size     uint64
+	exts     []extent
+	target   string
+	devmajor uint32
+	devminor uint32
+	xattrs   []xattr
+
+	// refs is the number of directory entries referencing the node.
+	refs     uint32
+	children map[string]*node
+
+	// layer is the AddLayer call that last created or updated the node.
+	layer int
+}
+
+func newDirNode(perm uint16, now time.Time) *node {
+	return &node{
+		mode:     sIFDIR | perm,
+		atime:    now,
+		mtime:    now,
+		ctime:    now,
+		children: map[string]*node{},
+	}
+}
+
+func (n *node) isDir() bool {
+	return n.mode&sIFMT == sIFDIR
+}
+
+func (n *node) link(name string, child *node) {
+	n.children[name] = child
+	child.refs++
+}
+
+func (n *node) fileType() uint8 {
+	switch n.mode & sIFMT {
+	case sIFREG:
+		return ftRegular
+	case sIFDIR:
+		return ftDir
+	case sIFCHR:
+		return ftCharDev
+	case sIFBLK:
+		return ftBlockDev
+	case sIFIFO:
+		return ftFifo
+	case sIFSOCK:
+		return ftSocket
+	case sIFLNK:
+		return ftSymlink
+	}
+	return ftUnknown
+}
+
+// sortedNames returns the names of the children of n in sorted order.
+func (n *node) sortedNames() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unixMode converts m to the ext4 i_mode representation.
+func unixMode(m fs.FileMode) uint16 {
+	mode := uint16(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= sISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= sISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= sISVTX
+	}
+	switch {
+	case m.IsDir():
+		mode |= sIFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= sIFLNK
+	case m&fs.ModeCharDevice != 0:
+		mode |= sIFCHR
+	case m&fs.ModeDevice != 0:
+		mode |= sIFBLK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= sIFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= sIFSOCK
+	default:
+		mode |= sIFREG
+	}
+	return mode
+}
+
+// cleanPath normalizes p to a slash-separated path without leading slash.
+// The root directory is returned as the empty string.
+func cleanPath(p string) (string, error) {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	for _, elem := range strings.Split(p, "/") {
+		if len(elem) > maxNameLen {
+			return "", fmt.Errorf("ext4: file name %q too long", elem)
+		}
+	}
+	return p, nil
+}
+
+// lookupDir returns the directory node at the clean path p, creating
+// missing directories when create is true. Both "" and "." refer to the root.
+func (b *Builder) lookupDir(p string, create bool) (*node, error) {
+	dir := b.root
+	if p == "" || p == "." {
+		return dir, nil
+	}
+	for _, elem := range strings.Split(p, "/") {
+		child, ok := dir.children[elem]
+		if !ok {
+			if !create {
+				return nil, fmt.Errorf("ext4: %s: %w", p, fs.ErrNotExist)
+			}
+			child = newDirNode(0755, b.now)
+			child.layer = b.layer
+			dir.link(elem, child)
+		}
+		if !child.isDir() {
+			return nil, fmt.Errorf("ext4: %s: not a directory", p)
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+func (b *Builder) setMeta(n *node, e *Entry) error {
+	attrs, err := makeXattrs(e.Xattrs)
+	if err != nil {
+		return err
+	}
+	if entries, values := xattrsSize(attrs); len(attrs) > 0 && xattrHeaderSize+entries+values > int(b.blockSize) {
+		return errXattrTooLarge
+	}
+	n.mode = unixMode(e.Mode)
+	n.uid, n.gid = e.UID, e.GID
+	n.mtime = e.ModTime
+	if n.mtime.IsZero() {
+		n.mtime = b.now
+	}
+	n.atime, n.ctime = e.AccessTime, e.ChangeTime
+	if n.atime.IsZero() {
+		n.atime = n.mtime
+	}
+	if n.ctime.IsZero() {
+		n.ctime = n.mtime
+	}
+	n.xattrs = attrs
+	n.layer = b.layer
+	return nil
+}
+
+// Add adds the object described by e. For regular files Size bytes of
+// content are read from r; r is ignored for all other types. An existing
+// object at the same path is replaced, except that adding a directory over
+// a directory only updates its metadata.
+func (b *Builder) Add(e *Entry, r io.Reader) error {
+	if b.closed {
+		return errors.New("ext4: builder is closed")
+	}
+	p, err := cleanPath(e.Path)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		if !e.Mode.IsDir() {
+			return errors.New("ext4: root must be a directory")
+		}
+		if err := b.setMeta(b.root, e); err != nil {
+			return fmt.Errorf("ext4: /: %w", err)
+		}
+		return nil
+	}
+	parent, err := b.lookupDir(path.Dir(p), true)
+	if err != nil {
+		return err
+	}
+	name := path.Base(p)
+	if old, ok := parent.children[name]; ok {
+		if old.isDir() && e.Mode.IsDir() {
+			if err := b.setMeta(old, e); err != nil {
+				return fmt.Errorf("ext4: %s: %w", p, err)
+			}
+			return nil
+		}
+		delete(parent.children, name)
+		b.unref(old)
+	}
+	n := &node{}
+	if err := b.setMeta(n, e); err != nil {
+		return fmt.Errorf("ext4: %s: %w", p, err)
+	}
+	switch n.mode & sIFMT {
+	case sIFDIR:
+		n.children = map[string]*node{}
+	case sIFREG:
+		if e.Size < 0 {
+			return fmt.Errorf("ext4: %s: negative size", p)
+		}
+		if err := b.writeData(n, r, e.Size); err != nil {
+			b.freeExtents(n)
+			if err == ErrNoSpace {
+				return err
+			}
+			return fmt.Errorf("ext4: %s: %w", p, err)
+		}
+	case sIFLNK:
+		n.target = e.Linkname
+		if len(n.target) > maxFastSymlink {
+			if len(n.target) >= int(b.blockSize) {
+				return fmt.Errorf("ext4: %s: symlink target too long", p)
+			}
+			if err := b.writeData(n, strings.NewReader(n.target), int64(len(n.target))); err != nil {
+				b.freeExtents(n)
+				return err
+			}
+		}
+	case sIFCHR, sIFBLK:
+		n.devmajor, n.devminor = e.Devmajor, e.Devminor
+	}
+	parent.link(name, n)
+	return nil
+}
+
+// Link adds a hard link at p to the existing non-directory object at target.
+func (b *Builder) Link(p, target string) error {
+	tp, err := cleanPath(target)
+	if err != nil {
+		return err
+	}
+	tdir, err := b.lookupDir(path.Dir(tp), false)
+	if err != nil {
+		return err
+	}
+	n, ok := tdir.children[path.Base(tp)]
+	if !ok || tp == "" {
+		return fmt.Errorf("ext4: link target %s: %w", target, fs.ErrNotExist)
+	}
+	if n.isDir() {
+		return fmt.Errorf("ext4: link target %s is a directory", target)
+	}
+	p, err = cleanPath(p)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return errors.New("ext4: cannot replace the root directory")
+	}
+	parent, err := b.lookupDir(path.Dir(p), true)
+	if err != nil {
+		return err
+	}
+	name := path.Base(p)
+	if old, ok := parent.children[name]; ok {
+		if old == n {
+			return nil
+		}
+		delete(parent.children, name)
+		b.unref(old)
+	}
+	parent.link(name, n)
+	return nil
+}
+
+// Remove removes the object at p, including all children of a directory.
+// Removing a path that does not exist is not an error.
+func (b *Builder) Remove(p string) error {
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return errors.New("ext4: cannot remove the root directory")
+	}
+	parent, err := b.lookupDir(path.Dir(p), false)
+	if err != nil {
+		return nil
+	}
+	name := path.Base(p)
+	if n, ok := parent.children[name]; ok {
+		delete(parent.children, name)
+		b.unref(n)
+	}
+	return nil
+}
+
+// unref drops a directory entry reference to n and frees its blocks once
+// it is no longer referenced.
+func (b *Builder) unref(n *node) {
+	n.refs--
+	if n.refs > 0 {
+		return
+	}
+	b.freeExtents(n)
+	for name, child := range n.children {
+		delete(n.children, name)
+		b.unref(child)
+	}
+}
+
+// freeExtents releases the data blocks of n.
+func (b *Builder) freeExtents(n *node) {
+	for _, e := range n.exts {
+		b.alloc.release(e.physical, uint64(e.length))
+	}
+	n.exts = nil
+}
+
+// writeData streams size bytes from r into newly allocated blocks of n.
+// Blocks consisting entirely of zeros are left as holes.
+func (b *Builder) writeData(n *node, r io.Reader, size int64) error {
+	const chunkBlocks = 256
+	bs := b.blockSize
+	total := uint64((size + bs - 1) / bs)
+	if total > 1<<32 {
+		return errors.New("file too large")
+	}
+	buf := make([]byte, chunkBlocks*bs)
+	var (
+		logical            uint32
+		runStart, runLen   uint64
+		batchStart, batchN uint64
+		batch              []byte
+	)
+	// Give back the unused rest of the last allocated run.
+	defer func() {
+		b.alloc.release(runStart, runLen)
+	}()
+	flush := func() error {
+		if batchN == 0 {
+			return nil
+		}
+		_, err := b.dev.WriteAt(batch, int64(batchStart)*bs)
+		batch, batchN = batch[:0], 0
+		return err
+	}
+	remaining := size
+	for remaining > 0 {
+		want := int64(len(buf))
+		if remaining < want {
+			want = remaining
+		}
+		if _, err := io.ReadFull(r, buf[:want]); err != nil {
+			return err
+		}
+		blocks := (want + bs - 1) / bs
+		for i := want; i < blocks*bs; i++ {
+			buf[i] = 0
+		}
+		for i := int64(0); i < blocks; i++ {
+			blk := buf[i*bs : (i+1)*bs]
+			if isZero(blk) {
+				logical++
+				continue
+			}
+			if runLen == 0 {
+				var err error
+				runStart, runLen, err = b.alloc.allocRun(total - uint64(logical))
+				if err != nil {
+					return err
+				}
+			}
+			phys := runStart
+			runStart++
+			runLen--
+			n.exts = appendExtent(n.exts, logical, phys)
+			logical++
+			if batchN > 0 && batchStart+batchN != phys {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if batchN == 0 {
+				batchStart = phys
+			}
+			batch = append(batch, blk...)
+			batchN++
+			if batchN == chunkBlocks {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		remaining -= want
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	n.size = uint64(size)
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+package ext4
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Device is the storage an ext4 file system lives on, typically a
+// partition of a raw disk image.
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// volume holds the superblock and group descriptors of an ext4 file system.
+type volume struct {
+	dev    Device
+	sb     *superblock
+	groups []groupDesc
+	bs     int64
+
+	// clock is the time modifications record, or zero for the current
+	// time.
+	clock time.Time
+}
+
+func openVolume(dev Device) (*volume, error) {
+	sb, err := readSuperblock(dev, superblockOffset)
+	if err != nil {
+		return nil, err
+	}
+	if sb.FeatureIncompat&featureIncompatUnsupported != 0 {
+		return nil, fmt.Errorf("incompatible features %#x: %w",
+			sb.FeatureIncompat&featureIncompatUnsupported, ErrUnsupported)
+	}
+	if sb.hasROCompat(featureROCompatBigalloc) {
+		return nil, fmt.Errorf("bigalloc: %w", ErrUnsupported)
+	}
+	groups, err := readGroupDescs(dev, sb)
+	if err != nil {
+		return nil, err
+	}
+	return &volume{
+		dev:    dev,
+		sb:     sb,
+		groups: groups,
+		bs:     sb.blockSize(),
+	}, nil
+}
+
+func (v *volume) readBlock(blk uint64) ([]byte, error) {
+	buf := make([]byte, v.bs)
+	if _, err := v.dev.ReadAt(buf, int64(blk)*v.bs); err != nil {
+		return nil, fmt.Errorf("ext4: reading block %d: %w", blk, err)
+	}
+	return buf, nil
+}
+
+func (v *volume) writeBlock(blk uint64, b []byte) error {
+	if _, err := v.dev.WriteAt(b, int64(blk)*v.bs); err != nil {
+		return fmt.Errorf("ext4: writing block %d: %w", blk, err)
+	}
+	return nil
+}
+
+// inodeOffset returns the byte offset of inode ino on the device.
+func (v *volume) inodeOffset(ino uint32) (int64, error) {
+	if ino == 0 || ino > v.sb.InodesCount {
+		return 0, fmt.Errorf("ext4: inode %d out of range", ino)
+	}
+	g := (ino - 1) / v.sb.InodesPerGroup
+	idx := (ino - 1) % v.sb.InodesPerGroup
+	return int64(v.groups[g].InodeTable)*v.bs + int64(idx)*int64(v.sb.inodeSize()), nil
+}
+
+// readInodeRaw reads the raw on-disk bytes of inode ino.
+func (v *volume) readInodeRaw(ino uint32) ([]byte, error) {
+	off, err := v.inodeOffset(ino)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, v.sb.inodeSize())
+	if _, err := v.dev.ReadAt(b, off); err != nil {
+		return nil, fmt.Errorf("ext4: reading inode %d: %w", ino, err)
+	}
+	if !v.sb.verifyInodeChecksum(ino, b) {
+		return nil, fmt.Errorf("inode %d: %w", ino, ErrChecksum)
+	}
+	return b, nil
+}
+
+func (v *volume) readInode(ino uint32) (*inode, error) {
+	b, err := v.readInodeRaw(ino)
+	if err != nil {
+		return nil, err
+	}
+	return decodeInode(b), nil
+}
+
+// writeInode encodes in over the current on-disk inode ino, preserving
+// in-inode extended attributes, and updates its checksum.
+func (v *volume) writeInode(ino uint32, in *inode) error {
+	off, err := v.inodeOffset(ino)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, v.sb.inodeSize())
+	if _, err := v.dev.ReadAt(b, off); err != nil {
+		return fmt.Errorf("ext4: reading inode %d: %w", ino, err)
+	}
+	in.encode(b)
+	return v.writeInodeRaw(ino, b)
+}
+
+func (v *volume) writeInodeRaw(ino uint32, b []byte) error {
+	off, err := v.inodeOffset(ino)
+	if err != nil {
+		return err
+	}
+	v.sb.setInodeChecksum(ino, b)
+	if _, err := v.dev.WriteAt(b, off); err != nil {
+		return fmt.Errorf("ext4: writing inode %d: %w", ino, err)
+	}
+	return nil
+}
+
+// blockBitmap returns the block bitmap of group g. For groups flagged
+// BLOCK_UNINIT the bitmap is computed from the group layout.
+func (v *volume) blockBitmap(g uint32) ([]byte, error) {
+	d := &v.groups[g]
+	if v.sb.hasGroupCsum() && d.Flags&bgBlockUninit != 0 {
+		return v.initBlockBitmap(g), nil
+	}
+	return v.readBlock(d.BlockBitmap)
+}
+
+// initBlockBitmap computes the bitmap of an uninitialized group: the
+// superblock and descriptor backups, any bitmaps and inode tables of the
+// flex group stored in it, and the padding past the end of the group.
+func (v *volume) initBlockBitmap(g uint32) []byte {
+	bm := make([]byte, v.bs)
+	for i := uint32(0); i < v.sb.superOverhead(g); i++ {
+		setBit(bm, i)
+	}
+	start := v.sb.groupFirstBlock(g)
+	end := start + uint64(v.sb.groupBlocks(g))
+	mark := func(blk uint64, n uint64) {
+		for b := blk; b < blk+n; b++ {
+			if b >= start && b < end {
+				setBit(bm, uint32(b-start))
+			}
+		}
+	}
+	itb := uint64(v.sb.inodeTableBlocks())
+	for i := range v.groups {
+		d := &v.groups[i]
+		mark(d.BlockBitmap, 1)
+		mark(d.InodeBitmap, 1)
+		mark(d.InodeTable, itb)
+	}
+	for i := v.sb.groupBlocks(g); i < uint32(v.bs*8); i++ {
+		setBit(bm, i)
+	}
+	return bm
+}
+
+// inodeBitmap returns the inode bitmap of group g. For groups flagged
+// INODE_UNINIT an empty bitmap with padding is returned.
+func (v *volume) inodeBitmap(g uint32) ([]byte, error) {
+	d := &v.groups[g]
+	if v.sb.hasGroupCsum() && d.Flags&bgInodeUninit != 0 {
+		bm := make([]byte, v.bs)
+		for i := v.sb.InodesPerGroup; i < uint32(v.bs*8); i++ {
+			setBit(bm, i)
+		}
+		return bm, nil
+	}
+	return v.readBlock(d.InodeBitmap)
+}
+
+// flush writes the superblock and group descriptor table. When backups is
+// true the copies in all backup groups are rewritten as well.
+func (v *volume) flush(backups bool) error {
+	sb := v.sb
+	gdt := encodeGroupDescs(sb, v.groups)
+	blocks := uint32(len(gdt) / int(v.bs))
+	for i := uint32(0); i < blocks; i++ {
+		if err := v.writeBlock(sb.groupDescLocation(i), gdt[int64(i)*v.bs:int64(i+1)*v.bs]); err != nil {
+			return err
+		}
+	}
+	sb.BlockGroupNr = 0
+	sb.updateChecksum()
+	if _, err := v.dev.WriteAt(sb.bytes(), superblockOffset); err != nil {
+		return fmt.Errorf("ext4: writing superblock: %w", err)
+	}
+	if !backups {
+		return nil
+	}
+	perBlock := uint32(v.bs) / uint32(sb.descSize())
+	metaBG := sb.hasIncompat(featureIncompatMetaBG)
+	for g := uint32(1); g < uint32(len(v.groups)); g++ {
+		start := sb.groupFirstBlock(g)
+		next := start
+		if sb.groupHasSuper(g) {
+			backup := *sb
+			backup.BlockGroupNr = uint16(g)
+			backup.updateChecksum()
+			if _, err := v.dev.WriteAt(backup.bytes(), int64(start)*v.bs); err != nil {
+				return fmt.Errorf("ext4: writing backup superblock: %w", err)
+			}
+			next++
+			if !metaBG || g/perBlock < sb.FirstMetaBg {
+				n := blocks
+				if metaBG {
+					n = sb.FirstMetaBg
+				}
+				if _, err := v.dev.WriteAt(gdt[:int64(n)*v.bs], int64(next)*v.bs); err != nil {
+					return fmt.Errorf("ext4: writing backup group descriptors: %w", err)
+				}
+				continue
+			}
+		}
+		if metaBG && g/perBlock >= sb.FirstMetaBg {
+			rel := g % perBlock
+			if rel == 1 || rel == perBlock-1 {
+				i := g / perBlock
+				if err := v.writeBlock(next, gdt[int64(i)*v.bs:int64(i+1)*v.bs]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func setBit(bm []byte, i uint32)       { bm[i/8] |= 1 << (i % 8) }
+func clearBit(bm []byte, i uint32)     { bm[i/8] &^= 1 << (i % 8) }
+func testBit(bm []byte, i uint32) bool { return bm[i/8]&(1<<(i%8)) != 0 }
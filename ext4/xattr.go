@@ -0,0 +1,224 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	xattrMagic      = 0xea020000
+	xattrHeaderSize = 32
+	xattrEntrySize  = 16
+)
+
+// Extended attribute name indexes.
+const (
+	xattrIndexUser         = 1
+	xattrIndexPOSIXAccess  = 2
+	xattrIndexPOSIXDefault = 3
+	xattrIndexTrusted      = 4
+	xattrIndexSecurity     = 6
+	xattrIndexSystem       = 7
+)
+
+var xattrPrefixes = []struct {
+	index  uint8
+	prefix string
+}{
+	{xattrIndexPOSIXAccess, "system.posix_acl_access"},
+	{xattrIndexPOSIXDefault, "system.posix_acl_default"},
+	{xattrIndexUser, "user."},
+	{xattrIndexTrusted, "trusted."},
+	{xattrIndexSecurity, "security."},
+	{xattrIndexSystem, "system."},
+}
+
+var errXattrTooLarge = errors.New("extended attributes do not fit into one block")
+
+// xattr is an extended attribute split into its name index and suffix.
+type xattr struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+// splitXattrName maps a full attribute name such as "user.foo" to its
+// on-disk index and suffix.
+func splitXattrName(name string) (uint8, string, error) {
+	for _, p := range xattrPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			suffix := name[len(p.prefix):]
+			if (p.index == xattrIndexPOSIXAccess || p.index == xattrIndexPOSIXDefault) && suffix != "" {
+				continue
+			}
+			return p.index, suffix, nil
+		}
+	}
+	return 0, "", fmt.Errorf("unsupported extended attribute namespace %q", name)
+}
+
+// makeXattrs converts a map of full attribute names to sorted on-disk attributes.
+func makeXattrs(m map[string][]byte) ([]xattr, error) {
+	attrs := make([]xattr, 0, len(m))
+	for name, value := range m {
+		index, suffix, err := splitXattrName(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(suffix) > maxNameLen {
+			return nil, fmt.Errorf("extended attribute name %q too long", name)
+		}
+		if index == xattrIndexPOSIXAccess || index == xattrIndexPOSIXDefault {
+			if value, err = aclToDisk(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		attrs = append(attrs, xattr{index: index, name: suffix, value: value})
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		a, b := attrs[i], attrs[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+	return attrs, nil
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// xattrsSize returns the bytes needed for the entries (including the
+// terminator) and the values of attrs.
+func xattrsSize(attrs []xattr) (entries, values int) {
+	entries = 4
+	for _, a := range attrs {
+		entries += pad4(xattrEntrySize + len(a.name))
+		values += pad4(len(a.value))
+	}
+	return entries, values
+}
+
+// encodeXattrs lays out attrs in b, which starts with the first entry.
+// Values are packed from the end of b; their offsets are relative to
+// valueBase, the offset of b in the structure the offsets refer to.
+func encodeXattrs(b []byte, attrs []xattr, valueBase int) error {
+	entries, values := xattrsSize(attrs)
+	if entries+values > len(b) {
+		return errXattrTooLarge
+	}
+	le := binary.LittleEndian
+	off := 0
+	vend := len(b)
+	for _, a := range attrs {
+		vend -= pad4(len(a.value))
+		copy(b[vend:], a.value)
+		e := b[off:]
+		e[0] = uint8(len(a.name))
+		e[1] = a.index
+		le.PutUint16(e[2:], uint16(vend+valueBase))
+		le.PutUint32(e[4:], 0)
+		le.PutUint32(e[8:], uint32(len(a.value)))
+		le.PutUint32(e[12:], xattrEntryHash(a.name, b[vend:vend+pad4(len(a.value))]))
+		copy(e[xattrEntrySize:], a.name)
+		off += pad4(xattrEntrySize + len(a.name))
+	}
+	return nil
+}
+
+// xattrEntryHash computes the hash of an attribute from its name and its
+// value padded to a multiple of four bytes.
+func xattrEntryHash(name string, value []byte) uint32 {
+	var h uint32
+	for i := 0; i < len(name); i++ {
+		h = (h << 5) ^ (h >> 27) ^ uint32(int8(name[i]))
+	}
+	for i := 0; i+4 <= len(value); i += 4 {
+		h = (h << 16) ^ (h >> 16) ^ binary.LittleEndian.Uint32(value[i:])
+	}
+	return h
+}
+
+// encodeXattrBlock builds an extended attribute block for attrs stored at block blk.
+func (sb *superblock) encodeXattrBlock(attrs []xattr, blk uint64) ([]byte, error) {
+	bs := int(sb.blockSize())
+	b := make([]byte, bs)
+	if err := encodeXattrs(b[xattrHeaderSize:], attrs, xattrHeaderSize); err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], xattrMagic)
+	le.PutUint32(b[4:], 1) // refcount
+	le.PutUint32(b[8:], 1) // blocks
+	var h uint32
+	for off := xattrHeaderSize; b[off] != 0 || b[off+1] != 0; {
+		e := le.Uint32(b[off+12:])
+		h = (h << 16) ^ (h >> 16) ^ e
+		off += pad4(xattrEntrySize + int(b[off]))
+	}
+	le.PutUint32(b[12:], h)
+	sb.setXattrBlockChecksum(b, blk)
+	return b, nil
+}
+
+// setXattrBlockChecksum stores the checksum of the extended attribute
+// block b located at block blk.
+func (sb *superblock) setXattrBlockChecksum(b []byte, blk uint64) {
+	if !sb.hasROCompat(featureROCompatMetadataCsum) {
+		return
+	}
+	le := binary.LittleEndian
+	var blkle [8]byte
+	le.PutUint64(blkle[:], blk)
+	le.PutUint32(b[16:], 0)
+	crc := crc32c(sb.csumSeed(), blkle[:])
+	le.PutUint32(b[16:], crc32c(crc, b))
+}
+
+// POSIX ACL tags.
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclXattrVersion = 2
+	aclDiskVersion  = 1
+)
+
+// aclToDisk converts a POSIX ACL from the system.posix_acl_* xattr format
+// used by the VFS (and tar) to the compact ext4 on-disk format.
+func aclToDisk(v []byte) ([]byte, error) {
+	le := binary.LittleEndian
+	if len(v) < 4 || (len(v)-4)%8 != 0 || le.Uint32(v) != aclXattrVersion {
+		return nil, errors.New("malformed POSIX ACL")
+	}
+	out := make([]byte, 4, len(v))
+	le.PutUint32(out, aclDiskVersion)
+	for off := 4; off < len(v); off += 8 {
+		tag := le.Uint16(v[off:])
+		perm := le.Uint16(v[off+2:])
+		var e [8]byte
+		le.PutUint16(e[0:], tag)
+		le.PutUint16(e[2:], perm)
+		switch tag {
+		case aclUser, aclGroup:
+			copy(e[4:], v[off+4:off+8])
+			out = append(out, e[:8]...)
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+			out = append(out, e[:4]...)
+		default:
+			return nil, fmt.Errorf("unknown ACL tag %#x", tag)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,777 @@
+package fat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BuilderOption configures a Builder.
+type BuilderOption func(b *Builder)
+
+// WithType selects FAT12, FAT16 or FAT32. By default FAT32 is used for
+// file systems of 512MiB and more, and FAT16 or, for very small sizes,
+// FAT12 otherwise. EFI system partitions should use FAT32.
+func WithType(t Type) BuilderOption {
+	return func(b *Builder) {
+		b.typ = t
+	}
+}
+
+// WithClusterSize sets the cluster size in bytes, a power of two from 512
+// to 65536. By default it is picked from the size and type.
+func WithClusterSize(size int) BuilderOption {
+	return func(b *Builder) {
+		b.clusterSize = size
+	}
+}
+
+// WithLabel sets the volume label, at most 11 characters. It is stored in
+// upper case.
+func WithLabel(label string) BuilderOption {
+	return func(b *Builder) {
+		b.label = label
+	}
+}
+
+// WithVolumeID sets the volume serial number. By default a random number
+// is used.
+func WithVolumeID(id uint32) BuilderOption {
+	return func(b *Builder) {
+		b.volumeID = id
+		b.hasVolumeID = true
+	}
+}
+
+// WithTimestamp sets the time used for files and directories without a
+// modification time. Together with WithVolumeID it makes the output
+// reproducible.
+func WithTimestamp(t time.Time) BuilderOption {
+	return func(b *Builder) {
+		b.now = t
+	}
+}
+
+// WithHiddenSectors records the offset of the file system on the disk in
+// 512 byte sectors, which some boot loaders need when the file system is
+// in a partition.
+func WithHiddenSectors(n uint32) BuilderOption {
+	return func(b *Builder) {
+		b.hiddenSectors = n
+	}
+}
+
+// Entry describes a file or directory added to a Builder.
+type Entry struct {
+	// Path is the slash-separated path relative to the root of the file
+	// system. Missing parent directories are created.
+	Path string
+
+	// Mode holds the type and permission bits. Only directories and
+	// regular files are supported; files without write permission are
+	// marked read-only.
+	Mode fs.FileMode
+
+	// ModTime is stored in its location, as FAT has no time zones. It is
+	// replaced by the builder timestamp when zero.
+	ModTime time.Time
+
+	// Size is the length of a regular file.
+	Size int64
+}
+
+// run is a range of consecutive clusters.
+type run struct {
+	start, n uint32
+}
+
+// node is a file or directory of the file system being built.
+type node struct {
+	name     string
+	dir      bool
+	readOnly bool
+	mtime    time.Time
+	size     int64
+	runs     []run
+	parent   *node
+	children map[string]*node // keyed by upper case name
+
+	// Set while closing.
+	short    [11]byte
+	caseFlag byte
+	lfn      bool
+}
+
+func (n *node) firstCluster() uint32 {
+	if len(n.runs) == 0 {
+		return 0
+	}
+	return n.runs[0].start
+}
+
+func (n *node) sortedChildren() []*node {
+	list := make([]*node, 0, len(n.children))
+	for _, c := range n.children {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// Builder writes a new FAT file system to a device.
+//
+// File data is written to the device while files are added; directories
+// and the allocation tables are written by Close.
+type Builder struct {
+	dev  io.WriterAt
+	size int64
+
+	typ           Type
+	clusterSize   int
+	label         string
+	volumeID      uint32
+	hasVolumeID   bool
+	now           time.Time
+	hiddenSectors uint32
+
+	reserved    uint32
+	fatSectors  uint32
+	rootSectors uint32
+	clusters    uint32
+	next        uint32
+
+	root   *node
+	closed bool
+}
+
+// NewBuilder creates a Builder writing a file system of size bytes to dev.
+// The device must be at least size bytes long; previous contents are
+// ignored.
+func NewBuilder(dev io.WriterAt, size int64, opts ...BuilderOption) (*Builder, error) {
+	b := &Builder{
+		dev:  dev,
+		size: size,
+		now:  time.Now(),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if len(b.label) > 11 {
+		return nil, fmt.Errorf("fat: label %q longer than 11 characters", b.label)
+	}
+	b.label = strings.ToUpper(b.label)
+	for i := 0; i < len(b.label); i++ {
+		if c := b.label[i]; c != ' ' && !isShortChar(c) {
+			return nil, fmt.Errorf("fat: invalid character %q in label %q", c, b.label)
+		}
+	}
+	if !b.hasVolumeID {
+		var id [4]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return nil, err
+		}
+		b.volumeID = binary.LittleEndian.Uint32(id[:])
+	}
+	if err := b.layout(); err != nil {
+		return nil, err
+	}
+	b.root = &node{dir: true, mtime: b.now, children: map[string]*node{}}
+	b.next = 2
+	if b.typ == FAT32 {
+		// The root directory starts at the first cluster.
+		b.root.runs = []run{{2, 1}}
+		b.next = 3
+	}
+	return b, nil
+}
+
+// geometry returns the FAT and cluster counts of a file system of total
+// sectors with the given type and sectors per cluster.
+func geometry(typ Type, total, reserved, rootSectors, spc uint32) (fatSectors, clusters uint32) {
+	fatSectors = 1
+	for {
+		meta := reserved + 2*fatSectors + rootSectors
+		if meta >= total {
+			return fatSectors, 0
+		}
+		clusters = (total - meta) / spc
+		var bytes uint64
+		switch typ {
+		case FAT12:
+			bytes = (uint64(clusters+2)*3 + 1) / 2
+		case FAT16:
+			bytes = uint64(clusters+2) * 2
+		default:
+			bytes = uint64(clusters+2) * 4
+		}
+		need := uint32((bytes + sectorSize - 1) / sectorSize)
+		if need <= fatSectors {
+			return fatSectors, clusters
+		}
+		fatSectors = need
+	}
+}
+
+// layout picks the type and cluster size like mkfs.fat and computes the
+// sizes of the regions.
+func (b *Builder) layout() error {
+	if b.size/sectorSize > 0xffffffff {
+		return fmt.Errorf("fat: image of %d bytes is too large", b.size)
+	}
+	total := uint32(b.size / sectorSize)
+	types := []Type{b.typ}
+	if b.typ == 0 {
+		types = []Type{FAT16, FAT12}
+		if b.size >= 512<<20 {
+			types = []Type{FAT32}
+		}
+	}
+	sizes := []int{b.clusterSize}
+	if b.clusterSize == 0 {
+		sizes = nil
+		for s := 512; s <= 32768; s *= 2 {
+			sizes = append(sizes, s)
+		}
+	} else if b.clusterSize < 512 || b.clusterSize > 65536 || b.clusterSize&(b.clusterSize-1) != 0 {
+		return fmt.Errorf("fat: invalid cluster size %d", b.clusterSize)
+	}
+	for _, typ := range types {
+		var min, max uint32
+		reserved, rootSectors := uint32(1), uint32(rootEntries*dirEntSize/sectorSize)
+		switch typ {
+		case FAT12:
+			min, max = 1, maxFAT12Clusters
+		case FAT16:
+			min, max = maxFAT12Clusters+1, maxFAT16Clusters
+		case FAT32:
+			min, max = maxFAT16Clusters+1, maxFAT32Clusters
+			reserved, rootSectors = 32, 0
+		default:
+			return fmt.Errorf("fat: unsupported type %d", int(typ))
+		}
+		candidates := sizes
+		if typ == FAT32 && b.clusterSize == 0 {
+			// Prefer 4KiB clusters up to 8GiB and larger ones above, but
+			// use smaller ones if needed to reach the FAT32 minimum.
+			pref := 4096
+			for s := int64(8 << 30); s < b.size && pref < 32768; s *= 2 {
+				pref *= 2
+			}
+			candidates = nil
+			for s := pref; s >= 512; s /= 2 {
+				candidates = append(candidates, s)
+			}
+		}
+		for _, cs := range candidates {
+			spc := uint32(cs / sectorSize)
+			fatSectors, clusters := geometry(typ, total, reserved, rootSectors, spc)
+			if clusters < min || clusters > max {
+				continue
+			}
+			b.typ = typ
+			b.clusterSize = cs
+			b.reserved, b.fatSectors, b.rootSectors, b.clusters = reserved, fatSectors, rootSectors, clusters
+			return nil
+		}
+	}
+	if b.typ != 0 {
+		return fmt.Errorf("fat: image of %d bytes cannot hold %v", b.size, b.typ)
+	}
+	return fmt.Errorf("fat: image of %d bytes is too small", b.size)
+}
+
+// Type returns the FAT variant being built.
+func (b *Builder) Type() Type {
+	return b.typ
+}
+
+func (b *Builder) clusterOffset(c uint32) int64 {
+	data := int64(b.reserved+2*b.fatSectors+b.rootSectors) * sectorSize
+	return data + int64(c-2)*int64(b.clusterSize)
+}
+
+// alloc returns a run of n new clusters.
+func (b *Builder) alloc(n uint32) (run, error) {
+	if uint64(b.next)+uint64(n) > uint64(b.clusters)+2 {
+		return run{}, ErrNoSpace
+	}
+	r := run{b.next, n}
+	b.next += n
+	return r, nil
+}
+
+// writeRuns writes data to the clusters of runs, zero filling the last
+// cluster if pad is set.
+func (b *Builder) writeRuns(runs []run, r io.Reader, size int64, pad bool) error {
+	buf := make([]byte, 256*1024)
+	cs := int64(b.clusterSize)
+	for _, rn := range runs {
+		off := b.clusterOffset(rn.start)
+		end := off + int64(rn.n)*cs
+		for off < end && (size > 0 || pad) {
+			n := int64(len(buf))
+			if rest := end - off; rest < n {
+				n = rest
+			}
+			chunk := buf[:n]
+			m := n
+			if size < m {
+				m = size
+			}
+			if _, err := io.ReadFull(r, chunk[:m]); err != nil {
+				return err
+			}
+			if !pad {
+				chunk = chunk[:m]
+			} else {
+				for i := m; i < n; i++ {
+					chunk[i] = 0
+				}
+			}
+			if _, err := b.dev.WriteAt(chunk, off); err != nil {
+				return err
+			}
+			size -= m
+			off += int64(len(chunk))
+		}
+	}
+	return nil
+}
+
+// lookupDir returns the directory at p, creating missing directories.
+func (b *Builder) lookupDir(p string) (*node, error) {
+	dir := b.root
+	if p == "" || p == "." {
+		return dir, nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		child, ok := dir.children[strings.ToUpper(name)]
+		if !ok {
+			if err := checkName(name); err != nil {
+				return nil, err
+			}
+			child = &node{name: name, dir: true, mtime: b.now, parent: dir, children: map[string]*node{}}
+			dir.children[strings.ToUpper(name)] = child
+		} else if !child.dir {
+			return nil, fmt.Errorf("fat: %s: not a directory", p)
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+// Add adds the file or directory described by e. For regular files Size
+// bytes of content are read from r and written to the device. Names are
+// case-insensitive; adding a directory over a directory only updates its
+// metadata, and other existing names are an error.
+func (b *Builder) Add(e *Entry, r io.Reader) error {
+	if b.closed {
+		return errors.New("fat: builder is closed")
+	}
+	p := strings.TrimPrefix(path.Clean("/"+e.Path), "/")
+	mtime := e.ModTime
+	if mtime.IsZero() {
+		mtime = b.now
+	}
+	if !e.Mode.IsDir() && !e.Mode.IsRegular() {
+		return fmt.Errorf("fat: %s: unsupported file type %v", p, e.Mode.Type())
+	}
+	if p == "" {
+		if !e.Mode.IsDir() {
+			return errors.New("fat: root must be a directory")
+		}
+		b.root.mtime = mtime
+		return nil
+	}
+	parent, err := b.lookupDir(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	name := path.Base(p)
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if old, ok := parent.children[strings.ToUpper(name)]; ok {
+		if old.dir && e.Mode.IsDir() {
+			old.mtime = mtime
+			return nil
+		}
+		return fmt.Errorf("fat: %s: %w", p, fs.ErrExist)
+	}
+	n := &node{
+		name:     name,
+		dir:      e.Mode.IsDir(),
+		readOnly: e.Mode.Perm()&0200 == 0,
+		mtime:    mtime,
+		parent:   parent,
+	}
+	if n.dir {
+		n.readOnly = false
+		n.children = map[string]*node{}
+	} else {
+		if e.Size < 0 || e.Size > 0xffffffff {
+			return fmt.Errorf("fat: %s: unsupported size %d", p, e.Size)
+		}
+		n.size = e.Size
+		if e.Size > 0 {
+			cs := int64(b.clusterSize)
+			rn, err := b.alloc(uint32((e.Size + cs - 1) / cs))
+			if err != nil {
+				return err
+			}
+			n.runs = []run{rn}
+			if err := b.writeRuns(n.runs, r, e.Size, false); err != nil {
+				return fmt.Errorf("fat: %s: %w", p, err)
+			}
+		}
+	}
+	parent.children[strings.ToUpper(name)] = n
+	return nil
+}
+
+// AddFiles adds regular files, mapping their paths to their contents, in
+// path order.
+func (b *Builder) AddFiles(files map[string][]byte) error {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		data := files[p]
+		e := &Entry{Path: p, Mode: 0644, Size: int64(len(data))}
+		if err := b.Add(e, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddDirectory adds the contents of the host directory root. Symbolic
+// links are followed; other special files are an error.
+func (b *Builder) AddDirectory(root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(p); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return fmt.Errorf("fat: %s: symbolic link to a directory", p)
+			}
+		}
+		e := &Entry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+		}
+		if !info.Mode().IsRegular() {
+			return b.Add(e, nil)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return b.Add(e, f)
+	})
+}
+
+// dirEntries returns the number of directory entries of dir.
+func (b *Builder) dirEntries(dir *node) int {
+	n := 0
+	if dir == b.root {
+		if b.label != "" {
+			n++
+		}
+	} else {
+		n = 2
+	}
+	for _, c := range dir.children {
+		n++
+		if c.lfn {
+			n += len(lfnEntries(c.name, 0))
+		}
+	}
+	return n
+}
+
+// Close writes the directories, the allocation tables and the boot
+// sector. The Builder cannot be used afterwards.
+func (b *Builder) Close() error {
+	if b.closed {
+		return errors.New("fat: builder is closed")
+	}
+	b.closed = true
+
+	// Name and size the directories, breadth first.
+	var dirs []*node
+	queue := []*node{b.root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		dirs = append(dirs, dir)
+		used := map[[11]byte]bool{}
+		for _, c := range dir.sortedChildren() {
+			c.short, c.caseFlag, c.lfn = shortName(c.name, used)
+			used[c.short] = true
+			if c.dir {
+				queue = append(queue, c)
+			}
+		}
+	}
+	cs := uint32(b.clusterSize)
+	for _, dir := range dirs {
+		size := uint32(b.dirEntries(dir)) * dirEntSize
+		if dir == b.root && b.typ != FAT32 {
+			if size > rootEntries*dirEntSize {
+				return fmt.Errorf("fat: more than %d entries in the root directory", rootEntries)
+			}
+			continue
+		}
+		if size > 65536*dirEntSize {
+			return fmt.Errorf("fat: directory %s has too many entries", dir.name)
+		}
+		need := (size + cs - 1) / cs
+		if need == 0 {
+			need = 1
+		}
+		have := uint32(0)
+		for _, r := range dir.runs {
+			have += r.n
+		}
+		if need > have {
+			r, err := b.alloc(need - have)
+			if err != nil {
+				return err
+			}
+			dir.runs = append(dir.runs, r)
+		}
+	}
+	for _, dir := range dirs {
+		data := b.encodeDir(dir)
+		if dir == b.root && b.typ != FAT32 {
+			buf := make([]byte, b.rootSectors*sectorSize)
+			copy(buf, data)
+			off := int64(b.reserved+2*b.fatSectors) * sectorSize
+			if _, err := b.dev.WriteAt(buf, off); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := b.writeRuns(dir.runs, bytes.NewReader(data), int64(len(data)), true); err != nil {
+			return err
+		}
+	}
+
+	if err := b.writeFATs(dirs); err != nil {
+		return err
+	}
+	return b.writeBootSectors()
+}
+
+// encodeDir returns the directory entries of dir.
+func (b *Builder) encodeDir(dir *node) []byte {
+	var data []byte
+	entry := func(sn [11]byte, attr, caseFlag byte, n *node, cluster uint32, size uint32) {
+		var e [dirEntSize]byte
+		copy(e[:11], sn[:])
+		e[11] = attr
+		e[12] = caseFlag
+		date, tim, tenth := encodeTime(n.mtime)
+		e[13] = tenth
+		binary.LittleEndian.PutUint16(e[14:], tim)
+		binary.LittleEndian.PutUint16(e[16:], date)
+		binary.LittleEndian.PutUint16(e[18:], date)
+		binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+		binary.LittleEndian.PutUint16(e[22:], tim)
+		binary.LittleEndian.PutUint16(e[24:], date)
+		binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+		binary.LittleEndian.PutUint32(e[28:], size)
+		data = append(data, e[:]...)
+	}
+	dotName := func(s string) (sn [11]byte) {
+		copy(sn[:], s+"          ")
+		return sn
+	}
+	if dir == b.root {
+		if b.label != "" {
+			var sn [11]byte
+			copy(sn[:], b.label+"           ")
+			entry(sn, attrVolumeID, 0, dir, 0, 0)
+		}
+	} else {
+		entry(dotName("."), attrDirectory, 0, dir, dir.firstCluster(), 0)
+		parent := uint32(0)
+		if dir.parent != b.root {
+			parent = dir.parent.firstCluster()
+		}
+		entry(dotName(".."), attrDirectory, 0, dir.parent, parent, 0)
+	}
+	for _, c := range dir.sortedChildren() {
+		if c.lfn {
+			for _, e := range lfnEntries(c.name, shortChecksum(c.short)) {
+				data = append(data, e[:]...)
+			}
+		}
+		attr := byte(attrArchive)
+		if c.dir {
+			attr = attrDirectory
+		} else if c.readOnly {
+			attr |= attrReadOnly
+		}
+		entry(c.short, attr, c.caseFlag, c, c.firstCluster(), uint32(c.size))
+	}
+	return data
+}
+
+// writeFATs encodes the cluster chains of all files and directories into
+// both allocation tables.
+func (b *Builder) writeFATs(dirs []*node) error {
+	table := make([]uint32, b.clusters+2)
+	eoc := map[Type]uint32{FAT12: 0xfff, FAT16: 0xffff, FAT32: 0x0fffffff}[b.typ]
+	table[0] = 0x0fffff00&eoc | 0xf8
+	table[1] = eoc
+	chain := func(runs []run) {
+		var prev uint32
+		for _, r := range runs {
+			for c := r.start; c < r.start+r.n; c++ {
+				if prev != 0 {
+					table[prev] = c
+				}
+				prev = c
+			}
+		}
+		if prev != 0 {
+			table[prev] = eoc
+		}
+	}
+	for _, dir := range dirs {
+		chain(dir.runs)
+		for _, c := range dir.children {
+			if !c.dir {
+				chain(c.runs)
+			}
+		}
+	}
+
+	buf := make([]byte, b.fatSectors*sectorSize)
+	for i, v := range table {
+		switch b.typ {
+		case FAT12:
+			off := i + i/2
+			if i%2 == 0 {
+				buf[off] = byte(v)
+				buf[off+1] = buf[off+1]&0xf0 | byte(v>>8)&0x0f
+			} else {
+				buf[off] = buf[off]&0x0f | byte(v<<4)
+				buf[off+1] = byte(v >> 4)
+			}
+		case FAT16:
+			binary.LittleEndian.PutUint16(buf[2*i:], uint16(v))
+		case FAT32:
+			binary.LittleEndian.PutUint32(buf[4*i:], v)
+		}
+	}
+	for i := uint32(0); i < 2; i++ {
+		off := int64(b.reserved+i*b.fatSectors) * sectorSize
+		if _, err := b.dev.WriteAt(buf, off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBootSectors writes the boot sector and, for FAT32, the FSInfo
+// sector and their backups.
+func (b *Builder) writeBootSectors() error {
+	bs := make([]byte, sectorSize)
+	bs[0], bs[2] = 0xeb, 0x90
+	copy(bs[3:], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(bs[11:], sectorSize)
+	bs[13] = byte(b.clusterSize / sectorSize)
+	binary.LittleEndian.PutUint16(bs[14:], uint16(b.reserved))
+	bs[16] = 2
+	total := uint32(b.size / sectorSize)
+	if b.typ != FAT32 {
+		binary.LittleEndian.PutUint16(bs[17:], rootEntries)
+	}
+	if total < 0x10000 && b.typ != FAT32 {
+		binary.LittleEndian.PutUint16(bs[19:], uint16(total))
+	} else {
+		binary.LittleEndian.PutUint32(bs[32:], total)
+	}
+	bs[21] = 0xf8
+	binary.LittleEndian.PutUint16(bs[24:], 63)
+	binary.LittleEndian.PutUint16(bs[26:], 255)
+	binary.LittleEndian.PutUint32(bs[28:], b.hiddenSectors)
+
+	ext := bs[36:]
+	if b.typ == FAT32 {
+		binary.LittleEndian.PutUint32(bs[36:], b.fatSectors)
+		binary.LittleEndian.PutUint32(bs[44:], b.root.firstCluster())
+		binary.LittleEndian.PutUint16(bs[48:], 1) // FSInfo
+		binary.LittleEndian.PutUint16(bs[50:], 6) // backup boot sector
+		ext = bs[64:]
+	} else {
+		binary.LittleEndian.PutUint16(bs[22:], uint16(b.fatSectors))
+	}
+	bs[1] = byte(len(bs) - len(ext) + 26 - 2)
+	ext[0] = 0x80 // drive number
+	ext[2] = 0x29
+	binary.LittleEndian.PutUint32(ext[3:], b.volumeID)
+	label := b.label
+	if label == "" {
+		label = "NO NAME"
+	}
+	copy(ext[7:18], label+"           ")
+	copy(ext[18:26], fmt.Sprintf("%-8v", b.typ))
+	// Boot code that halts, for firmware that tries to boot the volume.
+	copy(ext[26:], []byte{0xfa, 0xf4, 0xeb, 0xfd})
+	bs[510], bs[511] = 0x55, 0xaa
+
+	if _, err := b.dev.WriteAt(bs, 0); err != nil {
+		return err
+	}
+	if b.typ != FAT32 {
+		return nil
+	}
+	info := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(info[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(info[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(info[488:], b.clusters+2-b.next)
+	binary.LittleEndian.PutUint32(info[492:], b.next)
+	binary.LittleEndian.PutUint32(info[508:], 0xaa550000)
+	// The remaining reserved sectors, including the third sector of the
+	// boot record, are zeroed.
+	zero := make([]byte, (b.reserved-2)*sectorSize)
+	if _, err := b.dev.WriteAt(zero, 2*sectorSize); err != nil {
+		return err
+	}
+	for _, base := range []int64{0, 6} {
+		if _, err := b.dev.WriteAt(bs, base*sectorSize); err != nil {
+			return err
+		}
+		if _, err := b.dev.WriteAt(info, (base+1)*sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
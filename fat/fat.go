@@ -0,0 +1,171 @@
+// Package fat builds and reads FAT12, FAT16 and FAT32 file systems with
+// long file names, such as EFI system partitions and small configuration
+// disks for guests without virtio-fs.
+//
+// A Builder writes to any io.WriterAt, for example a raw disk image file or
+// a partition of one:
+//
+//	table, _ := partition.New(64<<20, 512)
+//	p, _ := table.AddSized(partition.Partition{Type: partition.TypeEFISystem, Name: "EFI"}, 60<<20)
+//	f, _ := os.Create("disk.img")
+//	f.Truncate(64 << 20)
+//	table.Write(f)
+//	off, size := table.Offset(p)
+//	b, _ := fat.NewBuilder(table.Section(f, p), size,
+//		fat.WithType(fat.FAT32), fat.WithLabel("EFI"), fat.WithHiddenSectors(uint32(off/512)))
+//	b.AddDirectory("esp")
+//	b.Close()
+//
+// The result is attached with vz.NewDiskImageStorageDeviceAttachment.
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Type is the FAT variant, named after the width of its table entries.
+type Type int
+
+// FAT variants. The zero Type lets NewBuilder pick one from the size.
+const (
+	FAT12 Type = 12
+	FAT16 Type = 16
+	FAT32 Type = 32
+)
+
+func (t Type) String() string {
+	return fmt.Sprintf("FAT%d", int(t))
+}
+
+const (
+	sectorSize = 512
+	dirEntSize = 32
+
+	// rootEntries is the size of the fixed FAT12 and FAT16 root directory.
+	rootEntries = 512
+
+	// Clusters counts at which the variants change, from the FAT
+	// specification.
+	maxFAT12Clusters = 4084
+	maxFAT16Clusters = 65524
+	maxFAT32Clusters = 0x0ffffff5 - 2
+
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLFN       = attrReadOnly | attrHidden | attrSystem | attrVolumeID
+
+	// Flags in the reserved byte of a short entry telling that the base
+	// name or the extension is displayed in lower case.
+	caseLowerBase = 0x08
+	caseLowerExt  = 0x10
+
+	lfnLast     = 0x40
+	lfnChars    = 13
+	maxLFNChars = 255
+)
+
+var (
+	// ErrNoSpace is returned when the data added to a Builder does not
+	// fit into the file system.
+	ErrNoSpace = errors.New("fat: no space left in image")
+
+	// ErrNotFAT is returned when opening a device without a FAT boot
+	// sector.
+	ErrNotFAT = errors.New("fat: not a FAT file system")
+)
+
+// bootSector holds the fields of the BIOS parameter block this package
+// uses.
+type bootSector struct {
+	bytesPerSector    uint16
+	sectorsPerCluster uint8
+	reservedSectors   uint16
+	numFATs           uint8
+	rootEntries       uint16
+	totalSectors      uint32
+	fatSectors        uint32
+	hiddenSectors     uint32
+	rootCluster       uint32
+	fsInfoSector      uint16
+	volumeID          uint32
+	label             string
+}
+
+func parseBootSector(b []byte) (*bootSector, error) {
+	if b[510] != 0x55 || b[511] != 0xaa || (b[0] != 0xeb && b[0] != 0xe9) {
+		return nil, ErrNotFAT
+	}
+	bs := &bootSector{
+		bytesPerSector:    binary.LittleEndian.Uint16(b[11:]),
+		sectorsPerCluster: b[13],
+		reservedSectors:   binary.LittleEndian.Uint16(b[14:]),
+		numFATs:           b[16],
+		rootEntries:       binary.LittleEndian.Uint16(b[17:]),
+		totalSectors:      uint32(binary.LittleEndian.Uint16(b[19:])),
+		fatSectors:        uint32(binary.LittleEndian.Uint16(b[22:])),
+		hiddenSectors:     binary.LittleEndian.Uint32(b[28:]),
+	}
+	if bs.totalSectors == 0 {
+		bs.totalSectors = binary.LittleEndian.Uint32(b[32:])
+	}
+	ext := b[36:]
+	if bs.fatSectors == 0 {
+		bs.fatSectors = binary.LittleEndian.Uint32(b[36:])
+		bs.rootCluster = binary.LittleEndian.Uint32(b[44:])
+		bs.fsInfoSector = binary.LittleEndian.Uint16(b[48:])
+		ext = b[64:]
+	}
+	if ext[2] == 0x29 {
+		bs.volumeID = binary.LittleEndian.Uint32(ext[3:])
+		bs.label = trimLabel(ext[7:18])
+	}
+	ss := bs.bytesPerSector
+	spc := bs.sectorsPerCluster
+	if ss < 512 || ss > 4096 || ss&(ss-1) != 0 || spc == 0 || spc&(spc-1) != 0 ||
+		bs.reservedSectors == 0 || bs.numFATs == 0 || bs.fatSectors == 0 {
+		return nil, ErrNotFAT
+	}
+	return bs, nil
+}
+
+func trimLabel(b []byte) string {
+	s := string(b)
+	for len(s) > 0 && s[len(s)-1] == ' ' {
+		s = s[:len(s)-1]
+	}
+	if s == "NO NAME" {
+		return ""
+	}
+	return s
+}
+
+// encodeTime returns the FAT date, time and 10 ms units of t, clamped to
+// the years 1980 to 2107.
+func encodeTime(t time.Time) (date, tim uint16, tenth uint8) {
+	if t.Year() < 1980 {
+		return 1<<5 | 1, 0, 0
+	}
+	if t.Year() > 2107 {
+		return 127<<9 | 12<<5 | 31, 23<<11 | 59<<5 | 29, 199
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tim = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	tenth = uint8(t.Second()%2*100 + t.Nanosecond()/10000000)
+	return date, tim, tenth
+}
+
+func decodeTime(date, tim uint16, tenth uint8, loc *time.Location) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	t := time.Date(int(date>>9)+1980, time.Month(date>>5&0xf), int(date&0x1f),
+		int(tim>>11), int(tim>>5&0x3f), int(tim&0x1f)*2, 0, loc)
+	return t.Add(time.Duration(tenth) * 10 * time.Millisecond)
+}
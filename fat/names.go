@@ -0,0 +1,194 @@
+package fat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// shortChars are the characters other than letters and digits allowed in
+// short (8.3) names.
+const shortChars = "!#$%&'()-@^_`{}~"
+
+func isShortChar(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte(shortChars, c) >= 0
+}
+
+// checkName reports whether name can be stored as a long file name.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("fat: invalid file name %q", name)
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return fmt.Errorf("fat: file name %q ends in a dot or space", name)
+	}
+	for _, c := range name {
+		if c < 0x20 || strings.ContainsRune(`"*/:<>?\|`, c) {
+			return fmt.Errorf("fat: invalid character %q in file name %q", c, name)
+		}
+	}
+	if len(utf16.Encode([]rune(name))) > maxLFNChars {
+		return fmt.Errorf("fat: file name %q too long", name)
+	}
+	return nil
+}
+
+// exactShortName returns the short entry name of name and the case flags
+// if name is a valid 8.3 name in a single case per part, so it needs no
+// long name entries.
+func exactShortName(name string) (sn [11]byte, flags byte, ok bool) {
+	base, ext := name, ""
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	if len(base) < 1 || len(base) > 8 || len(ext) > 3 || strings.IndexByte(ext, '.') >= 0 {
+		return sn, 0, false
+	}
+	part := func(s string, dst []byte, lowerFlag byte) bool {
+		upper, lower := false, false
+		for i := 0; i < len(s); i++ {
+			c := s[i]
+			switch {
+			case c >= 'a' && c <= 'z':
+				lower = true
+				c -= 'a' - 'A'
+			case c >= 'A' && c <= 'Z':
+				upper = true
+			case !isShortChar(c):
+				return false
+			}
+			dst[i] = c
+		}
+		if upper && lower {
+			return false
+		}
+		if lower {
+			flags |= lowerFlag
+		}
+		return true
+	}
+	for i := range sn {
+		sn[i] = ' '
+	}
+	if !part(base, sn[:8], caseLowerBase) || !part(ext, sn[8:], caseLowerExt) {
+		return sn, 0, false
+	}
+	return sn, flags, true
+}
+
+// basisName returns the upper case short name basis of a long name, as
+// the base and extension without padding.
+func basisName(name string) (base, ext string) {
+	conv := func(s string, max int) string {
+		var b []byte
+		for _, c := range strings.ToUpper(s) {
+			if c == ' ' || c == '.' {
+				continue
+			}
+			if c > 0x7f || !isShortChar(byte(c)) {
+				c = '_'
+			}
+			b = append(b, byte(c))
+			if len(b) == max {
+				break
+			}
+		}
+		return string(b)
+	}
+	name = strings.TrimLeft(name, ".")
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		base, ext = conv(name[:i], 8), conv(name[i+1:], 3)
+	} else {
+		base = conv(name, 8)
+	}
+	if base == "" {
+		base = "_"
+	}
+	return base, ext
+}
+
+// shortName returns a short name for name that is not yet in used, the
+// case flags, and whether long name entries are needed.
+func shortName(name string, used map[[11]byte]bool) (sn [11]byte, flags byte, lfn bool) {
+	if sn, flags, ok := exactShortName(name); ok && !used[sn] {
+		return sn, flags, false
+	}
+	base, ext := basisName(name)
+	for n := 1; ; n++ {
+		tail := "~" + strconv.Itoa(n)
+		b := base
+		if len(b)+len(tail) > 8 {
+			b = b[:8-len(tail)]
+		}
+		for i := range sn {
+			sn[i] = ' '
+		}
+		copy(sn[:8], b+tail)
+		copy(sn[8:], ext)
+		if !used[sn] {
+			return sn, 0, true
+		}
+	}
+}
+
+// shortChecksum is the checksum of a short name stored in its long name
+// entries.
+func shortChecksum(sn [11]byte) byte {
+	var sum byte
+	for _, c := range sn {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// lfnEntries returns the long name entries of name in on-disk order.
+func lfnEntries(name string, sum byte) [][dirEntSize]byte {
+	u := utf16.Encode([]rune(name))
+	count := (len(u) + lfnChars - 1) / lfnChars
+	if len(u)%lfnChars != 0 {
+		u = append(u, 0)
+	}
+	for len(u)%lfnChars != 0 {
+		u = append(u, 0xffff)
+	}
+	entries := make([][dirEntSize]byte, count)
+	for i := 0; i < count; i++ {
+		e := &entries[count-1-i]
+		e[0] = byte(i + 1)
+		if i == count-1 {
+			e[0] |= lfnLast
+		}
+		e[11] = attrLFN
+		e[13] = sum
+		chars := u[i*lfnChars : (i+1)*lfnChars]
+		for j, off := range lfnOffsets {
+			e[off] = byte(chars[j])
+			e[off+1] = byte(chars[j] >> 8)
+		}
+	}
+	return entries
+}
+
+// lfnOffsets are the byte offsets of the 13 characters of a long name
+// entry.
+var lfnOffsets = [lfnChars]int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
+// decodeShortName returns the display form of a short entry name.
+func decodeShortName(sn []byte, flags byte) string {
+	base := strings.TrimRight(string(sn[:8]), " ")
+	ext := strings.TrimRight(string(sn[8:11]), " ")
+	if base != "" && base[0] == 0x05 {
+		base = "\xe5" + base[1:]
+	}
+	if flags&caseLowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if flags&caseLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext != "" {
+		return base + "." + ext
+	}
+	return base
+}
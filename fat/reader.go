@@ -0,0 +1,474 @@
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// FS is a read-only view of a FAT file system. It implements fs.FS,
+// fs.ReadDirFS, fs.ReadFileFS and fs.StatFS. Names are looked up
+// case-insensitively. FAT timestamps have no time zone and are returned in
+// UTC.
+type FS struct {
+	r           io.ReaderAt
+	bs          *bootSector
+	typ         Type
+	label       string
+	clusterSize int64
+	dataStart   int64
+	clusters    uint32
+	table       []uint32
+	root        *dirent
+}
+
+// dirent is a parsed directory entry.
+type dirent struct {
+	name     string
+	attr     byte
+	mtime    time.Time
+	size     int64
+	cluster  uint32
+	fixedDir bool // the FAT12 or FAT16 root directory
+}
+
+func (d *dirent) isDir() bool { return d.attr&attrDirectory != 0 }
+
+// Open reads the boot sector and allocation table of the FAT file system
+// on r.
+func Open(r io.ReaderAt) (*FS, error) {
+	b := make([]byte, sectorSize)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotFAT
+		}
+		return nil, err
+	}
+	bs, err := parseBootSector(b)
+	if err != nil {
+		return nil, err
+	}
+	ss := int64(bs.bytesPerSector)
+	rootSectors := (uint32(bs.rootEntries)*dirEntSize + uint32(ss) - 1) / uint32(ss)
+	meta := uint32(bs.reservedSectors) + uint32(bs.numFATs)*bs.fatSectors + rootSectors
+	if meta >= bs.totalSectors {
+		return nil, ErrNotFAT
+	}
+	fsys := &FS{
+		r:           r,
+		bs:          bs,
+		label:       bs.label,
+		clusterSize: ss * int64(bs.sectorsPerCluster),
+		dataStart:   int64(meta) * ss,
+		clusters:    (bs.totalSectors - meta) / uint32(bs.sectorsPerCluster),
+	}
+	switch {
+	case fsys.clusters <= maxFAT12Clusters:
+		fsys.typ = FAT12
+	case fsys.clusters <= maxFAT16Clusters:
+		fsys.typ = FAT16
+	default:
+		fsys.typ = FAT32
+	}
+	if err := fsys.readTable(); err != nil {
+		return nil, err
+	}
+
+	fsys.root = &dirent{attr: attrDirectory}
+	if fsys.typ == FAT32 {
+		fsys.root.cluster = bs.rootCluster
+	} else {
+		fsys.root.fixedDir = true
+	}
+	_, label, err := fsys.readDir(fsys.root)
+	if err != nil {
+		return nil, err
+	}
+	if label != "" {
+		fsys.label = label
+	}
+	return fsys, nil
+}
+
+// Type returns the FAT variant.
+func (fsys *FS) Type() Type {
+	return fsys.typ
+}
+
+// Label returns the volume label.
+func (fsys *FS) Label() string {
+	return fsys.label
+}
+
+// readTable reads the first allocation table.
+func (fsys *FS) readTable() error {
+	ss := int64(fsys.bs.bytesPerSector)
+	buf := make([]byte, int64(fsys.bs.fatSectors)*ss)
+	if _, err := fsys.r.ReadAt(buf, int64(fsys.bs.reservedSectors)*ss); err != nil {
+		return fmt.Errorf("fat: reading allocation table: %w", err)
+	}
+	n := fsys.clusters + 2
+	var need int
+	switch fsys.typ {
+	case FAT12:
+		need = (int(n)*3 + 1) / 2
+	case FAT16:
+		need = int(n) * 2
+	default:
+		need = int(n) * 4
+	}
+	if need > len(buf) {
+		return ErrNotFAT
+	}
+	fsys.table = make([]uint32, n)
+	for i := range fsys.table {
+		switch fsys.typ {
+		case FAT12:
+			v := uint32(binary.LittleEndian.Uint16(buf[i+i/2:]))
+			if i%2 == 1 {
+				v >>= 4
+			}
+			fsys.table[i] = v & 0xfff
+		case FAT16:
+			fsys.table[i] = uint32(binary.LittleEndian.Uint16(buf[2*i:]))
+		default:
+			fsys.table[i] = binary.LittleEndian.Uint32(buf[4*i:]) & 0x0fffffff
+		}
+	}
+	return nil
+}
+
+// chain returns the clusters of the chain starting at first.
+func (fsys *FS) chain(first uint32) ([]uint32, error) {
+	var list []uint32
+	for c := first; c >= 2 && c < fsys.clusters+2; c = fsys.table[c] {
+		if len(list) > int(fsys.clusters) {
+			return nil, errors.New("fat: cluster chain loops")
+		}
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+func (fsys *FS) clusterOffset(c uint32) int64 {
+	return fsys.dataStart + int64(c-2)*fsys.clusterSize
+}
+
+// readDirData returns the raw entries of directory d.
+func (fsys *FS) readDirData(d *dirent) ([]byte, error) {
+	if d.fixedDir {
+		ss := int64(fsys.bs.bytesPerSector)
+		b := make([]byte, int64(fsys.bs.rootEntries)*dirEntSize)
+		off := int64(uint32(fsys.bs.reservedSectors)+uint32(fsys.bs.numFATs)*fsys.bs.fatSectors) * ss
+		if _, err := fsys.r.ReadAt(b, off); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	clusters, err := fsys.chain(d.cluster)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, int64(len(clusters))*fsys.clusterSize)
+	for i, c := range clusters {
+		if _, err := fsys.r.ReadAt(b[int64(i)*fsys.clusterSize:int64(i+1)*fsys.clusterSize], fsys.clusterOffset(c)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// readDir returns the entries of directory d, without "." and "..", and
+// the volume label if d is the root.
+func (fsys *FS) readDir(d *dirent) ([]*dirent, string, error) {
+	b, err := fsys.readDirData(d)
+	if err != nil {
+		return nil, "", err
+	}
+	var entries []*dirent
+	var label string
+	var lfn []uint16
+	var lfnSum byte
+	lfnNext := 0
+	for off := 0; off+dirEntSize <= len(b); off += dirEntSize {
+		e := b[off : off+dirEntSize]
+		if e[0] == 0 {
+			break
+		}
+		if e[0] == 0xe5 {
+			lfnNext = 0
+			continue
+		}
+		attr := e[11]
+		if attr&0x3f == attrLFN {
+			ord := int(e[0] &^ lfnLast)
+			if e[0]&lfnLast != 0 {
+				lfn = make([]uint16, ord*lfnChars)
+				lfnSum = e[13]
+			} else if ord != lfnNext-1 || e[13] != lfnSum {
+				lfnNext = 0
+				continue
+			}
+			if ord == 0 || len(lfn) < ord*lfnChars {
+				lfnNext = 0
+				continue
+			}
+			for j, o := range lfnOffsets {
+				lfn[(ord-1)*lfnChars+j] = binary.LittleEndian.Uint16(e[o:])
+			}
+			lfnNext = ord
+			continue
+		}
+		var sn [11]byte
+		copy(sn[:], e[:11])
+		hasLFN := lfnNext == 1 && lfnSum == shortChecksum(sn)
+		lfnNext = 0
+		if attr&attrVolumeID != 0 {
+			if attr&attrDirectory == 0 && label == "" {
+				label = trimLabel(e[:11])
+			}
+			continue
+		}
+		if sn[0] == '.' && (string(sn[:]) == ".          " || string(sn[:]) == "..         ") {
+			continue
+		}
+		ent := &dirent{
+			attr:    attr,
+			size:    int64(binary.LittleEndian.Uint32(e[28:])),
+			cluster: uint32(binary.LittleEndian.Uint16(e[20:]))<<16 | uint32(binary.LittleEndian.Uint16(e[26:])),
+			mtime: decodeTime(binary.LittleEndian.Uint16(e[24:]), binary.LittleEndian.Uint16(e[22:]),
+				0, time.UTC),
+		}
+		if fsys.typ != FAT32 {
+			ent.cluster &= 0xffff
+		}
+		if hasLFN {
+			n := 0
+			for n < len(lfn) && lfn[n] != 0 {
+				n++
+			}
+			ent.name = string(utf16.Decode(lfn[:n]))
+		} else {
+			ent.name = decodeShortName(e[:11], e[12])
+		}
+		entries = append(entries, ent)
+	}
+	return entries, label, nil
+}
+
+// lookup returns the entry at name.
+func (fsys *FS) lookup(op, name string) (*dirent, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	d := fsys.root
+	if name == "." {
+		return d, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !d.isDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		entries, _, err := fsys.readDir(d)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		var next *dirent
+		for _, e := range entries {
+			if strings.EqualFold(e.name, elem) {
+				next = e
+				break
+			}
+		}
+		if next == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		d = next
+	}
+	return d, nil
+}
+
+// Open opens the named file.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	d, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f := &file{fsys: fsys, d: d, name: path.Base(name)}
+	if !d.isDir() {
+		clusters, err := fsys.chain(d.cluster)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		if int64(len(clusters))*fsys.clusterSize < d.size {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("cluster chain shorter than file")}
+		}
+		f.clusters = clusters
+	}
+	return f, nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	d, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{d: d, name: path.Base(name)}, nil
+}
+
+func (fsys *FS) dirEntries(d *dirent) ([]fs.DirEntry, error) {
+	entries, _, err := fsys.readDir(d)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		list[i] = &fileInfo{d: e, name: e.name}
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name() < list[b].Name() })
+	return list, nil
+}
+
+// ReadDir returns the entries of the named directory sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	d, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !d.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	list, err := fsys.dirEntries(d)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return list, nil
+}
+
+// ReadFile returns the contents of the named file.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi := f.(*file)
+	if fi.d.isDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	b := make([]byte, fi.d.size)
+	if _, err := io.ReadFull(fi, b); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return b, nil
+}
+
+// file is an open file or directory.
+type file struct {
+	fsys     *FS
+	d        *dirent
+	name     string
+	clusters []uint32
+	off      int64
+	entries  []fs.DirEntry
+	read     bool
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return &fileInfo{d: f.d, name: f.name}, nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	if f.d.isDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	if f.off >= f.d.size {
+		return 0, io.EOF
+	}
+	cs := f.fsys.clusterSize
+	in := f.off % cs
+	n := cs - in
+	if rest := f.d.size - f.off; rest < n {
+		n = rest
+	}
+	if int64(len(b)) < n {
+		n = int64(len(b))
+	}
+	m, err := f.fsys.r.ReadAt(b[:n], f.fsys.clusterOffset(f.clusters[f.off/cs])+in)
+	f.off += int64(m)
+	if err == io.EOF && int64(m) == n {
+		err = nil
+	}
+	return m, err
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.d.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+	if !f.read {
+		list, err := f.fsys.dirEntries(f.d)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+		f.entries, f.read = list, true
+	}
+	if n <= 0 {
+		list := f.entries
+		f.entries = nil
+		return list, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	list := f.entries[:n]
+	f.entries = f.entries[n:]
+	return list, nil
+}
+
+// fileInfo implements fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	d    *dirent
+	name string
+}
+
+func (fi *fileInfo) Name() string { return fi.name }
+
+func (fi *fileInfo) Size() int64 {
+	if fi.d.isDir() {
+		return 0
+	}
+	return fi.d.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.d.isDir() {
+		return fs.ModeDir | 0755
+	}
+	if fi.d.attr&attrReadOnly != 0 {
+		return 0444
+	}
+	return 0644
+}
+
+func (fi *fileInfo) ModTime() time.Time         { return fi.d.mtime }
+func (fi *fileInfo) IsDir() bool                { return fi.d.isDir() }
+func (fi *fileInfo) Sys() interface{}           { return nil }
+func (fi *fileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
@@ -3,6 +3,9 @@ module github.com/mac-vz/vz
 go 1.16
 
 require (
+	github.com/klauspost/compress v1.15.4
 	github.com/rs/xid v1.2.1
+	github.com/ulikunitz/xz v0.5.10
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	golang.org/x/sys v0.0.0-20211210111614-af8b64212486
 )
@@ -0,0 +1,162 @@
+// Package guestfs gives access to the files of a stopped virtual machine
+// by opening the ext4 file system of its raw disk image in process, without
+// mounting it or booting a helper appliance.
+package guestfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mac-vz/vz/diskimage"
+	"github.com/mac-vz/vz/ext4"
+	"github.com/mac-vz/vz/partition"
+)
+
+// ErrNoFileSystem is returned when the disk image holds no ext4 file system
+// to open.
+var ErrNoFileSystem = errors.New("guestfs: no ext4 file system found")
+
+// Option configures how a disk image is opened.
+type Option func(d *Disk)
+
+// WithReadOnly opens the disk image read-only. A read-only disk may be
+// opened while a virtual machine uses the image read-only as well, and a
+// journal needing recovery is replayed in memory only.
+func WithReadOnly() Option {
+	return func(d *Disk) {
+		d.readOnly = true
+	}
+}
+
+// WithPartition selects the partition holding the file system by its
+// number. Partition 0 selects the whole, unpartitioned disk. By default a
+// Linux root partition is preferred, then the largest ext4 partition.
+func WithPartition(n int) Option {
+	return func(d *Disk) {
+		d.partition = n
+	}
+}
+
+// Disk is an ext4 file system of a disk image opened for in-process access.
+// The methods of the embedded ext4.FS read and modify guest files.
+//
+// While a Disk is open the image is locked like it is by a running virtual
+// machine: opening fails with diskimage.ErrInUse if a virtual machine uses
+// the image, and starting a virtual machine with the image fails until the
+// Disk is closed.
+type Disk struct {
+	*ext4.FS
+
+	f         *os.File
+	lock      *diskimage.Lock
+	readOnly  bool
+	partition int
+}
+
+// Open opens the file system of the raw disk image at path for reading
+// and writing, unless WithReadOnly is given. A journal left dirty by an
+// unclean guest shutdown is replayed first.
+func Open(path string, opts ...Option) (*Disk, error) {
+	d := &Disk{partition: -1}
+	for _, opt := range opts {
+		opt(d)
+	}
+	lock, err := diskimage.LockFile(path, !d.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	flag := os.O_RDWR
+	if d.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	d.f, d.lock = f, lock
+	if err := d.open(); err != nil {
+		d.f.Close()
+		d.lock.Unlock()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Disk) open() error {
+	fi, err := d.f.Stat()
+	if err != nil {
+		return err
+	}
+	sec, n, err := findFileSystem(d.f, fi.Size(), d.partition)
+	if err != nil {
+		return err
+	}
+	d.partition = n
+	if d.readOnly {
+		d.FS, err = ext4.OpenReadOnly(sec)
+	} else {
+		d.FS, err = ext4.Open(sec)
+	}
+	if err != nil {
+		if n > 0 {
+			return fmt.Errorf("guestfs: partition %d: %w", n, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Partition returns the number of the partition holding the file system,
+// or 0 if the file system spans the whole disk.
+func (d *Disk) Partition() int {
+	return d.partition
+}
+
+// Close flushes all changes to the disk image and releases its lock.
+func (d *Disk) Close() error {
+	var err error
+	if !d.readOnly {
+		err = d.f.Sync()
+	}
+	if cerr := d.f.Close(); err == nil {
+		err = cerr
+	}
+	if uerr := d.lock.Unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// findFileSystem locates the ext4 file system of the image f of the given
+// size. want selects a partition number, or -1 to pick one automatically.
+func findFileSystem(f *os.File, size int64, want int) (*partition.Section, int, error) {
+	_, parts, err := readPartitions(f, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	var best *Partition
+	for _, p := range parts {
+		if want >= 0 && p.Number != want {
+			continue
+		}
+		sec := partition.NewSection(f, p.Offset, p.Size)
+		if !ext4.Probe(sec) {
+			if want >= 0 {
+				return nil, 0, fmt.Errorf("guestfs: partition %d: %w", want, ErrNoFileSystem)
+			}
+			continue
+		}
+		if best == nil || (p.isRoot() && !best.isRoot()) || (p.isRoot() == best.isRoot() && p.Size > best.Size) {
+			best = p
+		}
+	}
+	if best == nil {
+		if want >= 0 {
+			return nil, 0, fmt.Errorf("guestfs: partition %d: %w", want, partition.ErrNotFound)
+		}
+		return nil, 0, ErrNoFileSystem
+	}
+	return partition.NewSection(f, best.Offset, best.Size), best.Number, nil
+}
@@ -0,0 +1,300 @@
+package guestfs
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mac-vz/vz/diskimage"
+	"github.com/mac-vz/vz/ext4"
+	"github.com/mac-vz/vz/partition"
+)
+
+// Inspection describes the partitions of a disk image and the Linux
+// installation found on it.
+type Inspection struct {
+	// Scheme is SchemeGPT, SchemeMBR or empty for an unpartitioned disk.
+	Scheme     string
+	Partitions []*Partition
+
+	// Root is the partition holding the root file system, or nil if no
+	// operating system was found.
+	Root *Partition
+
+	// OSRelease holds the fields of /etc/os-release, such as ID,
+	// VERSION_ID and PRETTY_NAME.
+	OSRelease map[string]string
+
+	// Kernels lists the installed kernels, newest first.
+	Kernels []*Kernel
+
+	Hostname  string
+	CloudInit bool
+}
+
+// Kernel is a kernel installed on the disk.
+type Kernel struct {
+	// Version is the kernel release, e.g. "5.15.0-91-generic".
+	Version string
+
+	// Partition is the number of the partition holding the kernel, which
+	// is the boot partition if /boot is separate from the root file system.
+	Partition int
+
+	// Path and Initrd are the paths of the kernel image and its initial
+	// ramdisk within the partition. Initrd is empty when there is none.
+	Path   string
+	Initrd string
+}
+
+// Kernel image and initial ramdisk name patterns, as "prefix", "suffix".
+var (
+	kernelPatterns = [][2]string{{"vmlinuz-", ""}, {"vmlinux-", ""}, {"Image-", ""}}
+	initrdPatterns = [][2]string{{"initrd.img-", ""}, {"initramfs-", ".img"}, {"initrd-", ".img"}, {"initrd-", ""}}
+)
+
+// InspectDisk inspects the raw disk image at path without modifying it.
+// The image is locked for shared access, so it cannot be inspected while a
+// virtual machine uses it read-write.
+func InspectDisk(path string) (*Inspection, error) {
+	lock, err := diskimage.LockFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme, parts, err := readPartitions(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	ins := &Inspection{Scheme: scheme, Partitions: parts}
+	filesystems := map[*Partition]*ext4.FS{}
+	for _, p := range parts {
+		sec := partition.NewSection(f, p.Offset, p.Size)
+		p.FileSystem = probeFileSystem(sec)
+		if p.FileSystem == nil || !strings.HasPrefix(p.FileSystem.Type, "ext") {
+			continue
+		}
+		fsys, err := ext4.OpenReadOnly(sec)
+		if err != nil {
+			// Unsupported features or corruption: report the partition only.
+			continue
+		}
+		filesystems[p] = fsys
+		if ins.Root != nil && (!p.isRoot() || ins.Root.isRoot()) {
+			continue
+		}
+		if release := readOSRelease(fsys); release != nil {
+			ins.Root = p
+			ins.OSRelease = release
+		}
+	}
+	if ins.Root == nil {
+		return ins, nil
+	}
+
+	root := filesystems[ins.Root]
+	ins.Hostname = readHostname(root)
+	ins.CloudInit = exists(root, "/etc/cloud/cloud.cfg") || exists(root, "/usr/bin/cloud-init")
+	ins.Kernels = findKernels(root, "/boot", ins.Root.Number)
+	if len(ins.Kernels) == 0 {
+		// A separate /boot partition keeps kernels at its top level.
+		for _, p := range parts {
+			if fsys, ok := filesystems[p]; ok && p != ins.Root {
+				ins.Kernels = append(ins.Kernels, findKernels(fsys, "/", p.Number)...)
+			}
+		}
+	}
+	sort.SliceStable(ins.Kernels, func(i, j int) bool {
+		return compareVersions(ins.Kernels[i].Version, ins.Kernels[j].Version) > 0
+	})
+	return ins, nil
+}
+
+// String summarizes the inspection, e.g. "Ubuntu 22.04.3 LTS, kernel 5.15.0-91-generic".
+func (ins *Inspection) String() string {
+	if ins.Root == nil {
+		return "no operating system"
+	}
+	name := ins.OSRelease["PRETTY_NAME"]
+	if name == "" {
+		name = strings.TrimSpace(ins.OSRelease["NAME"] + " " + ins.OSRelease["VERSION_ID"])
+	}
+	if name == "" {
+		name = "Linux"
+	}
+	if len(ins.Kernels) > 0 {
+		name += ", kernel " + ins.Kernels[0].Version
+	}
+	return name
+}
+
+// CommandLine returns kernel command line arguments suitable for booting
+// the inspected root file system with the Linux boot loader and a virtio
+// console. The root file system is referenced by UUID, which needs an
+// initial ramdisk to resolve.
+func (ins *Inspection) CommandLine() string {
+	args := []string{"console=hvc0"}
+	if ins.Root != nil && ins.Root.FileSystem != nil && ins.Root.FileSystem.UUID != "" {
+		args = append(args, "root=UUID="+ins.Root.FileSystem.UUID, "rw")
+	}
+	return strings.Join(args, " ")
+}
+
+func exists(fsys *ext4.FS, name string) bool {
+	_, err := fsys.Stat(name)
+	return err == nil
+}
+
+// readOSRelease parses os-release(5), returning nil if there is none.
+func readOSRelease(fsys *ext4.FS) map[string]string {
+	var data []byte
+	for _, name := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		var err error
+		if data, err = fsys.ReadFile(name); err == nil {
+			break
+		}
+	}
+	if data == nil {
+		return nil
+	}
+	fields := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		key, value := line[:i], line[i+1:]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		fields[key] = value
+	}
+	return fields
+}
+
+// readHostname returns the configured host name of the guest.
+func readHostname(fsys *ext4.FS) string {
+	for _, name := range []string{"/etc/hostname", "/etc/HOSTNAME"} {
+		if data, err := fsys.ReadFile(name); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+					return line
+				}
+			}
+		}
+	}
+	if data, err := fsys.ReadFile("/etc/sysconfig/network"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "HOSTNAME=") {
+				return strings.Trim(strings.TrimPrefix(line, "HOSTNAME="), `"' `)
+			}
+		}
+	}
+	return ""
+}
+
+// matchPattern returns the part of name between the prefix and suffix of p.
+func matchPattern(name string, p [2]string) (string, bool) {
+	if !strings.HasPrefix(name, p[0]) || !strings.HasSuffix(name, p[1]) || len(name) <= len(p[0])+len(p[1]) {
+		return "", false
+	}
+	return name[len(p[0]) : len(name)-len(p[1])], true
+}
+
+// findKernels lists the kernels stored in directory dir.
+func findKernels(fsys *ext4.FS, dir string, number int) []*Kernel {
+	ents, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	initrds := map[string]string{}
+	for _, e := range ents {
+		for _, p := range initrdPatterns {
+			if v, ok := matchPattern(e.Name(), p); ok {
+				if _, seen := initrds[v]; !seen {
+					initrds[v] = e.Name()
+				}
+				break
+			}
+		}
+	}
+	var kernels []*Kernel
+	for _, e := range ents {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		for _, p := range kernelPatterns {
+			v, ok := matchPattern(e.Name(), p)
+			if !ok || strings.HasSuffix(v, ".old") {
+				continue
+			}
+			k := &Kernel{Version: v, Partition: number, Path: pathJoin(dir, e.Name())}
+			if initrd, ok := initrds[v]; ok {
+				k.Initrd = pathJoin(dir, initrd)
+			}
+			kernels = append(kernels, k)
+			break
+		}
+	}
+	return kernels
+}
+
+func pathJoin(dir, name string) string {
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
+
+// compareVersions compares kernel versions, treating runs of digits as numbers.
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		da, ra := leadingDigits(a)
+		db, rb := leadingDigits(b)
+		switch {
+		case da != "" && db != "":
+			na, _ := strconv.ParseUint(da, 10, 64)
+			nb, _ := strconv.ParseUint(db, 10, 64)
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+			a, b = ra, rb
+		case a[0] != b[0]:
+			if a[0] < b[0] {
+				return -1
+			}
+			return 1
+		default:
+			a, b = a[1:], b[1:]
+		}
+	}
+	return len(a) - len(b)
+}
+
+func leadingDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i], s[i:]
+}
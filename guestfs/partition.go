@@ -0,0 +1,87 @@
+package guestfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mac-vz/vz/diskimage"
+	"github.com/mac-vz/vz/partition"
+)
+
+// Partition table schemes reported by Inspection.
+const (
+	SchemeGPT = "gpt"
+	SchemeMBR = "mbr"
+)
+
+// Partition is a region of a disk image that may hold a file system.
+type Partition struct {
+	// Number is the partition number, or 0 for a disk without partition table.
+	Number int
+
+	Offset int64
+	Size   int64
+
+	// Type is the GPT partition type GUID, or the MBR type as "0x83".
+	Type string
+
+	// Name and UUID are the GPT partition name and unique partition GUID,
+	// as used by root=PARTUUID=.
+	Name string
+	UUID string
+
+	// FileSystem is the file system found in the partition, if any.
+	FileSystem *FileSystem
+}
+
+func (p *Partition) isRoot() bool {
+	return p.Type == partition.TypeLinuxRootX86_64.String() || p.Type == partition.TypeLinuxRootARM64.String()
+}
+
+// readPartitions returns the partition table scheme of the image r of the
+// given size and its partitions. An image without partition table is
+// reported as a single partition 0 covering the whole disk.
+func readPartitions(r io.ReaderAt, size int64) (string, []*Partition, error) {
+	table, err := partition.Read(r, size)
+	if err == nil {
+		var parts []*Partition
+		for _, p := range table.Partitions {
+			off, n := table.Offset(p)
+			parts = append(parts, &Partition{
+				Number: p.Number,
+				Offset: off,
+				Size:   n,
+				Type:   p.Type.String(),
+				Name:   p.Name,
+				UUID:   p.GUID.String(),
+			})
+		}
+		return SchemeGPT, parts, nil
+	}
+	if !errors.Is(err, partition.ErrNoGPT) {
+		return "", nil, err
+	}
+	mbr, err := partition.ReadMBR(r)
+	if err != nil && !errors.Is(err, partition.ErrNoMBR) {
+		return "", nil, err
+	}
+	var parts []*Partition
+	if mbr != nil && !mbr.IsProtective() {
+		for i, p := range mbr.Partitions {
+			if p.IsEmpty() {
+				continue
+			}
+			parts = append(parts, &Partition{
+				Number: i + 1,
+				Offset: int64(p.FirstLBA) * diskimage.SectorSize,
+				Size:   int64(p.Sectors) * diskimage.SectorSize,
+				Type:   fmt.Sprintf("0x%02x", p.Type),
+			})
+		}
+	}
+	if len(parts) > 0 {
+		return SchemeMBR, parts, nil
+	}
+	return "", []*Partition{{Number: 0, Size: size}}, nil
+}
@@ -0,0 +1,80 @@
+package guestfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/mac-vz/vz/ext4"
+)
+
+// FileSystem identifies the file system of a partition.
+type FileSystem struct {
+	// Type is the file system type as reported by blkid: "ext2", "ext3",
+	// "ext4", "vfat", "xfs", "btrfs" or "swap".
+	Type  string
+	UUID  string
+	Label string
+}
+
+// formatUUID formats a big-endian UUID in its canonical form.
+func formatUUID(u []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// readAt reads n bytes at off, returning nil if they cannot be read.
+func readAt(r io.ReaderAt, off int64, n int) []byte {
+	b := make([]byte, n)
+	if _, err := r.ReadAt(b, off); err != nil {
+		return nil
+	}
+	return b
+}
+
+func trimLabel(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00 "))
+}
+
+// probeFileSystem detects the file system stored on r by its signature.
+// It returns nil for unknown contents.
+func probeFileSystem(r io.ReaderAt) *FileSystem {
+	if info, err := ext4.ReadInfo(r); err == nil {
+		return &FileSystem{Type: info.Type, UUID: formatUUID(info.UUID[:]), Label: info.Label}
+	}
+	if b := readAt(r, 0, 512); b != nil {
+		le := binary.LittleEndian
+		switch {
+		case string(b[0:4]) == "XFSB":
+			return &FileSystem{Type: "xfs", UUID: formatUUID(b[32:48]), Label: trimLabel(b[108:120])}
+		case b[510] == 0x55 && b[511] == 0xaa && string(b[82:87]) == "FAT32":
+			return &FileSystem{Type: "vfat", UUID: fatSerial(le.Uint32(b[67:])), Label: fatLabel(b[71:82])}
+		case b[510] == 0x55 && b[511] == 0xaa && string(b[54:57]) == "FAT":
+			return &FileSystem{Type: "vfat", UUID: fatSerial(le.Uint32(b[39:])), Label: fatLabel(b[43:54])}
+		}
+	}
+	if b := readAt(r, 0x10000, 0x200); b != nil && string(b[0x40:0x48]) == "_BHRfS_M" {
+		return &FileSystem{Type: "btrfs", UUID: formatUUID(b[0x20:0x30]), Label: trimLabel(b[0x12b:0x1ff])}
+	}
+	for _, page := range []int64{4096, 16384, 65536} {
+		if b := readAt(r, page-10, 10); string(b) == "SWAPSPACE2" {
+			hdr := readAt(r, 1024, 44)
+			if hdr == nil {
+				return &FileSystem{Type: "swap"}
+			}
+			return &FileSystem{Type: "swap", UUID: formatUUID(hdr[12:28]), Label: trimLabel(hdr[28:44])}
+		}
+	}
+	return nil
+}
+
+func fatSerial(id uint32) string {
+	return fmt.Sprintf("%04X-%04X", id>>16, id&0xffff)
+}
+
+func fatLabel(b []byte) string {
+	if l := trimLabel(b); l != "NO NAME" {
+		return l
+	}
+	return ""
+}
@@ -0,0 +1,220 @@
+// Package ignition generates Ignition configurations for Fedora CoreOS,
+// Flatcar and other guests provisioned by Ignition instead of cloud-init,
+// and delivers them on first boot.
+//
+// A Config is delivered in one of three ways, each selected by a platform
+// ID on the kernel command line built with CommandLine:
+//
+//   - PlatformAppleHV: the guest fetches the config over virtio-vsock from
+//     port VsockPort, answered by Server.ServeConn from a
+//     vz.NewVirtioSocketListener handler.
+//   - PlatformMetal: the guest fetches the config from an HTTP URL, which
+//     Server serves as an http.Handler on the guest network.
+//   - PlatformOpenStack: the guest reads the config from a config drive
+//     written by WriteConfigDrive and attached read-only.
+package ignition
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/fs"
+	"net/url"
+	"strings"
+)
+
+// Version is the Ignition specification version written by this package.
+const Version = "3.3.0"
+
+// Config is an Ignition version 3 configuration.
+type Config struct {
+	Ignition Ignition `json:"ignition"`
+	Storage  Storage  `json:"storage"`
+	Systemd  Systemd  `json:"systemd"`
+	Passwd   Passwd   `json:"passwd"`
+}
+
+// Ignition holds the metadata of a configuration. Version defaults to
+// Version.
+type Ignition struct {
+	Version string         `json:"version"`
+	Config  IgnitionConfig `json:"config"`
+}
+
+// IgnitionConfig references other configurations to merge with or
+// replace this one.
+type IgnitionConfig struct {
+	Merge   []Resource `json:"merge,omitempty"`
+	Replace *Resource  `json:"replace,omitempty"`
+}
+
+// Resource is a remote or inline file content.
+type Resource struct {
+	// Source is a URL: data, http, https, tftp, s3 or gs.
+	Source string `json:"source,omitempty"`
+
+	// Compression is "", "gzip" or "xz".
+	Compression string `json:"compression,omitempty"`
+
+	Verification Verification `json:"verification"`
+}
+
+// Verification holds the expected hash of a resource as "sha512-<hex>" or
+// "sha256-<hex>".
+type Verification struct {
+	Hash string `json:"hash,omitempty"`
+}
+
+// Storage holds the files, directories and links to create.
+type Storage struct {
+	Files       []File      `json:"files,omitempty"`
+	Directories []Directory `json:"directories,omitempty"`
+	Links       []Link      `json:"links,omitempty"`
+}
+
+// Node holds the fields shared by files, directories and links.
+type Node struct {
+	// Path is the absolute path of the node.
+	Path      string    `json:"path"`
+	Overwrite *bool     `json:"overwrite,omitempty"`
+	User      NodeOwner `json:"user"`
+	Group     NodeOwner `json:"group"`
+}
+
+// NodeOwner is a user or group by ID or name.
+type NodeOwner struct {
+	ID   *int   `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// File is a regular file.
+type File struct {
+	Node
+	Contents *Resource  `json:"contents,omitempty"`
+	Append   []Resource `json:"append,omitempty"`
+
+	// Mode holds the permission bits, including setuid, setgid and
+	// sticky. It defaults to 0644.
+	Mode *int `json:"mode,omitempty"`
+}
+
+// Directory is a directory.
+type Directory struct {
+	Node
+	Mode *int `json:"mode,omitempty"`
+}
+
+// Link is a symbolic or hard link.
+type Link struct {
+	Node
+	Target string `json:"target"`
+	Hard   *bool  `json:"hard,omitempty"`
+}
+
+// Systemd holds the units to install.
+type Systemd struct {
+	Units []Unit `json:"units,omitempty"`
+}
+
+// Unit is a systemd unit.
+type Unit struct {
+	Name     string   `json:"name"`
+	Enabled  *bool    `json:"enabled,omitempty"`
+	Mask     *bool    `json:"mask,omitempty"`
+	Contents string   `json:"contents,omitempty"`
+	Dropins  []Dropin `json:"dropins,omitempty"`
+}
+
+// Dropin is a drop-in configuration file of a unit.
+type Dropin struct {
+	Name     string `json:"name"`
+	Contents string `json:"contents,omitempty"`
+}
+
+// Passwd holds the users and groups to create or modify.
+type Passwd struct {
+	Users  []User  `json:"users,omitempty"`
+	Groups []Group `json:"groups,omitempty"`
+}
+
+// User is a user account.
+type User struct {
+	Name              string   `json:"name"`
+	PasswordHash      string   `json:"passwordHash,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	UID               *int     `json:"uid,omitempty"`
+	Gecos             string   `json:"gecos,omitempty"`
+	HomeDir           string   `json:"homeDir,omitempty"`
+	NoCreateHome      bool     `json:"noCreateHome,omitempty"`
+	PrimaryGroup      string   `json:"primaryGroup,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	Shell             string   `json:"shell,omitempty"`
+	System            bool     `json:"system,omitempty"`
+}
+
+// Group is a group.
+type Group struct {
+	Name         string `json:"name"`
+	GID          *int   `json:"gid,omitempty"`
+	PasswordHash string `json:"passwordHash,omitempty"`
+	System       bool   `json:"system,omitempty"`
+}
+
+// Bool returns a pointer to b, for the optional fields of a Config.
+func Bool(b bool) *bool {
+	return &b
+}
+
+// Int returns a pointer to i, for the optional fields of a Config.
+func Int(i int) *int {
+	return &i
+}
+
+// DataURL returns a data URL with the content b, for the Source of a
+// Resource.
+func DataURL(b []byte) string {
+	if isText(b) {
+		return "data:," + strings.ReplaceAll(url.PathEscape(string(b)), "+", "%2B")
+	}
+	return "data:;base64," + base64.StdEncoding.EncodeToString(b)
+}
+
+func isText(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 || c < 0x20 && c != '\n' && c != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewFile returns a file at path with the inline content data and the
+// permission bits of mode, replacing any existing file.
+func NewFile(path string, data []byte, mode fs.FileMode) File {
+	perm := int(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return File{
+		Node:     Node{Path: path, Overwrite: Bool(true)},
+		Contents: &Resource{Source: DataURL(data)},
+		Mode:     Int(perm),
+	}
+}
+
+// Marshal validates c and returns its JSON encoding.
+func (c *Config) Marshal() ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	v := *c
+	if v.Ignition.Version == "" {
+		v.Ignition.Version = Version
+	}
+	return json.Marshal(&v)
+}
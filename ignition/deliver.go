@@ -0,0 +1,129 @@
+package ignition
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mac-vz/vz/iso9660"
+)
+
+// Platform IDs understood by Ignition that a virtual machine can provide.
+const (
+	PlatformAppleHV   = "applehv"
+	PlatformMetal     = "metal"
+	PlatformOpenStack = "openstack"
+)
+
+const (
+	// VsockPort is the virtio-vsock port on the host that Ignition asks
+	// for the config on the applehv platform.
+	VsockPort = 1024
+
+	// ConfigDriveLabel is the volume label of an OpenStack config drive.
+	ConfigDriveLabel = "config-2"
+)
+
+// CommandLine returns the kernel command line cmdline with the arguments
+// that make Ignition run with the given platform ID. configURL is the
+// location of the config on PlatformMetal and is ignored when empty.
+func CommandLine(cmdline, platform, configURL string) string {
+	args := []string{"ignition.firstboot", "ignition.platform.id=" + platform}
+	if configURL != "" {
+		args = append(args, "ignition.config.url="+configURL)
+	}
+	if cmdline = strings.TrimSpace(cmdline); cmdline != "" {
+		args = append([]string{cmdline}, args...)
+	}
+	return strings.Join(args, " ")
+}
+
+// WriteConfigDrive writes c to a new OpenStack config drive image at
+// path, for PlatformOpenStack.
+func (c *Config) WriteConfigDrive(path string) error {
+	data, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+	w := iso9660.NewWriter(
+		iso9660.WithVolumeLabel(ConfigDriveLabel),
+		iso9660.WithTimestamp(time.Unix(0, 0)),
+	)
+	if err := w.AddFiles(map[string][]byte{"openstack/latest/user_data": data}); err != nil {
+		return err
+	}
+	return w.WriteFile(path)
+}
+
+// Server answers requests for a config over HTTP.
+type Server struct {
+	data []byte
+}
+
+// NewServer returns a Server for c.
+func NewServer(c *Config) (*Server, error) {
+	data, err := c.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return &Server{data: data}, nil
+}
+
+// ServeHTTP implements http.Handler, answering GET requests for any path
+// with the config.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.data)))
+	if r.Method == http.MethodGet {
+		w.Write(s.data)
+	}
+}
+
+// ServeConn answers the HTTP requests on conn until the guest closes it,
+// and then closes conn. It is meant for connections accepted on VsockPort.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Request:       req,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			ContentLength: int64(len(s.data)),
+			Body:          io.NopCloser(bytes.NewReader(s.data)),
+			Close:         req.Close,
+		}
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			resp.StatusCode = http.StatusMethodNotAllowed
+			resp.ContentLength = 0
+			resp.Body = http.NoBody
+		}
+		if err := resp.Write(conn); err != nil {
+			return err
+		}
+		if req.Close {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package ignition
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrInvalid is wrapped by the errors Validate returns.
+var ErrInvalid = errors.New("ignition: invalid config")
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...))
+}
+
+// unitSuffixes are the systemd unit types.
+var unitSuffixes = []string{
+	".service", ".socket", ".device", ".mount", ".automount", ".swap",
+	".target", ".path", ".timer", ".slice", ".scope",
+}
+
+// Validate reports the first problem that would make Ignition reject c or
+// fail the first boot.
+func (c *Config) Validate() error {
+	if v := c.Ignition.Version; v != "" {
+		parts := strings.Split(v, ".")
+		if len(parts) != 3 || parts[0] != "3" {
+			return invalid("unsupported version %q", v)
+		}
+	}
+	for i, r := range c.Ignition.Config.Merge {
+		if err := validateResource(&r, true); err != nil {
+			return invalid("ignition.config.merge[%d]: %v", i, err)
+		}
+	}
+	if r := c.Ignition.Config.Replace; r != nil {
+		if err := validateResource(r, true); err != nil {
+			return invalid("ignition.config.replace: %v", err)
+		}
+	}
+
+	paths := map[string]bool{}
+	node := func(kind string, i int, n *Node) error {
+		if !path.IsAbs(n.Path) || path.Clean(n.Path) != n.Path {
+			return invalid("storage.%s[%d]: path %q is not absolute and clean", kind, i, n.Path)
+		}
+		if paths[n.Path] {
+			return invalid("storage.%s[%d]: duplicate path %s", kind, i, n.Path)
+		}
+		paths[n.Path] = true
+		if n.User.ID != nil && n.User.Name != "" || n.Group.ID != nil && n.Group.Name != "" {
+			return invalid("storage.%s[%d]: owner has both ID and name", kind, i)
+		}
+		return nil
+	}
+	mode := func(kind string, i int, m *int) error {
+		if m != nil && (*m < 0 || *m > 07777) {
+			return invalid("storage.%s[%d]: invalid mode %#o", kind, i, *m)
+		}
+		return nil
+	}
+	for i := range c.Storage.Files {
+		f := &c.Storage.Files[i]
+		if err := node("files", i, &f.Node); err != nil {
+			return err
+		}
+		if err := mode("files", i, f.Mode); err != nil {
+			return err
+		}
+		if f.Contents != nil {
+			if err := validateResource(f.Contents, false); err != nil {
+				return invalid("storage.files[%d].contents: %v", i, err)
+			}
+		}
+		for j := range f.Append {
+			if err := validateResource(&f.Append[j], true); err != nil {
+				return invalid("storage.files[%d].append[%d]: %v", i, j, err)
+			}
+		}
+	}
+	for i := range c.Storage.Directories {
+		d := &c.Storage.Directories[i]
+		if err := node("directories", i, &d.Node); err != nil {
+			return err
+		}
+		if err := mode("directories", i, d.Mode); err != nil {
+			return err
+		}
+	}
+	for i := range c.Storage.Links {
+		l := &c.Storage.Links[i]
+		if err := node("links", i, &l.Node); err != nil {
+			return err
+		}
+		if l.Target == "" {
+			return invalid("storage.links[%d]: missing target", i)
+		}
+	}
+
+	units := map[string]bool{}
+	for i, u := range c.Systemd.Units {
+		if !hasUnitSuffix(u.Name) || strings.Contains(u.Name, "/") {
+			return invalid("systemd.units[%d]: invalid unit name %q", i, u.Name)
+		}
+		if units[u.Name] {
+			return invalid("systemd.units[%d]: duplicate unit %s", i, u.Name)
+		}
+		units[u.Name] = true
+		if u.Mask != nil && *u.Mask && u.Enabled != nil && *u.Enabled {
+			return invalid("systemd.units[%d]: %s is both masked and enabled", i, u.Name)
+		}
+		dropins := map[string]bool{}
+		for j, d := range u.Dropins {
+			if !strings.HasSuffix(d.Name, ".conf") || strings.Contains(d.Name, "/") {
+				return invalid("systemd.units[%d].dropins[%d]: invalid name %q", i, j, d.Name)
+			}
+			if dropins[d.Name] {
+				return invalid("systemd.units[%d].dropins[%d]: duplicate dropin %s", i, j, d.Name)
+			}
+			dropins[d.Name] = true
+		}
+	}
+
+	users := map[string]bool{}
+	for i, u := range c.Passwd.Users {
+		if u.Name == "" {
+			return invalid("passwd.users[%d]: missing name", i)
+		}
+		if users[u.Name] {
+			return invalid("passwd.users[%d]: duplicate user %s", i, u.Name)
+		}
+		users[u.Name] = true
+		for j, k := range u.SSHAuthorizedKeys {
+			if strings.ContainsAny(k, "\n\r") {
+				return invalid("passwd.users[%d].sshAuthorizedKeys[%d]: key spans several lines", i, j)
+			}
+		}
+	}
+	groups := map[string]bool{}
+	for i, g := range c.Passwd.Groups {
+		if g.Name == "" {
+			return invalid("passwd.groups[%d]: missing name", i)
+		}
+		if groups[g.Name] {
+			return invalid("passwd.groups[%d]: duplicate group %s", i, g.Name)
+		}
+		groups[g.Name] = true
+	}
+	return nil
+}
+
+func hasUnitSuffix(name string) bool {
+	for _, s := range unitSuffixes {
+		if strings.HasSuffix(name, s) && len(name) > len(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateResource checks the source URL, compression and hash of r. An
+// empty source is only valid for file contents, where it creates an empty
+// file.
+func validateResource(r *Resource, needSource bool) error {
+	if r.Source == "" {
+		if needSource {
+			return errors.New("missing source")
+		}
+	} else {
+		u, err := url.Parse(r.Source)
+		if err != nil {
+			return err
+		}
+		switch u.Scheme {
+		case "data":
+			if !strings.Contains(u.Opaque, ",") {
+				return errors.New("malformed data URL")
+			}
+		case "http", "https", "tftp", "s3", "gs", "arn":
+		default:
+			return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+		}
+	}
+	switch r.Compression {
+	case "", "gzip", "xz":
+	default:
+		return fmt.Errorf("unsupported compression %q", r.Compression)
+	}
+	if h := r.Verification.Hash; h != "" {
+		i := strings.IndexByte(h, '-')
+		if i < 0 {
+			return fmt.Errorf("malformed hash %q", h)
+		}
+		sum, err := hex.DecodeString(h[i+1:])
+		switch {
+		case err != nil:
+			return fmt.Errorf("malformed hash %q", h)
+		case h[:i] == "sha512" && len(sum) == 64, h[:i] == "sha256" && len(sum) == 32:
+		default:
+			return fmt.Errorf("unsupported hash %q", h)
+		}
+	}
+	return nil
+}
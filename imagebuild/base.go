@@ -0,0 +1,307 @@
+package imagebuild
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mac-vz/vz/diskimage"
+	"github.com/mac-vz/vz/ext4"
+	"github.com/mac-vz/vz/guestfs"
+	"github.com/mac-vz/vz/oci"
+	"github.com/ulikunitz/xz"
+)
+
+// tarballCommandLine boots a disk written from a tarball attached as the
+// first virtio block device.
+const tarballCommandLine = "console=hvc0 root=/dev/vda rootfstype=ext4 rw"
+
+// Base is the image a build starts from.
+type Base interface {
+	// digest returns a hash of the content of the base.
+	digest() (string, error)
+
+	// writeDisk writes the base to a new raw disk image at path of size
+	// bytes, or of a default size if size is zero, recording t as the
+	// time of objects without one.
+	writeDisk(path string, size int64, t time.Time) error
+
+	// commandLine returns the kernel command line booting the disk at
+	// path.
+	commandLine(path string) (string, error)
+}
+
+// FromOCI starts from the image of the OCI image layout or docker save
+// archive at path, selected with opts. The disk holds the init of the
+// package oci, which runs the image command; the kernel command line
+// starts it unless WithCommandLine passes another init= argument.
+func FromOCI(path string, opts ...oci.Option) Base {
+	return &ociBase{path: path, opts: opts}
+}
+
+type ociBase struct {
+	path string
+	opts []oci.Option
+}
+
+func (b *ociBase) digest() (string, error) {
+	img, err := oci.Open(b.path, b.opts...)
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+	return "oci " + img.Digest, nil
+}
+
+// writeDisk writes the image with the times recorded in its layers and
+// its creation time for the rest.
+func (b *ociBase) writeDisk(path string, size int64, t time.Time) error {
+	img, err := oci.Open(b.path, b.opts...)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	return img.WriteDisk(path, size)
+}
+
+func (b *ociBase) commandLine(path string) (string, error) {
+	return oci.CommandLine, nil
+}
+
+// FromTarball starts from the root file system in the tar archive at
+// path, which may be compressed with gzip, bzip2, xz or zstd. The disk
+// holds the file system without partition table.
+func FromTarball(path string) Base {
+	return &tarballBase{path: path}
+}
+
+type tarballBase struct {
+	path string
+}
+
+func (b *tarballBase) digest() (string, error) {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "tarball sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (b *tarballBase) writeDisk(path string, size int64, t time.Time) (err error) {
+	if size == 0 {
+		if size, err = b.diskSize(); err != nil {
+			return err
+		}
+	}
+	digest, err := b.digest()
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := decompress(in)
+	if err != nil {
+		return fmt.Errorf("imagebuild: %s: %w", b.path, err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	fsys, err := ext4.NewBuilder(f, size,
+		ext4.WithUUID(uuidFromDigest(digest)),
+		ext4.WithTimestamp(t),
+	)
+	if err != nil {
+		return err
+	}
+	if err := fsys.AddTar(r); err != nil {
+		return err
+	}
+	if err := fsys.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// diskSize returns the size of a disk holding the tarball with as much
+// free space again as it needs, rounded up to a MiB, like
+// oci.Image.DiskSize.
+func (b *tarballBase) diskSize() (int64, error) {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return 0, fmt.Errorf("imagebuild: %s: %w", b.path, err)
+	}
+	var blocks, entries int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("imagebuild: %s: %w", b.path, err)
+		}
+		blocks += (hdr.Size + 4095) / 4096
+		entries++
+	}
+	need := blocks*4096 + entries*16384
+	size := 2*need + 64<<20
+	return (size + 1<<20 - 1) &^ (1<<20 - 1), nil
+}
+
+func (b *tarballBase) commandLine(path string) (string, error) {
+	return tarballCommandLine, nil
+}
+
+// FromDisk starts from a copy of the raw disk image at path, which holds
+// an ext4 root file system, with or without partition table. WithDiskSize
+// grows the copy. The kernel command line refers to the root file system
+// by UUID and needs an initial RAM disk.
+func FromDisk(path string) Base {
+	return &diskBase{path: path}
+}
+
+type diskBase struct {
+	path string
+}
+
+// digest hashes the blocks of the disk holding data, so the digest does
+// not depend on which zero blocks the host file system stores as holes.
+func (b *diskBase) digest() (string, error) {
+	lock, err := diskimage.LockFile(b.path, false)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+	f, err := os.Open(b.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	extents, err := diskimage.DataExtents(f)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	var off [8]byte
+	binary.LittleEndian.PutUint64(off[:], uint64(fi.Size()))
+	h.Write(off[:])
+	const blockSize = 4096
+	buf := make([]byte, 1<<20)
+	zero := make([]byte, blockSize)
+	for _, e := range extents {
+		for pos := e.Offset; pos < e.Offset+e.Length; {
+			n := e.Offset + e.Length - pos
+			if n > int64(len(buf)) {
+				n = int64(len(buf))
+			}
+			if _, err := f.ReadAt(buf[:n], pos); err != nil {
+				return "", err
+			}
+			for i := int64(0); i < n; i += blockSize {
+				block := buf[i:n]
+				if len(block) > blockSize {
+					block = block[:blockSize]
+				}
+				if bytes.Equal(block, zero[:len(block)]) {
+					continue
+				}
+				binary.LittleEndian.PutUint64(off[:], uint64(pos+i))
+				h.Write(off[:])
+				h.Write(block)
+			}
+			pos += n
+		}
+	}
+	return "disk sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (b *diskBase) writeDisk(path string, size int64, t time.Time) error {
+	if err := diskimage.CloneDisk(b.path, path); err != nil {
+		return err
+	}
+	if size != 0 {
+		if err := diskimage.ResizeDisk(path, size); err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *diskBase) commandLine(path string) (string, error) {
+	ins, err := guestfs.InspectDisk(path)
+	if err != nil {
+		return "", err
+	}
+	return ins.CommandLine(), nil
+}
+
+// uuidFromDigest derives a version 4 UUID from digest.
+func uuidFromDigest(digest string) [16]byte {
+	var uuid [16]byte
+	sum := sha256.Sum256([]byte(digest))
+	copy(uuid[:], sum[:])
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return uuid
+}
+
+// decompress detects gzip, bzip2, xz and zstd compressed streams.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return xz.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return br, nil
+}
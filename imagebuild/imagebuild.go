@@ -0,0 +1,342 @@
+// Package imagebuild builds guest disk images from a base image and a
+// list of declarative steps, without root privileges and without booting
+// a virtual machine.
+//
+// The base, an OCI image layout, a root file system tarball or an existing
+// raw disk, is turned into a raw disk holding an ext4 file system. The
+// steps then edit that file system in process: they copy files, add users
+// and their SSH keys, enable systemd units and set the hostname. Build
+// writes the disk together with a kernel, an initial RAM disk and a spec
+// booting them:
+//
+//	spec, _ := imagebuild.Build("web.vm", imagebuild.FromTarball("rootfs.tar.gz"), []imagebuild.Step{
+//		imagebuild.Hostname{Name: "web"},
+//		imagebuild.User{Name: "admin", Groups: []string{"sudo"}, AuthorizedKeys: keys},
+//		imagebuild.CopyFile{Src: "nginx.conf", Path: "/etc/nginx/nginx.conf"},
+//		imagebuild.EnableUnit{Name: "nginx.service"},
+//	}, imagebuild.WithCache("cache"))
+//	config, _ := vz.NewVirtualMachineConfigurationFromSpec(spec)
+//
+// Builds are reproducible: the disk only depends on the base, the steps
+// and the options. Each step is identified by a hash of its parameters,
+// the content of the files it copies and the steps before it, so with a
+// cache only the steps after the first changed one run again.
+package imagebuild
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mac-vz/vz/diskimage"
+	"github.com/mac-vz/vz/guestfs"
+	"github.com/mac-vz/vz/vmspec"
+)
+
+// Files written by Build.
+const (
+	DiskName   = "disk.img"
+	KernelName = "kernel"
+	InitrdName = "initrd"
+	SpecName   = "spec.json"
+)
+
+// ErrNoKernel is returned when no kernel is given with WithKernel and the
+// disk holds none.
+var ErrNoKernel = errors.New("imagebuild: no kernel found")
+
+// Option is an option for Build.
+type Option func(o *options)
+
+type options struct {
+	cache       string
+	diskSize    int64
+	timestamp   time.Time
+	kernel      string
+	initrd      string
+	commandLine string
+	cpuCount    uint
+	memorySize  uint64
+}
+
+// WithCache keeps the disk after each step in the directory dir, so later
+// builds sharing the base and the first steps resume from there. Stale
+// entries are not removed.
+func WithCache(dir string) Option {
+	return func(o *options) {
+		o.cache = dir
+	}
+}
+
+// WithDiskSize sets the size of the disk. It defaults to twice the space
+// an OCI image or tarball needs, or the size of a base disk.
+func WithDiskSize(size int64) Option {
+	return func(o *options) {
+		o.diskSize = size
+	}
+}
+
+// WithTimestamp sets the time recorded for the files the steps change and
+// for a tarball base. It defaults to the Unix epoch.
+func WithTimestamp(t time.Time) Option {
+	return func(o *options) {
+		o.timestamp = t
+	}
+}
+
+// WithKernel boots the kernel at path instead of the newest kernel
+// installed on the disk, without initial RAM disk unless WithInitrd is
+// given. The Virtualization framework boots uncompressed kernels only on
+// arm64.
+func WithKernel(path string) Option {
+	return func(o *options) {
+		o.kernel = path
+	}
+}
+
+// WithInitrd boots with the initial RAM disk at path instead of the one
+// matching the kernel installed on the disk.
+func WithInitrd(path string) Option {
+	return func(o *options) {
+		o.initrd = path
+	}
+}
+
+// WithCommandLine appends arguments to the command line of the base.
+func WithCommandLine(args string) Option {
+	return func(o *options) {
+		o.commandLine = args
+	}
+}
+
+// WithCPUCount sets the number of CPUs of the spec.
+func WithCPUCount(n uint) Option {
+	return func(o *options) {
+		o.cpuCount = n
+	}
+}
+
+// WithMemorySize sets the memory size of the spec in bytes, a multiple of
+// 1 MiB.
+func WithMemorySize(size uint64) Option {
+	return func(o *options) {
+		o.memorySize = size
+	}
+}
+
+// Build creates the directory dir holding the disk built from base and
+// steps, the kernel and initial RAM disk booting it and a spec, and
+// returns the spec.
+func Build(dir string, base Base, steps []Step, opts ...Option) (spec *vmspec.VirtualMachineSpec, err error) {
+	o := &options{timestamp: time.Unix(0, 0)}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	spec = &vmspec.VirtualMachineSpec{
+		Kernel:     filepath.Join(dir, KernelName),
+		CPUCount:   o.cpuCount,
+		MemorySize: o.memorySize,
+		Disks:      []vmspec.Disk{{Path: filepath.Join(dir, DiskName)}},
+	}
+	disk := spec.Disks[0].Path
+	if o.cache == "" {
+		err = buildDisk(disk, base, steps, o)
+	} else {
+		err = buildCached(disk, base, steps, o)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.CommandLine, err = base.commandLine(disk); err != nil {
+		return nil, err
+	}
+	if args := strings.TrimSpace(o.commandLine); args != "" {
+		spec.CommandLine += " " + args
+	}
+	initrd := filepath.Join(dir, InitrdName)
+	switch {
+	case o.kernel != "":
+		err = copyFile(spec.Kernel, o.kernel)
+	default:
+		err = extractKernel(disk, spec.Kernel, initrd, o.initrd == "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if o.initrd != "" {
+		if err := copyFile(initrd, o.initrd); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := os.Stat(initrd); err == nil {
+		spec.Initrd = initrd
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	if err := spec.Save(filepath.Join(dir, SpecName)); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// buildDisk writes the base to path and applies all steps to it.
+func buildDisk(path string, base Base, steps []Step, o *options) error {
+	if err := base.writeDisk(path, o.diskSize, o.timestamp); err != nil {
+		return err
+	}
+	return applySteps(path, steps, 0, o.timestamp)
+}
+
+// buildCached builds the disk from the disk cached after the last step
+// whose result is known, caching the disks of the steps run.
+func buildCached(path string, base Base, steps []Step, o *options) error {
+	if err := os.MkdirAll(o.cache, 0755); err != nil {
+		return err
+	}
+	digest, err := base.digest()
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "imagebuild v1\n%s\n%d\n%d\n", digest, o.diskSize, o.timestamp.UnixNano())
+	keys := []string{hex.EncodeToString(h.Sum(nil))}
+	for _, step := range steps {
+		h := sha256.New()
+		fmt.Fprintf(h, "%s\n", keys[len(keys)-1])
+		if err := step.hash(h); err != nil {
+			return err
+		}
+		keys = append(keys, hex.EncodeToString(h.Sum(nil)))
+	}
+	cached := func(i int) string {
+		return filepath.Join(o.cache, keys[i]+".img")
+	}
+
+	i := len(keys) - 1
+	for ; i >= 0; i-- {
+		if _, err := os.Stat(cached(i)); err == nil {
+			break
+		}
+	}
+	if i < 0 {
+		err := cache(cached(0), func(tmp string) error {
+			return base.writeDisk(tmp, o.diskSize, o.timestamp)
+		})
+		if err != nil {
+			return err
+		}
+		i = 0
+	}
+	for ; i < len(steps); i++ {
+		step := steps[i]
+		err := cache(cached(i+1), func(tmp string) error {
+			if err := diskimage.CloneDisk(cached(i), tmp); err != nil {
+				return err
+			}
+			return applySteps(tmp, []Step{step}, i, o.timestamp)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return diskimage.CloneDisk(cached(len(steps)), path)
+}
+
+// cache creates the cache entry path with fn, writing to a temporary file
+// first so interrupted builds leave no entry behind.
+func cache(path string, fn func(tmp string) error) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := fn(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// applySteps opens the root file system of the disk at path and applies
+// steps, starting with step number first, recording t as the time of all
+// changes.
+func applySteps(path string, steps []Step, first int, t time.Time) error {
+	if len(steps) == 0 {
+		return nil
+	}
+	d, err := guestfs.Open(path)
+	if err != nil {
+		return err
+	}
+	d.SetTime(t)
+	for i, step := range steps {
+		if err := step.apply(d.FS, t); err != nil {
+			d.Close()
+			return fmt.Errorf("imagebuild: step %d (%T): %w", first+i+1, step, err)
+		}
+	}
+	return d.Close()
+}
+
+// extractKernel copies the newest kernel installed on the disk at path to
+// kernel and, if withInitrd is set, its initial RAM disk to initrd.
+func extractKernel(path, kernel, initrd string, withInitrd bool) error {
+	ins, err := guestfs.InspectDisk(path)
+	if err != nil {
+		return err
+	}
+	if len(ins.Kernels) == 0 {
+		return ErrNoKernel
+	}
+	k := ins.Kernels[0]
+	d, err := guestfs.Open(path, guestfs.WithReadOnly(), guestfs.WithPartition(k.Partition))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	files := [][2]string{{k.Path, kernel}}
+	if withInitrd && k.Initrd != "" {
+		files = append(files, [2]string{k.Initrd, initrd})
+	}
+	for _, f := range files {
+		data, err := d.ReadFile(f[0])
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(f[1], data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
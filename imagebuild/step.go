@@ -0,0 +1,272 @@
+package imagebuild
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mac-vz/vz/ext4"
+)
+
+// Step is a change to the root file system of a build.
+type Step interface {
+	// hash writes what the result of the step depends on to w.
+	hash(w io.Writer) error
+
+	// apply changes fsys, recording t as the time of the change where
+	// the file system itself does not.
+	apply(fsys *ext4.FS, t time.Time) error
+}
+
+// hashParams writes the type and fields of the step s to w.
+func hashParams(w io.Writer, s Step) error {
+	fmt.Fprintf(w, "%T\n", s)
+	return json.NewEncoder(w).Encode(s)
+}
+
+// File writes a file, creating its parent directories.
+type File struct {
+	Path string
+	Data []byte
+
+	// Mode holds the permission bits. It defaults to 0644.
+	Mode fs.FileMode
+
+	UID int
+	GID int
+}
+
+func (s File) hash(w io.Writer) error {
+	return hashParams(w, s)
+}
+
+func (s File) apply(fsys *ext4.FS, t time.Time) error {
+	mode := s.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	return writeFile(fsys, s.Path, s.Data, mode, s.UID, s.GID)
+}
+
+// CopyFile copies the host file, symbolic link or directory tree Src to
+// Path, creating the parent directories of Path.
+type CopyFile struct {
+	Src  string
+	Path string
+
+	// Mode replaces the permission bits of a copied file. Files in a
+	// directory tree keep their permission bits.
+	Mode fs.FileMode
+
+	// UID and GID own all copied objects.
+	UID int
+	GID int
+}
+
+func (s CopyFile) hash(w io.Writer) error {
+	if err := hashParams(w, s); err != nil {
+		return err
+	}
+	return s.walk(func(rel string, fi os.FileInfo, data []byte, target string) error {
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(w, "%q %o %q %s\n", rel, fi.Mode(), target, hex.EncodeToString(sum[:]))
+		return nil
+	})
+}
+
+func (s CopyFile) apply(fsys *ext4.FS, t time.Time) error {
+	return s.walk(func(rel string, fi os.FileInfo, data []byte, target string) error {
+		name := path.Join(s.Path, rel)
+		switch {
+		case fi.IsDir():
+			if err := mkdirAll(fsys, name); err != nil {
+				return err
+			}
+			if err := fsys.Chmod(name, fi.Mode()); err != nil {
+				return err
+			}
+			return fsys.Chown(name, s.UID, s.GID)
+		case fi.Mode()&fs.ModeSymlink != 0:
+			return symlink(fsys, target, name)
+		}
+		mode := fi.Mode()
+		if s.Mode != 0 && rel == "" {
+			mode = s.Mode
+		}
+		return writeFile(fsys, name, data, mode, s.UID, s.GID)
+	})
+}
+
+// walk calls fn for Src and, if it is a directory, everything below it in
+// lexical order, with the path relative to Src in slash form, the
+// contents of regular files and the targets of symbolic links. Other
+// objects are not supported.
+func (s CopyFile) walk(fn func(rel string, fi os.FileInfo, data []byte, target string) error) error {
+	return filepath.Walk(s.Src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.Src, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+		var (
+			data   []byte
+			target string
+		)
+		switch {
+		case fi.Mode().IsRegular():
+			data, err = ioutil.ReadFile(p)
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err = os.Readlink(p)
+		case !fi.IsDir():
+			err = fmt.Errorf("%s: unsupported file type %v", p, fi.Mode().Type())
+		}
+		if err != nil {
+			return err
+		}
+		return fn(rel, fi, data, target)
+	})
+}
+
+// Hostname sets the hostname in /etc/hostname and maps it to 127.0.1.1 in
+// /etc/hosts.
+type Hostname struct {
+	Name string
+}
+
+func (s Hostname) hash(w io.Writer) error {
+	return hashParams(w, s)
+}
+
+func (s Hostname) apply(fsys *ext4.FS, t time.Time) error {
+	if !validHostname(s.Name) {
+		return fmt.Errorf("invalid hostname %q", s.Name)
+	}
+	if err := writeFile(fsys, "/etc/hostname", []byte(s.Name+"\n"), 0644, 0, 0); err != nil {
+		return err
+	}
+	hosts, err := fsys.ReadFile("/etc/hosts")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	entry := "127.0.1.1\t" + s.Name
+	if short := strings.SplitN(s.Name, ".", 2)[0]; short != s.Name {
+		entry += " " + short
+	}
+	var lines []string
+	found := false
+	for _, line := range strings.Split(strings.TrimSuffix(string(hosts), "\n"), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "127.0.1.1" {
+			if found {
+				continue
+			}
+			line, found = entry, true
+		}
+		lines = append(lines, line)
+	}
+	if !found {
+		if len(hosts) == 0 {
+			lines = []string{"127.0.0.1\tlocalhost"}
+		}
+		lines = append(lines, entry)
+	}
+	return writeFile(fsys, "/etc/hosts", []byte(strings.Join(lines, "\n")+"\n"), 0644, 0, 0)
+}
+
+// validHostname reports whether name is a valid DNS name of at most 64
+// characters.
+func validHostname(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// mkdirAll creates the directory name and its missing parents with
+// permissions 0755, following symbolic links to directories.
+func mkdirAll(fsys *ext4.FS, name string) error {
+	dir := "/"
+	for _, elem := range strings.Split(path.Clean("/"+name), "/") {
+		if elem == "" {
+			continue
+		}
+		dir = path.Join(dir, elem)
+		fi, err := fsys.Stat(dir)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if err := fsys.Mkdir(dir, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case !fi.IsDir():
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+	}
+	return nil
+}
+
+// writeFile writes the regular file name with the permission bits mode
+// and owner uid and gid, replacing anything but a directory at name.
+func writeFile(fsys *ext4.FS, name string, data []byte, mode fs.FileMode, uid, gid int) error {
+	if err := mkdirAll(fsys, path.Dir(path.Clean("/"+name))); err != nil {
+		return err
+	}
+	if fi, err := fsys.Lstat(name); err == nil && !fi.Mode().IsRegular() && !fi.IsDir() {
+		if err := fsys.Remove(name); err != nil {
+			return err
+		}
+	}
+	if err := fsys.WriteFile(name, data, mode); err != nil {
+		return err
+	}
+	if err := fsys.Chmod(name, mode); err != nil {
+		return err
+	}
+	return fsys.Chown(name, uid, gid)
+}
+
+// symlink creates name as a symbolic link to target, replacing anything
+// but a directory at name.
+func symlink(fsys *ext4.FS, target, name string) error {
+	if err := mkdirAll(fsys, path.Dir(path.Clean("/"+name))); err != nil {
+		return err
+	}
+	if fi, err := fsys.Lstat(name); err == nil {
+		if old, err := fsys.Readlink(name); err == nil && old == target {
+			return nil
+		}
+		if fi.IsDir() {
+			return &fs.PathError{Op: "symlink", Path: name, Err: errors.New("is a directory")}
+		}
+		if err := fsys.Remove(name); err != nil {
+			return err
+		}
+	}
+	return fsys.Symlink(target, name)
+}
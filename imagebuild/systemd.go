@@ -0,0 +1,185 @@
+package imagebuild
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mac-vz/vz/ext4"
+)
+
+// unitDirs are the directories systemd loads unit files from, in order of
+// precedence.
+var unitDirs = []string{
+	"/etc/systemd/system",
+	"/usr/local/lib/systemd/system",
+	"/usr/lib/systemd/system",
+	"/lib/systemd/system",
+}
+
+// EnableUnit enables a systemd unit like systemctl enable: it creates the
+// symbolic links requested by the [Install] section of the unit file and
+// enables the units named by Also=.
+type EnableUnit struct {
+	// Name is the unit name, such as "ssh.service" or "getty@hvc0.service".
+	Name string
+}
+
+func (s EnableUnit) hash(w io.Writer) error {
+	return hashParams(w, s)
+}
+
+func (s EnableUnit) apply(fsys *ext4.FS, t time.Time) error {
+	return enableUnit(fsys, s.Name, map[string]bool{})
+}
+
+func enableUnit(fsys *ext4.FS, name string, seen map[string]bool) error {
+	if seen[name] {
+		return nil
+	}
+	seen[name] = true
+	file, err := findUnit(fsys, name)
+	if err != nil {
+		return err
+	}
+	data, err := fsys.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	install, err := parseInstall(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if len(install) == 0 {
+		return fmt.Errorf("unit %s has no [Install] section", name)
+	}
+	link := name
+	if prefix, instance, suffix := splitUnitName(name); instance == "" && strings.HasSuffix(prefix, "@") {
+		// A template is enabled with its default instance.
+		def := last(install["DefaultInstance"])
+		if def == "" {
+			return fmt.Errorf("template unit %s has no default instance", name)
+		}
+		link = prefix + def + suffix
+	}
+	for _, key := range []string{"WantedBy", "RequiredBy"} {
+		dir := ".wants"
+		if key == "RequiredBy" {
+			dir = ".requires"
+		}
+		for _, target := range install[key] {
+			if err := symlink(fsys, file, path.Join(unitDirs[0], target+dir, link)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, alias := range install["Alias"] {
+		if err := symlink(fsys, file, path.Join(unitDirs[0], alias)); err != nil {
+			return err
+		}
+	}
+	for _, also := range install["Also"] {
+		if err := enableUnit(fsys, also, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findUnit returns the path of the unit file of name, which is the file of
+// its template for an instance.
+func findUnit(fsys *ext4.FS, name string) (string, error) {
+	names := []string{name}
+	if prefix, instance, suffix := splitUnitName(name); instance != "" {
+		names = append(names, prefix+suffix)
+	}
+	for _, n := range names {
+		for _, dir := range unitDirs {
+			p := path.Join(dir, n)
+			fi, err := fsys.Lstat(p)
+			if err != nil {
+				continue
+			}
+			if fi.Mode()&fs.ModeSymlink != 0 {
+				// A link in /etc pointing to /dev/null masks the unit.
+				if target, err := fsys.Readlink(p); err == nil && target == "/dev/null" {
+					return "", fmt.Errorf("unit %s is masked", name)
+				}
+			}
+			if fi, err := fsys.Stat(p); err == nil && fi.Mode().IsRegular() {
+				return p, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unit %s: %w", name, fs.ErrNotExist)
+}
+
+// splitUnitName splits a unit name such as "getty@hvc0.service" into
+// "getty@", "hvc0" and ".service". The instance is empty for templates and
+// the prefix holds the whole name before the suffix for other units.
+func splitUnitName(name string) (prefix, instance, suffix string) {
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name, suffix = name[:i], name[i:]
+	}
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		return name[:i+1], name[i+1:], suffix
+	}
+	return name, "", suffix
+}
+
+// parseInstall returns the settings of the [Install] section of a unit
+// file, each a list of whitespace separated values. An empty assignment
+// resets the list.
+func parseInstall(data []byte) (map[string][]string, error) {
+	settings := map[string][]string{}
+	section := ""
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	var line string
+	for sc.Scan() {
+		line += strings.TrimSpace(sc.Text())
+		if strings.HasSuffix(line, "\\") {
+			line = strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		l := line
+		line = ""
+		switch {
+		case l == "" || l[0] == '#' || l[0] == ';':
+		case l[0] == '[':
+			section = strings.Trim(l, "[]")
+		case section == "Install":
+			i := strings.IndexByte(l, '=')
+			if i < 0 {
+				return nil, errors.New("invalid line in [Install] section: " + l)
+			}
+			key, value := strings.TrimSpace(l[:i]), strings.Fields(l[i+1:])
+			if len(value) == 0 {
+				settings[key] = []string{}
+				continue
+			}
+			settings[key] = append(settings[key], value...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for key, values := range settings {
+		if len(values) == 0 {
+			delete(settings, key)
+		}
+	}
+	return settings, nil
+}
+
+func last(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
@@ -0,0 +1,416 @@
+package imagebuild
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mac-vz/vz/ext4"
+)
+
+// Range of IDs given to users and groups without an explicit ID.
+const (
+	firstID = 1000
+	lastID  = 59999
+)
+
+// User adds a user account with a home directory, like useradd -m, or
+// updates an existing one, and installs its SSH keys.
+//
+// An existing account keeps its IDs, home directory and shell; it is added
+// to Groups, its password is replaced if PasswordHash is set and
+// AuthorizedKeys are appended to those it has.
+type User struct {
+	Name string
+
+	// UID defaults to the first free ID from 1000 on. The primary group
+	// is a new group named after the user, with the same ID if it is free.
+	UID int
+
+	// Comment is the GECOS field, usually the full name.
+	Comment string
+
+	// Home defaults to /home/Name and Shell to /bin/sh.
+	Home  string
+	Shell string
+
+	// Groups are the names of existing groups the user is added to.
+	Groups []string
+
+	// PasswordHash is the crypt(3) hash of the password, such as the
+	// output of "openssl passwd -6". Password logins are disabled
+	// without one.
+	PasswordHash string
+
+	// AuthorizedKeys are lines for ~/.ssh/authorized_keys.
+	AuthorizedKeys []string
+}
+
+func (s User) hash(w io.Writer) error {
+	return hashParams(w, s)
+}
+
+func (s User) apply(fsys *ext4.FS, t time.Time) error {
+	if !validName(s.Name) {
+		return fmt.Errorf("invalid user name %q", s.Name)
+	}
+	passwd, err := readDB(fsys, "/etc/passwd")
+	if err != nil {
+		return err
+	}
+	group, err := readDB(fsys, "/etc/group")
+	if err != nil {
+		return err
+	}
+	for _, g := range s.Groups {
+		if group.find(g) == nil {
+			return fmt.Errorf("group %q not found", g)
+		}
+	}
+
+	pw := passwd.find(s.Name)
+	created := pw == nil
+	if created {
+		if group.find(s.Name) != nil {
+			return fmt.Errorf("group %q already exists", s.Name)
+		}
+		uid := s.UID
+		if uid == 0 {
+			uid = passwd.freeID(2)
+		} else if passwd.findID(2, uid) != nil {
+			return fmt.Errorf("user ID %d already in use", uid)
+		}
+		gid := uid
+		if group.findID(2, gid) != nil {
+			gid = group.freeID(2)
+		}
+		home, shell := s.Home, s.Shell
+		if home == "" {
+			home = "/home/" + s.Name
+		}
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		pw = []string{s.Name, "x", strconv.Itoa(uid), strconv.Itoa(gid), s.Comment, home, shell}
+		for _, f := range pw {
+			if strings.ContainsAny(f, ":\n") {
+				return fmt.Errorf("invalid field %q for user %s", f, s.Name)
+			}
+		}
+		passwd.add(pw)
+		group.add([]string{s.Name, "x", strconv.Itoa(gid), ""})
+	}
+	for _, g := range s.Groups {
+		addMember(group.find(g), 3, s.Name)
+	}
+	if err := passwd.write(fsys); err != nil {
+		return err
+	}
+	if err := group.write(fsys); err != nil {
+		return err
+	}
+	if err := s.updateShadow(fsys, created); err != nil {
+		return err
+	}
+
+	uid, _ := strconv.Atoi(pw[2])
+	gid, _ := strconv.Atoi(pw[3])
+	home := pw[5]
+	if !created && len(s.AuthorizedKeys) == 0 {
+		return nil
+	}
+	if err := createHome(fsys, home, uid, gid); err != nil {
+		return err
+	}
+	if len(s.AuthorizedKeys) == 0 {
+		return nil
+	}
+	return addAuthorizedKeys(fsys, home, uid, gid, s.AuthorizedKeys)
+}
+
+// updateShadow adds the user to /etc/shadow and /etc/gshadow, or sets the
+// password of an existing user, if the files exist.
+//
+// The date of the last password change is left empty, which disables
+// password aging. The build timestamp defaults to the epoch, and a change
+// on day 0 makes PAM demand a new password before any login, including
+// logins with SSH keys.
+func (s User) updateShadow(fsys *ext4.FS, created bool) error {
+	shadow, err := readDB(fsys, "/etc/shadow")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hash := s.PasswordHash
+	if strings.ContainsAny(hash, ":\n") {
+		return fmt.Errorf("invalid password hash for user %s", s.Name)
+	}
+	if sp := shadow.find(s.Name); sp != nil {
+		if hash != "" {
+			sp[1], sp[2] = hash, ""
+		}
+	} else {
+		if hash == "" {
+			hash = "!"
+		}
+		shadow.add([]string{s.Name, hash, "", "0", "99999", "7", "", "", ""})
+	}
+	if err := shadow.write(fsys); err != nil {
+		return err
+	}
+
+	gshadow, err := readDB(fsys, "/etc/gshadow")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if created && gshadow.find(s.Name) == nil {
+		gshadow.add([]string{s.Name, "!", "", ""})
+	}
+	for _, g := range s.Groups {
+		if entry := gshadow.find(g); entry != nil {
+			addMember(entry, 3, s.Name)
+		}
+	}
+	return gshadow.write(fsys)
+}
+
+// createHome creates the home directory of a user, with the contents of
+// /etc/skel, unless it exists.
+func createHome(fsys *ext4.FS, home string, uid, gid int) error {
+	if _, err := fsys.Lstat(home); err == nil {
+		return nil
+	}
+	if err := mkdirAll(fsys, home); err != nil {
+		return err
+	}
+	mode := fs.FileMode(0755)
+	if uid == 0 {
+		mode = 0700
+	}
+	if err := fsys.Chmod(home, mode); err != nil {
+		return err
+	}
+	if err := fsys.Chown(home, uid, gid); err != nil {
+		return err
+	}
+	if _, err := fsys.Stat("/etc/skel"); err != nil {
+		return nil
+	}
+	return copyTree(fsys, "/etc/skel", home, uid, gid)
+}
+
+// copyTree copies the contents of the directory src to the existing
+// directory dst, owned by uid and gid.
+func copyTree(fsys *ext4.FS, src, dst string, uid, gid int) error {
+	entries, err := fsys.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		from, to := path.Join(src, e.Name()), path.Join(dst, e.Name())
+		fi, err := fsys.Lstat(from)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			if err := fsys.Mkdir(to, fi.Mode()); err != nil {
+				return err
+			}
+			if err := fsys.Chown(to, uid, gid); err != nil {
+				return err
+			}
+			if err := copyTree(fsys, from, to, uid, gid); err != nil {
+				return err
+			}
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := fsys.Readlink(from)
+			if err != nil {
+				return err
+			}
+			if err := fsys.Symlink(target, to); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			data, err := fsys.ReadFile(from)
+			if err != nil {
+				return err
+			}
+			if err := writeFile(fsys, to, data, fi.Mode().Perm(), uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addAuthorizedKeys appends the keys missing from ~/.ssh/authorized_keys.
+func addAuthorizedKeys(fsys *ext4.FS, home string, uid, gid int, keys []string) error {
+	dir := path.Join(home, ".ssh")
+	if _, err := fsys.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		if err := fsys.Mkdir(dir, 0700); err != nil {
+			return err
+		}
+		if err := fsys.Chown(dir, uid, gid); err != nil {
+			return err
+		}
+	}
+	name := path.Join(dir, "authorized_keys")
+	data, err := fsys.ReadFile(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	have := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		have[strings.TrimSpace(line)] = true
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" || have[key] {
+			continue
+		}
+		if strings.ContainsRune(key, '\n') {
+			return errors.New("authorized key spans several lines")
+		}
+		have[key] = true
+		data = append(data, key+"\n"...)
+	}
+	return writeFile(fsys, name, data, 0600, uid, gid)
+}
+
+// validName reports whether name is a portable user or group name.
+func validName(name string) bool {
+	if name == "" || len(name) > 32 || name[0] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// db is a colon separated account database such as /etc/passwd.
+type db struct {
+	name    string
+	entries [][]string
+	mode    fs.FileMode
+	uid     int
+	gid     int
+}
+
+// readDB reads the database name, keeping comments and blank lines as
+// entries of one field.
+func readDB(fsys *ext4.FS, name string) (*db, error) {
+	data, err := fsys.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fsys.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	d := &db{name: name, mode: fi.Mode().Perm(), uid: -1, gid: -1}
+	if in, ok := fi.Sys().(*ext4.Inode); ok {
+		d.uid, d.gid = int(in.UID), int(in.GID)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" && len(data) == 0 {
+			break
+		}
+		d.entries = append(d.entries, strings.Split(line, ":"))
+	}
+	return d, nil
+}
+
+func (d *db) find(name string) []string {
+	for _, e := range d.entries {
+		if len(e) > 1 && e[0] == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// findID returns the entry with the numeric ID id in field i.
+func (d *db) findID(i, id int) []string {
+	for _, e := range d.entries {
+		if len(e) > i && e[i] == strconv.Itoa(id) {
+			return e
+		}
+	}
+	return nil
+}
+
+// freeID returns the ID after the highest one in field i in the range of
+// IDs given out automatically, or the start of the range.
+func (d *db) freeID(i int) int {
+	var ids []int
+	for _, e := range d.entries {
+		if len(e) <= i {
+			continue
+		}
+		if id, err := strconv.Atoi(e[i]); err == nil && id >= firstID && id <= lastID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return firstID
+	}
+	sort.Ints(ids)
+	if next := ids[len(ids)-1] + 1; next <= lastID {
+		return next
+	}
+	for id := firstID; ; id++ {
+		if d.findID(i, id) == nil {
+			return id
+		}
+	}
+}
+
+func (d *db) add(entry []string) {
+	d.entries = append(d.entries, entry)
+}
+
+// write replaces the database, keeping its permissions and owner.
+func (d *db) write(fsys *ext4.FS) error {
+	var b strings.Builder
+	for _, e := range d.entries {
+		b.WriteString(strings.Join(e, ":"))
+		b.WriteByte('\n')
+	}
+	return writeFile(fsys, d.name, []byte(b.String()), d.mode, d.uid, d.gid)
+}
+
+// addMember adds user to the comma separated member list in field i of
+// entry.
+func addMember(entry []string, i int, user string) {
+	if len(entry) <= i {
+		return
+	}
+	var members []string
+	if entry[i] != "" {
+		members = strings.Split(entry[i], ",")
+	}
+	for _, m := range members {
+		if m == user {
+			return
+		}
+	}
+	entry[i] = strings.Join(append(members, user), ",")
+}
@@ -0,0 +1,495 @@
+// Package imagecache downloads kernels, initial ramdisks and disk images
+// into a local cache, so they can be passed to NewLinuxBootLoader and
+// NewDiskImageStorageDeviceAttachment by path.
+//
+// Files are fetched relative to a base URL, such as a distribution mirror
+// or a local HTTP mirror, and verified against a SHA-256 or SHA-512
+// digest, typically taken from the mirror's checksum file. Interrupted
+// downloads are resumed. Files compressed with gzip, xz, zstd or bzip2 are
+// decompressed on ingest, and the results are stored by the SHA-256 of
+// their content, so a file published under several names is stored once.
+//
+// Cached files are shared: attach disk images read-only, or clone them
+// with diskimage.CloneDisk first.
+//
+// A cache in dir is laid out as
+//
+//	dir/blobs/sha256/<hex>       decompressed content
+//	dir/refs/<alg>/<hex>         digest of a download -> blob digest
+//	dir/partial/<alg>-<hex>      downloads in progress
+//	dir/manifests/<hex>          checksum files, for offline use
+package imagecache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mac-vz/vz/diskimage"
+)
+
+var (
+	// ErrOffline is returned in offline mode when a file is not cached.
+	ErrOffline = errors.New("imagecache: not cached and offline")
+
+	// ErrDigestMismatch is returned when a download does not match its
+	// digest.
+	ErrDigestMismatch = errors.New("imagecache: digest mismatch")
+
+	// ErrNotInManifest is returned by Fetch when a file is not listed in
+	// the checksum file.
+	ErrNotInManifest = errors.New("imagecache: file not in manifest")
+)
+
+// Cache is a local cache of downloaded images.
+type Cache struct {
+	dir     string
+	base    *url.URL
+	client  *http.Client
+	offline bool
+
+	mu       sync.Mutex
+	inflight map[Digest]*sync.Mutex
+}
+
+// Option is an option for New.
+type Option func(c *Cache)
+
+// WithBaseURL sets the URL that file names are resolved against.
+func WithBaseURL(u *url.URL) Option {
+	return func(c *Cache) {
+		c.base = u
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for downloads. It defaults to
+// http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Cache) {
+		c.client = client
+	}
+}
+
+// WithOffline disables downloads. Only cached files and checksum files can
+// be used.
+func WithOffline() Option {
+	return func(c *Cache) {
+		c.offline = true
+	}
+}
+
+// New opens the cache in dir, creating it if needed.
+func New(dir string, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		dir:      dir,
+		client:   http.DefaultClient,
+		inflight: make(map[Digest]*sync.Mutex),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	for _, d := range []string{"blobs/sha256", "refs/sha256", "refs/sha512", "partial", "manifests"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// resolve returns the URL of name, which is either absolute or relative
+// to the base URL.
+func (c *Cache) resolve(name string) (*url.URL, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	if u.IsAbs() {
+		return u, nil
+	}
+	if c.base == nil {
+		return nil, fmt.Errorf("imagecache: relative name %q without base URL", name)
+	}
+	return c.base.ResolveReference(u), nil
+}
+
+// Manifest returns the checksum file name. It is downloaded unless the
+// cache is offline, in which case the last downloaded copy is used.
+func (c *Cache) Manifest(ctx context.Context, name string) (Manifest, error) {
+	u, err := c.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(u.String()))
+	cached := filepath.Join(c.dir, "manifests", hex.EncodeToString(sum[:]))
+	if c.offline {
+		f, err := os.Open(cached)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("%s: %w", u, ErrOffline)
+			}
+			return nil, err
+		}
+		defer f.Close()
+		return ParseManifest(f)
+	}
+	resp, err := c.get(ctx, u, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	m, err := ParseManifest(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(cached, data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Fetch returns the path of the cached file name, verified against its
+// digest in the checksum file manifest, downloading it if needed. Names
+// are resolved relative to the manifest.
+func (c *Cache) Fetch(ctx context.Context, manifest, name string) (string, error) {
+	m, err := c.Manifest(ctx, manifest)
+	if err != nil {
+		return "", err
+	}
+	d, ok := m[name]
+	if !ok {
+		return "", fmt.Errorf("%s: %w", name, ErrNotInManifest)
+	}
+	u, err := c.resolve(manifest)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	return c.Get(ctx, u.ResolveReference(ref).String(), d)
+}
+
+// Get returns the path of the cached file with digest, downloading name
+// if it is not cached. Compressed files are verified before they are
+// decompressed, and the path refers to the decompressed content.
+func (c *Cache) Get(ctx context.Context, name string, digest Digest) (string, error) {
+	digest, err := ParseDigest(string(digest))
+	if err != nil {
+		return "", err
+	}
+	mu := c.lockDigest(digest)
+	defer mu.Unlock()
+	if p, err := c.lookup(digest); err == nil {
+		return p, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if c.offline {
+		return "", fmt.Errorf("%s: %w", name, ErrOffline)
+	}
+	u, err := c.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	part := filepath.Join(c.dir, "partial", digest.Algorithm()+"-"+digest.Hex())
+	if err := c.download(ctx, u, part); err != nil {
+		return "", err
+	}
+	if err := verify(part, digest); err != nil {
+		os.Remove(part)
+		return "", fmt.Errorf("%s: %w", u, err)
+	}
+	blob, err := c.ingest(part)
+	if err != nil {
+		return "", err
+	}
+	if err := writeFile(c.refPath(digest), []byte(blob)); err != nil {
+		return "", err
+	}
+	return c.lookup(digest)
+}
+
+// lockDigest serializes downloads of the same file within the process.
+func (c *Cache) lockDigest(d Digest) *sync.Mutex {
+	c.mu.Lock()
+	mu, ok := c.inflight[d]
+	if !ok {
+		mu = &sync.Mutex{}
+		c.inflight[d] = mu
+	}
+	c.mu.Unlock()
+	mu.Lock()
+	return mu
+}
+
+func (c *Cache) refPath(d Digest) string {
+	return filepath.Join(c.dir, "refs", d.Algorithm(), d.Hex())
+}
+
+func (c *Cache) blobPath(d Digest) string {
+	return filepath.Join(c.dir, "blobs", "sha256", d.Hex())
+}
+
+// lookup returns the path of the cached file with digest d and marks it
+// as used.
+func (c *Cache) lookup(d Digest) (string, error) {
+	data, err := ioutil.ReadFile(c.refPath(d))
+	if err != nil {
+		return "", err
+	}
+	blob, err := ParseDigest(string(data))
+	if err != nil {
+		return "", err
+	}
+	p := c.blobPath(blob)
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// get issues a GET request for u starting at offset.
+func (c *Cache) get(ctx context.Context, u *url.URL, offset int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK,
+		resp.StatusCode == http.StatusPartialContent && offset > 0,
+		resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		return resp, nil
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("imagecache: GET %s: %s", u, resp.Status)
+}
+
+// download downloads u to part, resuming a previous download.
+func (c *Cache) download(ctx context.Context, u *url.URL, part string) error {
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Another process downloading the same file holds the lock.
+	lock, err := diskimage.LockFile(part, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	resp, err := c.get(ctx, u, offset)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The download was complete.
+		return nil
+	case http.StatusOK:
+		// The server ignored the range.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			return fmt.Errorf("imagecache: GET %s: unexpected range %q", u, resp.Header.Get("Content-Range"))
+		}
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return fmt.Errorf("imagecache: GET %s: %w", u, err)
+	}
+	return f.Sync()
+}
+
+// verify checks that the file at path has digest d.
+func verify(path string, d Digest) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := d.newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := sumDigest(d.Algorithm(), h); got != d {
+		return fmt.Errorf("%w: got %s, want %s", ErrDigestMismatch, got, d)
+	}
+	return nil
+}
+
+// ingest moves the verified download part into the blobs, decompressing
+// it, and returns the digest of the blob.
+func (c *Cache) ingest(part string) (Digest, error) {
+	in, err := os.Open(part)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	br := bufio.NewReaderSize(in, 1<<20)
+	dr, err := decompressor(br)
+	if err != nil {
+		return "", err
+	}
+	src := io.Reader(br)
+	if dr != nil {
+		defer dr.Close()
+		src = dr
+	}
+	out, err := ioutil.TempFile(filepath.Join(c.dir, "blobs"), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	tmp := out.Name()
+	defer func() {
+		out.Close()
+		os.Remove(tmp)
+		os.Remove(part)
+	}()
+	h := sha256.New()
+	w := &sparseWriter{f: out}
+	if _, err := io.Copy(io.MultiWriter(w, h), src); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return "", err
+	}
+	blob := sumDigest("sha256", h)
+	if _, err := os.Stat(c.blobPath(blob)); err == nil {
+		// The same content was cached under another digest.
+		return blob, nil
+	}
+	return blob, os.Rename(tmp, c.blobPath(blob))
+}
+
+// GC removes cached files that were not used for maxAge, and downloads
+// that were interrupted longer than maxAge ago, and returns the number of
+// bytes freed. Files that are attached to a running virtual machine are
+// kept.
+func (c *Cache) GC(maxAge time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cutoff := time.Now().Add(-maxAge)
+	var freed int64
+	remove := func(p string, fi os.FileInfo) error {
+		lock, err := diskimage.LockFile(p, true)
+		if errors.Is(err, diskimage.ErrInUse) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		freed += fi.Size()
+		return nil
+	}
+	for _, d := range []string{"blobs/sha256", "partial"} {
+		entries, err := ioutil.ReadDir(filepath.Join(c.dir, d))
+		if err != nil {
+			return freed, err
+		}
+		for _, fi := range entries {
+			if fi.IsDir() || fi.ModTime().After(cutoff) {
+				continue
+			}
+			if err := remove(filepath.Join(c.dir, d, fi.Name()), fi); err != nil {
+				return freed, err
+			}
+		}
+	}
+
+	// Drop references to removed blobs.
+	for _, alg := range []string{"sha256", "sha512"} {
+		dir := filepath.Join(c.dir, "refs", alg)
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return freed, err
+		}
+		for _, fi := range entries {
+			p := filepath.Join(dir, fi.Name())
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return freed, err
+			}
+			blob, err := ParseDigest(string(data))
+			if err == nil {
+				if _, err = os.Stat(c.blobPath(blob)); err == nil {
+					continue
+				}
+			}
+			if err := os.Remove(p); err != nil {
+				return freed, err
+			}
+		}
+	}
+	return freed, nil
+}
+
+// writeFile atomically writes data to path.
+func writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package imagecache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// decompressor returns a reader decompressing r if it starts with the
+// magic number of a gzip, xz, zstd or bzip2 stream, or nil if r is not
+// compressed.
+func decompressor(r *bufio.Reader) (io.ReadCloser, error) {
+	magic, _ := r.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(r)
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	}
+	return nil, nil
+}
+
+// sparseWriter writes to a file, leaving blocks of zeros as holes.
+type sparseWriter struct {
+	f   *os.File
+	off int64
+}
+
+const sparseBlock = 4096
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	// Runs of non-zero blocks are written at once.
+	run, runOff := 0, w.off
+	flush := func(end int) error {
+		if end > run {
+			if _, err := w.f.WriteAt(p[run:end], runOff); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := 0; i < len(p); {
+		n := sparseBlock - int(w.off%sparseBlock)
+		if n > len(p)-i {
+			n = len(p) - i
+		}
+		if isZero(p[i : i+n]) {
+			if err := flush(i); err != nil {
+				return 0, err
+			}
+			run, runOff = i+n, w.off+int64(n)
+		}
+		w.off += int64(n)
+		i += n
+	}
+	if err := flush(len(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sets the size of the file to the bytes written.
+func (w *sparseWriter) Close() error {
+	return w.f.Truncate(w.off)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
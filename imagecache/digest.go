@@ -0,0 +1,101 @@
+package imagecache
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Digest is a hash of a file in the form "sha256:<hex>" or "sha512:<hex>".
+type Digest string
+
+// ParseDigest parses a digest. A bare hex digest is accepted as well; its
+// algorithm is inferred from its length.
+func ParseDigest(s string) (Digest, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	alg, h := "", s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		alg, h = s[:i], s[i+1:]
+	}
+	if _, err := hex.DecodeString(h); err != nil {
+		return "", fmt.Errorf("imagecache: invalid digest %q", s)
+	}
+	switch {
+	case alg == "" && len(h) == 2*sha256.Size, alg == "sha256" && len(h) == 2*sha256.Size:
+		return Digest("sha256:" + h), nil
+	case alg == "" && len(h) == 2*sha512.Size, alg == "sha512" && len(h) == 2*sha512.Size:
+		return Digest("sha512:" + h), nil
+	}
+	return "", fmt.Errorf("imagecache: invalid digest %q", s)
+}
+
+// Algorithm returns the hash algorithm of d, "sha256" or "sha512".
+func (d Digest) Algorithm() string {
+	if i := strings.IndexByte(string(d), ':'); i >= 0 {
+		return string(d[:i])
+	}
+	return ""
+}
+
+// Hex returns the hex encoded hash of d.
+func (d Digest) Hex() string {
+	return string(d[strings.IndexByte(string(d), ':')+1:])
+}
+
+func (d Digest) newHash() hash.Hash {
+	if d.Algorithm() == "sha512" {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+func sumDigest(alg string, h hash.Hash) Digest {
+	return Digest(alg + ":" + hex.EncodeToString(h.Sum(nil)))
+}
+
+// Manifest maps file names to their digests.
+type Manifest map[string]Digest
+
+// bsdLine matches the output of "sha256sum --tag" and BSD sha256.
+var bsdLine = regexp.MustCompile(`^(SHA256|SHA512) ?\((.+)\) ?= ?([0-9a-fA-F]+)$`)
+
+// ParseManifest parses a checksum file in the format written by sha256sum
+// and sha512sum, with or without --tag, as published by most distribution
+// mirrors. Blank lines, comments and PGP armor are ignored.
+func ParseManifest(r io.Reader) (Manifest, error) {
+	m := make(Manifest)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "-----") {
+			continue
+		}
+		var name, sum string
+		if sub := bsdLine.FindStringSubmatch(line); sub != nil {
+			name, sum = sub[2], strings.ToLower(sub[1])+":"+sub[3]
+		} else {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			sum, name = fields[0], strings.TrimPrefix(fields[1], "*")
+		}
+		d, err := ParseDigest(sum)
+		if err != nil {
+			// Other lines of signed checksum files, like "Hash: SHA256".
+			continue
+		}
+		m[path.Clean(strings.TrimPrefix(name, "./"))] = d
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
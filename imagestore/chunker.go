@@ -0,0 +1,95 @@
+package imagestore
+
+import "io"
+
+// Content-defined chunking parameters. Chunk boundaries depend only on
+// the surrounding data, so an insertion into an image only changes the
+// chunks around it.
+const (
+	minChunk = 16 << 10
+	avgChunk = 64 << 10
+	maxChunk = 256 << 10
+
+	// The chunker uses a stricter mask before avgChunk and a looser one
+	// after it, which narrows the chunk size distribution (FastCDC).
+	maskS = uint64(1<<18-1) << (64 - 18)
+	maskL = uint64(1<<14-1) << (64 - 14)
+)
+
+// gear is the table of the rolling gear hash. It must never change, or
+// images imported before and after stop sharing chunks.
+var gear = func() [256]uint64 {
+	var t [256]uint64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// cut returns the length of the chunk at the start of b.
+func cut(b []byte) int {
+	n := len(b)
+	if n <= minChunk {
+		return n
+	}
+	if n > maxChunk {
+		n = maxChunk
+	}
+	normal := avgChunk
+	if n < normal {
+		normal = n
+	}
+	var h uint64
+	i := minChunk
+	for ; i < normal; i++ {
+		h = h<<1 + gear[b[i]]
+		if h&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + gear[b[i]]
+		if h&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunker splits a stream into content-defined chunks.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, maxChunk)}
+}
+
+// next returns the next chunk, or io.EOF at the end of the stream.
+func (c *chunker) next() ([]byte, error) {
+	for c.n < len(c.buf) && !c.eof {
+		m, err := c.r.Read(c.buf[c.n:])
+		c.n += m
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+	l := cut(c.buf[:c.n])
+	chunk := append([]byte(nil), c.buf[:l]...)
+	c.n = copy(c.buf, c.buf[l:c.n])
+	return chunk, nil
+}
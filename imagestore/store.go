@@ -0,0 +1,553 @@
+// Package imagestore implements a local store of raw disk images that
+// deduplicates them across images.
+//
+// Images are split into content-defined chunks, which are compressed with
+// zstd and stored under the SHA-256 hash of their uncompressed content, so
+// images that differ only slightly share most of their chunks. Each image
+// is described by a manifest listing its chunks; ranges that are holes or
+// zeros are not stored at all. Materialize writes an image back to a
+// sparse raw file, verifying every chunk against its hash.
+//
+// Because chunks are addressed by content, images can be distributed
+// incrementally: a receiver fetches the manifest, asks Missing which
+// chunks it lacks, and transfers only those with Chunk and PutChunk.
+//
+// A store in dir is laid out as
+//
+//	dir/chunks/ab/abcdef….zst
+//	dir/images/name.json
+package imagestore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mac-vz/vz/diskimage"
+)
+
+var (
+	// ErrNotFound is returned when an image does not exist.
+	ErrNotFound = errors.New("imagestore: no such image")
+
+	// ErrExists is returned when an image name is already taken.
+	ErrExists = errors.New("imagestore: image already exists")
+
+	// ErrCorrupt is returned when a stored chunk does not match its hash.
+	ErrCorrupt = errors.New("imagestore: corrupt chunk")
+
+	// ErrMissingChunk is returned when a chunk referenced by a manifest is
+	// not in the store.
+	ErrMissingChunk = errors.New("imagestore: missing chunk")
+)
+
+// Manifest describes an image in the store.
+type Manifest struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+
+	// Chunks are the non-zero ranges of the image in ascending order.
+	// Everything else reads as zeros.
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Chunk is a range of an image stored as a chunk.
+type Chunk struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Hash   string `json:"hash"` // hex SHA-256 of the uncompressed data
+}
+
+// Store is an image store.
+type Store struct {
+	dir string
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// Open opens the image store in dir, creating it if needed.
+func Open(dir string) (*Store, error) {
+	for _, d := range []string{"chunks", "images"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	lock := filepath.Join(dir, "lock")
+	f, err := os.OpenFile(lock, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	return &Store{dir: dir, enc: enc, dec: dec}, nil
+}
+
+// Close releases the resources of the store.
+func (s *Store) Close() error {
+	s.dec.Close()
+	return s.enc.Close()
+}
+
+// lock locks the store. Imports take a shared lock and garbage collection
+// an exclusive one, so it never removes the chunks of an import in progress.
+func (s *Store) lock(exclusive bool) (*diskimage.Lock, error) {
+	return diskimage.LockFile(filepath.Join(s.dir, "lock"), exclusive)
+}
+
+func validName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("imagestore: invalid image name %q", name)
+	}
+	return nil
+}
+
+func (s *Store) manifestPath(name string) string {
+	return filepath.Join(s.dir, "images", name+".json")
+}
+
+func (s *Store) chunkPath(hash string) string {
+	return filepath.Join(s.dir, "chunks", hash[:2], hash+".zst")
+}
+
+func validHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil && strings.ToLower(hash) == hash
+}
+
+// writeFile atomically writes data to path.
+func writeFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Import adds the raw disk image at path to the store as name and returns
+// its manifest. Only chunks that are not already in the store are written.
+func (s *Store) Import(name, path string) (*Manifest, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(s.manifestPath(name)); err == nil {
+		return nil, fmt.Errorf("%q: %w", name, ErrExists)
+	}
+	storeLock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer storeLock.Unlock()
+	lock, err := diskimage.LockFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	extents, err := diskimage.DataExtents(f)
+	if err != nil {
+		return nil, err
+	}
+
+	type job struct {
+		i    int
+		data []byte
+	}
+	var (
+		chunks []Chunk
+		mu     sync.Mutex
+		werr   error
+		wg     sync.WaitGroup
+		jobs   = make(chan job)
+	)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				sum := sha256.Sum256(j.data)
+				hash := hex.EncodeToString(sum[:])
+				err := s.putChunk(hash, j.data)
+				mu.Lock()
+				chunks[j.i].Hash = hash
+				if err != nil && werr == nil {
+					werr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	err = func() error {
+		defer close(jobs)
+		for _, e := range extents {
+			c := newChunker(io.NewSectionReader(f, e.Offset, e.Length))
+			off := e.Offset
+			for {
+				data, err := c.next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if !isZero(data) {
+					mu.Lock()
+					chunks = append(chunks, Chunk{Offset: off, Length: int64(len(data))})
+					i := len(chunks) - 1
+					mu.Unlock()
+					jobs <- job{i, data}
+				}
+				off += int64(len(data))
+			}
+		}
+		return nil
+	}()
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if werr != nil {
+		return nil, werr
+	}
+
+	m := &Manifest{
+		Name:    name,
+		Size:    fi.Size(),
+		Created: time.Now().UTC(),
+		Chunks:  chunks,
+	}
+	if err := s.writeManifest(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// putChunk compresses and stores data under hash unless it is stored
+// already.
+func (s *Store) putChunk(hash string, data []byte) error {
+	p := s.chunkPath(hash)
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	return writeFile(p, s.enc.EncodeAll(data, nil))
+}
+
+func (s *Store) writeManifest(m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(s.manifestPath(m.Name), data)
+}
+
+// Manifest returns the manifest of the image name.
+func (s *Store) Manifest(name string) (*Manifest, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(s.manifestPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%q: %w", name, ErrNotFound)
+		}
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("imagestore: image %q: %w", name, err)
+	}
+	return m, nil
+}
+
+// List returns the names of the images in the store in sorted order.
+func (s *Store) List() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.dir, "images"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(name, ".json"))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete removes the image name from the store. Its chunks stay in the
+// store until the next GC.
+func (s *Store) Delete(name string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(s.manifestPath(name)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%q: %w", name, ErrNotFound)
+		}
+		return err
+	}
+	return nil
+}
+
+// readChunk returns the uncompressed data of the chunk hash after
+// verifying it.
+func (s *Store) readChunk(hash string, buf []byte) ([]byte, error) {
+	if !validHash(hash) {
+		return nil, fmt.Errorf("imagestore: invalid chunk hash %q", hash)
+	}
+	compressed, err := ioutil.ReadFile(s.chunkPath(hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", hash, ErrMissingChunk)
+		}
+		return nil, err
+	}
+	data, err := s.dec.DecodeAll(compressed, buf[:0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %v", hash, ErrCorrupt, err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, fmt.Errorf("%s: %w", hash, ErrCorrupt)
+	}
+	return data, nil
+}
+
+// Materialize writes the image name to a new sparse raw file at path.
+func (s *Store) Materialize(name, path string) (err error) {
+	m, err := s.Manifest(name)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if err := out.Truncate(m.Size); err != nil {
+		return err
+	}
+	buf := make([]byte, 0, maxChunk)
+	for _, c := range m.Chunks {
+		data, err := s.readChunk(c.Hash, buf)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != c.Length || c.Offset < 0 || c.Offset+c.Length > m.Size {
+			return fmt.Errorf("imagestore: image %q: bad chunk at offset %d", name, c.Offset)
+		}
+		if _, err := out.WriteAt(data, c.Offset); err != nil {
+			return err
+		}
+	}
+	return out.Sync()
+}
+
+// Verify checks that all chunks of the image name are present and match
+// their hashes.
+func (s *Store) Verify(name string) error {
+	m, err := s.Manifest(name)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, maxChunk)
+	for _, c := range m.Chunks {
+		if _, err := s.readChunk(c.Hash, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GC removes the chunks no image refers to and returns the number of
+// bytes freed. It fails with diskimage.ErrInUse while an import is in
+// progress.
+func (s *Store) GC() (int64, error) {
+	lock, err := s.lock(true)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+	names, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[string]bool)
+	for _, name := range names {
+		m, err := s.Manifest(name)
+		if err != nil {
+			return 0, err
+		}
+		for _, c := range m.Chunks {
+			used[c.Hash] = true
+		}
+	}
+	var freed int64
+	root := filepath.Join(s.dir, "chunks")
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		hash := strings.TrimSuffix(fi.Name(), ".zst")
+		if used[hash] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		freed += fi.Size()
+		return nil
+	})
+	return freed, err
+}
+
+// Missing returns the hashes of the chunks of m that are not in the
+// store, without duplicates.
+func (s *Store) Missing(m *Manifest) []string {
+	var missing []string
+	seen := make(map[string]bool)
+	for _, c := range m.Chunks {
+		if seen[c.Hash] {
+			continue
+		}
+		seen[c.Hash] = true
+		if !validHash(c.Hash) {
+			missing = append(missing, c.Hash)
+			continue
+		}
+		if _, err := os.Stat(s.chunkPath(c.Hash)); err != nil {
+			missing = append(missing, c.Hash)
+		}
+	}
+	return missing
+}
+
+// Chunk returns the compressed chunk hash, as transferred to another
+// store.
+func (s *Store) Chunk(hash string) ([]byte, error) {
+	if !validHash(hash) {
+		return nil, fmt.Errorf("imagestore: invalid chunk hash %q", hash)
+	}
+	data, err := ioutil.ReadFile(s.chunkPath(hash))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", hash, ErrMissingChunk)
+	}
+	return data, err
+}
+
+// PutChunk adds a compressed chunk received from another store. It fails
+// with ErrCorrupt if the chunk does not match hash.
+func (s *Store) PutChunk(hash string, compressed []byte) error {
+	if !validHash(hash) {
+		return fmt.Errorf("imagestore: invalid chunk hash %q", hash)
+	}
+	data, err := s.dec.DecodeAll(compressed, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %v", hash, ErrCorrupt, err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("%s: %w", hash, ErrCorrupt)
+	}
+	lock, err := s.lock(false)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	p := s.chunkPath(hash)
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	return writeFile(p, compressed)
+}
+
+// PutManifest adds an image received from another store. All of its
+// chunks must have been added with PutChunk first.
+func (s *Store) PutManifest(m *Manifest) error {
+	if err := validName(m.Name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(s.manifestPath(m.Name)); err == nil {
+		return fmt.Errorf("%q: %w", m.Name, ErrExists)
+	}
+	lock, err := s.lock(false)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if missing := s.Missing(m); len(missing) > 0 {
+		return fmt.Errorf("%s: %w", missing[0], ErrMissingChunk)
+	}
+	return s.writeManifest(m)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,297 @@
+// Package initrd writes initial RAM disks: cpio archives in the "newc"
+// format the Linux kernel unpacks into its initramfs, optionally
+// compressed.
+//
+// The kernel unpacks concatenated archives in order, later files replacing
+// earlier ones, so an archive written here can be appended to an existing
+// initrd to add files to it without unpacking it.
+package initrd
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the compression of an archive.
+type Compression int
+
+// Compressions supported by the kernel. Zstd needs Linux 5.9 or later.
+const (
+	None Compression = iota
+	Gzip
+	Zstd
+)
+
+const (
+	newcMagic = "070701"
+	trailer   = "TRAILER!!!"
+)
+
+// File type bits of the cpio mode.
+const (
+	sIFIFO  = 0010000
+	sIFCHR  = 0020000
+	sIFDIR  = 0040000
+	sIFBLK  = 0060000
+	sIFREG  = 0100000
+	sIFLNK  = 0120000
+	sIFSOCK = 0140000
+	sISUID  = 0004000
+	sISGID  = 0002000
+	sISVTX  = 0001000
+)
+
+// Option configures a Writer.
+type Option func(w *Writer)
+
+// WithCompression sets the compression of the archive. It defaults to
+// Gzip, which all kernels support.
+func WithCompression(c Compression) Option {
+	return func(w *Writer) {
+		w.compression = c
+	}
+}
+
+// WithTimestamp sets the modification time of entries added without one.
+// It defaults to the Unix epoch, so archives are reproducible.
+func WithTimestamp(t time.Time) Option {
+	return func(w *Writer) {
+		w.now = t
+	}
+}
+
+// Entry describes a file system object added to a Writer.
+type Entry struct {
+	// Path is the slash-separated path of the object relative to the root
+	// of the initramfs. Missing parent directories are created.
+	Path string
+
+	// Mode holds the type and permission bits, including setuid, setgid
+	// and sticky bits.
+	Mode fs.FileMode
+
+	UID uint32
+	GID uint32
+
+	// ModTime defaults to the writer timestamp.
+	ModTime time.Time
+
+	// Size is the length of a regular file.
+	Size int64
+
+	// Linkname is the target of a symbolic link.
+	Linkname string
+
+	// Devmajor and Devminor identify character and block devices.
+	Devmajor uint32
+	Devminor uint32
+}
+
+// Writer writes an archive to an io.Writer.
+type Writer struct {
+	w           io.Writer
+	cw          io.WriteCloser
+	compression Compression
+	now         time.Time
+	off         int64
+	ino         uint32
+	dirs        map[string]bool
+	err         error
+	closed      bool
+}
+
+// NewWriter returns a Writer writing an archive to w.
+func NewWriter(w io.Writer, opts ...Option) (*Writer, error) {
+	iw := &Writer{
+		compression: Gzip,
+		now:         time.Unix(0, 0),
+		dirs:        map[string]bool{},
+	}
+	for _, opt := range opts {
+		opt(iw)
+	}
+	switch iw.compression {
+	case None:
+		iw.w = w
+	case Gzip:
+		gw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		iw.cw, iw.w = gw, gw
+	case Zstd:
+		// The kernel decompresses with a window of at most 8 MiB.
+		zw, err := zstd.NewWriter(w, zstd.WithWindowSize(8<<20), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		iw.cw, iw.w = zw, zw
+	default:
+		return nil, fmt.Errorf("initrd: unknown compression %d", iw.compression)
+	}
+	return iw, nil
+}
+
+// Add adds the object described by e. For regular files Size bytes of
+// content are read from r; r is ignored for all other types.
+func (w *Writer) Add(e *Entry, r io.Reader) error {
+	if w.closed {
+		return errors.New("initrd: writer is closed")
+	}
+	if w.err != nil {
+		return w.err
+	}
+	p := path.Clean("/" + e.Path)[1:]
+	if p == "" {
+		return errors.New("initrd: cannot add the root directory")
+	}
+	if err := w.addParents(path.Dir(p)); err != nil {
+		return err
+	}
+	mode := unixMode(e.Mode)
+	var data io.Reader
+	size := e.Size
+	switch mode &^ 07777 {
+	case sIFREG:
+		if size < 0 || size > 1<<32-1 {
+			return fmt.Errorf("initrd: %s: invalid size %d", p, size)
+		}
+		data = io.LimitReader(r, size)
+	case sIFLNK:
+		size = int64(len(e.Linkname))
+		data = strings.NewReader(e.Linkname)
+	case sIFDIR:
+		size = 0
+		w.dirs[p] = true
+	default:
+		size = 0
+	}
+	t := e.ModTime
+	if t.IsZero() {
+		t = w.now
+	}
+	nlink := 1
+	if mode&^07777 == sIFDIR {
+		nlink = 2
+	}
+	w.ino++
+	if err := w.header(w.ino, mode, e.UID, e.GID, nlink, uint32(t.Unix()), uint32(size), e.Devmajor, e.Devminor, p); err != nil {
+		return err
+	}
+	if data != nil {
+		n, err := io.Copy(writerFunc(w.write), data)
+		if err == nil && n != size {
+			err = fmt.Errorf("initrd: %s: %w", p, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			w.err = err
+			return err
+		}
+	}
+	return w.pad()
+}
+
+// header writes the header and name of an entry, padded to 4 bytes.
+func (w *Writer) header(ino, mode, uid, gid uint32, nlink int, mtime, size, major, minor uint32, name string) error {
+	hdr := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		newcMagic, ino, mode, uid, gid, nlink, mtime, size, 0, 0, major, minor, len(name)+1, 0)
+	if err := w.write([]byte(hdr + name + "\x00")); err != nil {
+		return err
+	}
+	return w.pad()
+}
+
+// addParents adds the missing directories of dir.
+func (w *Writer) addParents(dir string) error {
+	if dir == "." || w.dirs[dir] {
+		return nil
+	}
+	if err := w.addParents(path.Dir(dir)); err != nil {
+		return err
+	}
+	return w.Add(&Entry{Path: dir, Mode: fs.ModeDir | 0755}, nil)
+}
+
+type writerFunc func(p []byte) error
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	if err := f(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *Writer) write(p []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	n, err := w.w.Write(p)
+	w.off += int64(n)
+	w.err = err
+	return err
+}
+
+// pad aligns the archive to 4 bytes.
+func (w *Writer) pad() error {
+	if n := w.off % 4; n != 0 {
+		return w.write(make([]byte, 4-n))
+	}
+	return nil
+}
+
+// Close writes the end of the archive and flushes the compressor. It
+// does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.header(0, 0, 0, 0, 1, 0, 0, 0, 0, trailer); err != nil {
+		return err
+	}
+	w.closed = true
+	if w.cw != nil {
+		return w.cw.Close()
+	}
+	return nil
+}
+
+func unixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= sISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= sISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= sISVTX
+	}
+	switch {
+	case m.IsDir():
+		mode |= sIFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= sIFLNK
+	case m&fs.ModeCharDevice != 0:
+		mode |= sIFCHR
+	case m&fs.ModeDevice != 0:
+		mode |= sIFBLK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= sIFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= sIFSOCK
+	default:
+		mode |= sIFREG
+	}
+	return mode
+}
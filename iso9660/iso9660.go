@@ -0,0 +1,223 @@
+// Package iso9660 reads and writes ISO 9660 CD-ROM images with the Joliet
+// and Rock Ridge extensions.
+//
+// Images written by this package are reproducible byte for byte on every
+// host, unlike those of hdiutil and genisoimage, and can be attached to a
+// virtual machine read-only, for example as a cloud-init seed disk:
+//
+//	w := iso9660.NewWriter(iso9660.WithVolumeLabel("cidata"))
+//	w.AddFiles(map[string][]byte{"meta-data": meta, "user-data": user})
+//	w.WriteFile("seed.iso")
+//	vz.NewDiskImageStorageDeviceAttachment("seed.iso", true)
+//
+// Rock Ridge records POSIX names, modes, ownership, timestamps, symbolic
+// links and device nodes for Linux guests; Joliet records Unicode names
+// for other guests. The primary volume uses mangled ISO 9660 level 2 names.
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 2048
+
+	// systemAreaSectors are reserved at the start of the image.
+	systemAreaSectors = 16
+
+	vdPrimary       = 1
+	vdSupplementary = 2
+	vdTerminator    = 255
+	standardID      = "CD001"
+
+	flagDirectory  = 0x02
+	flagMultiExtnt = 0x80
+)
+
+// jolietEscape is the escape sequence of a Joliet supplementary volume
+// descriptor using UCS-2 level 3.
+var jolietEscape = []byte("%/E")
+
+// ErrNotISO is returned when opening an image without ISO 9660 volume
+// descriptors.
+var ErrNotISO = errors.New("iso9660: not an ISO 9660 image")
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// both32 returns the little-endian half of a both-endian number.
+func both32(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b)
+}
+
+// putRecordTime encodes t in the 7 byte format of directory records.
+func putRecordTime(b []byte, t time.Time) {
+	t = t.UTC()
+	year := t.Year() - 1900
+	if year < 0 {
+		year = 0
+	} else if year > 255 {
+		year = 255
+	}
+	b[0] = byte(year)
+	b[1] = byte(t.Month())
+	b[2] = byte(t.Day())
+	b[3] = byte(t.Hour())
+	b[4] = byte(t.Minute())
+	b[5] = byte(t.Second())
+	b[6] = 0 // offset from GMT in 15 minute intervals
+}
+
+func recordTime(b []byte) time.Time {
+	if b[1] == 0 {
+		return time.Time{}
+	}
+	t := time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, time.UTC)
+	return t.Add(-time.Duration(int8(b[6])) * 15 * time.Minute)
+}
+
+// putVolumeTime encodes t in the 17 byte format of volume descriptors. A
+// zero t is encoded as "not specified".
+func putVolumeTime(b []byte, t time.Time) {
+	if t.IsZero() {
+		copy(b, "0000000000000000")
+		b[16] = 0
+		return
+	}
+	copy(b, t.UTC().Format("20060102150405")+"00")
+	b[16] = 0
+}
+
+// putString writes s to b padded with spaces.
+func putString(b []byte, s string) {
+	n := copy(b, s)
+	for i := n; i < len(b); i++ {
+		b[i] = ' '
+	}
+}
+
+// putUCS2 writes s to b in UCS-2 big-endian padded with spaces.
+func putUCS2(b []byte, s string) {
+	u := encodeUCS2(s)
+	n := copy(b, u)
+	for i := n; i+1 < len(b); i += 2 {
+		b[i], b[i+1] = 0, ' '
+	}
+}
+
+func encodeUCS2(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.BigEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+func decodeUCS2(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// POSIX file type bits used by Rock Ridge.
+const (
+	sIFMT   = 0170000
+	sIFSOCK = 0140000
+	sIFLNK  = 0120000
+	sIFREG  = 0100000
+	sIFBLK  = 0060000
+	sIFDIR  = 0040000
+	sIFCHR  = 0020000
+	sIFIFO  = 0010000
+	sISUID  = 0004000
+	sISGID  = 0002000
+	sISVTX  = 0001000
+)
+
+func posixMode(m fs.FileMode) uint32 {
+	v := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		v |= sIFDIR
+	case m&fs.ModeSymlink != 0:
+		v |= sIFLNK
+	case m&fs.ModeCharDevice != 0:
+		v |= sIFCHR
+	case m&fs.ModeDevice != 0:
+		v |= sIFBLK
+	case m&fs.ModeNamedPipe != 0:
+		v |= sIFIFO
+	case m&fs.ModeSocket != 0:
+		v |= sIFSOCK
+	default:
+		v |= sIFREG
+	}
+	if m&fs.ModeSetuid != 0 {
+		v |= sISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		v |= sISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		v |= sISVTX
+	}
+	return v
+}
+
+func fileMode(v uint32) fs.FileMode {
+	m := fs.FileMode(v & 0777)
+	switch v & sIFMT {
+	case sIFDIR:
+		m |= fs.ModeDir
+	case sIFLNK:
+		m |= fs.ModeSymlink
+	case sIFCHR:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case sIFBLK:
+		m |= fs.ModeDevice
+	case sIFIFO:
+		m |= fs.ModeNamedPipe
+	case sIFSOCK:
+		m |= fs.ModeSocket
+	}
+	if v&sISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if v&sISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if v&sISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// cleanPath returns p relative to the root without leading or trailing
+// slashes. It reports false for paths with empty, "." or ".." elements.
+func cleanPath(p string) (string, bool) {
+	p = strings.Trim(p, "/")
+	if p == "" || p == "." {
+		return "", true
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return "", false
+		}
+	}
+	return p, true
+}
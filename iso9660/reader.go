@@ -0,0 +1,479 @@
+package iso9660
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// extent is a contiguous run of sectors holding (part of) a file.
+type extent struct {
+	lba  uint32
+	size uint32
+}
+
+// dirent is a parsed directory record.
+type dirent struct {
+	name     string
+	mode     fs.FileMode
+	uid, gid uint32
+	mtime    time.Time
+	size     int64
+	extents  []extent
+	target   string
+	major    uint32
+	minor    uint32
+}
+
+func (d *dirent) isDir() bool { return d.mode.IsDir() }
+
+// FS is a read-only view of an ISO 9660 image. It implements fs.FS,
+// fs.ReadDirFS, fs.ReadFileFS and fs.StatFS; symbolic links are not
+// followed.
+//
+// Names and attributes are taken from Rock Ridge entries when present,
+// otherwise from the Joliet volume, and otherwise from the primary volume.
+type FS struct {
+	r         io.ReaderAt
+	label     string
+	root      *dirent
+	joliet    bool
+	rockRidge bool
+	suspSkip  int
+}
+
+// Open reads the volume descriptors of the image r.
+func Open(r io.ReaderAt) (*FS, error) {
+	fsys := &FS{r: r}
+	var pvd, svd []byte
+	for sector := int64(systemAreaSectors); ; sector++ {
+		b := make([]byte, sectorSize)
+		if _, err := r.ReadAt(b, sector*sectorSize); err != nil {
+			if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, ErrNotISO
+			}
+			return nil, err
+		}
+		if string(b[1:6]) != standardID {
+			return nil, ErrNotISO
+		}
+		if b[0] == vdTerminator {
+			break
+		}
+		switch b[0] {
+		case vdPrimary:
+			if pvd == nil {
+				pvd = b
+			}
+		case vdSupplementary:
+			esc := b[88:91]
+			if svd == nil && esc[0] == '%' && esc[1] == '/' && (esc[2] == '@' || esc[2] == 'C' || esc[2] == 'E') {
+				svd = b
+			}
+		}
+	}
+	if pvd == nil {
+		return nil, ErrNotISO
+	}
+	fsys.label = strings.TrimRight(string(pvd[40:72]), " ")
+
+	root, err := fsys.rootRecord(pvd)
+	if err != nil {
+		return nil, err
+	}
+	// Rock Ridge is announced by an SP entry in the "." record of the
+	// root directory.
+	b, err := fsys.readExtent(root.extents[0])
+	if err != nil {
+		return nil, err
+	}
+	rec, ok := recordAt(b, 0)
+	if ok {
+		if su := systemUse(rec); len(su) >= 7 && string(su[:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef {
+			fsys.rockRidge = true
+			fsys.suspSkip = int(su[6])
+		}
+	}
+	if !fsys.rockRidge && svd != nil {
+		if root, err = fsys.rootRecord(svd); err != nil {
+			return nil, err
+		}
+		fsys.joliet = true
+	}
+	if fsys.rockRidge || fsys.joliet {
+		// The "." record carries the attributes of the root.
+		entries, err := fsys.parseDir(root, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 && entries[0].name == "." {
+			self := entries[0]
+			self.name = "."
+			root = self
+		}
+	}
+	root.name = "."
+	fsys.root = root
+	return fsys, nil
+}
+
+// Label returns the volume label of the primary volume.
+func (fsys *FS) Label() string {
+	return fsys.label
+}
+
+func (fsys *FS) rootRecord(vd []byte) (*dirent, error) {
+	rec := vd[156:190]
+	d := &dirent{
+		mode:    fs.ModeDir | 0555,
+		mtime:   recordTime(rec[18:]),
+		extents: []extent{{both32(rec[2:]), both32(rec[10:])}},
+	}
+	if d.extents[0].size == 0 {
+		return nil, ErrNotISO
+	}
+	return d, nil
+}
+
+func (fsys *FS) readExtent(e extent) ([]byte, error) {
+	b := make([]byte, e.size)
+	if _, err := fsys.r.ReadAt(b, int64(e.lba)*sectorSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("iso9660: reading extent at sector %d: %w", e.lba, err)
+	}
+	return b, nil
+}
+
+// recordAt returns the directory record at off in b. Records do not cross
+// sectors, and a zero length byte pads the rest of a sector.
+func recordAt(b []byte, off int) ([]byte, bool) {
+	if off >= len(b) || b[off] == 0 {
+		return nil, false
+	}
+	n := int(b[off])
+	if n < 34 || off+n > len(b) || 33+int(b[off+32]) > n {
+		return nil, false
+	}
+	return b[off : off+n], true
+}
+
+func systemUse(rec []byte) []byte {
+	idLen := int(rec[32])
+	start := 33 + idLen
+	if idLen%2 == 0 {
+		start++
+	}
+	if start > len(rec) {
+		return nil
+	}
+	return rec[start:]
+}
+
+// parseDir returns the entries of the directory d. The "." record is
+// included only if self is set, and ".." is always omitted.
+func (fsys *FS) parseDir(d *dirent, self bool) ([]*dirent, error) {
+	var entries []*dirent
+	var last *dirent
+	for _, e := range d.extents {
+		b, err := fsys.readExtent(e)
+		if err != nil {
+			return nil, err
+		}
+		for off := 0; off < len(b); {
+			rec, ok := recordAt(b, off)
+			if !ok {
+				if off%sectorSize == 0 && (off >= len(b) || b[off] != 0) {
+					return nil, fmt.Errorf("iso9660: malformed directory record at sector %d", int(e.lba)+off/sectorSize)
+				}
+				off += sectorSize - off%sectorSize
+				continue
+			}
+			off += len(rec)
+			ent, err := fsys.parseRecord(rec)
+			if err != nil {
+				return nil, err
+			}
+			switch ent.name {
+			case "..":
+				continue
+			case ".":
+				if !self {
+					continue
+				}
+			}
+			// Multi-extent files continue in the following records.
+			if last != nil && last.name == ent.name && !ent.isDir() {
+				last.extents = append(last.extents, ent.extents...)
+				last.size += ent.size
+			} else {
+				entries = append(entries, ent)
+			}
+			last = nil
+			if rec[25]&flagMultiExtnt != 0 {
+				last = entries[len(entries)-1]
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (fsys *FS) parseRecord(rec []byte) (*dirent, error) {
+	id := rec[33 : 33+int(rec[32])]
+	d := &dirent{
+		mtime:   recordTime(rec[18:]),
+		size:    int64(both32(rec[10:])),
+		extents: []extent{{both32(rec[2:]), both32(rec[10:])}},
+	}
+	switch {
+	case len(id) == 1 && id[0] == 0:
+		d.name = "."
+	case len(id) == 1 && id[0] == 1:
+		d.name = ".."
+	case fsys.joliet:
+		d.name = decodeUCS2(id)
+	default:
+		d.name = strings.TrimSuffix(strings.TrimSuffix(string(id), ";1"), ".")
+	}
+	if rec[25]&flagDirectory != 0 {
+		d.mode = fs.ModeDir | 0555
+	} else {
+		d.mode = 0444
+	}
+	if !fsys.rockRidge {
+		return d, nil
+	}
+
+	var info rrInfo
+	su := systemUse(rec)
+	if len(su) > fsys.suspSkip {
+		su = su[fsys.suspSkip:]
+	}
+	for seen := 0; ; seen++ {
+		ce, err := parseSUSP(su, &info)
+		if err != nil {
+			return nil, err
+		}
+		if ce == nil {
+			break
+		}
+		if seen > 64 {
+			return nil, errSUSP
+		}
+		b := make([]byte, ce[2])
+		if _, err := fsys.r.ReadAt(b, int64(ce[0])*sectorSize+int64(ce[1])); err != nil {
+			return nil, fmt.Errorf("iso9660: reading continuation area: %w", err)
+		}
+		su = b
+	}
+	if d.name != "." && d.name != ".." && info.name != "" {
+		d.name = info.name
+	}
+	if info.hasMode {
+		d.mode = fileMode(info.mode)
+		d.uid, d.gid = info.uid, info.gid
+	}
+	if !info.mtime.IsZero() {
+		d.mtime = info.mtime
+	}
+	d.target = info.target
+	d.major, d.minor = info.major, info.minor
+	return d, nil
+}
+
+// lookup returns the entry at name.
+func (fsys *FS) lookup(op, name string) (*dirent, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	d := fsys.root
+	if name == "." {
+		return d, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !d.isDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		entries, err := fsys.parseDir(d, false)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		var next *dirent
+		for _, e := range entries {
+			if e.name == elem {
+				next = e
+				break
+			}
+		}
+		if next == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		d = next
+	}
+	return d, nil
+}
+
+// Open opens the named file.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	d, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f := &file{fsys: fsys, d: d, name: path.Base(name)}
+	if d.isDir() {
+		return f, nil
+	}
+	var readers []io.Reader
+	if d.mode.IsRegular() {
+		for _, e := range d.extents {
+			readers = append(readers, io.NewSectionReader(fsys.r, int64(e.lba)*sectorSize, int64(e.size)))
+		}
+	}
+	f.r = io.MultiReader(readers...)
+	return f, nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	d, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{d: d, name: path.Base(name)}, nil
+}
+
+// ReadDir returns the entries of the named directory sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	d, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !d.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := fsys.parseDir(d, false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	list := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		list[i] = &fileInfo{d: e, name: e.name}
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name() < list[b].Name() })
+	return list, nil
+}
+
+// ReadFile returns the contents of the named regular file.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi := f.(*file)
+	if !fi.d.mode.IsRegular() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("not a regular file")}
+	}
+	b := make([]byte, fi.d.size)
+	if _, err := io.ReadFull(fi.r, b); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return b, nil
+}
+
+// Readlink returns the target of the named symbolic link.
+func (fsys *FS) Readlink(name string) (string, error) {
+	d, err := fsys.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if d.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return d.target, nil
+}
+
+// file is an open file or directory.
+type file struct {
+	fsys    *FS
+	d       *dirent
+	name    string
+	r       io.Reader
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return &fileInfo{d: f.d, name: f.name}, nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	if f.d.isDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	return f.r.Read(b)
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.d.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+	if !f.read {
+		entries, err := f.fsys.parseDir(f.d, false)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+		for _, e := range entries {
+			f.entries = append(f.entries, &fileInfo{d: e, name: e.name})
+		}
+		sort.Slice(f.entries, func(a, b int) bool { return f.entries[a].Name() < f.entries[b].Name() })
+		f.read = true
+	}
+	if n <= 0 {
+		list := f.entries
+		f.entries = nil
+		return list, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	list := f.entries[:n]
+	f.entries = f.entries[n:]
+	return list, nil
+}
+
+// fileInfo implements fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	d    *dirent
+	name string
+}
+
+func (fi *fileInfo) Name() string { return fi.name }
+
+func (fi *fileInfo) Size() int64 {
+	if fi.d.mode.IsRegular() {
+		return fi.d.size
+	}
+	return 0
+}
+
+func (fi *fileInfo) Mode() fs.FileMode          { return fi.d.mode }
+func (fi *fileInfo) ModTime() time.Time         { return fi.d.mtime }
+func (fi *fileInfo) IsDir() bool                { return fi.d.isDir() }
+func (fi *fileInfo) Sys() interface{}           { return nil }
+func (fi *fileInfo) Type() fs.FileMode          { return fi.d.mode.Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
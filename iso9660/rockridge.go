@@ -0,0 +1,277 @@
+package iso9660
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Rock Ridge is stored as System Use Sharing Protocol (SUSP) entries in the
+// system use area of directory records. Entries that do not fit into a
+// record continue in a continuation area referenced by a CE entry.
+
+const (
+	rrID         = "RRIP_1991A"
+	rrDescriptor = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rrSource     = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+
+	ceLen = 28
+	// maxEntryData is the most payload a single entry with a flags byte
+	// can hold.
+	maxEntryData = 255 - 5
+)
+
+func suspEntry(sig string, data ...byte) []byte {
+	e := make([]byte, 4, 4+len(data))
+	copy(e, sig)
+	e[2] = byte(4 + len(data))
+	e[3] = 1
+	return append(e, data...)
+}
+
+// spEntry marks the use of SUSP in the first record of the root directory.
+func spEntry() []byte {
+	return suspEntry("SP", 0xbe, 0xef, 0)
+}
+
+// erEntry identifies the Rock Ridge extension.
+func erEntry() []byte {
+	data := []byte{byte(len(rrID)), byte(len(rrDescriptor)), byte(len(rrSource)), 1}
+	data = append(data, rrID...)
+	data = append(data, rrDescriptor...)
+	data = append(data, rrSource...)
+	return suspEntry("ER", data...)
+}
+
+func ceEntry(lba, off, length uint32) []byte {
+	e := suspEntry("CE", make([]byte, 24)...)
+	putBoth32(e[4:], lba)
+	putBoth32(e[12:], off)
+	putBoth32(e[20:], length)
+	return e
+}
+
+func pxEntry(mode, nlink, uid, gid uint32) []byte {
+	e := suspEntry("PX", make([]byte, 32)...)
+	putBoth32(e[4:], mode)
+	putBoth32(e[12:], nlink)
+	putBoth32(e[20:], uid)
+	putBoth32(e[28:], gid)
+	return e
+}
+
+// tfEntry records the modification, access and attribute change times.
+func tfEntry(mtime, atime, ctime time.Time) []byte {
+	e := suspEntry("TF", make([]byte, 1+3*7)...)
+	e[4] = 0x02 | 0x04 | 0x08
+	putRecordTime(e[5:], mtime)
+	putRecordTime(e[12:], atime)
+	putRecordTime(e[19:], ctime)
+	return e
+}
+
+func pnEntry(major, minor uint32) []byte {
+	e := suspEntry("PN", make([]byte, 16)...)
+	putBoth32(e[4:], major)
+	putBoth32(e[12:], minor)
+	return e
+}
+
+// nmEntries records a name, split into several entries if needed.
+func nmEntries(name string) [][]byte {
+	var entries [][]byte
+	for {
+		n := len(name)
+		flags := byte(0)
+		if n > maxEntryData {
+			n, flags = maxEntryData, 1 // CONTINUE
+		}
+		entries = append(entries, suspEntry("NM", append([]byte{flags}, name[:n]...)...))
+		name = name[n:]
+		if name == "" {
+			return entries
+		}
+	}
+}
+
+// slEntries records the target of a symbolic link as a list of components,
+// split into several entries if needed.
+func slEntries(target string) [][]byte {
+	var comps [][]byte
+	if strings.HasPrefix(target, "/") {
+		comps = append(comps, []byte{0x08, 0}) // ROOT
+	}
+	for _, c := range strings.Split(strings.Trim(target, "/"), "/") {
+		switch c {
+		case "":
+			continue
+		case ".":
+			comps = append(comps, []byte{0x02, 0}) // CURRENT
+			continue
+		case "..":
+			comps = append(comps, []byte{0x04, 0}) // PARENT
+			continue
+		}
+		for len(c) > maxEntryData-2 {
+			comps = append(comps, append([]byte{0x01, maxEntryData - 2}, c[:maxEntryData-2]...))
+			c = c[maxEntryData-2:]
+		}
+		comps = append(comps, append([]byte{0, byte(len(c))}, c...))
+	}
+	var entries [][]byte
+	var data []byte
+	for _, c := range comps {
+		if len(data)+len(c) > maxEntryData {
+			entries = append(entries, suspEntry("SL", append([]byte{1}, data...)...))
+			data = nil
+		}
+		data = append(data, c...)
+	}
+	return append(entries, suspEntry("SL", append([]byte{0}, data...)...))
+}
+
+// rrInfo is the Rock Ridge information of a directory record.
+type rrInfo struct {
+	found        bool
+	name         string
+	hasMode      bool
+	mode         uint32
+	nlink        uint32
+	uid, gid     uint32
+	mtime, atime time.Time
+	target       string
+	major, minor uint32
+}
+
+// errSUSP is returned for malformed system use areas.
+var errSUSP = errors.New("iso9660: malformed Rock Ridge entry")
+
+// parseSUSP parses the entries in su into info and returns the location of
+// a continuation area, if any.
+func parseSUSP(su []byte, info *rrInfo) (ce []uint32, err error) {
+	var slPending []byte
+	for len(su) >= 4 {
+		sig, l := string(su[:2]), int(su[2])
+		if l < 4 || l > len(su) {
+			break
+		}
+		e := su[:l]
+		su = su[l:]
+		switch sig {
+		case "ST":
+			return ce, nil
+		case "CE":
+			if l < ceLen {
+				return nil, errSUSP
+			}
+			ce = []uint32{both32(e[4:]), both32(e[12:]), both32(e[20:])}
+		case "PX":
+			if l < 36 {
+				return nil, errSUSP
+			}
+			info.found, info.hasMode = true, true
+			info.mode, info.nlink = both32(e[4:]), both32(e[12:])
+			info.uid, info.gid = both32(e[20:]), both32(e[28:])
+		case "PN":
+			if l < 20 {
+				return nil, errSUSP
+			}
+			info.major, info.minor = both32(e[4:]), both32(e[12:])
+		case "NM":
+			if l < 5 {
+				return nil, errSUSP
+			}
+			info.found = true
+			switch {
+			case e[4]&0x02 != 0:
+				info.name = "."
+			case e[4]&0x04 != 0:
+				info.name = ".."
+			default:
+				info.name += string(e[5:])
+			}
+		case "SL":
+			if l < 5 {
+				return nil, errSUSP
+			}
+			info.found = true
+			slPending = append(slPending, e[5:]...)
+			if e[4]&1 == 0 {
+				info.target += decodeSL(slPending)
+				slPending = nil
+			}
+		case "TF":
+			if l < 5 {
+				return nil, errSUSP
+			}
+			parseTF(e, info)
+		}
+	}
+	return ce, nil
+}
+
+func parseTF(e []byte, info *rrInfo) {
+	flags := e[4]
+	size := 7
+	if flags&0x80 != 0 {
+		size = 17 // long form, not written by this package
+	}
+	b := e[5:]
+	next := func() (time.Time, bool) {
+		if len(b) < size {
+			return time.Time{}, false
+		}
+		var t time.Time
+		if size == 7 {
+			t = recordTime(b)
+		} else if parsed, err := time.Parse("20060102150405", string(b[:14])); err == nil {
+			t = parsed
+		}
+		b = b[size:]
+		return t, true
+	}
+	for bit := byte(1); bit <= 0x40; bit <<= 1 {
+		if flags&bit == 0 {
+			continue
+		}
+		t, ok := next()
+		if !ok {
+			return
+		}
+		switch bit {
+		case 0x02:
+			info.mtime = t
+		case 0x04:
+			info.atime = t
+		}
+	}
+}
+
+// decodeSL decodes the component records of SL entries.
+func decodeSL(b []byte) string {
+	var sb strings.Builder
+	cont := false
+	for len(b) >= 2 {
+		flags, l := b[0], int(b[1])
+		if 2+l > len(b) {
+			break
+		}
+		content := b[2 : 2+l]
+		b = b[2+l:]
+		switch {
+		case flags&0x08 != 0:
+			sb.WriteString("/")
+			continue
+		case flags&0x02 != 0:
+			content = []byte(".")
+		case flags&0x04 != 0:
+			content = []byte("..")
+		}
+		if !cont && sb.Len() > 0 && !strings.HasSuffix(sb.String(), "/") {
+			sb.WriteString("/")
+		}
+		sb.Write(content)
+		cont = flags&0x01 != 0
+	}
+	return sb.String()
+}
@@ -0,0 +1,924 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// maxLabel is the length of the volume label in the primary volume
+	// descriptor; Joliet volume labels hold half as many characters.
+	maxLabel = 32
+
+	// maxISOName is the longest ISO 9660 level 2 file identifier,
+	// excluding the ";1" version.
+	maxISOName = 30
+
+	// maxJolietName is the longest Joliet name in characters.
+	maxJolietName = 64
+
+	maxFileSize = 1<<32 - 1
+)
+
+// Option configures a Writer.
+type Option func(w *Writer)
+
+// WithVolumeLabel sets the volume label, at most 32 ASCII characters. The
+// Joliet volume label holds the first 16 of them.
+func WithVolumeLabel(label string) Option {
+	return func(w *Writer) {
+		w.label = label
+	}
+}
+
+// WithTimestamp sets the creation time of the volume and of files added
+// without a modification time. It defaults to the time NewWriter is
+// called; a fixed timestamp makes the output reproducible.
+func WithTimestamp(t time.Time) Option {
+	return func(w *Writer) {
+		w.now = t
+	}
+}
+
+// WithJoliet enables or disables the Joliet extension. It is enabled by
+// default.
+func WithJoliet(enabled bool) Option {
+	return func(w *Writer) {
+		w.joliet = enabled
+	}
+}
+
+// WithRockRidge enables or disables the Rock Ridge extension. It is
+// enabled by default.
+func WithRockRidge(enabled bool) Option {
+	return func(w *Writer) {
+		w.rockRidge = enabled
+	}
+}
+
+// Entry describes a file system object added to a Writer.
+type Entry struct {
+	// Path is the slash-separated path of the object relative to the root
+	// of the image. Missing parent directories are created.
+	Path string
+
+	// Mode holds the type and permission bits.
+	Mode fs.FileMode
+
+	UID uint32
+	GID uint32
+
+	// ModTime is replaced by the writer timestamp when zero.
+	ModTime time.Time
+
+	// Size is the length of a regular file.
+	Size int64
+
+	// Linkname is the target of a symbolic link.
+	Linkname string
+
+	// Devmajor and Devminor identify character and block devices.
+	Devmajor uint32
+	Devminor uint32
+}
+
+// node is a file system object of the image being written.
+type node struct {
+	name     string
+	mode     fs.FileMode
+	uid, gid uint32
+	mtime    time.Time
+	size     int64
+	data     []byte // content of files added from memory
+	src      string // host path of files added with AddDirectory
+	target   string
+	major    uint32
+	minor    uint32
+	parent   *node
+	children map[string]*node
+
+	isoName    string
+	jolietName string
+	lba        uint32 // file data or primary directory extent
+	jolietLBA  uint32
+	dirSize    uint32
+	jolietSize uint32
+	dirNum     uint16
+	jolietNum  uint16
+}
+
+func (n *node) isDir() bool { return n.mode.IsDir() }
+
+// Writer builds an ISO 9660 image.
+//
+// Files are added with Add, AddFiles and AddDirectory, and the image is
+// produced by WriteTo or WriteFile. Files added with AddDirectory are read
+// from the host when the image is written.
+type Writer struct {
+	label     string
+	now       time.Time
+	joliet    bool
+	rockRidge bool
+	root      *node
+}
+
+// NewWriter returns a Writer for an empty image.
+func NewWriter(opts ...Option) *Writer {
+	w := &Writer{
+		now:       time.Now(),
+		joliet:    true,
+		rockRidge: true,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.root = &node{mode: fs.ModeDir | 0755, mtime: w.now, children: map[string]*node{}}
+	return w
+}
+
+// lookupDir returns the directory at p, creating missing directories.
+func (w *Writer) lookupDir(p string) (*node, error) {
+	dir := w.root
+	if p == "" || p == "." {
+		return dir, nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		child, ok := dir.children[name]
+		if !ok {
+			child = &node{name: name, mode: fs.ModeDir | 0755, mtime: w.now, parent: dir, children: map[string]*node{}}
+			dir.children[name] = child
+		} else if !child.isDir() {
+			return nil, fmt.Errorf("iso9660: %s: not a directory", p)
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+// add adds the object e, with data or src as its content.
+func (w *Writer) add(e *Entry, data []byte, src string) error {
+	p, ok := cleanPath(e.Path)
+	if !ok {
+		return fmt.Errorf("iso9660: invalid path %q", e.Path)
+	}
+	mtime := e.ModTime
+	if mtime.IsZero() {
+		mtime = w.now
+	}
+	if p == "" {
+		if !e.Mode.IsDir() {
+			return errors.New("iso9660: root must be a directory")
+		}
+		w.root.mode, w.root.uid, w.root.gid, w.root.mtime = e.Mode, e.UID, e.GID, mtime
+		return nil
+	}
+	parent, err := w.lookupDir(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	name := path.Base(p)
+	if len(name) > 255 {
+		return fmt.Errorf("iso9660: %s: name too long", p)
+	}
+	n := &node{
+		name:   name,
+		mode:   e.Mode,
+		uid:    e.UID,
+		gid:    e.GID,
+		mtime:  mtime,
+		data:   data,
+		src:    src,
+		target: e.Linkname,
+		major:  e.Devmajor,
+		minor:  e.Devminor,
+		parent: parent,
+	}
+	switch {
+	case e.Mode.IsDir():
+		if old, ok := parent.children[name]; ok && old.isDir() {
+			old.mode, old.uid, old.gid, old.mtime = e.Mode, e.UID, e.GID, mtime
+			return nil
+		}
+		n.children = map[string]*node{}
+	case e.Mode.IsRegular():
+		if e.Size < 0 || e.Size > maxFileSize {
+			return fmt.Errorf("iso9660: %s: unsupported size %d", p, e.Size)
+		}
+		n.size = e.Size
+	}
+	parent.children[name] = n
+	return nil
+}
+
+// Add adds the object described by e. For regular files Size bytes of
+// content are read from r into memory; r is ignored for all other types.
+// An existing object at the same path is replaced, except that adding a
+// directory over a directory only updates its metadata.
+func (w *Writer) Add(e *Entry, r io.Reader) error {
+	var data []byte
+	if e.Mode.IsRegular() {
+		if e.Size < 0 || e.Size > maxFileSize {
+			return fmt.Errorf("iso9660: %s: unsupported size %d", e.Path, e.Size)
+		}
+		data = make([]byte, e.Size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("iso9660: %s: %w", e.Path, err)
+		}
+	}
+	return w.add(e, data, "")
+}
+
+// AddFiles adds regular files with mode 0644, mapping their paths to their
+// contents.
+func (w *Writer) AddFiles(files map[string][]byte) error {
+	for p, data := range files {
+		e := &Entry{Path: p, Mode: 0644, Size: int64(len(data))}
+		if err := w.add(e, data, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddDirectory adds the contents of the host directory root, preserving
+// modes, ownership, timestamps, symbolic links and device nodes. File
+// contents are read when the image is written.
+func (w *Writer) AddDirectory(root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		e := &Entry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			e.UID, e.GID = st.Uid, st.Gid
+			if info.Mode()&os.ModeDevice != 0 {
+				e.Devmajor = unix.Major(uint64(st.Rdev))
+				e.Devminor = unix.Minor(uint64(st.Rdev))
+			}
+		}
+		src := ""
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if e.Linkname, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			src = p
+		}
+		return w.add(e, nil, src)
+	})
+}
+
+// WriteFile writes the image to a new file at path.
+func (w *Writer) WriteFile(path string) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if _, err := w.WriteTo(f); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// record is a directory record being laid out.
+type record struct {
+	n      *node
+	id     []byte
+	inline [][]byte // system use entries stored in the record
+	ce     []byte   // system use entries stored in the continuation area
+	ceLBA  uint32
+	ceOff  uint32
+}
+
+func (r *record) len() int {
+	n := 33 + len(r.id)
+	if len(r.id)%2 == 0 {
+		n++
+	}
+	for _, e := range r.inline {
+		n += len(e)
+	}
+	if len(r.ce) > 0 {
+		n += ceLen
+	}
+	return n + n%2
+}
+
+// layout holds the geometry of the image.
+type layout struct {
+	dirs        []*node // primary directories in path table order
+	jolietDirs  []*node
+	records     map[*node][]*record
+	jolietRecs  map[*node][]*record
+	files       []*node
+	pathTable   []byte // little-endian; the big-endian table is derived
+	jolietTable []byte
+
+	lPath, mPath, jlPath, jmPath uint32
+	pathSectors, jolietSectors   uint32
+	ceStart, ceSectors           uint32
+	metaSectors                  uint32
+	total                        uint32
+}
+
+func sectors(n int64) uint32 {
+	return uint32((n + sectorSize - 1) / sectorSize)
+}
+
+// WriteTo writes the image to out.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	if len(w.label) > maxLabel {
+		return 0, fmt.Errorf("iso9660: volume label %q longer than %d characters", w.label, maxLabel)
+	}
+	for _, c := range w.label {
+		if c >= utf8.RuneSelf || c < ' ' {
+			return 0, fmt.Errorf("iso9660: volume label %q is not printable ASCII", w.label)
+		}
+	}
+	l, err := w.layout()
+	if err != nil {
+		return 0, err
+	}
+	meta := make([]byte, int64(l.metaSectors)*sectorSize)
+	w.writeDescriptors(meta, l)
+	copy(meta[l.lPath*sectorSize:], l.pathTable)
+	copy(meta[l.mPath*sectorSize:], bigEndianPathTable(l.pathTable))
+	if w.joliet {
+		copy(meta[l.jlPath*sectorSize:], l.jolietTable)
+		copy(meta[l.jmPath*sectorSize:], bigEndianPathTable(l.jolietTable))
+	}
+	for _, d := range l.dirs {
+		writeDir(meta[d.lba*sectorSize:], l.records[d], meta, false)
+	}
+	if w.joliet {
+		for _, d := range l.jolietDirs {
+			writeDir(meta[d.jolietLBA*sectorSize:], l.jolietRecs[d], meta, true)
+		}
+	}
+
+	cw := &countWriter{w: out}
+	if _, err := cw.Write(meta); err != nil {
+		return cw.n, err
+	}
+	pad := make([]byte, sectorSize)
+	for _, f := range l.files {
+		if err := writeData(cw, f); err != nil {
+			return cw.n, err
+		}
+		if rest := f.size % sectorSize; rest != 0 {
+			if _, err := cw.Write(pad[:sectorSize-rest]); err != nil {
+				return cw.n, err
+			}
+		}
+	}
+	return cw.n, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeData writes the content of the file n.
+func writeData(w io.Writer, n *node) error {
+	if n.src == "" {
+		_, err := w.Write(n.data)
+		return err
+	}
+	f, err := os.Open(n.src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(w, f, n.size); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("iso9660: %s: file shrank while writing the image", n.src)
+		}
+		return err
+	}
+	return nil
+}
+
+// layout assigns names, directory records and sectors to all objects.
+func (w *Writer) layout() (*layout, error) {
+	l := &layout{
+		records:    map[*node][]*record{},
+		jolietRecs: map[*node][]*record{},
+	}
+	l.dirs = bfs(w.root, func(n *node) string { return n.isoName }, assignISONames)
+	if len(l.dirs) > 0xffff {
+		return nil, errors.New("iso9660: too many directories")
+	}
+	for i, d := range l.dirs {
+		d.dirNum = uint16(i + 1)
+		recs, err := w.dirRecords(d)
+		if err != nil {
+			return nil, err
+		}
+		l.records[d] = recs
+	}
+	if w.joliet {
+		l.jolietDirs = bfs(w.root, func(n *node) string { return n.jolietName }, assignJolietNames)
+		for i, d := range l.jolietDirs {
+			d.jolietNum = uint16(i + 1)
+			l.jolietRecs[d] = jolietRecords(d)
+		}
+	}
+
+	l.pathTable = pathTable(l.dirs, func(n *node) ([]byte, uint16) {
+		return []byte(n.isoName), n.parent.dirNum
+	})
+	cur := uint32(systemAreaSectors + 2) // primary descriptor and terminator
+	if w.joliet {
+		l.jolietTable = pathTable(l.jolietDirs, func(n *node) ([]byte, uint16) {
+			return encodeUCS2(n.jolietName), n.parent.jolietNum
+		})
+		cur++
+	}
+	l.pathSectors = sectors(int64(len(l.pathTable)))
+	l.lPath, l.mPath = cur, cur+l.pathSectors
+	cur += 2 * l.pathSectors
+	if w.joliet {
+		l.jolietSectors = sectors(int64(len(l.jolietTable)))
+		l.jlPath, l.jmPath = cur, cur+l.jolietSectors
+		cur += 2 * l.jolietSectors
+	}
+
+	for _, d := range l.dirs {
+		d.dirSize = dirSize(l.records[d])
+		d.lba = cur
+		cur += d.dirSize / sectorSize
+	}
+	// Continuation areas are packed into sectors after the directories.
+	l.ceStart = cur
+	var off uint32
+	for _, d := range l.dirs {
+		for _, r := range l.records[d] {
+			if len(r.ce) == 0 {
+				continue
+			}
+			if off+uint32(len(r.ce)) > sectorSize {
+				cur++
+				off = 0
+			}
+			r.ceLBA, r.ceOff = cur, off
+			off += uint32(len(r.ce))
+		}
+	}
+	if off > 0 {
+		cur++
+	}
+	l.ceSectors = cur - l.ceStart
+	if w.joliet {
+		for _, d := range l.jolietDirs {
+			d.jolietSize = dirSize(l.jolietRecs[d])
+			d.jolietLBA = cur
+			cur += d.jolietSize / sectorSize
+		}
+	}
+	l.metaSectors = cur
+
+	// File data follows in path order.
+	var walk func(d *node)
+	walk = func(d *node) {
+		for _, name := range sortedNames(d) {
+			n := d.children[name]
+			switch {
+			case n.isDir():
+				walk(n)
+			case n.mode.IsRegular() && n.size > 0:
+				n.lba = cur
+				cur += sectors(n.size)
+				l.files = append(l.files, n)
+			}
+		}
+	}
+	walk(w.root)
+	l.total = cur
+	return l, nil
+}
+
+func sortedNames(d *node) []string {
+	names := make([]string, 0, len(d.children))
+	for name := range d.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bfs assigns names to the children of every directory with assign and
+// returns the directories in path table order: breadth first, sorted by
+// parent and then by the name returned by key.
+func bfs(root *node, key func(*node) string, assign func(d *node)) []*node {
+	root.parent = root
+	dirs := []*node{root}
+	for i := 0; i < len(dirs); i++ {
+		d := dirs[i]
+		assign(d)
+		var sub []*node
+		for _, c := range d.children {
+			if c.isDir() {
+				sub = append(sub, c)
+			}
+		}
+		sort.Slice(sub, func(a, b int) bool { return key(sub[a]) < key(sub[b]) })
+		dirs = append(dirs, sub...)
+	}
+	return dirs
+}
+
+// assignISONames gives the children of d unique ISO 9660 level 2 names.
+func assignISONames(d *node) {
+	used := map[string]bool{}
+	for _, name := range sortedNames(d) {
+		c := d.children[name]
+		base, ext := name, ""
+		if !c.isDir() {
+			if i := strings.LastIndexByte(name, '.'); i > 0 {
+				base, ext = name[:i], name[i+1:]
+			}
+		}
+		base, ext = isoChars(base), isoChars(ext)
+		if len(ext) > maxISOName/2 {
+			ext = ext[:maxISOName/2]
+		}
+		max := maxISOName - len(ext)
+		if c.isDir() {
+			max = maxISOName + 1
+		} else if ext != "" {
+			max--
+		}
+		if base == "" {
+			base = "_"
+		}
+		for i := 0; ; i++ {
+			b := base
+			if i > 0 {
+				suffix := fmt.Sprintf("~%d", i)
+				if len(b)+len(suffix) > max {
+					b = b[:max-len(suffix)]
+				}
+				b += suffix
+			} else if len(b) > max {
+				b = b[:max]
+			}
+			n := b
+			if ext != "" {
+				n += "." + ext
+			}
+			if !used[n] {
+				used[n] = true
+				c.isoName = n
+				break
+			}
+		}
+	}
+}
+
+// isoChars maps s to the d-characters A-Z, 0-9 and _.
+func isoChars(s string) string {
+	b := []byte(strings.ToUpper(s))
+	for i, c := range b {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// assignJolietNames gives the children of d unique Joliet names.
+func assignJolietNames(d *node) {
+	used := map[string]bool{}
+	for _, name := range sortedNames(d) {
+		r := []rune(strings.Map(func(c rune) rune {
+			if strings.ContainsRune("*/:;?\\", c) || c < ' ' {
+				return '_'
+			}
+			return c
+		}, name))
+		for i := 0; ; i++ {
+			n := r
+			suffix := ""
+			if i > 0 {
+				suffix = fmt.Sprintf("~%d", i)
+			}
+			if len(n)+len(suffix) > maxJolietName {
+				n = n[:maxJolietName-len(suffix)]
+			}
+			s := string(n) + suffix
+			if !used[s] {
+				used[s] = true
+				d.children[name].jolietName = s
+				break
+			}
+		}
+	}
+}
+
+// dirRecords returns the primary records of directory d with their Rock
+// Ridge entries.
+func (w *Writer) dirRecords(d *node) ([]*record, error) {
+	recs := []*record{{n: d, id: []byte{0}}, {n: d.parent, id: []byte{1}}}
+	children := make([]*node, 0, len(d.children))
+	for _, c := range d.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(a, b int) bool { return children[a].isoName < children[b].isoName })
+	for _, c := range children {
+		id := c.isoName
+		if !c.isDir() {
+			id += ";1"
+		}
+		recs = append(recs, &record{n: c, id: []byte(id)})
+	}
+	if !w.rockRidge {
+		return recs, nil
+	}
+	for i, r := range recs {
+		var entries [][]byte
+		if d == w.root && i == 0 {
+			entries = append(entries, spEntry())
+		}
+		nlink := uint32(1)
+		if r.n.isDir() {
+			nlink = 2
+			for _, c := range r.n.children {
+				if c.isDir() {
+					nlink++
+				}
+			}
+		}
+		entries = append(entries,
+			pxEntry(posixMode(r.n.mode), nlink, r.n.uid, r.n.gid),
+			tfEntry(r.n.mtime, r.n.mtime, r.n.mtime))
+		if i >= 2 {
+			entries = append(entries, nmEntries(r.n.name)...)
+			if r.n.mode&fs.ModeSymlink != 0 {
+				entries = append(entries, slEntries(r.n.target)...)
+			}
+			if r.n.mode&fs.ModeDevice != 0 {
+				entries = append(entries, pnEntry(r.n.major, r.n.minor))
+			}
+		}
+		if d == w.root && i == 0 {
+			entries = append(entries, erEntry())
+		}
+		if err := r.fit(entries); err != nil {
+			return nil, fmt.Errorf("iso9660: %s: %w", r.n.name, err)
+		}
+	}
+	return recs, nil
+}
+
+// fit distributes system use entries between the record and its
+// continuation area.
+func (r *record) fit(entries [][]byte) error {
+	avail := 255 - (33 + len(r.id) + 1 - len(r.id)%2)
+	total := 0
+	for _, e := range entries {
+		total += len(e)
+	}
+	if total <= avail {
+		r.inline = entries
+		return nil
+	}
+	used := 0
+	i := 0
+	for ; i < len(entries) && used+len(entries[i])+ceLen <= avail; i++ {
+		used += len(entries[i])
+	}
+	r.inline = entries[:i]
+	for _, e := range entries[i:] {
+		r.ce = append(r.ce, e...)
+	}
+	if len(r.ce) > sectorSize {
+		return errors.New("Rock Ridge entries too long")
+	}
+	return nil
+}
+
+// jolietRecords returns the Joliet records of directory d.
+func jolietRecords(d *node) []*record {
+	recs := []*record{{n: d, id: []byte{0}}, {n: d.parent, id: []byte{1}}}
+	children := make([]*node, 0, len(d.children))
+	for _, c := range d.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(a, b int) bool {
+		return bytes.Compare(encodeUCS2(children[a].jolietName), encodeUCS2(children[b].jolietName)) < 0
+	})
+	for _, c := range children {
+		recs = append(recs, &record{n: c, id: encodeUCS2(c.jolietName)})
+	}
+	return recs
+}
+
+// dirSize returns the size of a directory extent holding recs. Records do
+// not cross sector boundaries.
+func dirSize(recs []*record) uint32 {
+	size, off := uint32(sectorSize), 0
+	for _, r := range recs {
+		n := r.len()
+		if off+n > sectorSize {
+			size += sectorSize
+			off = 0
+		}
+		off += n
+	}
+	return size
+}
+
+// writeDir encodes the records of a directory into b, and their
+// continuation areas into the image meta.
+func writeDir(b []byte, recs []*record, meta []byte, joliet bool) {
+	off := 0
+	for _, r := range recs {
+		n := r.len()
+		if off%sectorSize+n > sectorSize {
+			off += sectorSize - off%sectorSize
+		}
+		rb := b[off : off+n]
+		rb[0] = byte(n)
+		lba, size := r.n.lba, uint32(r.n.size)
+		if joliet && r.n.isDir() {
+			lba, size = r.n.jolietLBA, r.n.jolietSize
+		} else if r.n.isDir() {
+			size = r.n.dirSize
+		}
+		if !r.n.isDir() && !r.n.mode.IsRegular() {
+			size = 0
+		}
+		if size == 0 && !r.n.isDir() {
+			lba = 0
+		}
+		putBoth32(rb[2:], lba)
+		putBoth32(rb[10:], size)
+		putRecordTime(rb[18:], r.n.mtime)
+		if r.n.isDir() {
+			rb[25] = flagDirectory
+		}
+		putBoth16(rb[28:], 1)
+		rb[32] = byte(len(r.id))
+		p := 33 + copy(rb[33:], r.id)
+		if len(r.id)%2 == 0 {
+			p++
+		}
+		for _, e := range r.inline {
+			p += copy(rb[p:], e)
+		}
+		if len(r.ce) > 0 {
+			copy(rb[p:], ceEntry(r.ceLBA, r.ceOff, uint32(len(r.ce))))
+			copy(meta[int64(r.ceLBA)*sectorSize+int64(r.ceOff):], r.ce)
+		}
+		off += n
+	}
+}
+
+// pathTable encodes the little-endian path table of dirs. name returns the
+// identifier of a directory and the number of its parent.
+func pathTable(dirs []*node, name func(*node) ([]byte, uint16)) []byte {
+	var b []byte
+	for i, d := range dirs {
+		id, parent := name(d)
+		if i == 0 {
+			id, parent = []byte{0}, 1
+		}
+		e := make([]byte, 8+len(id)+len(id)%2)
+		e[0] = byte(len(id))
+		// The extent is filled in by patchPathTable.
+		binary.LittleEndian.PutUint16(e[6:], parent)
+		copy(e[8:], id)
+		b = append(b, e...)
+	}
+	return b
+}
+
+// patchPathTable fills in the extents of dirs in the path table b.
+func patchPathTable(b []byte, dirs []*node, lba func(*node) uint32) {
+	off := 0
+	for _, d := range dirs {
+		binary.LittleEndian.PutUint32(b[off+2:], lba(d))
+		off += 8 + int(b[off]) + int(b[off])%2
+	}
+}
+
+// bigEndianPathTable converts a little-endian path table.
+func bigEndianPathTable(le []byte) []byte {
+	b := append([]byte(nil), le...)
+	for off := 0; off < len(b); {
+		binary.BigEndian.PutUint32(b[off+2:], binary.LittleEndian.Uint32(le[off+2:]))
+		binary.BigEndian.PutUint16(b[off+6:], binary.LittleEndian.Uint16(le[off+6:]))
+		off += 8 + int(b[off]) + int(b[off])%2
+	}
+	return b
+}
+
+// writeDescriptors encodes the volume descriptors into meta.
+func (w *Writer) writeDescriptors(meta []byte, l *layout) {
+	patchPathTable(l.pathTable, l.dirs, func(n *node) uint32 { return n.lba })
+	pvd := meta[systemAreaSectors*sectorSize:]
+	w.writeDescriptor(pvd, l, vdPrimary)
+	next := systemAreaSectors + 1
+	if w.joliet {
+		patchPathTable(l.jolietTable, l.jolietDirs, func(n *node) uint32 { return n.jolietLBA })
+		w.writeDescriptor(meta[next*sectorSize:], l, vdSupplementary)
+		next++
+	}
+	t := meta[next*sectorSize:]
+	t[0] = vdTerminator
+	copy(t[1:], standardID)
+	t[6] = 1
+}
+
+func (w *Writer) writeDescriptor(b []byte, l *layout, typ byte) {
+	joliet := typ == vdSupplementary
+	b[0] = typ
+	copy(b[1:], standardID)
+	b[6] = 1
+	putStr := putString
+	if joliet {
+		putStr = putUCS2
+		copy(b[88:], jolietEscape)
+	}
+	putStr(b[8:40], "")
+	label := w.label
+	if joliet && len(label) > maxLabel/2 {
+		label = label[:maxLabel/2]
+	}
+	putStr(b[40:72], label)
+	putBoth32(b[80:], l.total)
+	putBoth16(b[120:], 1)
+	putBoth16(b[124:], 1)
+	putBoth16(b[128:], sectorSize)
+
+	table, lPath, mPath, root := l.pathTable, l.lPath, l.mPath, w.root.lba
+	rootSize := w.root.dirSize
+	if joliet {
+		table, lPath, mPath, root = l.jolietTable, l.jlPath, l.jmPath, w.root.jolietLBA
+		rootSize = w.root.jolietSize
+	}
+	putBoth32(b[132:], uint32(len(table)))
+	binary.LittleEndian.PutUint32(b[140:], lPath)
+	binary.BigEndian.PutUint32(b[148:], mPath)
+
+	r := b[156:190]
+	r[0] = 34
+	putBoth32(r[2:], root)
+	putBoth32(r[10:], rootSize)
+	putRecordTime(r[18:], w.root.mtime)
+	r[25] = flagDirectory
+	putBoth16(r[28:], 1)
+	r[32] = 1
+
+	putStr(b[190:318], "") // volume set
+	putStr(b[318:446], "") // publisher
+	putStr(b[446:574], "") // data preparer
+	putStr(b[574:702], "") // application
+	putStr(b[702:739], "") // copyright file
+	putStr(b[739:776], "") // abstract file
+	putStr(b[776:813], "") // bibliographic file
+	putVolumeTime(b[813:], w.now)
+	putVolumeTime(b[830:], w.now)
+	putVolumeTime(b[847:], time.Time{})
+	putVolumeTime(b[864:], time.Time{})
+	b[881] = 1
+}
@@ -0,0 +1,110 @@
+package kernelpkg
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+)
+
+// walkDeb walks the data archive of the Debian package r, an ar archive.
+func walkDeb(r io.Reader, fn func(f *file, r io.Reader) error) error {
+	br := bufio.NewReader(r)
+	if _, err := br.Discard(len(arMagic)); err != nil {
+		return err
+	}
+	for {
+		var hdr [arHeaderSize]byte
+		if _, err := io.ReadFull(br, hdr[:]); err == io.EOF {
+			return fmt.Errorf("%w: no data archive", ErrFormat)
+		} else if err != nil {
+			return err
+		}
+		if string(hdr[58:60]) != "`\n" {
+			return fmt.Errorf("%w: bad ar header", ErrFormat)
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(hdr[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(hdr[48:58])), 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("%w: bad ar member size", ErrFormat)
+		}
+		if name == "data.tar" || strings.HasPrefix(name, "data.tar.") {
+			return walkTar(io.LimitReader(br, size), fn)
+		}
+		// Members start on even offsets.
+		if _, err := br.Discard(int(size + size%2)); err != nil {
+			return err
+		}
+	}
+}
+
+// walkTar walks the entries of the possibly compressed tar archive r.
+func walkTar(r io.Reader, fn func(f *file, r io.Reader) error) error {
+	r, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f := &file{
+			name:     cleanName(hdr.Name),
+			mode:     hdr.FileInfo().Mode(),
+			size:     hdr.Size,
+			linkname: hdr.Linkname,
+		}
+		if f.name == "" || hdr.Typeflag == tar.TypeLink {
+			continue
+		}
+		if err := fn(f, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// cleanName returns name relative to the root, without leading "./" or
+// slash.
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// decompress detects gzip, bzip2, xz and zstd compressed streams.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return xz.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return br, nil
+}
@@ -0,0 +1,55 @@
+package kernelpkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+)
+
+// decompressKernel returns the uncompressed image of the kernel data and
+// reports whether data was compressed. Images it does not know, such as
+// x86 bzImages that decompress themselves, are returned unchanged.
+func decompressKernel(data []byte) ([]byte, bool, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return readAll(data)
+	case len(data) >= 56 && string(data[0:2]) == "MZ" && string(data[4:8]) == "zimg":
+		// EFI zboot images wrap the compressed kernel in a PE
+		// decompressor, and describe the payload in their header.
+		off := binary.LittleEndian.Uint32(data[8:])
+		size := binary.LittleEndian.Uint32(data[12:])
+		if uint64(off)+uint64(size) > uint64(len(data)) {
+			return nil, false, fmt.Errorf("%w: truncated zboot image", ErrFormat)
+		}
+		payload := data[off : off+size]
+		comp := string(bytes.TrimRight(data[24:56], "\x00"))
+		switch comp {
+		case "gzip":
+		case "xz", "zstd":
+			// The kernel build appends the uncompressed size, which
+			// the decompressors take for a broken stream.
+			if len(payload) < 4 {
+				return nil, false, fmt.Errorf("%w: truncated zboot image", ErrFormat)
+			}
+			payload = payload[:len(payload)-4]
+		default:
+			return nil, false, fmt.Errorf("kernelpkg: unsupported zboot compression %q", comp)
+		}
+		return readAll(payload)
+	}
+	return data, false, nil
+}
+
+// readAll decompresses data.
+func readAll(data []byte) ([]byte, bool, error) {
+	r, err := decompress(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, fmt.Errorf("kernelpkg: decompressing kernel: %w", err)
+	}
+	return out, true, nil
+}
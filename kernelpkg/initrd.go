@@ -0,0 +1,523 @@
+package kernelpkg
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mac-vz/vz/initrd"
+)
+
+// DefaultModules are the modules WriteInitrd adds: the virtio drivers of
+// the devices the Virtualization framework attaches and the ext4 file
+// system.
+var DefaultModules = []string{
+	"virtio_pci", "virtio_blk", "virtio_net", "virtio_console", "virtiofs", "ext4",
+}
+
+// Option is an option for WriteInitrd.
+type Option func(o *options)
+
+type options struct {
+	modules     []string
+	busybox     string
+	compression initrd.Compression
+}
+
+// WithModules sets the modules added to the initrd. It defaults to
+// DefaultModules.
+func WithModules(modules ...string) Option {
+	return func(o *options) {
+		o.modules = modules
+	}
+}
+
+// WithBusybox adds the statically linked busybox binary at path and an
+// /init that loads the modules, mounts the device named by root= on the
+// kernel command line and switches to it. Without it the initrd only
+// holds the modules, for hooks such as those of package rootoverlay that
+// load them with modprobe.
+func WithBusybox(path string) Option {
+	return func(o *options) {
+		o.busybox = path
+	}
+}
+
+// WithCompression sets the compression of the initrd. It defaults to
+// initrd.Gzip.
+func WithCompression(c initrd.Compression) Option {
+	return func(o *options) {
+		o.compression = c
+	}
+}
+
+// busyboxApplets are the commands /init runs.
+var busyboxApplets = []string{
+	"sh", "cat", "echo", "findfs", "insmod", "modprobe", "mount", "sleep",
+	"switch_root", "umount",
+}
+
+// WriteInitrd writes a new initrd at name holding the modules of k, along
+// with the modules they depend on, uncompressed below /lib/modules and
+// listed in a modules.dep of their own. The initrd therefore cannot be
+// appended to one holding other modules of k. Modules built into the
+// kernel are skipped, missing ones are an error.
+func (k *Kernel) WriteInitrd(name string, opts ...Option) (err error) {
+	o := &options{modules: DefaultModules, compression: initrd.Gzip}
+	for _, opt := range opts {
+		opt(o)
+	}
+	var mods []*module
+	if k.ModulesDir != "" {
+		idx, err := indexModules(k.ModulesDir)
+		if err != nil {
+			return err
+		}
+		if mods, err = idx.resolve(o.modules); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(name)
+		}
+	}()
+	iw, err := initrd.NewWriter(f, initrd.WithCompression(o.compression))
+	if err != nil {
+		return err
+	}
+	dir := "/lib/modules/" + k.Version
+	var dep bytes.Buffer
+	for _, m := range mods {
+		if err := iw.Add(&initrd.Entry{Path: path.Join(dir, m.rel), Mode: 0644, Size: int64(len(m.data))}, bytes.NewReader(m.data)); err != nil {
+			return err
+		}
+		dep.WriteString(m.rel + ":")
+		for _, d := range m.deps {
+			dep.WriteString(" " + d.rel)
+		}
+		dep.WriteString("\n")
+	}
+	if len(mods) > 0 {
+		if err := iw.Add(&initrd.Entry{Path: dir + "/modules.dep", Mode: 0644, Size: int64(dep.Len())}, &dep); err != nil {
+			return err
+		}
+	}
+	if o.busybox != "" {
+		if err := addInit(iw, o.busybox, dir, mods); err != nil {
+			return err
+		}
+	}
+	return iw.Close()
+}
+
+// addInit adds busybox and an /init loading mods.
+func addInit(iw *initrd.Writer, busybox, dir string, mods []*module) error {
+	bf, err := os.Open(busybox)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+	fi, err := bf.Stat()
+	if err != nil {
+		return err
+	}
+	if err := iw.Add(&initrd.Entry{Path: "/bin/busybox", Mode: 0755, Size: fi.Size()}, bf); err != nil {
+		return err
+	}
+	for _, applet := range busyboxApplets {
+		if err := iw.Add(&initrd.Entry{Path: "/bin/" + applet, Mode: fs.ModeSymlink | 0777, Linkname: "busybox"}, nil); err != nil {
+			return err
+		}
+	}
+	for _, d := range []string{"/dev", "/proc", "/sys", "/newroot"} {
+		if err := iw.Add(&initrd.Entry{Path: d, Mode: fs.ModeDir | 0755}, nil); err != nil {
+			return err
+		}
+	}
+	if err := iw.Add(&initrd.Entry{Path: "/dev/console", Mode: fs.ModeDevice | fs.ModeCharDevice | 0600, Devmajor: 5, Devminor: 1}, nil); err != nil {
+		return err
+	}
+	var paths []string
+	for _, m := range mods {
+		paths = append(paths, path.Join(dir, m.rel))
+	}
+	s := []byte(strings.Replace(initScript, "@MODULES@", strings.Join(paths, " "), 1))
+	return iw.Add(&initrd.Entry{Path: "/init", Mode: 0755, Size: int64(len(s))}, bytes.NewReader(s))
+}
+
+const initScript = `#!/bin/sh
+# Loads the modules, mounts the root device and switches to it.
+export PATH=/bin
+
+fail() {
+	echo "init: $*" >&2
+	echo "init: starting a shell" >&2
+	exec sh
+}
+
+mount -t proc proc /proc
+mount -t sysfs sysfs /sys
+mount -t devtmpfs devtmpfs /dev 2>/dev/null
+
+for m in @MODULES@; do
+	insmod "$m" || echo "init: cannot load $m" >&2
+done
+
+root= rootfstype= rootflags= mode=ro init=/sbin/init
+for arg in $(cat /proc/cmdline); do
+	case $arg in
+	root=*) root=${arg#root=} ;;
+	rootfstype=*) rootfstype=${arg#rootfstype=} ;;
+	rootflags=*) rootflags=${arg#rootflags=} ;;
+	init=*) init=${arg#init=} ;;
+	ro|rw) mode=$arg ;;
+	esac
+done
+[ -n "$root" ] || fail "no root= on the kernel command line"
+
+# device waits up to 30 seconds for the device named by $1.
+device() {
+	i=0
+	while [ $i -lt 300 ]; do
+		case $1 in
+		UUID=*|LABEL=*|PARTUUID=*|PARTLABEL=*) dev=$(findfs "$1" 2>/dev/null) ;;
+		*) dev=$1 ;;
+		esac
+		[ -n "$dev" ] && [ -b "$dev" ] && return 0
+		sleep 0.1 2>/dev/null || sleep 1
+		i=$((i + 1))
+	done
+	return 1
+}
+
+device "$root" || fail "root device $root not found"
+mount -o $mode${rootflags:+,$rootflags} ${rootfstype:+-t $rootfstype} "$dev" /newroot ||
+	fail "cannot mount $root"
+
+mount --move /dev /newroot/dev
+umount /sys /proc
+exec switch_root /newroot "$init"
+`
+
+// module is a loadable kernel module.
+type module struct {
+	name string
+
+	// rel is the path of the uncompressed module relative to the modules
+	// directory.
+	rel string
+
+	// file is the path of the possibly compressed module.
+	file string
+
+	data []byte
+	info map[string][]string
+	deps []*module
+}
+
+// moduleIndex holds the modules of a kernel by normalized name.
+type moduleIndex struct {
+	modules map[string]*module
+	builtin map[string]bool
+
+	// aliases maps aliases to module names. It is filled on first use.
+	aliases map[string][]string
+}
+
+// moduleSuffixes are the file name suffixes of modules, by compression.
+var moduleSuffixes = []string{".ko", ".ko.xz", ".ko.zst", ".ko.gz"}
+
+// indexModules indexes the modules in the directory dir.
+func indexModules(dir string) (*moduleIndex, error) {
+	idx := &moduleIndex{modules: map[string]*module{}, builtin: map[string]bool{}}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		for _, suffix := range moduleSuffixes {
+			if !strings.HasSuffix(rel, suffix) {
+				continue
+			}
+			rel = strings.TrimSuffix(rel, suffix) + ".ko"
+			name := moduleName(rel)
+			if _, ok := idx.modules[name]; !ok {
+				idx.modules[name] = &module{name: name, rel: rel, file: p}
+			}
+			break
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "modules.builtin"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			idx.builtin[moduleName(line)] = true
+		}
+	}
+	return idx, nil
+}
+
+// moduleName returns the name of the module at p, with dashes replaced by
+// underscores as the kernel does.
+func moduleName(p string) string {
+	name := path.Base(p)
+	if i := strings.Index(name, ".ko"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// resolve returns the modules names, that are not built in, with their
+// dependencies, each after the modules it depends on.
+func (idx *moduleIndex) resolve(names []string) ([]*module, error) {
+	var (
+		order []*module
+		state = map[*module]int{} // 1 while visiting, 2 when done
+	)
+	var visit func(m *module) error
+	visit = func(m *module) error {
+		switch state[m] {
+		case 1:
+			return fmt.Errorf("kernelpkg: module %s depends on itself", m.name)
+		case 2:
+			return nil
+		}
+		state[m] = 1
+		if err := idx.load(m); err != nil {
+			return err
+		}
+		for _, d := range m.info["depends"] {
+			for _, name := range strings.Split(d, ",") {
+				if name == "" {
+					continue
+				}
+				name = moduleName(name)
+				if idx.builtin[name] {
+					continue
+				}
+				dep, ok := idx.modules[name]
+				if !ok {
+					return fmt.Errorf("kernelpkg: module %s needed by %s not found", name, m.name)
+				}
+				if err := visit(dep); err != nil {
+					return err
+				}
+				m.deps = append(m.deps, dep)
+			}
+		}
+		// Soft dependencies are loaded before the module when present,
+		// but not listed in modules.dep.
+		for _, name := range softDeps(m.info["softdep"]) {
+			dep, err := idx.lookup(name)
+			if err != nil {
+				return err
+			}
+			if dep != nil {
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		state[m] = 2
+		order = append(order, m)
+		return nil
+	}
+	for _, name := range names {
+		name = moduleName(name)
+		if idx.builtin[name] {
+			continue
+		}
+		m, ok := idx.modules[name]
+		if !ok {
+			return nil, fmt.Errorf("kernelpkg: module %s not found", name)
+		}
+		if err := visit(m); err != nil {
+			return nil, err
+		}
+	}
+	// A module reached through several paths only lists its direct
+	// dependencies; modules.dep lists all of them, nearest first.
+	for _, m := range order {
+		m.deps = allDeps(m)
+	}
+	return order, nil
+}
+
+// allDeps returns the direct and indirect dependencies of m, in reverse
+// load order.
+func allDeps(m *module) []*module {
+	var (
+		list []*module
+		seen = map[*module]bool{}
+	)
+	var walk func(m *module)
+	walk = func(m *module) {
+		for _, d := range m.deps {
+			if !seen[d] {
+				seen[d] = true
+				walk(d)
+				list = append(list, d)
+			}
+		}
+	}
+	walk(m)
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list
+}
+
+// softDeps returns the modules to load before a module from its softdep
+// entries, such as "pre: crc32c".
+func softDeps(entries []string) []string {
+	var names []string
+	for _, e := range entries {
+		pre := false
+		for _, f := range strings.Fields(e) {
+			switch f {
+			case "pre:":
+				pre = true
+			case "post:":
+				pre = false
+			default:
+				if pre {
+					names = append(names, f)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// lookup returns the module named or aliased name, or nil if it is built
+// in or missing.
+func (idx *moduleIndex) lookup(name string) (*module, error) {
+	if n := moduleName(name); idx.builtin[n] {
+		return nil, nil
+	} else if m, ok := idx.modules[n]; ok {
+		return m, nil
+	}
+	// Aliases usually start with the name of the module, as crc32c does
+	// for crc32c_generic; try those before reading all modules.
+	if idx.aliases == nil {
+		for n, m := range idx.modules {
+			if !strings.HasPrefix(n, moduleName(name)) {
+				continue
+			}
+			if err := idx.load(m); err != nil {
+				return nil, err
+			}
+			for _, a := range m.info["alias"] {
+				if a == name {
+					return m, nil
+				}
+			}
+		}
+		if err := idx.loadAliases(); err != nil {
+			return nil, err
+		}
+	}
+	candidates := idx.aliases[name]
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	return idx.modules[candidates[0]], nil
+}
+
+// loadAliases reads the aliases of all modules, which means decompressing
+// them all.
+func (idx *moduleIndex) loadAliases() error {
+	idx.aliases = map[string][]string{}
+	var names []string
+	for name := range idx.modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := idx.modules[name]
+		if err := idx.load(m); err != nil {
+			return err
+		}
+		for _, a := range m.info["alias"] {
+			idx.aliases[a] = append(idx.aliases[a], name)
+		}
+	}
+	return nil
+}
+
+// load reads, decompresses and parses the module m unless it already is.
+func (idx *moduleIndex) load(m *module) error {
+	if m.data != nil {
+		return nil
+	}
+	f, err := os.Open(m.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := decompress(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("kernelpkg: %s: %w", m.file, err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("kernelpkg: %s: %w", m.file, err)
+	}
+	info, err := modinfo(data)
+	if err != nil {
+		return fmt.Errorf("kernelpkg: %s: %w", m.file, err)
+	}
+	m.data, m.info = data, info
+	return nil
+}
+
+// modinfo returns the entries of the .modinfo section of the module data.
+func modinfo(data []byte) (map[string][]string, error) {
+	ef, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	info := map[string][]string{}
+	s := ef.Section(".modinfo")
+	if s == nil {
+		return info, nil
+	}
+	sdata, err := s.Data()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range bytes.Split(sdata, []byte{0}) {
+		kv := strings.SplitN(string(e), "=", 2)
+		if len(kv) == 2 {
+			info[kv[0]] = append(info[kv[0]], kv[1])
+		}
+	}
+	return info, nil
+}
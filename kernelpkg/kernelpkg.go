@@ -0,0 +1,223 @@
+// Package kernelpkg extracts distribution kernels from their packages, so
+// virtual machines can boot an exact, pinned kernel version without
+// installing it anywhere.
+//
+// Extract reads locally downloaded Debian packages (.deb) and RPM packages
+// (.rpm) without external tools, and writes the kernel image and the
+// modules of the kernel they hold. Distributions split kernels across
+// packages differently, so all packages of one kernel are passed at once,
+// such as linux-image and linux-modules on Ubuntu or kernel-core and
+// kernel-modules-core on Fedora:
+//
+//	k, _ := kernelpkg.Extract("kernel", "linux-image-6.1.0-13-arm64_6.1.55-1_arm64.deb")
+//	k.WriteInitrd("kernel/initrd")
+//	vz.NewLinuxBootLoader(k.Path, vz.WithInitrd("kernel/initrd"))
+//
+// Kernels compressed with gzip or as EFI zboot images, as shipped for
+// arm64, are decompressed, since the Virtualization framework only boots
+// uncompressed arm64 kernels.
+package kernelpkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrFormat is returned for files that are neither Debian nor RPM
+	// packages, or that are corrupt.
+	ErrFormat = errors.New("kernelpkg: unsupported package format")
+
+	// ErrNoKernel is returned when the packages hold no kernel image.
+	ErrNoKernel = errors.New("kernelpkg: no kernel found")
+)
+
+// Kernel is a kernel extracted from packages.
+type Kernel struct {
+	// Version is the kernel release, such as "6.1.0-13-arm64".
+	Version string
+
+	// Path is the kernel image.
+	Path string
+
+	// ModulesDir holds the modules of the kernel, laid out like
+	// /lib/modules/Version. It is empty if the packages hold no modules.
+	ModulesDir string
+}
+
+// file is an entry of the payload of a package.
+type file struct {
+	// name is the path relative to the root, without leading slash.
+	name     string
+	mode     os.FileMode
+	size     int64
+	linkname string
+}
+
+// Extract creates the directory dir and writes the kernel image and the
+// modules held by packages to it. The packages must hold exactly one
+// kernel version.
+func Extract(dir string, packages ...string) (k *Kernel, err error) {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	var (
+		versions = map[string]bool{}
+		images   = map[string][]byte{}
+	)
+	modules := filepath.Join(dir, "modules")
+	for _, p := range packages {
+		err := walkPackage(p, func(f *file, r io.Reader) error {
+			if version, ok := kernelImage(f.name); ok && f.mode.IsRegular() {
+				data, err := ioutil.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				versions[version] = true
+				images[version] = data
+				return nil
+			}
+			version, rel, ok := moduleFile(f.name)
+			if !ok {
+				return nil
+			}
+			versions[version] = true
+			return writeFile(filepath.Join(modules, version, filepath.FromSlash(rel)), f, r)
+		})
+		if errors.Is(err, ErrFormat) {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("kernelpkg: %s: %w", p, err)
+		}
+	}
+	if len(versions) > 1 {
+		var list []string
+		for v := range versions {
+			list = append(list, v)
+		}
+		sort.Strings(list)
+		return nil, fmt.Errorf("kernelpkg: packages hold several kernels: %s", strings.Join(list, ", "))
+	}
+	k = &Kernel{}
+	for v := range versions {
+		k.Version = v
+	}
+	data, ok := images[k.Version]
+	if !ok {
+		return nil, ErrNoKernel
+	}
+	data, decompressed, err := decompressKernel(data)
+	if err != nil {
+		return nil, err
+	}
+	name := "vmlinuz-" + k.Version
+	if decompressed {
+		name = "Image-" + k.Version
+	}
+	k.Path = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(k.Path, data, 0644); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(modules, k.Version)); err == nil {
+		k.ModulesDir = filepath.Join(modules, k.Version)
+	}
+	return k, nil
+}
+
+// kernelImage reports whether name is a kernel image and returns its
+// version. Debian and Ubuntu install kernels to /boot, Fedora and openSUSE
+// ship them next to the modules.
+func kernelImage(name string) (string, bool) {
+	dir, base := path.Split(name)
+	if dir == "boot/" {
+		for _, prefix := range []string{"vmlinuz-", "vmlinux-", "Image-"} {
+			if strings.HasPrefix(base, prefix) && len(base) > len(prefix) {
+				return base[len(prefix):], true
+			}
+		}
+		return "", false
+	}
+	if base != "vmlinuz" && base != "Image" {
+		return "", false
+	}
+	version, rel, ok := moduleFile(name)
+	return version, ok && rel == base
+}
+
+// moduleFile reports whether name is below the modules directory of a
+// kernel and returns the version and the path relative to that directory.
+func moduleFile(name string) (version, rel string, ok bool) {
+	name = strings.TrimPrefix(name, "usr/")
+	if !strings.HasPrefix(name, "lib/modules/") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, "lib/modules/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// writeFile writes the directory, symbolic link or regular file f with the
+// contents r to p, creating its parents.
+func writeFile(p string, f *file, r io.Reader) error {
+	switch {
+	case f.mode.IsDir():
+		return os.MkdirAll(p, 0755)
+	case f.mode&os.ModeSymlink != 0:
+		// Links such as build and source point into the headers.
+		return nil
+	case !f.mode.IsRegular():
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, r, f.size); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// walkPackage calls fn for each entry of the payload of the package at p,
+// with r reading the contents of regular files.
+func walkPackage(p string, fn func(f *file, r io.Reader) error) error {
+	pf, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer pf.Close()
+	var magic [8]byte
+	if _, err := io.ReadFull(pf, magic[:]); err != nil {
+		return ErrFormat
+	}
+	if _, err := pf.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	switch {
+	case bytes.Equal(magic[:], []byte(arMagic)):
+		return walkDeb(pf, fn)
+	case bytes.Equal(magic[:4], []byte(rpmLeadMagic)):
+		return walkRPM(pf, fn)
+	}
+	return ErrFormat
+}
@@ -0,0 +1,146 @@
+package kernelpkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+const (
+	rpmLeadMagic   = "\xed\xab\xee\xdb"
+	rpmLeadSize    = 96
+	rpmHeaderMagic = "\x8e\xad\xe8\x01"
+
+	cpioHeaderSize = 110
+	cpioTrailer    = "TRAILER!!!"
+)
+
+// walkRPM walks the payload of the RPM package r: the lead, the signature
+// and the header are skipped, the compression of the cpio archive that
+// follows is detected.
+func walkRPM(r io.Reader, fn func(f *file, r io.Reader) error) error {
+	br := bufio.NewReader(r)
+	if _, err := br.Discard(rpmLeadSize); err != nil {
+		return fmt.Errorf("%w: short lead", ErrFormat)
+	}
+	// The signature is padded to a multiple of 8 bytes, the header is not.
+	for _, pad := range []bool{true, false} {
+		var intro [16]byte
+		if _, err := io.ReadFull(br, intro[:]); err != nil {
+			return fmt.Errorf("%w: short header", ErrFormat)
+		}
+		if string(intro[:4]) != rpmHeaderMagic {
+			return fmt.Errorf("%w: bad header magic", ErrFormat)
+		}
+		n := int64(binary.BigEndian.Uint32(intro[8:]))*16 + int64(binary.BigEndian.Uint32(intro[12:]))
+		if pad {
+			n += (8 - n%8) % 8
+		}
+		if _, err := io.CopyN(ioutil.Discard, br, n); err != nil {
+			return fmt.Errorf("%w: short header", ErrFormat)
+		}
+	}
+	payload, err := decompress(br)
+	if err != nil {
+		return err
+	}
+	return walkCpio(payload, fn)
+}
+
+// walkCpio walks the entries of the cpio archive r in the "newc" format,
+// with or without checksums.
+func walkCpio(r io.Reader, fn func(f *file, r io.Reader) error) error {
+	br := bufio.NewReader(r)
+	var off int64
+	skip := func(n int64) error {
+		_, err := io.CopyN(ioutil.Discard, br, n)
+		off += n
+		return err
+	}
+	for {
+		var hdr [cpioHeaderSize]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return fmt.Errorf("%w: short cpio header", ErrFormat)
+		}
+		off += cpioHeaderSize
+		if m := string(hdr[:6]); m != "070701" && m != "070702" {
+			return fmt.Errorf("%w: bad cpio magic", ErrFormat)
+		}
+		field := func(i int) (int64, error) {
+			v, err := strconv.ParseUint(string(hdr[6+8*i:14+8*i]), 16, 32)
+			if err != nil {
+				return 0, fmt.Errorf("%w: bad cpio header", ErrFormat)
+			}
+			return int64(v), nil
+		}
+		mode, err := field(1)
+		if err != nil {
+			return err
+		}
+		size, err := field(6)
+		if err != nil {
+			return err
+		}
+		nameSize, err := field(11)
+		if err != nil {
+			return err
+		}
+		if nameSize == 0 {
+			return fmt.Errorf("%w: bad cpio header", ErrFormat)
+		}
+		name := make([]byte, nameSize)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return err
+		}
+		off += nameSize
+		if err := skip((4 - off%4) % 4); err != nil {
+			return err
+		}
+		raw := string(bytes.TrimRight(name, "\x00"))
+		if raw == cpioTrailer {
+			return nil
+		}
+		f := &file{name: cleanName(raw), mode: cpioMode(uint32(mode)), size: size}
+		data := io.LimitReader(br, size)
+		if f.mode&os.ModeSymlink != 0 {
+			target, err := ioutil.ReadAll(data)
+			if err != nil {
+				return err
+			}
+			f.linkname, f.size = string(target), 0
+		}
+		if f.name != "" {
+			if err := fn(f, data); err != nil {
+				return err
+			}
+		}
+		// Skip what fn did not read.
+		if _, err := io.Copy(ioutil.Discard, data); err != nil {
+			return err
+		}
+		off += size
+		if err := skip((4 - off%4) % 4); err != nil {
+			return err
+		}
+	}
+}
+
+// cpioMode converts the type and permission bits of a cpio mode.
+func cpioMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	switch mode & 0170000 {
+	case 0040000:
+		m |= os.ModeDir
+	case 0120000:
+		m |= os.ModeSymlink
+	case 0100000:
+	default:
+		m |= os.ModeIrregular
+	}
+	return m
+}
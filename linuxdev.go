@@ -0,0 +1,31 @@
+package vz
+
+import (
+	"net"
+
+	"github.com/mac-vz/vz/linuxdev"
+)
+
+// LinuxGuestDevices returns the names a Linux guest gives to the devices
+// of the lists passed to SetStorageDevicesVirtualMachineConfiguration,
+// SetSerialPortsVirtualMachineConfiguration,
+// SetNetworkDevicesVirtualMachineConfiguration and
+// SetDirectorySharingDevices.
+func LinuxGuestDevices(
+	storage []StorageDeviceConfiguration,
+	serialPorts []*VirtioConsoleDeviceSerialPortConfiguration,
+	network []*VirtioNetworkDeviceConfiguration,
+	sharing []DirectorySharingDeviceConfiguration,
+) *linuxdev.Devices {
+	macs := make([]net.HardwareAddr, len(network))
+	for i, n := range network {
+		macs[i] = n.MACAddress().HardwareAddr()
+	}
+	var tags []string
+	for _, s := range sharing {
+		if fs, ok := s.(*VZVirtioFileSystemDeviceConfiguration); ok {
+			tags = append(tags, fs.Tag())
+		}
+	}
+	return linuxdev.New(len(storage), len(serialPorts), macs, tags)
+}
@@ -0,0 +1,140 @@
+// Package linuxdev predicts the names a Linux guest gives to the devices
+// of a virtual machine, so kernel arguments, fstab and network
+// configurations can be generated from the device lists of a
+// configuration instead of by trial and error:
+//
+//	devs := vz.LinuxGuestDevices(disks, consoles, nics, shares)
+//	c := cmdline.Parse("rw")
+//	c.Set("root", devs.Disks[0])
+//	c.Set("console", devs.Console())
+//
+// Disks, consoles and network interfaces are numbered in the order of the
+// lists passed to the configuration. The predictable interface names
+// assume the PCI layout of the Virtualization framework, which places the
+// network devices first, from slot 1.
+package linuxdev
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// firstNetworkSlot is the PCI slot of the first network device.
+const firstNetworkSlot = 1
+
+// Devices are the guest-side names of the devices of a virtual machine.
+type Devices struct {
+	// Disks are the block device paths, such as "/dev/vda".
+	Disks []string
+
+	// Consoles are the console names, such as "hvc0".
+	Consoles []string
+
+	Interfaces []Interface
+
+	// Tags are the virtiofs tags of the shared directories.
+	Tags []string
+}
+
+// Interface is the name of a network interface.
+type Interface struct {
+	// Name is the kernel name, such as "eth0".
+	Name string
+
+	// PredictableName is the name given by systemd and udev, such as
+	// "enp0s1".
+	PredictableName string
+
+	// MAC is the address of the device, if known.
+	MAC net.HardwareAddr
+}
+
+// New returns the names of disks virtio block devices, consoles virtio
+// console ports, network devices with the addresses macs, nil where
+// unknown, and shared directories with the tags tags.
+func New(disks, consoles int, macs []net.HardwareAddr, tags []string) *Devices {
+	d := &Devices{Tags: tags}
+	for i := 0; i < disks; i++ {
+		d.Disks = append(d.Disks, DiskPath(i))
+	}
+	for i := 0; i < consoles; i++ {
+		d.Consoles = append(d.Consoles, ConsoleName(i))
+	}
+	for i, mac := range macs {
+		d.Interfaces = append(d.Interfaces, Interface{
+			Name:            InterfaceName(i),
+			PredictableName: PredictableInterfaceName(i),
+			MAC:             mac,
+		})
+	}
+	return d
+}
+
+// Console returns the name of the first console, or "" if there is none.
+func (d *Devices) Console() string {
+	if len(d.Consoles) == 0 {
+		return ""
+	}
+	return d.Consoles[0]
+}
+
+// Fstab returns fstab entries mounting the shared directories at the
+// mount points dirs, keyed by tag, in the order of Tags. It fails if dirs
+// names a tag that is not shared.
+func (d *Devices) Fstab(dirs map[string]string) (string, error) {
+	shared := map[string]bool{}
+	for _, tag := range d.Tags {
+		shared[tag] = true
+	}
+	for tag := range dirs {
+		if !shared[tag] {
+			return "", fmt.Errorf("linuxdev: no shared directory with tag %q", tag)
+		}
+	}
+	var b strings.Builder
+	for _, tag := range d.Tags {
+		if dir, ok := dirs[tag]; ok {
+			fmt.Fprintf(&b, "%s %s virtiofs defaults 0 0\n", tag, dir)
+		}
+	}
+	return b.String(), nil
+}
+
+// DiskName returns the name of the i-th virtio block device: vda to vdz,
+// then vdaa and so on.
+func DiskName(i int) string {
+	var name []byte
+	for ; i >= 0; i = i/26 - 1 {
+		name = append([]byte{byte('a' + i%26)}, name...)
+	}
+	return "vd" + string(name)
+}
+
+// DiskPath returns the device path of the i-th virtio block device.
+func DiskPath(i int) string {
+	return "/dev/" + DiskName(i)
+}
+
+// PartitionPath returns the device path of partition part, numbered from
+// 1, of the i-th virtio block device.
+func PartitionPath(i, part int) string {
+	return DiskPath(i) + strconv.Itoa(part)
+}
+
+// ConsoleName returns the name of the i-th virtio console port.
+func ConsoleName(i int) string {
+	return "hvc" + strconv.Itoa(i)
+}
+
+// InterfaceName returns the kernel name of the i-th network device.
+func InterfaceName(i int) string {
+	return "eth" + strconv.Itoa(i)
+}
+
+// PredictableInterfaceName returns the name systemd and udev give to the
+// i-th network device.
+func PredictableInterfaceName(i int) string {
+	return "enp0s" + strconv.Itoa(firstNetworkSlot+i)
+}
@@ -0,0 +1,97 @@
+package nbd
+
+// Constants of the NBD protocol.
+// see: https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	nbdMagic         = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic         = 0x49484156454f5054 // "IHAVEOPT"
+	optReplyMagic    = 0x0003e889045565a9
+	requestMagic     = 0x25609513
+	simpleMagic      = 0x67446698
+	structuredMagic  = 0x668e33ef
+	maxOptionLength  = 64 << 10
+	maxPayloadLength = 32 << 20
+)
+
+// Handshake flags.
+const (
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+)
+
+// Options.
+const (
+	optExportName      = 1
+	optAbort           = 2
+	optList            = 3
+	optStartTLS        = 5
+	optInfo            = 6
+	optGo              = 7
+	optStructuredReply = 8
+)
+
+// Option reply types.
+const (
+	repAck          = 1
+	repServer       = 2
+	repInfo         = 3
+	repErrUnsup     = 1<<31 + 1
+	repErrPolicy    = 1<<31 + 2
+	repErrInvalid   = 1<<31 + 3
+	repErrUnknown   = 1<<31 + 6
+	repErrTooBig    = 1<<31 + 9
+	infoExport      = 0
+	infoName        = 1
+	infoDescription = 2
+	infoBlockSize   = 3
+)
+
+// Transmission flags.
+const (
+	transHasFlags       = 1 << 0
+	transReadOnly       = 1 << 1
+	transSendFlush      = 1 << 2
+	transSendFUA        = 1 << 3
+	transSendTrim       = 1 << 5
+	transSendWriteZeros = 1 << 6
+	transSendDF         = 1 << 7
+	transCanMultiConn   = 1 << 8
+	transSendFastZero   = 1 << 11
+)
+
+// Commands.
+const (
+	cmdRead        = 0
+	cmdWrite       = 1
+	cmdDisc        = 2
+	cmdFlush       = 3
+	cmdTrim        = 4
+	cmdWriteZeroes = 6
+)
+
+// Command flags.
+const (
+	cmdFlagFUA      = 1 << 0
+	cmdFlagNoHole   = 1 << 1
+	cmdFlagDF       = 1 << 2
+	cmdFlagFastZero = 1 << 4
+)
+
+// Structured reply flags and types.
+const (
+	replyFlagDone       = 1 << 0
+	replyTypeNone       = 0
+	replyTypeOffsetData = 1
+	replyTypeOffsetHole = 2
+	replyTypeError      = 1<<15 + 1
+)
+
+// Error values, which are Linux errno values regardless of the platform.
+const (
+	errPerm     = 1
+	errIO       = 5
+	errInval    = 22
+	errNoSpc    = 28
+	errOverflow = 75
+	errNotSup   = 95
+)
@@ -0,0 +1,405 @@
+// Package nbd implements a Network Block Device server.
+//
+// The server speaks the fixed newstyle handshake and supports structured
+// replies. Its exports are stored in block.Backend implementations, so raw
+// images, in-memory disks and layered backends can all be attached to a
+// virtual machine through NBD, or inspected on Linux with nbd-client.
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/mac-vz/vz/block"
+)
+
+var (
+	// ErrServerClosed is returned by Serve after Close was called.
+	ErrServerClosed = errors.New("nbd: server closed")
+
+	// ErrExportExists is returned when adding an export whose name is taken.
+	ErrExportExists = errors.New("nbd: export already exists")
+)
+
+// Export is a block device offered by a Server.
+type Export struct {
+	// Name identifies the export to clients. A client asking for the
+	// empty name gets the first export added to the server.
+	Name        string
+	Description string
+	Backend     block.Backend
+}
+
+// Server serves exports to NBD clients.
+type Server struct {
+	mu        sync.Mutex
+	exports   map[string]*Export
+	order     []string
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// NewServer returns a server offering exports.
+func NewServer(exports ...*Export) (*Server, error) {
+	s := &Server{
+		exports:   map[string]*Export{},
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+	for _, e := range exports {
+		if err := s.AddExport(e); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// AddExport offers another export. Clients connecting afterwards can use it.
+func (s *Server) AddExport(e *Export) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.exports[e.Name]; ok {
+		return fmt.Errorf("%w: %q", ErrExportExists, e.Name)
+	}
+	s.exports[e.Name] = e
+	s.order = append(s.order, e.Name)
+	return nil
+}
+
+// RemoveExport stops offering the export called name. Clients already
+// using it are not disconnected, and its backend is not closed.
+func (s *Server) RemoveExport(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.exports, name)
+	for i, n := range s.order {
+		if n == name {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// export returns the export called name.
+func (s *Server) export(name string) *Export {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.exports[name]; ok {
+		return e
+	}
+	if name == "" && len(s.order) > 0 {
+		return s.exports[s.order[0]]
+	}
+	return nil
+}
+
+// list returns the exports in the order they were added.
+func (s *Server) list() []*Export {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exports := make([]*Export, 0, len(s.order))
+	for _, name := range s.order {
+		exports = append(exports, s.exports[name])
+	}
+	return exports
+}
+
+// Serve accepts connections on l, for example a unix socket created with
+// net.Listen("unix", path), and serves each of them in a goroutine. It
+// returns when l fails or the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn serves a single client connection and closes it when the
+// client disconnects.
+func (s *Server) ServeConn(c net.Conn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		c.Close()
+		return ErrServerClosed
+	}
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	cn := &conn{
+		s: s,
+		c: c,
+		r: bufio.NewReader(c),
+		w: bufio.NewWriter(c),
+	}
+	err := cn.handshake()
+	if err == nil && cn.export != nil {
+		err = cn.transmit()
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// Close stops all listeners and disconnects all clients. The backends of
+// the exports are not closed.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
+}
+
+// conn is a client connection.
+type conn struct {
+	s *Server
+	c net.Conn
+	r *bufio.Reader
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	noZeroes   bool
+	structured bool
+	export     *Export
+}
+
+func (c *conn) read(data ...interface{}) error {
+	for _, d := range data {
+		if err := binary.Read(c.r, binary.BigEndian, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handshake negotiates the export. On return c.export is nil if the
+// client aborted the negotiation.
+func (c *conn) handshake() error {
+	binary.Write(c.w, binary.BigEndian, uint64(nbdMagic))
+	binary.Write(c.w, binary.BigEndian, uint64(optMagic))
+	binary.Write(c.w, binary.BigEndian, uint16(flagFixedNewstyle|flagNoZeroes))
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	var clientFlags uint32
+	if err := c.read(&clientFlags); err != nil {
+		return err
+	}
+	if clientFlags&^(flagFixedNewstyle|flagNoZeroes) != 0 {
+		return fmt.Errorf("nbd: unknown client flags %#x", clientFlags)
+	}
+	c.noZeroes = clientFlags&flagNoZeroes != 0
+
+	for {
+		var (
+			magic  uint64
+			opt    uint32
+			length uint32
+		)
+		if err := c.read(&magic, &opt, &length); err != nil {
+			return err
+		}
+		if magic != optMagic {
+			return fmt.Errorf("nbd: bad option magic %#x", magic)
+		}
+		if length > maxOptionLength {
+			if _, err := io.CopyN(ioutil.Discard, c.r, int64(length)); err != nil {
+				return err
+			}
+			if err := c.optReply(opt, repErrTooBig, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return err
+		}
+
+		var err error
+		switch opt {
+		case optExportName:
+			e := c.s.export(string(data))
+			if e == nil {
+				return fmt.Errorf("nbd: unknown export %q", data)
+			}
+			c.export = e
+			binary.Write(c.w, binary.BigEndian, uint64(e.Backend.Size()))
+			binary.Write(c.w, binary.BigEndian, c.transmissionFlags(e))
+			if !c.noZeroes {
+				c.w.Write(make([]byte, 124))
+			}
+			return c.w.Flush()
+		case optAbort:
+			c.optReply(opt, repAck, nil)
+			return nil
+		case optList:
+			err = c.list(opt, data)
+		case optInfo, optGo:
+			var done bool
+			if done, err = c.info(opt, data); err == nil && done {
+				return nil
+			}
+		case optStructuredReply:
+			if len(data) != 0 {
+				err = c.optReply(opt, repErrInvalid, nil)
+			} else {
+				c.structured = true
+				err = c.optReply(opt, repAck, nil)
+			}
+		case optStartTLS:
+			err = c.optReply(opt, repErrPolicy, nil)
+		default:
+			err = c.optReply(opt, repErrUnsup, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// optReply sends an option reply.
+func (c *conn) optReply(opt, typ uint32, data []byte) error {
+	binary.Write(c.w, binary.BigEndian, uint64(optReplyMagic))
+	binary.Write(c.w, binary.BigEndian, opt)
+	binary.Write(c.w, binary.BigEndian, typ)
+	binary.Write(c.w, binary.BigEndian, uint32(len(data)))
+	c.w.Write(data)
+	return c.w.Flush()
+}
+
+func (c *conn) list(opt uint32, data []byte) error {
+	if len(data) != 0 {
+		return c.optReply(opt, repErrInvalid, nil)
+	}
+	for _, e := range c.s.list() {
+		b := make([]byte, 4, 4+len(e.Name)+len(e.Description))
+		binary.BigEndian.PutUint32(b, uint32(len(e.Name)))
+		b = append(append(b, e.Name...), e.Description...)
+		if err := c.optReply(opt, repServer, b); err != nil {
+			return err
+		}
+	}
+	return c.optReply(opt, repAck, nil)
+}
+
+// info handles NBD_OPT_INFO and NBD_OPT_GO, reporting whether
+// transmission starts.
+func (c *conn) info(opt uint32, data []byte) (bool, error) {
+	if len(data) < 6 {
+		return false, c.optReply(opt, repErrInvalid, nil)
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(len(data)) < 6+uint64(n) {
+		return false, c.optReply(opt, repErrInvalid, nil)
+	}
+	name := string(data[4 : 4+n])
+	reqs := data[4+n:]
+	count := int(binary.BigEndian.Uint16(reqs))
+	if len(reqs) != 2+2*count {
+		return false, c.optReply(opt, repErrInvalid, nil)
+	}
+	e := c.s.export(name)
+	if e == nil {
+		return false, c.optReply(opt, repErrUnknown, []byte(fmt.Sprintf("unknown export %q", name)))
+	}
+
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b, infoExport)
+	binary.BigEndian.PutUint64(b[2:], uint64(e.Backend.Size()))
+	binary.BigEndian.PutUint16(b[10:], c.transmissionFlags(e))
+	if err := c.optReply(opt, repInfo, b); err != nil {
+		return false, err
+	}
+	for i := 0; i < count; i++ {
+		var b []byte
+		switch binary.BigEndian.Uint16(reqs[2+2*i:]) {
+		case infoName:
+			b = append([]byte{0, infoName}, e.Name...)
+		case infoDescription:
+			if e.Description == "" {
+				continue
+			}
+			b = append([]byte{0, infoDescription}, e.Description...)
+		default:
+			continue
+		}
+		if err := c.optReply(opt, repInfo, b); err != nil {
+			return false, err
+		}
+	}
+	b = make([]byte, 14)
+	binary.BigEndian.PutUint16(b, infoBlockSize)
+	binary.BigEndian.PutUint32(b[2:], 1)
+	binary.BigEndian.PutUint32(b[6:], 4096)
+	binary.BigEndian.PutUint32(b[10:], maxPayloadLength)
+	if err := c.optReply(opt, repInfo, b); err != nil {
+		return false, err
+	}
+	if err := c.optReply(opt, repAck, nil); err != nil {
+		return false, err
+	}
+	if opt != optGo {
+		return false, nil
+	}
+	c.export = e
+	return true, nil
+}
+
+// transmissionFlags returns the flags of export e.
+func (c *conn) transmissionFlags(e *Export) uint16 {
+	flags := uint16(transHasFlags | transSendFlush | transSendFUA | transCanMultiConn)
+	if c.structured {
+		flags |= transSendDF
+	}
+	if e.Backend.ReadOnly() {
+		return flags | transReadOnly
+	}
+	return flags | transSendTrim | transSendWriteZeros | transSendFastZero
+}
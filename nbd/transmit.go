@@ -0,0 +1,204 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/mac-vz/vz/block"
+)
+
+// maxInflight is the number of requests of a connection that are
+// processed concurrently.
+const maxInflight = 16
+
+// request is a transmission phase request.
+type request struct {
+	flags  uint16
+	typ    uint16
+	handle uint64
+	offset uint64
+	length uint32
+	data   []byte
+}
+
+// transmit serves the requests of the client until it disconnects.
+func (c *conn) transmit() error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, maxInflight)
+	hdr := make([]byte, 28)
+	for {
+		if _, err := io.ReadFull(c.r, hdr); err != nil {
+			return err
+		}
+		if magic := binary.BigEndian.Uint32(hdr); magic != requestMagic {
+			return fmt.Errorf("nbd: bad request magic %#x", magic)
+		}
+		req := &request{
+			flags:  binary.BigEndian.Uint16(hdr[4:]),
+			typ:    binary.BigEndian.Uint16(hdr[6:]),
+			handle: binary.BigEndian.Uint64(hdr[8:]),
+			offset: binary.BigEndian.Uint64(hdr[16:]),
+			length: binary.BigEndian.Uint32(hdr[24:]),
+		}
+		switch req.typ {
+		case cmdDisc:
+			return nil
+		case cmdWrite:
+			if req.length > maxPayloadLength {
+				// The payload still has to be consumed to find the
+				// next request.
+				if _, err := io.CopyN(ioutil.Discard, c.r, int64(req.length)); err != nil {
+					return err
+				}
+				if err := c.reply(req, errOverflow, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			req.data = make([]byte, req.length)
+			if _, err := io.ReadFull(c.r, req.data); err != nil {
+				return err
+			}
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errno, data := c.handle(req)
+			if err := c.reply(req, errno, data); err != nil {
+				// The connection is broken: make the reading loop stop.
+				c.c.Close()
+			}
+		}()
+	}
+}
+
+// handle executes a request, returning an NBD error value and, for reads,
+// the data read.
+func (c *conn) handle(req *request) (uint32, []byte) {
+	b := c.export.Backend
+	size := b.Size()
+	off, length := int64(req.offset), int64(req.length)
+	if req.offset > uint64(size) || length > size-off {
+		if req.typ == cmdWrite || req.typ == cmdWriteZeroes {
+			return errNoSpc, nil
+		}
+		return errInval, nil
+	}
+	writes := req.typ == cmdWrite || req.typ == cmdTrim || req.typ == cmdWriteZeroes
+	if writes && b.ReadOnly() {
+		return errPerm, nil
+	}
+	var err error
+	switch req.typ {
+	case cmdRead:
+		if req.length > maxPayloadLength {
+			return errOverflow, nil
+		}
+		data := make([]byte, req.length)
+		if _, err := b.ReadAt(data, off); err != nil && err != io.EOF {
+			return errno(err), nil
+		}
+		return 0, data
+	case cmdWrite:
+		_, err = b.WriteAt(req.data, off)
+	case cmdFlush:
+		err = b.Flush()
+	case cmdTrim:
+		err = b.Trim(off, length)
+	case cmdWriteZeroes:
+		var flags block.ZeroFlags
+		if req.flags&cmdFlagNoHole != 0 {
+			flags |= block.ZeroNoHole
+		}
+		if req.flags&cmdFlagFastZero != 0 {
+			// Clients ask to learn whether pre-zeroing pays off;
+			// backends that would write zeros decline.
+			flags |= block.ZeroFast
+		}
+		err = block.WriteZeroes(b, off, length, flags)
+	default:
+		return errInval, nil
+	}
+	if err == nil && writes && req.flags&cmdFlagFUA != 0 {
+		err = b.Flush()
+	}
+	if err != nil {
+		return errno(err), nil
+	}
+	return 0, nil
+}
+
+// errno maps a backend error to an NBD error value.
+func errno(err error) uint32 {
+	switch {
+	case errors.Is(err, block.ErrReadOnly):
+		return errPerm
+	case errors.Is(err, block.ErrSlowZero):
+		return errNotSup
+	}
+	return errIO
+}
+
+// reply sends the reply to req.
+func (c *conn) reply(req *request, errno uint32, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !c.structured {
+		binary.Write(c.w, binary.BigEndian, uint32(simpleMagic))
+		binary.Write(c.w, binary.BigEndian, errno)
+		binary.Write(c.w, binary.BigEndian, req.handle)
+		if errno == 0 {
+			c.w.Write(data)
+		}
+		return c.w.Flush()
+	}
+
+	switch {
+	case errno != 0:
+		// NBD_REPLY_TYPE_ERROR with an empty message.
+		payload := make([]byte, 6)
+		binary.BigEndian.PutUint32(payload, errno)
+		c.chunk(req, replyTypeError, payload, nil)
+	case req.typ != cmdRead || len(data) == 0:
+		c.chunk(req, replyTypeNone, nil, nil)
+	case req.flags&cmdFlagDF == 0 && isZero(data):
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint64(payload, req.offset)
+		binary.BigEndian.PutUint32(payload[8:], uint32(len(data)))
+		c.chunk(req, replyTypeOffsetHole, payload, nil)
+	default:
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, req.offset)
+		c.chunk(req, replyTypeOffsetData, payload, data)
+	}
+	return c.w.Flush()
+}
+
+// chunk writes the final structured reply chunk of req.
+func (c *conn) chunk(req *request, typ uint16, payload, data []byte) {
+	binary.Write(c.w, binary.BigEndian, uint32(structuredMagic))
+	binary.Write(c.w, binary.BigEndian, uint16(replyFlagDone))
+	binary.Write(c.w, binary.BigEndian, typ)
+	binary.Write(c.w, binary.BigEndian, req.handle)
+	binary.Write(c.w, binary.BigEndian, uint32(len(payload)+len(data)))
+	c.w.Write(payload)
+	c.w.Write(data)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
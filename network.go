@@ -165,6 +165,20 @@ func (v *VirtioNetworkDeviceConfiguration) SetMACAddress(macAddress *MACAddress)
 	C.setNetworkDevicesVZMACAddress(v.Ptr(), macAddress.Ptr())
 }
 
+// MACAddress returns the MAC address of the device, a random locally
+// administered address unless set with SetMACAddress.
+func (v *VirtioNetworkDeviceConfiguration) MACAddress() *MACAddress {
+	ma := &MACAddress{
+		pointer: pointer{
+			ptr: C.getNetworkDevicesVZMACAddress(v.Ptr()),
+		},
+	}
+	runtime.SetFinalizer(ma, func(self *MACAddress) {
+		self.Release()
+	})
+	return ma
+}
+
 // MACAddress represents a media access control address (MAC address), the 48-bit ethernet address.
 // see: https://developer.apple.com/documentation/virtualization/vzmacaddress?language=objc
 type MACAddress struct {
@@ -0,0 +1,338 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mac-vz/vz/ext4"
+	"github.com/mac-vz/vz/vmspec"
+)
+
+const (
+	// InitPath is where the init running the image command is installed.
+	InitPath = "/sbin/vz-init"
+
+	// CommandLine is the kernel command line booting a disk written by
+	// WriteDisk attached as the first virtio block device.
+	CommandLine = "console=hvc0 root=/dev/vda rootfstype=ext4 rw init=" + InitPath
+)
+
+// Files written by WriteBundle.
+const (
+	DiskName   = "disk.img"
+	KernelName = "kernel"
+	InitrdName = "initrd"
+	SpecName   = "spec.json"
+)
+
+// Apply adds the layers of the image to b in order, applying whiteouts.
+func (img *Image) Apply(b *ext4.Builder) error {
+	for i := range img.layers {
+		r, err := img.OpenLayer(i)
+		if err != nil {
+			return err
+		}
+		err = b.AddLayer(r)
+		if err == nil {
+			// Drain the tar padding so the digests are checked.
+			_, err = io.Copy(io.Discard, r)
+		}
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("oci: layer %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// AddInit adds the mount points, device nodes and init script the image
+// needs to boot with CommandLine. The init mounts the kernel file systems,
+// runs the entrypoint and command of the image with its environment and
+// working directory, and powers the machine off when the command exits.
+// The command runs as root; the User of the image is ignored.
+//
+// The init is a shell script, so the image must provide /bin/sh and mount.
+func (img *Image) AddInit(b *ext4.Builder) error {
+	t := img.timestamp()
+	entries := []*ext4.Entry{
+		{Path: "/dev", Mode: fs.ModeDir | 0755},
+		{Path: "/proc", Mode: fs.ModeDir | 0555},
+		{Path: "/sys", Mode: fs.ModeDir | 0555},
+		{Path: "/run", Mode: fs.ModeDir | 0755},
+		{Path: "/tmp", Mode: fs.ModeDir | fs.ModeSticky | 0777},
+		// The kernel opens the console before devtmpfs is mounted.
+		{Path: "/dev/console", Mode: fs.ModeDevice | fs.ModeCharDevice | 0600, Devmajor: 5, Devminor: 1},
+		{Path: "/dev/null", Mode: fs.ModeDevice | fs.ModeCharDevice | 0666, Devmajor: 1, Devminor: 3},
+	}
+	for _, e := range entries {
+		e.ModTime = t
+		if err := b.Add(e, nil); err != nil {
+			return err
+		}
+	}
+	script := img.initScript()
+	return b.Add(&ext4.Entry{Path: InitPath, Mode: 0755, ModTime: t, Size: int64(len(script))}, bytes.NewReader(script))
+}
+
+// initScript returns the init running the command of the image.
+func (img *Image) initScript() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`#!/bin/sh
+# Runs the command of ` + img.Digest + `.
+export PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
+mount -t proc proc /proc
+mount -t sysfs sysfs /sys
+mount -t devtmpfs devtmpfs /dev 2>/dev/null
+mkdir -p /dev/pts /dev/shm
+mount -t devpts devpts /dev/pts
+mount -t tmpfs tmpfs /dev/shm
+mount -t tmpfs tmpfs /run
+`)
+	for _, env := range img.Config.Env {
+		if strings.IndexByte(env, '=') > 0 {
+			buf.WriteString("export " + shellQuote(env) + "\n")
+		}
+	}
+	if dir := img.Config.WorkingDir; dir != "" {
+		buf.WriteString("mkdir -p " + shellQuote(dir) + " && cd " + shellQuote(dir) + "\n")
+	}
+	args := append(append([]string{}, img.Config.Entrypoint...), img.Config.Cmd...)
+	if len(args) == 0 {
+		args = []string{"/bin/sh"}
+	}
+	for i, arg := range args {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(shellQuote(arg))
+	}
+	buf.WriteString(`
+echo "$0: command exited with status $?"
+sync
+echo o > /proc/sysrq-trigger
+while :; do sleep 60; done
+`)
+	return buf.Bytes()
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// timestamp returns the time used for the files the package adds and the
+// file system metadata, so the disk only depends on the image.
+func (img *Image) timestamp() time.Time {
+	if img.Created.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return img.Created
+}
+
+// DiskSize returns the size of a disk holding the image with as much free
+// space again as the image needs, rounded up to a MiB. It reads all
+// layers.
+func (img *Image) DiskSize() (int64, error) {
+	var blocks, entries int64
+	for i := range img.layers {
+		r, err := img.OpenLayer(i)
+		if err != nil {
+			return 0, err
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				r.Close()
+				return 0, fmt.Errorf("oci: layer %d: %w", i, err)
+			}
+			blocks += (hdr.Size + 4095) / 4096
+			entries++
+		}
+		// Drain the tar padding so the digests are checked.
+		_, err = io.Copy(io.Discard, r)
+		r.Close()
+		if err != nil {
+			return 0, fmt.Errorf("oci: layer %d: %w", i, err)
+		}
+	}
+	// Each entry accounts for an inode at the default inode ratio of the
+	// ext4 builder.
+	need := blocks*4096 + entries*16384
+	size := 2*need + 64<<20
+	return (size + 1<<20 - 1) &^ (1<<20 - 1), nil
+}
+
+// WriteDisk writes the image with its init to a new raw disk image of
+// size bytes at path, holding an ext4 file system without partition
+// table. A size of zero picks DiskSize. The disk only depends on the
+// image and size.
+func (img *Image) WriteDisk(path string, size int64) (err error) {
+	if size == 0 {
+		if size, err = img.DiskSize(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	// The file system UUID is derived from the image digest.
+	var uuid [16]byte
+	sum := sha256.Sum256([]byte(img.Digest))
+	copy(uuid[:], sum[:])
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	b, err := ext4.NewBuilder(f, size,
+		ext4.WithUUID(uuid),
+		ext4.WithTimestamp(img.timestamp()),
+	)
+	if err != nil {
+		return err
+	}
+	if err := img.Apply(b); err != nil {
+		return err
+	}
+	if err := img.AddInit(b); err != nil {
+		return err
+	}
+	if err := b.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// BundleOption is an option for WriteBundle.
+type BundleOption func(o *bundleOptions)
+
+type bundleOptions struct {
+	initrd      string
+	diskSize    int64
+	commandLine string
+	cpuCount    uint
+	memorySize  uint64
+}
+
+// WithInitrd adds the initial RAM disk at path to the bundle, for kernels
+// that need modules to mount the root disk.
+func WithInitrd(path string) BundleOption {
+	return func(o *bundleOptions) {
+		o.initrd = path
+	}
+}
+
+// WithDiskSize sets the size of the root disk. It defaults to DiskSize.
+func WithDiskSize(size int64) BundleOption {
+	return func(o *bundleOptions) {
+		o.diskSize = size
+	}
+}
+
+// WithCommandLine appends arguments to CommandLine.
+func WithCommandLine(args string) BundleOption {
+	return func(o *bundleOptions) {
+		o.commandLine = args
+	}
+}
+
+// WithCPUCount sets the number of CPUs of the spec.
+func WithCPUCount(n uint) BundleOption {
+	return func(o *bundleOptions) {
+		o.cpuCount = n
+	}
+}
+
+// WithMemorySize sets the memory size of the spec in bytes, a multiple of
+// 1 MiB.
+func WithMemorySize(size uint64) BundleOption {
+	return func(o *bundleOptions) {
+		o.memorySize = size
+	}
+}
+
+// WriteBundle creates the directory dir holding a root disk written by
+// WriteDisk, a copy of the kernel at kernel and a spec booting them, and
+// returns the spec. The kernel must be one the Virtualization framework
+// boots, which is an uncompressed Image on arm64.
+func (img *Image) WriteBundle(dir, kernel string, opts ...BundleOption) (spec *vmspec.VirtualMachineSpec, err error) {
+	o := &bundleOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	spec = &vmspec.VirtualMachineSpec{
+		Kernel:      filepath.Join(dir, KernelName),
+		CommandLine: CommandLine,
+		CPUCount:    o.cpuCount,
+		MemorySize:  o.memorySize,
+		Disks:       []vmspec.Disk{{Path: filepath.Join(dir, DiskName)}},
+	}
+	if args := strings.TrimSpace(o.commandLine); args != "" {
+		spec.CommandLine += " " + args
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	if err := copyFile(spec.Kernel, kernel); err != nil {
+		return nil, err
+	}
+	if o.initrd != "" {
+		spec.Initrd = filepath.Join(dir, InitrdName)
+		if err := copyFile(spec.Initrd, o.initrd); err != nil {
+			return nil, err
+		}
+	}
+	if err := img.WriteDisk(spec.Disks[0].Path, o.diskSize); err != nil {
+		return nil, err
+	}
+	if err := spec.Save(filepath.Join(dir, SpecName)); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
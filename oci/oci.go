@@ -0,0 +1,550 @@
+// Package oci turns container images into bootable virtual machines
+// without a container runtime, a registry or network access.
+//
+// Open reads an OCI image layout, as a directory or a tar archive, or an
+// archive written by docker save. Its layers are applied with their
+// whiteouts into an ext4 root disk together with a minimal init that runs
+// the image command, and WriteBundle pairs that disk with a kernel:
+//
+//	img, _ := oci.Open("alpine.tar", oci.WithPlatform("linux/arm64"))
+//	defer img.Close()
+//	spec, _ := img.WriteBundle("alpine.vm", "Image")
+//	config, _ := vz.NewVirtualMachineConfigurationFromSpec(spec)
+//
+// All blobs are verified against their digests while they are read.
+package oci
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Media types of the index and manifest documents this package reads.
+const (
+	MediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Annotations naming an image in the index of a layout.
+const (
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+
+	annotationContainerdName = "io.containerd.image.name"
+)
+
+var (
+	// ErrNotImage is returned when opening something that is neither an
+	// OCI image layout nor a docker save archive.
+	ErrNotImage = errors.New("oci: not an image layout")
+
+	// ErrNotFound is returned when no image of a layout matches the
+	// requested reference and platform.
+	ErrNotFound = errors.New("oci: no matching image")
+
+	// ErrDigest is returned when a blob does not match its digest.
+	ErrDigest = errors.New("oci: digest mismatch")
+)
+
+// Descriptor references a blob of an image layout.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Platform is the operating system and CPU architecture an image runs on.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ParsePlatform parses a platform written as "os/arch" or
+// "os/arch/variant".
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("oci: invalid platform %q", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// matches reports whether an image for p runs on want. An empty wanted
+// variant matches all variants.
+func (p Platform) matches(want Platform) bool {
+	return p.OS == want.OS && p.Architecture == want.Architecture &&
+		(want.Variant == "" || p.Variant == want.Variant)
+}
+
+// ImageConfig is the execution configuration of an image.
+type ImageConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+type index struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []Descriptor `json:"manifests"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    Descriptor   `json:"config"`
+	Layers    []Descriptor `json:"layers"`
+}
+
+// configFile is the image configuration blob.
+type configFile struct {
+	Created *time.Time `json:"created,omitempty"`
+	Platform
+	Config ImageConfig `json:"config"`
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// dockerManifest is an entry of the manifest.json of a docker save
+// archive.
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// Option is an option for Open.
+type Option func(o *options)
+
+type options struct {
+	platform  string
+	reference string
+}
+
+// WithPlatform selects the image for platform, written as "os/arch" or
+// "os/arch/variant", from a multi-platform layout. It defaults to Linux on
+// the architecture of the host.
+func WithPlatform(platform string) Option {
+	return func(o *options) {
+		o.platform = platform
+	}
+}
+
+// WithReference selects the image named ref in a layout holding several
+// images. It matches the reference name annotation of the index, the full
+// image name recorded by containerd and docker, or a repository tag of a
+// docker save archive.
+func WithReference(ref string) Option {
+	return func(o *options) {
+		o.reference = ref
+	}
+}
+
+// Image is a container image of a layout on disk.
+type Image struct {
+	// Digest identifies the image: the digest of its manifest, or of its
+	// configuration for docker save archives without one.
+	Digest string
+
+	Platform Platform
+
+	// Created is the creation time of the image, or the zero time.
+	Created time.Time
+
+	Config ImageConfig
+
+	store  store
+	layers []layer
+}
+
+// layer is a layer blob and the digests of its compressed and
+// uncompressed content. digest is empty for docker save archives.
+type layer struct {
+	name   string
+	digest string
+	diffID string
+}
+
+// Open opens the image at p, a directory or tar archive holding an OCI
+// image layout, or a tar archive written by docker save. Tar archives
+// must not be compressed.
+func Open(p string, opts ...Option) (*Image, error) {
+	o := &options{platform: "linux/" + runtime.GOARCH}
+	for _, opt := range opts {
+		opt(o)
+	}
+	want, err := ParsePlatform(o.platform)
+	if err != nil {
+		return nil, err
+	}
+	s, err := openStore(p)
+	if err != nil {
+		return nil, err
+	}
+	img, err := openImage(s, o.reference, want)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func openImage(s store, ref string, want Platform) (*Image, error) {
+	data, err := readFile(s, "index.json")
+	if err == nil {
+		var idx index
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return nil, fmt.Errorf("oci: index.json: %w", err)
+		}
+		return openIndex(s, &idx, ref, want)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	data, err = readFile(s, "manifest.json")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotImage
+		}
+		return nil, err
+	}
+	var manifests []dockerManifest
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return nil, fmt.Errorf("oci: manifest.json: %w", err)
+	}
+	return openDocker(s, manifests, ref, want)
+}
+
+// openIndex selects the image of an OCI layout.
+func openIndex(s store, idx *index, ref string, want Platform) (*Image, error) {
+	var found []*Image
+	seen := map[string]bool{}
+	var walk func(descs []Descriptor, depth int) error
+	walk = func(descs []Descriptor, depth int) error {
+		for _, d := range descs {
+			if depth == 0 && ref != "" && d.Annotations[AnnotationRefName] != ref && d.Annotations[annotationContainerdName] != ref {
+				continue
+			}
+			if d.Platform != nil && !d.Platform.matches(want) {
+				continue
+			}
+			switch d.MediaType {
+			case MediaTypeImageIndex, mediaTypeDockerManifestList:
+				if depth > 4 {
+					return fmt.Errorf("oci: %s: index nested too deeply", d.Digest)
+				}
+				data, err := readBlob(s, d.Digest)
+				if err != nil {
+					return err
+				}
+				var child index
+				if err := json.Unmarshal(data, &child); err != nil {
+					return fmt.Errorf("oci: %s: %w", d.Digest, err)
+				}
+				if err := walk(child.Manifests, depth+1); err != nil {
+					return err
+				}
+			case MediaTypeImageManifest, mediaTypeDockerManifest:
+				if seen[d.Digest] {
+					continue
+				}
+				seen[d.Digest] = true
+				img, err := openManifest(s, d.Digest)
+				if err != nil {
+					return err
+				}
+				if img.Platform.matches(want) {
+					found = append(found, img)
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(idx.Manifests, 0); err != nil {
+		return nil, err
+	}
+	return selectImage(found, ref, want)
+}
+
+func openManifest(s store, digest string) (*Image, error) {
+	data, err := readBlob(s, digest)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("oci: %s: %w", digest, err)
+	}
+	data, err = readBlob(s, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	img, err := newImage(s, digest, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Layers) != len(img.layers) {
+		return nil, fmt.Errorf("oci: %s: %d layers but %d diff IDs", digest, len(m.Layers), len(img.layers))
+	}
+	for i, d := range m.Layers {
+		name, err := blobPath(d.Digest)
+		if err != nil {
+			return nil, err
+		}
+		img.layers[i].name = name
+		img.layers[i].digest = d.Digest
+	}
+	return img, nil
+}
+
+// openDocker selects the image of a docker save archive.
+func openDocker(s store, manifests []dockerManifest, ref string, want Platform) (*Image, error) {
+	var found []*Image
+	for _, m := range manifests {
+		if ref != "" && !contains(m.RepoTags, ref) {
+			continue
+		}
+		name := path.Clean(m.Config)
+		data, err := readFile(s, name)
+		if err != nil {
+			return nil, err
+		}
+		// The configuration is named after its digest.
+		sum := sha256.Sum256(data)
+		digest := hex.EncodeToString(sum[:])
+		if id := strings.TrimSuffix(path.Base(name), ".json"); len(id) == len(digest) && id != digest {
+			return nil, fmt.Errorf("%w: %s", ErrDigest, name)
+		}
+		img, err := newImage(s, "sha256:"+digest, data)
+		if err != nil {
+			return nil, err
+		}
+		if len(m.Layers) != len(img.layers) {
+			return nil, fmt.Errorf("oci: %s: %d layers but %d diff IDs", name, len(m.Layers), len(img.layers))
+		}
+		for i, l := range m.Layers {
+			img.layers[i].name = path.Clean(l)
+		}
+		if img.Platform.matches(want) {
+			found = append(found, img)
+		}
+	}
+	return selectImage(found, ref, want)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func selectImage(found []*Image, ref string, want Platform) (*Image, error) {
+	switch {
+	case len(found) == 0 && ref != "":
+		return nil, fmt.Errorf("%w: %s for %s", ErrNotFound, ref, want)
+	case len(found) == 0:
+		return nil, fmt.Errorf("%w for %s", ErrNotFound, want)
+	case len(found) > 1:
+		return nil, fmt.Errorf("oci: %d images for %s, select one with WithReference", len(found), want)
+	}
+	return found[0], nil
+}
+
+// newImage returns an image with the configuration blob data.
+func newImage(s store, digest string, data []byte) (*Image, error) {
+	var c configFile
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("oci: image config: %w", err)
+	}
+	img := &Image{
+		Digest:   digest,
+		Platform: c.Platform,
+		Config:   c.Config,
+		store:    s,
+		layers:   make([]layer, len(c.RootFS.DiffIDs)),
+	}
+	if c.Created != nil {
+		img.Created = *c.Created
+	}
+	for i, id := range c.RootFS.DiffIDs {
+		img.layers[i].diffID = id
+	}
+	return img, nil
+}
+
+// Close closes the layout of the image.
+func (img *Image) Close() error {
+	return img.store.Close()
+}
+
+// NumLayers returns the number of layers of the image.
+func (img *Image) NumLayers() int {
+	return len(img.layers)
+}
+
+// OpenLayer returns the uncompressed tar stream of layer i, starting with
+// the base layer. Reading it to the end fails with ErrDigest when the
+// layer does not match its digests.
+func (img *Image) OpenLayer(i int) (io.ReadCloser, error) {
+	if i < 0 || i >= len(img.layers) {
+		return nil, fmt.Errorf("oci: no layer %d", i)
+	}
+	l := img.layers[i]
+	f, err := img.store.open(l.name)
+	if err != nil {
+		return nil, err
+	}
+	r := io.Reader(f)
+	if l.digest != "" {
+		if r, err = verify(r, l.digest); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	br := bufio.NewReader(r)
+	dr, err := decompress(br)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("oci: layer %d: %w", i, err)
+	}
+	if dr != nil {
+		r = dr
+	} else {
+		r = br
+	}
+	if r, err = verify(r, l.diffID); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &layerReader{Reader: r, f: f, dr: dr}, nil
+}
+
+type layerReader struct {
+	io.Reader
+	f  io.Closer
+	dr io.ReadCloser
+}
+
+func (r *layerReader) Close() error {
+	if r.dr != nil {
+		r.dr.Close()
+	}
+	return r.f.Close()
+}
+
+// decompress returns a reader decompressing r if it starts with the magic
+// number of a gzip, zstd or bzip2 stream, or nil if r is not compressed.
+func decompress(r *bufio.Reader) (io.ReadCloser, error) {
+	magic, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(r)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	}
+	return nil, nil
+}
+
+// verifyReader fails with ErrDigest at the end of a stream not matching
+// its digest.
+type verifyReader struct {
+	r      io.Reader
+	h      hash.Hash
+	digest string
+}
+
+func verify(r io.Reader, digest string) (io.Reader, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, fmt.Errorf("oci: unsupported digest %q", digest)
+	}
+	return &verifyReader{r: r, h: sha256.New(), digest: digest}, nil
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && "sha256:"+hex.EncodeToString(v.h.Sum(nil)) != v.digest {
+		return n, fmt.Errorf("%w: %s", ErrDigest, v.digest)
+	}
+	return n, err
+}
+
+// blobPath returns the path of the blob with digest in a layout.
+func blobPath(digest string) (string, error) {
+	i := strings.IndexByte(digest, ':')
+	if i <= 0 || strings.ContainsAny(digest, "/\\") || digest[i+1:] == "" {
+		return "", fmt.Errorf("oci: invalid digest %q", digest)
+	}
+	return "blobs/" + digest[:i] + "/" + digest[i+1:], nil
+}
+
+// readBlob reads and verifies the blob with digest.
+func readBlob(s store, digest string) ([]byte, error) {
+	name, err := blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := verify(f, digest)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func readFile(s store, name string) ([]byte, error) {
+	f, err := s.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,134 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// store gives access to the files of an image layout by their slash
+// separated path relative to its root.
+type store interface {
+	open(name string) (io.ReadCloser, error)
+	Close() error
+}
+
+// openStore opens the directory or uncompressed tar archive at p.
+func openStore(p string) (store, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return dirStore(p), nil
+	}
+	return openTarStore(p)
+}
+
+// dirStore is an image layout in a directory.
+type dirStore string
+
+func (d dirStore) open(name string) (io.ReadCloser, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("oci: invalid path %q", name)
+	}
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+func (d dirStore) Close() error {
+	return nil
+}
+
+func validName(name string) bool {
+	return name != "" && path.Clean(name) == name && !path.IsAbs(name) &&
+		name != ".." && !strings.HasPrefix(name, "../")
+}
+
+// tarStore is an image layout in a tar archive, such as written by
+// docker save. Files are read in place, so the archive must not be
+// compressed.
+type tarStore struct {
+	f     *os.File
+	files map[string]tarFile
+	links map[string]string
+}
+
+type tarFile struct {
+	off, size int64
+}
+
+func openTarStore(p string) (*tarStore, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	s := &tarStore{f: f, files: map[string]tarFile{}, links: map[string]string{}}
+	if err := s.index(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("oci: %s: %w", p, err)
+	}
+	return s, nil
+}
+
+// index records where the files of the archive are. The tar reader reads
+// no further than the headers, so the offset of the file after Next is
+// the offset of its content.
+func (s *tarStore) index() error {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(s.f, magic); err != nil {
+		return ErrNotImage
+	}
+	if bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) || bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		return fmt.Errorf("compressed archives must be decompressed first: %w", ErrNotImage)
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tr := tar.NewReader(s.f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %w", err, ErrNotImage)
+		}
+		name := path.Clean("/" + hdr.Name)[1:]
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			off, err := s.f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			s.files[name] = tarFile{off: off, size: hdr.Size}
+		case tar.TypeSymlink:
+			s.links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		case tar.TypeLink:
+			s.links[name] = path.Clean("/" + hdr.Linkname)[1:]
+		}
+	}
+}
+
+func (s *tarStore) open(name string) (io.ReadCloser, error) {
+	for i := 0; i < 40; i++ {
+		if f, ok := s.files[name]; ok {
+			return ioutil.NopCloser(io.NewSectionReader(s.f, f.off, f.size)), nil
+		}
+		target, ok := s.links[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+func (s *tarStore) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,622 @@
+// Package partition reads and writes GUID (GPT) and DOS (MBR) partition
+// tables of raw disk images such as the ones attached with
+// vz.NewDiskImageStorageDeviceAttachment.
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"unicode/utf16"
+)
+
+const (
+	gptSignature      = "EFI PART"
+	gptRevision       = 0x00010000
+	gptHeaderSize     = 92
+	gptEntrySize      = 128
+	gptEntryCount     = 128
+	gptNameLength     = 36
+	defaultSectorSize = 512
+
+	// DefaultAlignment is the alignment in bytes used when placing new partitions.
+	DefaultAlignment = 1024 * 1024
+)
+
+var (
+	// ErrNoGPT is returned when neither the primary nor the backup GPT header is valid.
+	ErrNoGPT = errors.New("partition: no valid GPT found")
+
+	// ErrNoSpace is returned when a partition does not fit into the free space of the table.
+	ErrNoSpace = errors.New("partition: not enough free space")
+
+	// ErrNotFound is returned when a partition number does not refer to a used entry.
+	ErrNotFound = errors.New("partition: no such partition")
+
+	// ErrOverlap is returned when a partition would overlap another partition or GPT metadata.
+	ErrOverlap = errors.New("partition: partition overlaps existing data")
+)
+
+// Partition is a single used entry of a GUID partition table.
+type Partition struct {
+	// Number is the 1-based index of the entry in the partition array,
+	// matching the numbering used by Linux (e.g. /dev/vda1).
+	Number int
+
+	Type       GUID
+	GUID       GUID
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       string
+}
+
+// Sectors returns the length of the partition in sectors.
+func (p *Partition) Sectors() uint64 {
+	return p.LastLBA - p.FirstLBA + 1
+}
+
+// Table is an in-memory GUID partition table.
+//
+// A Table is read from a disk with Read or created with New, modified with
+// Add, Delete, Resize and Relocate and finally written back with Write.
+type Table struct {
+	SectorSize     int
+	DiskGUID       GUID
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+
+	// BackupLBA is the sector holding the backup GPT header, which is
+	// the last sector of the disk.
+	BackupLBA uint64
+
+	// EntryCount and EntrySize describe the partition entry array.
+	EntryCount uint32
+	EntrySize  uint32
+
+	// Partitions holds the used entries ordered by Number.
+	Partitions []*Partition
+
+	// Boot code of an existing protective MBR, preserved on Write.
+	mbr *MBR
+}
+
+// New creates an empty table for a disk of size bytes.
+//
+// sectorSize is the logical sector size of the disk, 0 means 512.
+func New(size int64, sectorSize int) (*Table, error) {
+	if sectorSize == 0 {
+		sectorSize = defaultSectorSize
+	}
+	t := &Table{
+		SectorSize: sectorSize,
+		DiskGUID:   NewRandomGUID(),
+		EntryCount: gptEntryCount,
+		EntrySize:  gptEntrySize,
+	}
+	if err := t.Relocate(size); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// entrySectors returns the number of sectors occupied by the partition entry array.
+func (t *Table) entrySectors() uint64 {
+	n := uint64(t.EntryCount) * uint64(t.EntrySize)
+	ss := uint64(t.SectorSize)
+	return (n + ss - 1) / ss
+}
+
+// TotalSectors returns the number of sectors on the disk the table describes.
+func (t *Table) TotalSectors() uint64 {
+	return t.BackupLBA + 1
+}
+
+// Relocate adapts the table to a disk of size bytes. It moves the backup
+// header and entry array to the end of the disk and updates the last usable
+// LBA accordingly. It is used after growing or shrinking an image file.
+//
+// It fails when an existing partition would end past the new last usable LBA.
+func (t *Table) Relocate(size int64) error {
+	ss := int64(t.SectorSize)
+	total := uint64(size / ss)
+	es := t.entrySectors()
+	if total < 2*es+3 {
+		return fmt.Errorf("partition: disk of %d bytes is too small for a GPT", size)
+	}
+	first := 2 + es
+	last := total - 2 - es
+	for _, p := range t.Partitions {
+		if p.LastLBA > last {
+			return fmt.Errorf("partition %d ends at LBA %d beyond last usable LBA %d: %w",
+				p.Number, p.LastLBA, last, ErrOverlap)
+		}
+	}
+	t.FirstUsableLBA = first
+	t.LastUsableLBA = last
+	t.BackupLBA = total - 1
+	return nil
+}
+
+// Read reads a GUID partition table from r, which holds a disk of size bytes.
+//
+// The sector size is detected by probing for the header at 512 and 4096
+// bytes. When the primary header or its entry array is corrupt the backup
+// copy at the end of the disk is used instead.
+func Read(r io.ReaderAt, size int64) (*Table, error) {
+	var mbr *MBR
+	if m, err := ReadMBR(r); err == nil {
+		mbr = m
+	}
+	for _, ss := range []int{512, 4096} {
+		total := uint64(size / int64(ss))
+		if total < 2 {
+			continue
+		}
+		t, err := readHeader(r, ss, 1, total)
+		if err != nil {
+			t, err = readHeader(r, ss, total-1, total)
+			if err != nil {
+				continue
+			}
+		}
+		t.mbr = mbr
+		return t, nil
+	}
+	return nil, ErrNoGPT
+}
+
+// ReadFile reads the GUID partition table of the disk image at path.
+func ReadFile(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return Read(f, fi.Size())
+}
+
+// readHeader reads the GPT header at lba of a disk of total sectors of ss
+// bytes, and its entry array.
+func readHeader(r io.ReaderAt, ss int, lba, total uint64) (*Table, error) {
+	hdr := make([]byte, ss)
+	if _, err := r.ReadAt(hdr, int64(lba)*int64(ss)); err != nil {
+		return nil, err
+	}
+	if string(hdr[0:8]) != gptSignature {
+		return nil, ErrNoGPT
+	}
+	hsize := binary.LittleEndian.Uint32(hdr[12:])
+	if hsize < gptHeaderSize || int(hsize) > ss {
+		return nil, ErrNoGPT
+	}
+	want := binary.LittleEndian.Uint32(hdr[16:])
+	binary.LittleEndian.PutUint32(hdr[16:], 0)
+	if crc32.ChecksumIEEE(hdr[:hsize]) != want {
+		return nil, fmt.Errorf("partition: GPT header at LBA %d: checksum mismatch", lba)
+	}
+	my := binary.LittleEndian.Uint64(hdr[24:])
+	alt := binary.LittleEndian.Uint64(hdr[32:])
+	if my != lba {
+		return nil, ErrNoGPT
+	}
+	t := &Table{
+		SectorSize:     ss,
+		FirstUsableLBA: binary.LittleEndian.Uint64(hdr[40:]),
+		LastUsableLBA:  binary.LittleEndian.Uint64(hdr[48:]),
+		EntryCount:     binary.LittleEndian.Uint32(hdr[80:]),
+		EntrySize:      binary.LittleEndian.Uint32(hdr[84:]),
+	}
+	if lba == 1 {
+		t.BackupLBA = alt
+	} else {
+		t.BackupLBA = my
+	}
+	copy(t.DiskGUID[:], hdr[56:72])
+	if alt >= total || t.LastUsableLBA >= total || t.FirstUsableLBA > t.LastUsableLBA {
+		return nil, fmt.Errorf("partition: GPT header at LBA %d: usable range or backup outside of the disk", lba)
+	}
+	if t.EntrySize < gptEntrySize || t.EntrySize > 4096 || t.EntrySize%8 != 0 || t.EntryCount == 0 || t.EntryCount > 1024 {
+		return nil, fmt.Errorf("partition: unsupported GPT entry array %dx%d", t.EntryCount, t.EntrySize)
+	}
+	// The primary entry array lies between the header and the first
+	// usable LBA, the backup one between the last usable LBA and the
+	// backup header.
+	entriesLBA := binary.LittleEndian.Uint64(hdr[72:])
+	sectors := (uint64(t.EntryCount)*uint64(t.EntrySize) + uint64(ss) - 1) / uint64(ss)
+	start, end := lba+1, t.FirstUsableLBA
+	if lba != 1 {
+		start, end = t.LastUsableLBA+1, lba
+	}
+	if end > total || entriesLBA < start || entriesLBA > end || sectors > end-entriesLBA {
+		return nil, fmt.Errorf("partition: GPT entries at LBA %d: outside of the disk or overlapping partitions", entriesLBA)
+	}
+	entries := make([]byte, int(t.EntryCount)*int(t.EntrySize))
+	if _, err := r.ReadAt(entries, int64(entriesLBA)*int64(ss)); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(hdr[88:]) {
+		return nil, fmt.Errorf("partition: GPT entries at LBA %d: checksum mismatch", entriesLBA)
+	}
+	for i := 0; i < int(t.EntryCount); i++ {
+		e := entries[i*int(t.EntrySize):]
+		var typ GUID
+		copy(typ[:], e[0:16])
+		if typ.IsZero() {
+			continue
+		}
+		p := &Partition{
+			Number:     i + 1,
+			Type:       typ,
+			FirstLBA:   binary.LittleEndian.Uint64(e[32:]),
+			LastLBA:    binary.LittleEndian.Uint64(e[40:]),
+			Attributes: binary.LittleEndian.Uint64(e[48:]),
+			Name:       decodeName(e[56:128]),
+		}
+		copy(p.GUID[:], e[16:32])
+		if p.FirstLBA > p.LastLBA || p.FirstLBA < t.FirstUsableLBA || p.LastLBA > t.LastUsableLBA {
+			return nil, fmt.Errorf("partition: GPT partition %d: LBAs %d-%d outside of the usable range", p.Number, p.FirstLBA, p.LastLBA)
+		}
+		t.Partitions = append(t.Partitions, p)
+	}
+	return t, nil
+}
+
+func decodeName(b []byte) string {
+	u := make([]uint16, 0, gptNameLength)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+func encodeName(dst []byte, name string) {
+	u := utf16.Encode([]rune(name))
+	if len(u) > gptNameLength {
+		u = u[:gptNameLength]
+	}
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(dst[2*i:], c)
+	}
+}
+
+// Partition returns the partition with the given number.
+func (t *Table) Partition(number int) (*Partition, error) {
+	for _, p := range t.Partitions {
+		if p.Number == number {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("partition %d: %w", number, ErrNotFound)
+}
+
+// Offset returns the byte offset and length of p on the disk.
+func (t *Table) Offset(p *Partition) (offset, length int64) {
+	ss := int64(t.SectorSize)
+	return int64(p.FirstLBA) * ss, int64(p.Sectors()) * ss
+}
+
+// alignment returns DefaultAlignment in sectors.
+func (t *Table) alignment() uint64 {
+	a := uint64(DefaultAlignment / t.SectorSize)
+	if a == 0 {
+		a = 1
+	}
+	return a
+}
+
+// Add inserts p into the table and returns the stored entry.
+//
+// A zero Number selects the lowest free entry. A zero FirstLBA places the
+// partition at the start of the first free region large enough, aligned to
+// DefaultAlignment. A zero LastLBA extends the partition to the end of that
+// free region. A zero GUID is replaced by a random one.
+func (t *Table) Add(p Partition) (*Partition, error) {
+	if p.Type.IsZero() {
+		return nil, errors.New("partition: partition type must not be zero")
+	}
+	if p.Number == 0 {
+		p.Number = t.freeNumber()
+		if p.Number == 0 {
+			return nil, errors.New("partition: partition entry array is full")
+		}
+	} else if p.Number < 1 || p.Number > int(t.EntryCount) {
+		return nil, fmt.Errorf("partition: number %d out of range", p.Number)
+	} else if _, err := t.Partition(p.Number); err == nil {
+		return nil, fmt.Errorf("partition: number %d already in use", p.Number)
+	}
+	if p.GUID.IsZero() {
+		p.GUID = NewRandomGUID()
+	}
+	if p.FirstLBA == 0 {
+		if p.LastLBA != 0 {
+			return nil, errors.New("partition: LastLBA given without FirstLBA")
+		}
+		first, last, ok := t.findFree(0)
+		if !ok {
+			return nil, ErrNoSpace
+		}
+		p.FirstLBA, p.LastLBA = first, last
+	} else if p.LastLBA == 0 {
+		_, last, ok := t.freeRegionAt(p.FirstLBA)
+		if !ok {
+			return nil, ErrOverlap
+		}
+		p.LastLBA = last
+	}
+	if err := t.checkRange(&p, p.FirstLBA, p.LastLBA); err != nil {
+		return nil, err
+	}
+	np := p
+	t.Partitions = append(t.Partitions, &np)
+	t.sort()
+	return &np, nil
+}
+
+// AddSized is like Add but allocates a partition of the given size in bytes
+// in the first free region large enough to hold it.
+func (t *Table) AddSized(p Partition, size int64) (*Partition, error) {
+	ss := int64(t.SectorSize)
+	sectors := uint64((size + ss - 1) / ss)
+	if sectors == 0 {
+		return nil, errors.New("partition: size must be positive")
+	}
+	first, _, ok := t.findFree(sectors)
+	if !ok {
+		return nil, ErrNoSpace
+	}
+	p.FirstLBA = first
+	p.LastLBA = first + sectors - 1
+	return t.Add(p)
+}
+
+// Delete removes the partition with the given number.
+func (t *Table) Delete(number int) error {
+	for i, p := range t.Partitions {
+		if p.Number == number {
+			t.Partitions = append(t.Partitions[:i], t.Partitions[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("partition %d: %w", number, ErrNotFound)
+}
+
+// Resize changes the last LBA of the partition with the given number.
+// A zero lastLBA grows the partition up to the next partition or the end
+// of the usable area.
+func (t *Table) Resize(number int, lastLBA uint64) error {
+	p, err := t.Partition(number)
+	if err != nil {
+		return err
+	}
+	if lastLBA == 0 {
+		lastLBA = t.LastUsableLBA
+		for _, o := range t.Partitions {
+			if o != p && o.FirstLBA > p.FirstLBA && o.FirstLBA-1 < lastLBA {
+				lastLBA = o.FirstLBA - 1
+			}
+		}
+	}
+	if err := t.checkRange(p, p.FirstLBA, lastLBA); err != nil {
+		return err
+	}
+	p.LastLBA = lastLBA
+	return nil
+}
+
+// Last returns the partition with the highest starting LBA, or nil when the table is empty.
+func (t *Table) Last() *Partition {
+	var last *Partition
+	for _, p := range t.Partitions {
+		if last == nil || p.FirstLBA > last.FirstLBA {
+			last = p
+		}
+	}
+	return last
+}
+
+func (t *Table) checkRange(self *Partition, first, last uint64) error {
+	if last < first {
+		return fmt.Errorf("partition: last LBA %d before first LBA %d", last, first)
+	}
+	if first < t.FirstUsableLBA || last > t.LastUsableLBA {
+		return fmt.Errorf("partition: LBA range %d-%d outside usable area %d-%d: %w",
+			first, last, t.FirstUsableLBA, t.LastUsableLBA, ErrOverlap)
+	}
+	for _, o := range t.Partitions {
+		if o == self || o.Number == self.Number {
+			continue
+		}
+		if first <= o.LastLBA && o.FirstLBA <= last {
+			return fmt.Errorf("partition: LBA range %d-%d overlaps partition %d: %w",
+				first, last, o.Number, ErrOverlap)
+		}
+	}
+	return nil
+}
+
+func (t *Table) freeNumber() int {
+	used := make(map[int]bool, len(t.Partitions))
+	for _, p := range t.Partitions {
+		used[p.Number] = true
+	}
+	for n := 1; n <= int(t.EntryCount); n++ {
+		if !used[n] {
+			return n
+		}
+	}
+	return 0
+}
+
+// FreeRegion is an unpartitioned range of sectors.
+type FreeRegion struct {
+	FirstLBA uint64
+	LastLBA  uint64
+}
+
+// Free returns the unpartitioned regions of the usable area in ascending order.
+func (t *Table) Free() []FreeRegion {
+	ps := make([]*Partition, len(t.Partitions))
+	copy(ps, t.Partitions)
+	sort.Slice(ps, func(i, j int) bool { return ps[i].FirstLBA < ps[j].FirstLBA })
+	var free []FreeRegion
+	next := t.FirstUsableLBA
+	for _, p := range ps {
+		if p.FirstLBA > next {
+			free = append(free, FreeRegion{FirstLBA: next, LastLBA: p.FirstLBA - 1})
+		}
+		if p.LastLBA+1 > next {
+			next = p.LastLBA + 1
+		}
+	}
+	if next <= t.LastUsableLBA {
+		free = append(free, FreeRegion{FirstLBA: next, LastLBA: t.LastUsableLBA})
+	}
+	return free
+}
+
+// findFree returns the first aligned free region holding at least sectors
+// sectors. When sectors is zero any non-empty region matches.
+func (t *Table) findFree(sectors uint64) (first, last uint64, ok bool) {
+	align := t.alignment()
+	for _, r := range t.Free() {
+		start := (r.FirstLBA + align - 1) / align * align
+		if start > r.LastLBA {
+			continue
+		}
+		if sectors == 0 || r.LastLBA-start+1 >= sectors {
+			return start, r.LastLBA, true
+		}
+	}
+	return 0, 0, false
+}
+
+func (t *Table) freeRegionAt(lba uint64) (first, last uint64, ok bool) {
+	for _, r := range t.Free() {
+		if r.FirstLBA <= lba && lba <= r.LastLBA {
+			return r.FirstLBA, r.LastLBA, true
+		}
+	}
+	return 0, 0, false
+}
+
+func (t *Table) sort() {
+	sort.Slice(t.Partitions, func(i, j int) bool {
+		return t.Partitions[i].Number < t.Partitions[j].Number
+	})
+}
+
+func (t *Table) entries() []byte {
+	buf := make([]byte, int(t.entrySectors())*t.SectorSize)
+	for _, p := range t.Partitions {
+		e := buf[(p.Number-1)*int(t.EntrySize):]
+		copy(e[0:16], p.Type[:])
+		copy(e[16:32], p.GUID[:])
+		binary.LittleEndian.PutUint64(e[32:], p.FirstLBA)
+		binary.LittleEndian.PutUint64(e[40:], p.LastLBA)
+		binary.LittleEndian.PutUint64(e[48:], p.Attributes)
+		encodeName(e[56:128], p.Name)
+	}
+	return buf
+}
+
+func (t *Table) header(my, alt, entriesLBA uint64, entriesCRC uint32) []byte {
+	hdr := make([]byte, t.SectorSize)
+	copy(hdr[0:8], gptSignature)
+	binary.LittleEndian.PutUint32(hdr[8:], gptRevision)
+	binary.LittleEndian.PutUint32(hdr[12:], gptHeaderSize)
+	binary.LittleEndian.PutUint64(hdr[24:], my)
+	binary.LittleEndian.PutUint64(hdr[32:], alt)
+	binary.LittleEndian.PutUint64(hdr[40:], t.FirstUsableLBA)
+	binary.LittleEndian.PutUint64(hdr[48:], t.LastUsableLBA)
+	copy(hdr[56:72], t.DiskGUID[:])
+	binary.LittleEndian.PutUint64(hdr[72:], entriesLBA)
+	binary.LittleEndian.PutUint32(hdr[80:], t.EntryCount)
+	binary.LittleEndian.PutUint32(hdr[84:], t.EntrySize)
+	binary.LittleEndian.PutUint32(hdr[88:], entriesCRC)
+	binary.LittleEndian.PutUint32(hdr[16:], crc32.ChecksumIEEE(hdr[:gptHeaderSize]))
+	return hdr
+}
+
+// Write writes the protective MBR, the primary header and entry array and
+// the backup entry array and header to w.
+func (t *Table) Write(w io.WriterAt) error {
+	ss := int64(t.SectorSize)
+	entries := t.entries()
+	crc := crc32.ChecksumIEEE(entries[:int(t.EntryCount)*int(t.EntrySize)])
+	backupEntriesLBA := t.BackupLBA - t.entrySectors()
+
+	mbr := NewProtectiveMBR(t.TotalSectors())
+	if t.mbr != nil && t.mbr.IsProtective() {
+		mbr.BootCode = t.mbr.BootCode
+		mbr.DiskSignature = t.mbr.DiskSignature
+	}
+	// With 4K sectors the MBR still occupies the first 512 bytes only.
+	first := make([]byte, ss)
+	copy(first, mbr.Bytes())
+
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, first},
+		{2, entries},
+		{1, t.header(1, t.BackupLBA, 2, crc)},
+		{backupEntriesLBA, entries},
+		{t.BackupLBA, t.header(t.BackupLBA, 1, backupEntriesLBA, crc)},
+	}
+	for _, wr := range writes {
+		if _, err := w.WriteAt(wr.data, int64(wr.lba)*ss); err != nil {
+			return fmt.Errorf("partition: writing GPT: %w", err)
+		}
+	}
+	return nil
+}
+
+// WriteFile writes t to the disk image at path.
+func (t *Table) WriteFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := t.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ClearBackup overwrites the backup header at the old end of a disk with
+// zeros so stale copies cannot be picked up after the table has been
+// relocated. oldSize is the size of the disk before it was grown.
+func (t *Table) ClearBackup(w io.WriterAt, oldSize int64) error {
+	ss := int64(t.SectorSize)
+	lba := oldSize/ss - 1
+	if lba <= 1 || uint64(lba) == t.BackupLBA {
+		return nil
+	}
+	for _, p := range t.Partitions {
+		if p.FirstLBA <= uint64(lba) && uint64(lba) <= p.LastLBA {
+			return nil
+		}
+	}
+	_, err := w.WriteAt(bytes.Repeat([]byte{0}, int(ss)), lba*ss)
+	return err
+}
@@ -0,0 +1,86 @@
+package partition
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// GUID is a globally unique identifier as stored on disk in a GPT.
+//
+// The first three fields are stored little-endian, the remaining bytes
+// big-endian, so the in-memory layout matches the on-disk layout.
+type GUID [16]byte
+
+// Well-known partition type GUIDs.
+var (
+	TypeUnused          = GUID{}
+	TypeEFISystem       = MustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	TypeBIOSBoot        = MustParseGUID("21686148-6449-6E6F-744E-656564454649")
+	TypeLinuxFilesystem = MustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	TypeLinuxSwap       = MustParseGUID("0657FD6D-A4AB-43C4-84E5-0933C84B4F4F")
+	TypeLinuxLVM        = MustParseGUID("E6D6D379-F507-44C2-A23C-238F2A3DF928")
+	TypeLinuxRootX86_64 = MustParseGUID("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+	TypeLinuxRootARM64  = MustParseGUID("B921B045-1DF0-41C3-AF44-4C6F280D3FAE")
+	TypeMicrosoftBasic  = MustParseGUID("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7")
+	TypeAppleAPFS       = MustParseGUID("7C3457EF-0000-11AA-AA11-00306543ECAC")
+)
+
+// ParseGUID parses the canonical textual form
+// "XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX" of a GUID.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 ||
+		len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return g, fmt.Errorf("invalid GUID %q: %w", s, err)
+	}
+	binary.LittleEndian.PutUint32(g[0:4], binary.BigEndian.Uint32(b[0:4]))
+	binary.LittleEndian.PutUint16(g[4:6], binary.BigEndian.Uint16(b[4:6]))
+	binary.LittleEndian.PutUint16(g[6:8], binary.BigEndian.Uint16(b[6:8]))
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+// MustParseGUID is like ParseGUID but panics if s cannot be parsed.
+func MustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// NewRandomGUID returns a random (version 4) GUID.
+func NewRandomGUID() GUID {
+	var g GUID
+	if _, err := rand.Read(g[:]); err != nil {
+		panic(err)
+	}
+	// version 4 lives in the high nibble of the third field,
+	// which is stored little-endian.
+	g[7] = (g[7] & 0x0f) | 0x40
+	g[8] = (g[8] & 0x3f) | 0x80
+	return g
+}
+
+// IsZero reports whether g is the all-zero GUID.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10],
+		g[10:16],
+	)
+}
@@ -0,0 +1,151 @@
+package partition
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MBR partition type identifiers.
+const (
+	MBRTypeEmpty      byte = 0x00
+	MBRTypeFAT12      byte = 0x01
+	MBRTypeFAT16      byte = 0x06
+	MBRTypeFAT32LBA   byte = 0x0c
+	MBRTypeLinux      byte = 0x83
+	MBRTypeLinuxSwap  byte = 0x82
+	MBRTypeEFISystem  byte = 0xef
+	MBRTypeProtective byte = 0xee
+)
+
+const (
+	mbrSize          = 512
+	mbrTableOffset   = 446
+	mbrSignature     = 0xaa55
+	mbrSignatureOff  = 510
+	mbrDiskSigOffset = 440
+)
+
+// ErrNoMBR is returned when the first sector does not carry the 0x55AA boot signature.
+var ErrNoMBR = errors.New("partition: no MBR boot signature")
+
+// MBRPartition is one of the four primary entries of a master boot record.
+type MBRPartition struct {
+	Bootable bool
+	Type     byte
+	FirstLBA uint32
+	Sectors  uint32
+}
+
+// IsEmpty reports whether the entry is unused.
+func (p MBRPartition) IsEmpty() bool {
+	return p.Type == MBRTypeEmpty || p.Sectors == 0
+}
+
+// MBR represents a classic DOS master boot record.
+//
+// The boot code area is preserved as-is when an MBR read with ReadMBR is written back.
+type MBR struct {
+	BootCode      [mbrDiskSigOffset]byte
+	DiskSignature uint32
+	Partitions    [4]MBRPartition
+}
+
+// ReadMBR reads the master boot record from the first sector of r.
+func ReadMBR(r io.ReaderAt) (*MBR, error) {
+	buf := make([]byte, mbrSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("partition: reading MBR: %w", err)
+	}
+	if binary.LittleEndian.Uint16(buf[mbrSignatureOff:]) != mbrSignature {
+		return nil, ErrNoMBR
+	}
+	m := &MBR{
+		DiskSignature: binary.LittleEndian.Uint32(buf[mbrDiskSigOffset:]),
+	}
+	copy(m.BootCode[:], buf)
+	for i := range m.Partitions {
+		e := buf[mbrTableOffset+16*i:]
+		m.Partitions[i] = MBRPartition{
+			Bootable: e[0] == 0x80,
+			Type:     e[4],
+			FirstLBA: binary.LittleEndian.Uint32(e[8:]),
+			Sectors:  binary.LittleEndian.Uint32(e[12:]),
+		}
+	}
+	return m, nil
+}
+
+// NewProtectiveMBR returns the protective MBR required in front of a GPT
+// on a disk of the given number of sectors.
+func NewProtectiveMBR(totalSectors uint64) *MBR {
+	size := totalSectors - 1
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	m := &MBR{}
+	m.Partitions[0] = MBRPartition{
+		Type:     MBRTypeProtective,
+		FirstLBA: 1,
+		Sectors:  uint32(size),
+	}
+	return m
+}
+
+// IsProtective reports whether m is a GPT protective MBR.
+func (m *MBR) IsProtective() bool {
+	for _, p := range m.Partitions {
+		if p.Type == MBRTypeProtective {
+			return true
+		}
+	}
+	return false
+}
+
+// Bytes returns the 512 byte on-disk encoding of m.
+func (m *MBR) Bytes() []byte {
+	buf := make([]byte, mbrSize)
+	copy(buf, m.BootCode[:])
+	binary.LittleEndian.PutUint32(buf[mbrDiskSigOffset:], m.DiskSignature)
+	for i, p := range m.Partitions {
+		e := buf[mbrTableOffset+16*i : mbrTableOffset+16*(i+1)]
+		if p.IsEmpty() {
+			continue
+		}
+		if p.Bootable {
+			e[0] = 0x80
+		}
+		first := chs(uint64(p.FirstLBA))
+		last := chs(uint64(p.FirstLBA) + uint64(p.Sectors) - 1)
+		copy(e[1:4], first[:])
+		e[4] = p.Type
+		copy(e[5:8], last[:])
+		binary.LittleEndian.PutUint32(e[8:], p.FirstLBA)
+		binary.LittleEndian.PutUint32(e[12:], p.Sectors)
+	}
+	binary.LittleEndian.PutUint16(buf[mbrSignatureOff:], mbrSignature)
+	return buf
+}
+
+// WriteMBR writes m to the first sector of w.
+func WriteMBR(w io.WriterAt, m *MBR) error {
+	if _, err := w.WriteAt(m.Bytes(), 0); err != nil {
+		return fmt.Errorf("partition: writing MBR: %w", err)
+	}
+	return nil
+}
+
+// chs converts lba to the legacy cylinder/head/sector triple using the
+// usual 255 heads, 63 sectors geometry. Addresses which do not fit are
+// clamped to the 0xfeffff marker.
+func chs(lba uint64) [3]byte {
+	const heads, sectors = 255, 63
+	c := lba / (heads * sectors)
+	if c > 1023 {
+		return [3]byte{0xfe, 0xff, 0xff}
+	}
+	h := (lba / sectors) % heads
+	s := lba%sectors + 1
+	return [3]byte{byte(h), byte(s) | byte((c>>2)&0xc0), byte(c)}
+}
@@ -0,0 +1,61 @@
+package partition
+
+import (
+	"errors"
+	"io"
+)
+
+// ReadWriterAt is the interface of disks and partitions that can be read and written at offsets.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+var errOutOfRange = errors.New("partition: access beyond end of section")
+
+// Section is a view of a byte range of a disk, such as a single partition.
+// Offsets passed to ReadAt and WriteAt are relative to the start of the section.
+type Section struct {
+	rw  ReadWriterAt
+	off int64
+	n   int64
+}
+
+// NewSection returns a Section of rw starting at off with length n.
+func NewSection(rw ReadWriterAt, off, n int64) *Section {
+	return &Section{rw: rw, off: off, n: n}
+}
+
+// Section returns a view of partition p on the disk rw.
+func (t *Table) Section(rw ReadWriterAt, p *Partition) *Section {
+	off, n := t.Offset(p)
+	return NewSection(rw, off, n)
+}
+
+// Size returns the length of the section in bytes.
+func (s *Section) Size() int64 {
+	return s.n
+}
+
+// ReadAt implements io.ReaderAt.
+func (s *Section) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= s.n {
+		return 0, io.EOF
+	}
+	if max := s.n - off; int64(len(p)) > max {
+		n, err := s.rw.ReadAt(p[:max], s.off+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return s.rw.ReadAt(p, s.off+off)
+}
+
+// WriteAt implements io.WriterAt.
+func (s *Section) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.n {
+		return 0, errOutOfRange
+	}
+	return s.rw.WriteAt(p, s.off+off)
+}
@@ -0,0 +1,309 @@
+// Package rootoverlay boots Linux guests from a read-only root disk shared
+// by many virtual machines, with writes going to an overlayfs upper layer
+// on a per-machine scratch disk or in memory.
+//
+// WriteInitrd appends a hook to the initrd of the guest kernel. The hook
+// runs as the initramfs init selected with rdinit=, mounts the root disk
+// read-only, stacks an overlay over it and switches to it. The root disk
+// itself is never written, so it is attached read-only:
+//
+//	rootoverlay.WriteInitrd("initrd.overlay", "initrd")
+//	rootoverlay.WriteScratchDisk("scratch.img", 4<<30)
+//	root, _ := vz.NewDiskImageStorageDeviceAttachment("root.img", true)
+//	scratch, _ := vz.NewDiskImageStorageDeviceAttachment("scratch.img", false)
+//	vz.NewLinuxBootLoader("vmlinuz",
+//		vz.WithInitrd("initrd.overlay"),
+//		vz.WithCommandLine(rootoverlay.CommandLine("console=hvc0", "/dev/vda", "/dev/vdb")))
+//
+// Inside the guest the read-only root and the upper layer stay visible at
+// /media/root-ro and /media/root-rw.
+package rootoverlay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mac-vz/vz/cmdline"
+	"github.com/mac-vz/vz/ext4"
+	"github.com/mac-vz/vz/initrd"
+)
+
+const (
+	// InitPath is the path of the hook in the initramfs.
+	InitPath = "/vz/overlay-init"
+
+	// Tmpfs selects an upper layer in memory, discarded at shutdown.
+	Tmpfs = "tmpfs"
+
+	// ScratchLabel is the volume label of scratch disks written by
+	// WriteScratchDisk.
+	ScratchLabel = "vz-overlay"
+
+	// Kernel command line parameter selecting the upper layer.
+	upperParam = "vz.overlay"
+)
+
+// DefaultModules are the kernel modules the hook loads before mounting
+// the disks. Modules missing from the initrd or built into the kernel are
+// skipped.
+var DefaultModules = []string{"virtio_pci", "virtio_blk", "ext4", "overlay"}
+
+// Option is an option for WriteInitrd.
+type Option func(o *options)
+
+type options struct {
+	modules     []string
+	busybox     string
+	compression initrd.Compression
+}
+
+// WithModules sets the kernel modules the hook loads. It defaults to
+// DefaultModules.
+func WithModules(modules ...string) Option {
+	return func(o *options) {
+		o.modules = modules
+	}
+}
+
+// WithBusybox adds the statically linked busybox binary at path to the
+// hook, for kernels booted without a distribution initrd, which otherwise
+// provides the shell and tools the hook runs.
+func WithBusybox(path string) Option {
+	return func(o *options) {
+		o.busybox = path
+	}
+}
+
+// WithCompression sets the compression of the hook. It defaults to
+// initrd.Gzip.
+func WithCompression(c initrd.Compression) Option {
+	return func(o *options) {
+		o.compression = c
+	}
+}
+
+// busyboxApplets are the commands the hook runs.
+var busyboxApplets = []string{
+	"sh", "cat", "echo", "findfs", "mkdir", "modprobe", "mount", "sleep",
+	"switch_root", "umount",
+}
+
+// CommandLine returns the kernel command line args with the arguments
+// that boot through the hook from the read-only root device root, such as
+// /dev/vda or UUID=…, with the upper layer on the device upper or in
+// memory if upper is Tmpfs or empty.
+func CommandLine(args, root, upper string) string {
+	c := cmdline.Parse(args)
+	if upper == "" {
+		upper = Tmpfs
+	}
+	c.Set("root", root)
+	c.Delete("rw")
+	c.SetFlag("ro")
+	c.Set("rdinit", InitPath)
+	c.Set(upperParam, upper)
+	return c.String()
+}
+
+// Hook writes the hook as a compressed initrd archive to w.
+func Hook(w io.Writer, opts ...Option) error {
+	o := &options{modules: DefaultModules, compression: initrd.Gzip}
+	for _, opt := range opts {
+		opt(o)
+	}
+	iw, err := initrd.NewWriter(w, initrd.WithCompression(o.compression))
+	if err != nil {
+		return err
+	}
+	shell := "/bin/sh"
+	if o.busybox != "" {
+		// Without a distribution initrd nothing provides /bin/sh.
+		shell = "/vz/bin/sh"
+	}
+	script := initScript(shell, o.modules)
+	if err := iw.Add(&initrd.Entry{Path: InitPath, Mode: 0755, Size: int64(len(script))}, bytes.NewReader(script)); err != nil {
+		return err
+	}
+	for _, dir := range []string{"/vz/lower", "/vz/upper", "/vz/root", "/dev", "/proc", "/sys"} {
+		if err := iw.Add(&initrd.Entry{Path: dir, Mode: fs.ModeDir | 0755}, nil); err != nil {
+			return err
+		}
+	}
+	if err := iw.Add(&initrd.Entry{Path: "/dev/console", Mode: fs.ModeDevice | fs.ModeCharDevice | 0600, Devmajor: 5, Devminor: 1}, nil); err != nil {
+		return err
+	}
+	if o.busybox != "" {
+		f, err := os.Open(o.busybox)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if err := iw.Add(&initrd.Entry{Path: "/vz/bin/busybox", Mode: 0755, Size: fi.Size()}, f); err != nil {
+			return err
+		}
+		for _, applet := range busyboxApplets {
+			if err := iw.Add(&initrd.Entry{Path: "/vz/bin/" + applet, Mode: fs.ModeSymlink | 0777, Linkname: "busybox"}, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return iw.Close()
+}
+
+// WriteInitrd writes a new initrd at path holding the initrd at base, if
+// any, followed by the hook.
+func WriteInitrd(path, base string, opts ...Option) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if base != "" {
+		in, err := os.Open(base)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(f, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+		// The kernel skips zeros between archives, which start on 4 byte
+		// boundaries.
+		if _, err := f.Write(make([]byte, (4-n%4)%4)); err != nil {
+			return err
+		}
+	}
+	return Hook(f, opts...)
+}
+
+// WriteScratchDisk writes a new empty scratch disk of size bytes at path,
+// formatted for the upper layer.
+func WriteScratchDisk(path string, size int64) (err error) {
+	if size < 16<<20 {
+		return errors.New("rootoverlay: scratch disk smaller than 16 MiB")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	b, err := ext4.NewBuilder(f, size, ext4.WithLabel(ScratchLabel))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, dir := range []string{"upper", "work"} {
+		if err := b.Add(&ext4.Entry{Path: dir, Mode: fs.ModeDir | 0755, ModTime: now}, nil); err != nil {
+			return err
+		}
+	}
+	if err := b.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// initScript returns the hook, run by shell, loading modules and mounting
+// the overlay.
+func initScript(shell string, modules []string) []byte {
+	s := strings.Replace(script, "@SHELL@", shell, 1)
+	return []byte(strings.Replace(s, "@MODULES@", strings.Join(modules, " "), 1))
+}
+
+const script = `#!@SHELL@
+# Mounts the root device read-only below an overlay and switches to it.
+export PATH=/vz/bin:/usr/sbin:/usr/bin:/sbin:/bin
+
+fail() {
+	echo "overlay-init: $*" >&2
+	echo "overlay-init: starting a shell" >&2
+	exec sh
+}
+
+mount -t proc proc /proc
+mount -t sysfs sysfs /sys
+mount -t devtmpfs devtmpfs /dev 2>/dev/null
+
+root= rootfstype= rootflags= upper=` + Tmpfs + ` init=/sbin/init
+for arg in $(cat /proc/cmdline); do
+	case $arg in
+	root=*) root=${arg#root=} ;;
+	rootfstype=*) rootfstype=${arg#rootfstype=} ;;
+	rootflags=*) rootflags=${arg#rootflags=} ;;
+	` + upperParam + `=*) upper=${arg#` + upperParam + `=} ;;
+	init=*) init=${arg#init=} ;;
+	esac
+done
+[ -n "$root" ] || fail "no root= on the kernel command line"
+
+for m in @MODULES@; do
+	modprobe -q "$m" 2>/dev/null
+done
+
+# device waits up to 30 seconds for the device named by $1.
+device() {
+	i=0
+	while [ $i -lt 300 ]; do
+		case $1 in
+		UUID=*|LABEL=*|PARTUUID=*|PARTLABEL=*) dev=$(findfs "$1" 2>/dev/null) ;;
+		*) dev=$1 ;;
+		esac
+		[ -n "$dev" ] && [ -b "$dev" ] && return 0
+		sleep 0.1 2>/dev/null || sleep 1
+		i=$((i + 1))
+	done
+	return 1
+}
+
+device "$root" || fail "root device $root not found"
+mount -o ro${rootflags:+,$rootflags} ${rootfstype:+-t $rootfstype} "$dev" /vz/lower ||
+	fail "cannot mount $root"
+
+if [ "$upper" = ` + Tmpfs + ` ]; then
+	mount -t tmpfs -o mode=0755 tmpfs /vz/upper || fail "cannot mount tmpfs"
+else
+	device "$upper" || fail "scratch device $upper not found"
+	mount "$dev" /vz/upper || fail "cannot mount $upper"
+fi
+mkdir -p /vz/upper/upper /vz/upper/work
+mount -t overlay overlay -o lowerdir=/vz/lower,upperdir=/vz/upper/upper,workdir=/vz/upper/work /vz/root ||
+	fail "cannot mount the overlay"
+
+mkdir -p /vz/root/media/root-ro /vz/root/media/root-rw
+mount --move /vz/lower /vz/root/media/root-ro
+mount --move /vz/upper /vz/root/media/root-rw
+mount --move /dev /vz/root/dev
+umount /sys /proc
+
+if command -v switch_root >/dev/null; then
+	exec switch_root /vz/root "$init"
+fi
+exec run-init /vz/root "$init"
+`
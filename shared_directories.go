@@ -24,6 +24,8 @@ type VZVirtioFileSystemDeviceConfiguration struct {
 	pointer
 
 	*baseDirectorySharingDeviceConfiguration
+
+	tag string
 }
 
 func MountFolder(tagName string, path string) {
@@ -42,9 +44,15 @@ func NewVZVirtioFileSystemDeviceConfiguration(tagName string, folder string, rea
 			ptr: C.newVZVirtioDirectorySharingDeviceConfiguration(tagNameChars.CString(),
 				folderChars.CString(), C.bool(readOnly)),
 		},
+		tag: tagName,
 	}
 	runtime.SetFinalizer(config, func(self *VZVirtioFileSystemDeviceConfiguration) {
 		self.Release()
 	})
 	return config
 }
+
+// Tag returns the tag the guest mounts the shared directory by.
+func (c *VZVirtioFileSystemDeviceConfiguration) Tag() string {
+	return c.tag
+}
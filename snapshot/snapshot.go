@@ -0,0 +1,346 @@
+// Package snapshot manages named snapshots of a raw disk image.
+//
+// Snapshots are copy-on-write clones of the disk image made with
+// diskimage.CloneDisk, so taking one is cheap on APFS. They form a tree:
+// each snapshot records the snapshot the disk was at when it was taken,
+// and disks provisioned from a snapshot with Tree.Clone are recorded as
+// its children as well.
+//
+// The tree of disk.img is stored next to it in disk.img.snapshots/.
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mac-vz/vz/diskimage"
+)
+
+var (
+	// ErrNotFound is returned when a snapshot does not exist.
+	ErrNotFound = errors.New("snapshot: no such snapshot")
+
+	// ErrExists is returned when a snapshot name is already taken.
+	ErrExists = errors.New("snapshot: snapshot already exists")
+
+	// ErrHasChildren is returned when deleting a snapshot that other
+	// snapshots or cloned disks were created from.
+	ErrHasChildren = errors.New("snapshot: snapshot has children")
+)
+
+const indexName = "index.json"
+
+// Snapshot is a named point-in-time copy of a disk image.
+type Snapshot struct {
+	Name string `json:"name"`
+
+	// Parent is the name of the snapshot the disk was at when this one was
+	// taken, or empty for the first snapshot.
+	Parent string `json:"parent,omitempty"`
+
+	Created time.Time `json:"created"`
+
+	// Clones are the paths of the disk images provisioned from the snapshot.
+	Clones []string `json:"clones,omitempty"`
+
+	path string
+}
+
+// Path returns the path of the snapshot's disk image. It can be attached
+// read-only to a virtual machine.
+func (s *Snapshot) Path() string {
+	return s.path
+}
+
+type index struct {
+	// Current is the snapshot the disk was last taken as or reverted to.
+	Current   string      `json:"current,omitempty"`
+	Snapshots []*Snapshot `json:"snapshots"`
+}
+
+// Tree is the snapshot tree of a disk image.
+type Tree struct {
+	disk string
+	dir  string
+	idx  index
+}
+
+// Open opens the snapshot tree of the disk image at path. A disk without
+// snapshots has an empty tree.
+func Open(path string) (*Tree, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	t := &Tree{disk: path, dir: path + ".snapshots"}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Disk returns the path of the disk image.
+func (t *Tree) Disk() string {
+	return t.disk
+}
+
+// Current returns the snapshot the disk image derives from, or nil if no
+// snapshot was taken yet.
+func (t *Tree) Current() *Snapshot {
+	s, _ := t.Get(t.idx.Current)
+	return s
+}
+
+// Snapshots returns all snapshots, oldest first.
+func (t *Tree) Snapshots() []*Snapshot {
+	return append([]*Snapshot(nil), t.idx.Snapshots...)
+}
+
+// Get returns the snapshot called name.
+func (t *Tree) Get(name string) (*Snapshot, error) {
+	for _, s := range t.idx.Snapshots {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrNotFound, name)
+}
+
+// Children returns the snapshots taken while the disk derived from the
+// snapshot called name.
+func (t *Tree) Children(name string) []*Snapshot {
+	var children []*Snapshot
+	for _, s := range t.idx.Snapshots {
+		if s.Parent == name {
+			children = append(children, s)
+		}
+	}
+	return children
+}
+
+// Take snapshots the disk image under name. It fails with
+// diskimage.ErrInUse while a virtual machine uses the disk read-write.
+func (t *Tree) Take(name string) (*Snapshot, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	var snap *Snapshot
+	err := t.update(func() error {
+		if _, err := t.Get(name); err == nil {
+			return fmt.Errorf("%w: %q", ErrExists, name)
+		}
+		// CloneDisk fails while a virtual machine writes to the disk.
+		snap = &Snapshot{Name: name, Parent: t.idx.Current, Created: time.Now().UTC(), path: t.path(name)}
+		if err := diskimage.CloneDisk(t.disk, snap.path); err != nil {
+			return err
+		}
+		// Snapshots are never written to.
+		if err := os.Chmod(snap.path, 0444); err != nil {
+			os.Remove(snap.path)
+			return err
+		}
+		t.idx.Snapshots = append(t.idx.Snapshots, snap)
+		t.idx.Current = name
+		return nil
+	})
+	return snap, err
+}
+
+// Revert discards the contents of the disk image and replaces them with
+// the snapshot called name. It fails with diskimage.ErrInUse while a
+// virtual machine uses the disk.
+func (t *Tree) Revert(name string) error {
+	return t.update(func() error {
+		snap, err := t.Get(name)
+		if err != nil {
+			return err
+		}
+		lock, err := diskimage.LockFile(t.disk, true)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		fi, err := os.Stat(t.disk)
+		if err != nil {
+			return err
+		}
+		tmp := t.disk + ".revert"
+		os.Remove(tmp)
+		if err := diskimage.CloneDisk(snap.path, tmp); err != nil {
+			return err
+		}
+		if err := os.Chmod(tmp, fi.Mode().Perm()); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, t.disk); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		t.idx.Current = name
+		return nil
+	})
+}
+
+// Clone provisions a new disk image at dst from the snapshot called name
+// and records it as a child of the snapshot.
+func (t *Tree) Clone(name, dst string) error {
+	return t.update(func() error {
+		snap, err := t.Get(name)
+		if err != nil {
+			return err
+		}
+		abs, err := filepath.Abs(dst)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(t.disk)
+		if err != nil {
+			return err
+		}
+		if err := diskimage.CloneDisk(snap.path, abs); err != nil {
+			return err
+		}
+		// Clones are writable like the disk they descend from.
+		if err := os.Chmod(abs, fi.Mode().Perm()); err != nil {
+			os.Remove(abs)
+			return err
+		}
+		snap.Clones = append(snap.Clones, abs)
+		return nil
+	})
+}
+
+// Delete removes the snapshot called name.
+//
+// A snapshot that other snapshots were taken from, or that cloned disks
+// which still exist were provisioned from, cannot be deleted and
+// ErrHasChildren is returned. A snapshot attached to a running virtual
+// machine fails with diskimage.ErrInUse. Deleting the current snapshot
+// makes its parent the current one.
+func (t *Tree) Delete(name string) error {
+	return t.update(func() error {
+		snap, err := t.Get(name)
+		if err != nil {
+			return err
+		}
+		if children := t.Children(name); len(children) > 0 {
+			return fmt.Errorf("%w: %q was taken from %q", ErrHasChildren, children[0].Name, name)
+		}
+		snap.Clones = existing(snap.Clones)
+		if len(snap.Clones) > 0 {
+			return fmt.Errorf("%w: %s was cloned from %q", ErrHasChildren, snap.Clones[0], name)
+		}
+		lock, err := diskimage.LockFile(snap.path, true)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		defer lock.Unlock()
+		if err := os.Remove(snap.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for i, s := range t.idx.Snapshots {
+			if s == snap {
+				t.idx.Snapshots = append(t.idx.Snapshots[:i], t.idx.Snapshots[i+1:]...)
+				break
+			}
+		}
+		if t.idx.Current == name {
+			t.idx.Current = snap.Parent
+		}
+		return nil
+	})
+}
+
+// existing returns the paths that still exist.
+func existing(paths []string) []string {
+	var kept []string
+	for _, p := range paths {
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || name == indexName {
+		return fmt.Errorf("snapshot: invalid name %q", name)
+	}
+	return nil
+}
+
+func (t *Tree) path(name string) string {
+	return filepath.Join(t.dir, name+".img")
+}
+
+// load reads the index, which is missing until the first snapshot is taken.
+func (t *Tree) load() error {
+	t.idx = index{}
+	data, err := ioutil.ReadFile(filepath.Join(t.dir, indexName))
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(data) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &t.idx); err != nil {
+		return fmt.Errorf("snapshot: reading index of %s: %w", t.disk, err)
+	}
+	for _, s := range t.idx.Snapshots {
+		s.path = t.path(s.Name)
+	}
+	sort.SliceStable(t.idx.Snapshots, func(i, j int) bool {
+		return t.idx.Snapshots[i].Created.Before(t.idx.Snapshots[j].Created)
+	})
+	return nil
+}
+
+// update applies fn to the latest index and saves it, holding an exclusive
+// lock on the index so concurrent updates fail with diskimage.ErrInUse.
+func (t *Tree) update(fn func() error) error {
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return err
+	}
+	indexPath := filepath.Join(t.dir, indexName)
+	f, err := os.OpenFile(indexPath, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	lock, err := diskimage.LockFile(indexPath, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if err := t.load(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(&t.idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The index is rewritten in place: replacing it would drop the lock.
+	f, err = os.OpenFile(indexPath, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,33 @@
+package vz
+
+import "github.com/mac-vz/vz/vmspec"
+
+// NewVirtualMachineConfigurationFromSpec creates a configuration booting
+// the kernel of spec with a LinuxBootLoader, with the disks of spec
+// attached in order as virtio block devices.
+//
+// Consoles, network and other devices are left to the caller; the
+// storage devices set here are replaced by a later call to
+// SetStorageDevicesVirtualMachineConfiguration.
+func NewVirtualMachineConfigurationFromSpec(spec *vmspec.VirtualMachineSpec) (*VirtualMachineConfiguration, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	opts := []LinuxBootLoaderOption{WithCommandLine(spec.CommandLine)}
+	if spec.Initrd != "" {
+		opts = append(opts, WithInitrd(spec.Initrd))
+	}
+	bootLoader := NewLinuxBootLoader(spec.Kernel, opts...)
+	config := NewVirtualMachineConfiguration(bootLoader, spec.CPUs(), spec.Memory())
+
+	devices := make([]StorageDeviceConfiguration, 0, len(spec.Disks))
+	for _, d := range spec.Disks {
+		attachment, err := NewDiskImageStorageDeviceAttachment(d.Path, d.ReadOnly)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, NewVirtioBlockDeviceConfiguration(attachment))
+	}
+	config.SetStorageDevicesVirtualMachineConfiguration(devices)
+	return config, nil
+}
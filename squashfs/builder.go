@@ -0,0 +1,540 @@
+package squashfs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// File mode type bits.
+const (
+	sIFMT   = 0xf000
+	sIFSOCK = 0xc000
+	sIFLNK  = 0xa000
+	sIFREG  = 0x8000
+	sIFBLK  = 0x6000
+	sIFDIR  = 0x4000
+	sIFCHR  = 0x2000
+	sIFIFO  = 0x1000
+	sISUID  = 0x0800
+	sISGID  = 0x0400
+	sISVTX  = 0x0200
+)
+
+// Option configures a Builder.
+type Option func(b *Builder)
+
+// WithCompression sets the compression of the image. It defaults to Zstd.
+func WithCompression(c Compression) Option {
+	return func(b *Builder) {
+		b.compression = c
+	}
+}
+
+// WithBlockSize sets the size of data blocks, a power of two between
+// 4 KiB and 1 MiB. It defaults to 128 KiB. Larger blocks compress better
+// but make random reads slower.
+func WithBlockSize(size int) Option {
+	return func(b *Builder) {
+		b.blockSize = size
+	}
+}
+
+// WithTimestamp sets the modification time of the image and of objects
+// added without one. It defaults to the Unix epoch, so images are
+// reproducible.
+func WithTimestamp(t time.Time) Option {
+	return func(b *Builder) {
+		b.now = t
+	}
+}
+
+// Entry describes a file system object added to a Builder.
+type Entry struct {
+	// Path is the slash-separated path of the object relative to the root
+	// of the file system. Missing parent directories are created.
+	Path string
+
+	// Mode holds the type and permission bits, including setuid, setgid
+	// and sticky bits.
+	Mode fs.FileMode
+
+	UID uint32
+	GID uint32
+
+	// ModTime defaults to the builder timestamp. SquashFS stores seconds
+	// only.
+	ModTime time.Time
+
+	// Size is the length of a regular file.
+	Size int64
+
+	// Linkname is the target of a symbolic link.
+	Linkname string
+
+	// Devmajor and Devminor identify character and block devices.
+	Devmajor uint32
+	Devminor uint32
+
+	// Xattrs maps full extended attribute names to their values. SquashFS
+	// stores the user, trusted and security namespaces only.
+	Xattrs map[string][]byte
+}
+
+// node is a file system object of the tree being built. Hard links share
+// a node.
+type node struct {
+	mode     uint16
+	uid, gid uint32
+	mtime    time.Time
+	target   string
+	devmajor uint32
+	devminor uint32
+	xattrs   []xattr
+
+	// data locates the contents of a regular file.
+	data *fileData
+
+	// refs is the number of directory entries referencing the node.
+	refs     uint32
+	children map[string]*node
+
+	// ino and ref are the inode number and inode reference, assigned by
+	// Close.
+	ino     uint32
+	ref     uint64
+	written bool
+}
+
+// fileData locates the blocks and tail of a regular file in the image.
+type fileData struct {
+	size   uint64
+	start  uint64
+	blocks []uint32
+	sparse uint64
+
+	// frag is the index of the fragment block holding the tail at offset
+	// fragOff, or noFragment.
+	frag    uint32
+	fragOff uint32
+}
+
+func newDirNode(now time.Time) *node {
+	return &node{
+		mode:     sIFDIR | 0755,
+		mtime:    now,
+		children: map[string]*node{},
+	}
+}
+
+func (n *node) isDir() bool {
+	return n.mode&sIFMT == sIFDIR
+}
+
+func (n *node) link(name string, child *node) {
+	n.children[name] = child
+	child.refs++
+}
+
+// sortedNames returns the names of the children of n in sorted order.
+func (n *node) sortedNames() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Builder writes a new SquashFS image.
+//
+// File data is compressed and written while files are added, identical
+// files being stored once; the inode, directory and lookup tables are
+// written by Close. Objects replaced or removed after being added keep
+// their data in the image, so trees should be assembled before they are
+// added where size matters.
+type Builder struct {
+	w           io.WriterAt
+	compression Compression
+	blockSize   int
+	now         time.Time
+	comp        compressor
+
+	root *node
+
+	// off is the end of the data written so far and high the largest end
+	// ever written, past off when duplicate files were rolled back.
+	off  int64
+	high int64
+
+	frag      []byte
+	fragments []fragment
+	files     map[[sha256.Size]byte]*fileData
+	size      int64
+	closed    bool
+}
+
+// fragment is an entry of the fragment table.
+type fragment struct {
+	start uint64
+	size  uint32
+}
+
+// NewBuilder creates a Builder writing an image to w, starting at offset
+// zero.
+func NewBuilder(w io.WriterAt, opts ...Option) (*Builder, error) {
+	b := &Builder{
+		w:           w,
+		compression: Zstd,
+		blockSize:   defaultBlockSize,
+		now:         time.Unix(0, 0),
+		off:         superblockSize,
+		high:        superblockSize,
+		files:       map[[sha256.Size]byte]*fileData{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.blockSize < minBlockSize || b.blockSize > maxBlockSize || b.blockSize&(b.blockSize-1) != 0 {
+		return nil, fmt.Errorf("squashfs: invalid block size %d", b.blockSize)
+	}
+	var err error
+	if b.comp, err = newCompressor(b.compression, b.blockSize); err != nil {
+		return nil, err
+	}
+	b.root = newDirNode(b.now)
+	b.root.refs = 1
+	return b, nil
+}
+
+// unixMode converts m to the Unix mode representation.
+func unixMode(m fs.FileMode) uint16 {
+	mode := uint16(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= sISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= sISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= sISVTX
+	}
+	switch {
+	case m.IsDir():
+		mode |= sIFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= sIFLNK
+	case m&fs.ModeCharDevice != 0:
+		mode |= sIFCHR
+	case m&fs.ModeDevice != 0:
+		mode |= sIFBLK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= sIFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= sIFSOCK
+	default:
+		mode |= sIFREG
+	}
+	return mode
+}
+
+// cleanPath normalizes p to a slash-separated path without leading slash.
+// The root directory is returned as the empty string.
+func cleanPath(p string) (string, error) {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	for _, elem := range strings.Split(p, "/") {
+		if len(elem) > maxNameLen {
+			return "", fmt.Errorf("squashfs: file name %q too long", elem)
+		}
+	}
+	return p, nil
+}
+
+// lookupDir returns the directory node at the clean path p, creating
+// missing directories when create is true. Both "" and "." refer to the root.
+func (b *Builder) lookupDir(p string, create bool) (*node, error) {
+	dir := b.root
+	if p == "" || p == "." {
+		return dir, nil
+	}
+	for _, elem := range strings.Split(p, "/") {
+		child, ok := dir.children[elem]
+		if !ok {
+			if !create {
+				return nil, fmt.Errorf("squashfs: %s: %w", p, fs.ErrNotExist)
+			}
+			child = newDirNode(b.now)
+			dir.link(elem, child)
+		}
+		if !child.isDir() {
+			return nil, fmt.Errorf("squashfs: %s: not a directory", p)
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+func (b *Builder) setMeta(n *node, e *Entry) error {
+	attrs, err := makeXattrs(e.Xattrs)
+	if err != nil {
+		return err
+	}
+	n.mode = unixMode(e.Mode)
+	n.uid, n.gid = e.UID, e.GID
+	n.mtime = e.ModTime
+	if n.mtime.IsZero() {
+		n.mtime = b.now
+	}
+	n.xattrs = attrs
+	return nil
+}
+
+// Add adds the object described by e. For regular files Size bytes of
+// content are read from r; r is ignored for all other types. An existing
+// object at the same path is replaced, except that adding a directory over
+// a directory only updates its metadata.
+func (b *Builder) Add(e *Entry, r io.Reader) error {
+	if b.closed {
+		return errors.New("squashfs: builder is closed")
+	}
+	p, err := cleanPath(e.Path)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		if !e.Mode.IsDir() {
+			return errors.New("squashfs: root must be a directory")
+		}
+		if err := b.setMeta(b.root, e); err != nil {
+			return fmt.Errorf("squashfs: /: %w", err)
+		}
+		return nil
+	}
+	parent, err := b.lookupDir(path.Dir(p), true)
+	if err != nil {
+		return err
+	}
+	name := path.Base(p)
+	if old, ok := parent.children[name]; ok {
+		if old.isDir() && e.Mode.IsDir() {
+			if err := b.setMeta(old, e); err != nil {
+				return fmt.Errorf("squashfs: %s: %w", p, err)
+			}
+			return nil
+		}
+		delete(parent.children, name)
+		unref(old)
+	}
+	n := &node{}
+	if err := b.setMeta(n, e); err != nil {
+		return fmt.Errorf("squashfs: %s: %w", p, err)
+	}
+	switch n.mode & sIFMT {
+	case sIFDIR:
+		n.children = map[string]*node{}
+	case sIFREG:
+		if e.Size < 0 {
+			return fmt.Errorf("squashfs: %s: negative size", p)
+		}
+		if n.data, err = b.writeData(r, e.Size); err != nil {
+			return fmt.Errorf("squashfs: %s: %w", p, err)
+		}
+	case sIFLNK:
+		n.target = e.Linkname
+	case sIFCHR, sIFBLK:
+		n.devmajor, n.devminor = e.Devmajor, e.Devminor
+	}
+	parent.link(name, n)
+	return nil
+}
+
+// Link adds a hard link at p to the existing non-directory object at target.
+func (b *Builder) Link(p, target string) error {
+	if b.closed {
+		return errors.New("squashfs: builder is closed")
+	}
+	tp, err := cleanPath(target)
+	if err != nil {
+		return err
+	}
+	tdir, err := b.lookupDir(path.Dir(tp), false)
+	if err != nil {
+		return err
+	}
+	n, ok := tdir.children[path.Base(tp)]
+	if !ok || tp == "" {
+		return fmt.Errorf("squashfs: link target %s: %w", target, fs.ErrNotExist)
+	}
+	if n.isDir() {
+		return fmt.Errorf("squashfs: link target %s is a directory", target)
+	}
+	p, err = cleanPath(p)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return errors.New("squashfs: cannot replace the root directory")
+	}
+	parent, err := b.lookupDir(path.Dir(p), true)
+	if err != nil {
+		return err
+	}
+	name := path.Base(p)
+	if old, ok := parent.children[name]; ok {
+		if old == n {
+			return nil
+		}
+		delete(parent.children, name)
+		unref(old)
+	}
+	parent.link(name, n)
+	return nil
+}
+
+// Remove removes the object at p, including all children of a directory.
+// Removing a path that does not exist is not an error.
+func (b *Builder) Remove(p string) error {
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return errors.New("squashfs: cannot remove the root directory")
+	}
+	parent, err := b.lookupDir(path.Dir(p), false)
+	if err != nil {
+		return nil
+	}
+	name := path.Base(p)
+	if n, ok := parent.children[name]; ok {
+		delete(parent.children, name)
+		unref(n)
+	}
+	return nil
+}
+
+// unref drops a directory entry reference to n and, once it is no longer
+// referenced, to its children.
+func unref(n *node) {
+	n.refs--
+	if n.refs > 0 {
+		return
+	}
+	for name, child := range n.children {
+		delete(n.children, name)
+		unref(child)
+	}
+}
+
+// writeData compresses size bytes from r into data blocks and the tail
+// into the fragment buffer. Blocks of zeros are stored as holes. A file
+// identical to an earlier one reuses its data.
+func (b *Builder) writeData(r io.Reader, size int64) (*fileData, error) {
+	d := &fileData{size: uint64(size), start: uint64(b.off), frag: noFragment}
+	h := sha256.New()
+	buf := make([]byte, b.blockSize)
+	bs := int64(b.blockSize)
+	for remaining := size; remaining > 0; {
+		n := bs
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return nil, err
+		}
+		h.Write(buf[:n])
+		remaining -= n
+		if n < bs {
+			d.frag = 0
+			break
+		}
+		if isZero(buf) {
+			d.blocks = append(d.blocks, 0)
+			d.sparse += uint64(bs)
+			continue
+		}
+		sz, err := b.writeBlock(buf)
+		if err != nil {
+			return nil, err
+		}
+		d.blocks = append(d.blocks, sz)
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	if prev, ok := b.files[sum]; ok && prev.size == d.size {
+		b.off = int64(d.start)
+		return prev, nil
+	}
+	if d.frag != noFragment {
+		tail := buf[:size%bs]
+		if len(b.frag)+len(tail) > b.blockSize {
+			if err := b.flushFragment(); err != nil {
+				return nil, err
+			}
+		}
+		d.frag = uint32(len(b.fragments))
+		d.fragOff = uint32(len(b.frag))
+		b.frag = append(b.frag, tail...)
+	}
+	b.files[sum] = d
+	return d, nil
+}
+
+// writeBlock compresses and writes a data block, returning its size entry.
+func (b *Builder) writeBlock(p []byte) (uint32, error) {
+	c, err := b.comp.compress(p)
+	if err != nil {
+		return 0, err
+	}
+	sz := uint32(len(c))
+	if len(c) >= len(p) {
+		c = p
+		sz = uint32(len(p)) | dataUncompressed
+	}
+	if err := b.write(c); err != nil {
+		return 0, err
+	}
+	return sz, nil
+}
+
+// flushFragment writes the fragment buffer as a fragment block.
+func (b *Builder) flushFragment() error {
+	if len(b.frag) == 0 {
+		return nil
+	}
+	start := uint64(b.off)
+	sz, err := b.writeBlock(b.frag)
+	if err != nil {
+		return err
+	}
+	b.fragments = append(b.fragments, fragment{start: start, size: sz})
+	b.frag = b.frag[:0]
+	return nil
+}
+
+// write appends p to the image.
+func (b *Builder) write(p []byte) error {
+	if _, err := b.w.WriteAt(p, b.off); err != nil {
+		return err
+	}
+	b.off += int64(len(p))
+	if b.off > b.high {
+		b.high = b.off
+	}
+	return nil
+}
+
+func isZero(p []byte) bool {
+	for _, c := range p {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
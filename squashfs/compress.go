@@ -0,0 +1,87 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compressor compresses data and metadata blocks, each independently.
+type compressor interface {
+	compress(p []byte) ([]byte, error)
+}
+
+// newCompressor returns a compressor for c. The kernel decompresses with a
+// window of the block size, or 8 KiB for smaller blocks.
+func newCompressor(c Compression, blockSize int) (compressor, error) {
+	window := blockSize
+	if window < metadataSize {
+		window = metadataSize
+	}
+	switch c {
+	case Gzip:
+		return zlibCompressor{}, nil
+	case XZ:
+		return xzCompressor{xz.WriterConfig{DictCap: window, CheckSum: xz.CRC32}}, nil
+	case Zstd:
+		// Frames carry no checksum, like those of mksquashfs: the kernel
+		// fails to decode some checksummed frames split across pages.
+		enc, err := zstd.NewWriter(nil,
+			zstd.WithWindowSize(window),
+			zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithEncoderCRC(false))
+		if err != nil {
+			return nil, err
+		}
+		return zstdCompressor{enc}, nil
+	}
+	return nil, fmt.Errorf("squashfs: unsupported compression %v", c)
+}
+
+type zlibCompressor struct{}
+
+func (zlibCompressor) compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type xzCompressor struct {
+	config xz.WriterConfig
+}
+
+func (c xzCompressor) compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := c.config.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type zstdCompressor struct {
+	enc *zstd.Encoder
+}
+
+func (c zstdCompressor) compress(p []byte) ([]byte, error) {
+	return c.enc.EncodeAll(p, nil), nil
+}
@@ -0,0 +1,543 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// metaWriter builds a table of metadata blocks in memory.
+type metaWriter struct {
+	comp compressor
+	buf  []byte
+	out  []byte
+}
+
+// pos returns the reference of the next byte written: the offset of its
+// block in the table shifted left by 16, ored with its offset in the
+// block.
+func (m *metaWriter) pos() uint64 {
+	return uint64(len(m.out))<<16 | uint64(len(m.buf))
+}
+
+func (m *metaWriter) write(p []byte) error {
+	m.buf = append(m.buf, p...)
+	for len(m.buf) >= metadataSize {
+		if err := m.flushBlock(metadataSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes the partial last block.
+func (m *metaWriter) flush() error {
+	if len(m.buf) == 0 {
+		return nil
+	}
+	return m.flushBlock(len(m.buf))
+}
+
+func (m *metaWriter) flushBlock(n int) error {
+	block := m.buf[:n]
+	c, err := m.comp.compress(block)
+	if err != nil {
+		return err
+	}
+	hdr := uint16(len(c))
+	if len(c) >= n {
+		c = block
+		hdr = uint16(n) | metadataUncompressed
+	}
+	m.out = append(m.out, byte(hdr), byte(hdr>>8))
+	m.out = append(m.out, c...)
+	m.buf = append(m.buf[:0], m.buf[n:]...)
+	return nil
+}
+
+// finisher holds the state of Close.
+type finisher struct {
+	b      *Builder
+	inodes metaWriter
+	dirs   metaWriter
+	ids    map[uint32]uint16
+	count  uint32
+
+	xattrs   metaWriter
+	xattrIDs []byte
+	xattrSet map[string]uint32
+}
+
+// Close writes the inode, directory, fragment, ID and xattr tables and the
+// superblock, and pads the image to a multiple of 4 KiB. It does not close
+// the underlying writer.
+func (b *Builder) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if err := b.flushFragment(); err != nil {
+		return err
+	}
+	f := &finisher{
+		b:        b,
+		inodes:   metaWriter{comp: b.comp},
+		dirs:     metaWriter{comp: b.comp},
+		xattrs:   metaWriter{comp: b.comp},
+		ids:      map[uint32]uint16{},
+		xattrSet: map[string]uint32{},
+	}
+	f.number(b.root)
+	if err := f.collectIDs(); err != nil {
+		return err
+	}
+	if err := f.writeDir(b.root, f.count+1); err != nil {
+		return err
+	}
+	if err := f.inodes.flush(); err != nil {
+		return err
+	}
+	if err := f.dirs.flush(); err != nil {
+		return err
+	}
+
+	sb := make([]byte, superblockSize)
+	le := binary.LittleEndian
+	flags := uint16(flagDuplicates)
+	if len(f.xattrSet) == 0 {
+		flags |= flagNoXattrs
+	}
+
+	le.PutUint64(sb[64:], uint64(b.off))
+	if err := b.write(f.inodes.out); err != nil {
+		return err
+	}
+	le.PutUint64(sb[72:], uint64(b.off))
+	if err := b.write(f.dirs.out); err != nil {
+		return err
+	}
+
+	// The fragment and ID tables are followed by the locations of their
+	// metadata blocks, which the superblock points to.
+	var frags []byte
+	for _, fr := range b.fragments {
+		var e [16]byte
+		le.PutUint64(e[0:], fr.start)
+		le.PutUint32(e[8:], fr.size)
+		frags = append(frags, e[:]...)
+	}
+	fragTable, err := b.writeTable(frags)
+	if err != nil {
+		return err
+	}
+	le.PutUint64(sb[80:], fragTable)
+
+	ids := make([]uint32, len(f.ids))
+	for id, i := range f.ids {
+		ids[i] = id
+	}
+	idData := make([]byte, 4*len(ids))
+	for i, id := range ids {
+		le.PutUint32(idData[4*i:], id)
+	}
+	idTable, err := b.writeTable(idData)
+	if err != nil {
+		return err
+	}
+	le.PutUint64(sb[48:], idTable)
+
+	xattrTable := invalidTable
+	if len(f.xattrSet) > 0 {
+		if xattrTable, err = f.writeXattrTable(); err != nil {
+			return err
+		}
+	}
+	le.PutUint64(sb[56:], xattrTable)
+	le.PutUint64(sb[88:], invalidTable)
+
+	le.PutUint32(sb[0:], magic)
+	le.PutUint32(sb[4:], f.count)
+	le.PutUint32(sb[8:], uint32(b.now.Unix()))
+	le.PutUint32(sb[12:], uint32(b.blockSize))
+	le.PutUint32(sb[16:], uint32(len(b.fragments)))
+	le.PutUint16(sb[20:], uint16(b.compression))
+	blockLog := uint16(0)
+	for 1<<blockLog < b.blockSize {
+		blockLog++
+	}
+	le.PutUint16(sb[22:], blockLog)
+	le.PutUint16(sb[24:], flags)
+	le.PutUint16(sb[26:], uint16(len(ids)))
+	le.PutUint16(sb[28:], 4)
+	le.PutUint16(sb[30:], 0)
+	le.PutUint64(sb[32:], b.root.ref)
+	le.PutUint64(sb[40:], uint64(b.off))
+	if _, err := b.w.WriteAt(sb, 0); err != nil {
+		return err
+	}
+
+	// Pad to 4 KiB, as loop devices need, and clear data of duplicate
+	// files written past the end.
+	b.size = (b.off + 4095) &^ 4095
+	end := b.size
+	if b.high > end {
+		end = b.high
+	}
+	_, err = b.w.WriteAt(make([]byte, end-b.off), b.off)
+	return err
+}
+
+// Size returns the size of the image written by Close.
+func (b *Builder) Size() int64 {
+	return b.size
+}
+
+// writeTable writes data as metadata blocks followed by their locations,
+// and returns the position of the locations.
+func (b *Builder) writeTable(data []byte) (uint64, error) {
+	index, err := b.writeBlocks(data)
+	if err != nil {
+		return 0, err
+	}
+	pos := uint64(b.off)
+	return pos, b.write(index)
+}
+
+// writeBlocks writes data as metadata blocks and returns their locations.
+func (b *Builder) writeBlocks(data []byte) ([]byte, error) {
+	m := metaWriter{comp: b.comp}
+	start := uint64(b.off)
+	var index []byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > metadataSize {
+			n = metadataSize
+		}
+		var loc [8]byte
+		binary.LittleEndian.PutUint64(loc[:], start+uint64(len(m.out)))
+		index = append(index, loc[:]...)
+		if err := m.write(data[:n]); err != nil {
+			return nil, err
+		}
+		if err := m.flush(); err != nil {
+			return nil, err
+		}
+		data = data[n:]
+	}
+	return index, b.write(m.out)
+}
+
+// number assigns inode numbers in the order the inodes are written: the
+// children of each directory before the directory, the root last.
+func (f *finisher) number(dir *node) {
+	for _, name := range dir.sortedNames() {
+		child := dir.children[name]
+		if child.isDir() {
+			f.number(child)
+		} else if child.ino == 0 {
+			f.count++
+			child.ino = f.count
+		}
+	}
+	f.count++
+	dir.ino = f.count
+}
+
+// collectIDs builds the sorted table of user and group IDs.
+func (f *finisher) collectIDs() error {
+	seen := map[uint32]bool{}
+	var walk func(n *node)
+	walk = func(n *node) {
+		seen[n.uid] = true
+		seen[n.gid] = true
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(f.b.root)
+	if len(seen) > 1<<16 {
+		return ErrTooManyIDs
+	}
+	ids := make([]uint32, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for i, id := range ids {
+		f.ids[id] = uint16(i)
+	}
+	return nil
+}
+
+// writeDir writes the inodes of the children of dir, its listing and its
+// inode.
+func (f *finisher) writeDir(dir *node, parent uint32) error {
+	names := dir.sortedNames()
+	subdirs := uint32(0)
+	for _, name := range names {
+		child := dir.children[name]
+		if child.isDir() {
+			subdirs++
+			if err := f.writeDir(child, dir.ino); err != nil {
+				return err
+			}
+		} else if !child.written {
+			if err := f.writeInode(child); err != nil {
+				return err
+			}
+		}
+	}
+	listing := f.dirs.pos()
+	size, err := f.writeListing(dir, names)
+	if err != nil {
+		return err
+	}
+	return f.writeDirInode(dir, listing, size+3, subdirs+2, parent)
+}
+
+// writeListing writes the directory entries of dir and returns their size.
+// Entries share a header while their inodes are in the same metadata block
+// and their inode numbers are close enough to the first one.
+func (f *finisher) writeListing(dir *node, names []string) (uint32, error) {
+	le := binary.LittleEndian
+	var buf bytes.Buffer
+	for i := 0; i < len(names); {
+		first := dir.children[names[i]]
+		j := i + 1
+		for j < len(names) && j-i < maxDirRun {
+			n := dir.children[names[j]]
+			delta := int64(n.ino) - int64(first.ino)
+			if n.ref>>16 != first.ref>>16 || delta < -32768 || delta > 32767 {
+				break
+			}
+			j++
+		}
+		var hdr [12]byte
+		le.PutUint32(hdr[0:], uint32(j-i-1))
+		le.PutUint32(hdr[4:], uint32(first.ref>>16))
+		le.PutUint32(hdr[8:], first.ino)
+		buf.Write(hdr[:])
+		for _, name := range names[i:j] {
+			n := dir.children[name]
+			var e [8]byte
+			le.PutUint16(e[0:], uint16(n.ref))
+			le.PutUint16(e[2:], uint16(int16(int64(n.ino)-int64(first.ino))))
+			le.PutUint16(e[4:], basicType(n.mode))
+			le.PutUint16(e[6:], uint16(len(name)-1))
+			buf.Write(e[:])
+			buf.WriteString(name)
+		}
+		i = j
+	}
+	return uint32(buf.Len()), f.dirs.write(buf.Bytes())
+}
+
+// basicType returns the basic inode type of mode, used in directory
+// entries.
+func basicType(mode uint16) uint16 {
+	switch mode & sIFMT {
+	case sIFDIR:
+		return typeDir
+	case sIFREG:
+		return typeFile
+	case sIFLNK:
+		return typeSymlink
+	case sIFBLK:
+		return typeBlock
+	case sIFCHR:
+		return typeChar
+	case sIFIFO:
+		return typeFifo
+	}
+	return typeSocket
+}
+
+// header returns the common inode header of n.
+func (f *finisher) header(n *node, typ uint16) []byte {
+	le := binary.LittleEndian
+	p := make([]byte, 16)
+	le.PutUint16(p[0:], typ)
+	le.PutUint16(p[2:], n.mode&^sIFMT)
+	le.PutUint16(p[4:], f.ids[n.uid])
+	le.PutUint16(p[6:], f.ids[n.gid])
+	le.PutUint32(p[8:], uint32(n.mtime.Unix()))
+	le.PutUint32(p[12:], n.ino)
+	return p
+}
+
+func (f *finisher) writeDirInode(n *node, listing uint64, size, nlink, parent uint32) error {
+	xattr, err := f.xattrID(n)
+	if err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	var p []byte
+	if size <= 0xffff && xattr == noXattr {
+		p = f.header(n, typeDir)
+		var d [16]byte
+		le.PutUint32(d[0:], uint32(listing>>16))
+		le.PutUint32(d[4:], nlink)
+		le.PutUint16(d[8:], uint16(size))
+		le.PutUint16(d[10:], uint16(listing))
+		le.PutUint32(d[12:], parent)
+		p = append(p, d[:]...)
+	} else {
+		p = f.header(n, typeExtDir)
+		var d [24]byte
+		le.PutUint32(d[0:], nlink)
+		le.PutUint32(d[4:], size)
+		le.PutUint32(d[8:], uint32(listing>>16))
+		le.PutUint32(d[12:], parent)
+		le.PutUint16(d[16:], 0)
+		le.PutUint16(d[18:], uint16(listing))
+		le.PutUint32(d[20:], xattr)
+		p = append(p, d[:]...)
+	}
+	n.ref = f.inodes.pos()
+	return f.inodes.write(p)
+}
+
+// writeInode writes the inode of the non-directory n.
+func (f *finisher) writeInode(n *node) error {
+	xattr, err := f.xattrID(n)
+	if err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	ext := xattr != noXattr || n.refs > 1
+	var p []byte
+	switch n.mode & sIFMT {
+	case sIFREG:
+		d := n.data
+		if !ext && d.start < 1<<32 && d.size < 1<<32 {
+			p = f.header(n, typeFile)
+			var h [16]byte
+			le.PutUint32(h[0:], uint32(d.start))
+			le.PutUint32(h[4:], d.frag)
+			le.PutUint32(h[8:], d.fragOff)
+			le.PutUint32(h[12:], uint32(d.size))
+			p = append(p, h[:]...)
+		} else {
+			p = f.header(n, typeExtFile)
+			var h [40]byte
+			le.PutUint64(h[0:], d.start)
+			le.PutUint64(h[8:], d.size)
+			le.PutUint64(h[16:], d.sparse)
+			le.PutUint32(h[24:], n.refs)
+			le.PutUint32(h[28:], d.frag)
+			le.PutUint32(h[32:], d.fragOff)
+			le.PutUint32(h[36:], xattr)
+			p = append(p, h[:]...)
+		}
+		for _, sz := range d.blocks {
+			var s [4]byte
+			le.PutUint32(s[:], sz)
+			p = append(p, s[:]...)
+		}
+	case sIFLNK:
+		typ := uint16(typeSymlink)
+		if ext {
+			typ = typeExtSymlink
+		}
+		p = f.header(n, typ)
+		var h [8]byte
+		le.PutUint32(h[0:], n.refs)
+		le.PutUint32(h[4:], uint32(len(n.target)))
+		p = append(p, h[:]...)
+		p = append(p, n.target...)
+		if ext {
+			le.PutUint32(h[0:], xattr)
+			p = append(p, h[:4]...)
+		}
+	case sIFBLK, sIFCHR:
+		typ := basicType(n.mode)
+		if ext {
+			typ += typeExtDir - typeDir
+		}
+		p = f.header(n, typ)
+		var h [12]byte
+		le.PutUint32(h[0:], n.refs)
+		le.PutUint32(h[4:], n.devminor&0xff|n.devmajor<<8|(n.devminor&^0xff)<<12)
+		le.PutUint32(h[8:], xattr)
+		if ext {
+			p = append(p, h[:12]...)
+		} else {
+			p = append(p, h[:8]...)
+		}
+	default:
+		typ := basicType(n.mode)
+		if ext {
+			typ += typeExtDir - typeDir
+		}
+		p = f.header(n, typ)
+		var h [8]byte
+		le.PutUint32(h[0:], n.refs)
+		le.PutUint32(h[4:], xattr)
+		if ext {
+			p = append(p, h[:8]...)
+		} else {
+			p = append(p, h[:4]...)
+		}
+	}
+	n.ref = f.inodes.pos()
+	n.written = true
+	return f.inodes.write(p)
+}
+
+// xattrID returns the index of the xattr set of n in the xattr ID table,
+// adding the set on first use, or noXattr.
+func (f *finisher) xattrID(n *node) (uint32, error) {
+	if len(n.xattrs) == 0 {
+		return noXattr, nil
+	}
+	kv := encodeXattrs(n.xattrs)
+	if id, ok := f.xattrSet[string(kv)]; ok {
+		return id, nil
+	}
+	if len(f.xattrSet) == noXattr {
+		return 0, errors.New("squashfs: too many distinct extended attribute sets")
+	}
+	size := 0
+	for _, a := range n.xattrs {
+		size += len(xattrPrefixes[a.typ].prefix) + len(a.name) + 1 + len(a.value)
+	}
+	var e [16]byte
+	le := binary.LittleEndian
+	le.PutUint64(e[0:], f.xattrs.pos())
+	le.PutUint32(e[8:], uint32(len(n.xattrs)))
+	le.PutUint32(e[12:], uint32(size))
+	if err := f.xattrs.write(kv); err != nil {
+		return 0, err
+	}
+	id := uint32(len(f.xattrSet))
+	f.xattrSet[string(kv)] = id
+	f.xattrIDs = append(f.xattrIDs, e[:]...)
+	return id, nil
+}
+
+// writeXattrTable writes the xattr key and value pairs, the xattr ID
+// table and its header, which must end the image, and returns the
+// position of the header.
+func (f *finisher) writeXattrTable() (uint64, error) {
+	b := f.b
+	if err := f.xattrs.flush(); err != nil {
+		return 0, err
+	}
+	kvStart := uint64(b.off)
+	if err := b.write(f.xattrs.out); err != nil {
+		return 0, err
+	}
+	index, err := b.writeBlocks(f.xattrIDs)
+	if err != nil {
+		return 0, err
+	}
+	pos := uint64(b.off)
+	var hdr [16]byte
+	binary.LittleEndian.PutUint64(hdr[0:], kvStart)
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(f.xattrSet)))
+	if err := b.write(append(hdr[:], index...)); err != nil {
+		return 0, err
+	}
+	return pos, nil
+}
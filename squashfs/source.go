@@ -0,0 +1,202 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
+)
+
+// paxXattrPrefix prefixes extended attributes in PAX headers.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// AddDirectory adds the contents of the host directory root, preserving
+// modes, ownership, timestamps, hard links, device nodes and extended
+// attributes. Files are added in lexical order, so the image does not
+// depend on the order the host lists directories in.
+func (b *Builder) AddDirectory(root string) error {
+	type fileID struct{ dev, ino uint64 }
+	links := map[fileID]string{}
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		e := &Entry{
+			Path:    rel,
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			e.UID, e.GID = st.Uid, st.Gid
+			if !info.IsDir() && st.Nlink > 1 {
+				id := fileID{uint64(st.Dev), uint64(st.Ino)}
+				if target, ok := links[id]; ok {
+					return b.Link(rel, target)
+				}
+				links[id] = rel
+			}
+			if info.Mode()&os.ModeDevice != 0 {
+				e.Devmajor = unix.Major(uint64(st.Rdev))
+				e.Devminor = unix.Minor(uint64(st.Rdev))
+			}
+		}
+		if e.Xattrs, err = listXattrs(p); err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if e.Linkname, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return b.Add(e, f)
+		}
+		return b.Add(e, nil)
+	})
+}
+
+// listXattrs returns the extended attributes of the file at p in the
+// namespaces SquashFS stores, without following symbolic links.
+func listXattrs(p string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size == 0 {
+		// File systems without xattr support have nothing to copy.
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(p, buf)
+	if err != nil {
+		return nil, fmt.Errorf("squashfs: listing xattrs of %s: %w", p, err)
+	}
+	var attrs map[string][]byte
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if !storedXattr(name) {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(p, name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("squashfs: reading xattr %s of %s: %w", name, p, err)
+		}
+		value := make([]byte, vsize)
+		if vsize > 0 {
+			if vsize, err = unix.Lgetxattr(p, name, value); err != nil {
+				return nil, fmt.Errorf("squashfs: reading xattr %s of %s: %w", name, p, err)
+			}
+		}
+		if attrs == nil {
+			attrs = map[string][]byte{}
+		}
+		attrs[name] = value[:vsize]
+	}
+	return attrs, nil
+}
+
+// storedXattr reports whether the attribute name is in a namespace
+// SquashFS stores. Others, such as POSIX ACLs, are skipped when copying
+// from the host.
+func storedXattr(name string) bool {
+	for _, p := range xattrPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTar adds the contents of a tar archive, which may be compressed with
+// gzip, bzip2, xz or zstd. Entries replace objects added earlier at the
+// same path.
+func (b *Builder) AddTar(r io.Reader) error {
+	r, err := decompress(r)
+	if err != nil {
+		return fmt.Errorf("squashfs: %w", err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("squashfs: reading tar: %w", err)
+		}
+		name := path.Clean("/" + hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			if err := b.Link(name, hdr.Linkname); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeSymlink,
+			tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		default:
+			continue
+		}
+		e := &Entry{
+			Path:     name,
+			Mode:     hdr.FileInfo().Mode(),
+			UID:      uint32(hdr.Uid),
+			GID:      uint32(hdr.Gid),
+			ModTime:  hdr.ModTime,
+			Size:     hdr.Size,
+			Linkname: hdr.Linkname,
+			Devmajor: uint32(hdr.Devmajor),
+			Devminor: uint32(hdr.Devminor),
+		}
+		for k, v := range hdr.PAXRecords {
+			if name := strings.TrimPrefix(k, paxXattrPrefix); name != k && storedXattr(name) {
+				if e.Xattrs == nil {
+					e.Xattrs = map[string][]byte{}
+				}
+				e.Xattrs[name] = []byte(v)
+			}
+		}
+		if err := b.Add(e, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// decompress detects gzip, bzip2, xz and zstd compressed streams.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return xz.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return br, nil
+}
@@ -0,0 +1,111 @@
+// Package squashfs builds compressed, read-only SquashFS 4.0 images, for
+// root disks of immutable appliance virtual machines.
+//
+// A Builder writes to any io.WriterAt. The image only depends on the
+// objects added and the builder options, so builds are reproducible:
+//
+//	f, _ := os.Create("root.sqfs")
+//	b, _ := squashfs.NewBuilder(f, squashfs.WithCompression(squashfs.Zstd),
+//		squashfs.WithTimestamp(time.Unix(0, 0)))
+//	b.AddDirectory("rootfs")
+//	b.Close()
+//	f.Truncate(b.Size())
+//
+// The image is attached read-only with vz.NewDiskImageStorageDeviceAttachment
+// and booted with the arguments of CommandLine.
+package squashfs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mac-vz/vz/cmdline"
+)
+
+// Compression is the compression algorithm of an image.
+type Compression uint16
+
+// Compression algorithms, with the IDs stored in the superblock. The
+// kernel needs CONFIG_SQUASHFS_ZLIB, CONFIG_SQUASHFS_XZ or
+// CONFIG_SQUASHFS_ZSTD to read them.
+const (
+	Gzip Compression = 1
+	XZ   Compression = 4
+	Zstd Compression = 6
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case XZ:
+		return "xz"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", uint16(c))
+}
+
+const (
+	magic          = 0x73717368
+	superblockSize = 96
+
+	// metadataSize is the uncompressed size of the blocks of the inode,
+	// directory, fragment, ID and xattr tables.
+	metadataSize = 8192
+
+	// Flags of the size of metadata and data blocks telling that the
+	// block is stored uncompressed.
+	metadataUncompressed = 0x8000
+	dataUncompressed     = 1 << 24
+
+	invalidTable = ^uint64(0)
+	noFragment   = 0xffffffff
+	noXattr      = 0xffffffff
+
+	defaultBlockSize = 128 << 10
+	minBlockSize     = 4 << 10
+	maxBlockSize     = 1 << 20
+
+	// maxDirRun is the number of directory entries sharing a header.
+	maxDirRun = 256
+
+	maxNameLen = 256
+
+	flagDuplicates = 0x0040
+	flagNoXattrs   = 0x0200
+)
+
+// Inode types. Directory entries use the basic types.
+const (
+	typeDir = iota + 1
+	typeFile
+	typeSymlink
+	typeBlock
+	typeChar
+	typeFifo
+	typeSocket
+	typeExtDir
+	typeExtFile
+	typeExtSymlink
+	typeExtBlock
+	typeExtChar
+	typeExtFifo
+	typeExtSocket
+)
+
+// ErrTooManyIDs is returned when an image would have more distinct user
+// and group IDs than SquashFS can store.
+var ErrTooManyIDs = errors.New("squashfs: more than 65536 distinct user and group IDs")
+
+// CommandLine returns the kernel command line args with the arguments
+// mounting the SquashFS image on the block device root, such as /dev/vda,
+// as the read-only root file system.
+func CommandLine(args, root string) string {
+	c := cmdline.Parse(args)
+	c.Set("root", root)
+	c.Set("rootfstype", "squashfs")
+	c.Delete("rw")
+	c.SetFlag("ro")
+	return c.String()
+}
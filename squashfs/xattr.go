@@ -0,0 +1,77 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Extended attribute name types.
+const (
+	xattrUser     = 0
+	xattrTrusted  = 1
+	xattrSecurity = 2
+)
+
+var xattrPrefixes = []struct {
+	typ    uint16
+	prefix string
+}{
+	{xattrUser, "user."},
+	{xattrTrusted, "trusted."},
+	{xattrSecurity, "security."},
+}
+
+// xattr is an extended attribute split into its name type and suffix.
+type xattr struct {
+	typ   uint16
+	name  string
+	value []byte
+}
+
+// makeXattrs converts a map of full attribute names to sorted attributes.
+func makeXattrs(m map[string][]byte) ([]xattr, error) {
+	attrs := make([]xattr, 0, len(m))
+	for name, value := range m {
+		a, ok := xattr{}, false
+		for _, p := range xattrPrefixes {
+			if strings.HasPrefix(name, p.prefix) {
+				a, ok = xattr{typ: p.typ, name: name[len(p.prefix):], value: value}, true
+				break
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unsupported extended attribute namespace %q", name)
+		}
+		if len(a.name) > 0xffff {
+			return nil, fmt.Errorf("extended attribute name %q too long", name)
+		}
+		attrs = append(attrs, a)
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		a, b := attrs[i], attrs[j]
+		if a.typ != b.typ {
+			return a.typ < b.typ
+		}
+		return a.name < b.name
+	})
+	return attrs, nil
+}
+
+// encodeXattrs returns the key and value pairs of attrs as stored in the
+// xattr table.
+func encodeXattrs(attrs []xattr) []byte {
+	var p []byte
+	for _, a := range attrs {
+		var hdr [4]byte
+		binary.LittleEndian.PutUint16(hdr[0:], a.typ)
+		binary.LittleEndian.PutUint16(hdr[2:], uint16(len(a.name)))
+		p = append(p, hdr[:]...)
+		p = append(p, a.name...)
+		binary.LittleEndian.PutUint32(hdr[0:], uint32(len(a.value)))
+		p = append(p, hdr[:]...)
+		p = append(p, a.value...)
+	}
+	return p
+}
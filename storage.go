@@ -6,7 +6,12 @@ package vz
 # include "virtualization.h"
 */
 import "C"
-import "runtime"
+import (
+	"errors"
+	"runtime"
+
+	"github.com/mac-vz/vz/diskimage"
+)
 
 type baseStorageDeviceAttachment struct{}
 
@@ -30,35 +35,80 @@ var _ StorageDeviceAttachment = (*DiskImageStorageDeviceAttachment)(nil)
 // Only raw data disk images are supported.
 // see: https://developer.apple.com/documentation/virtualization/vzdiskimagestoragedeviceattachment?language=objc
 type DiskImageStorageDeviceAttachment struct {
+	diskPath string
+	readOnly bool
 	pointer
 
+	// discard is set by WithEphemeral, and ephemeral is the clone of the
+	// disk image the attachment uses instead of the image itself.
+	discard   bool
+	ephemeral *diskimage.Ephemeral
+
 	*baseStorageDeviceAttachment
 }
 
+// DiskImageStorageDeviceAttachmentOption is an option for NewDiskImageStorageDeviceAttachment.
+type DiskImageStorageDeviceAttachmentOption func(a *DiskImageStorageDeviceAttachment)
+
+// WithEphemeral attaches a temporary writable clone of the disk image
+// instead of the image itself, so the disk image never changes.
+//
+// The clone is made with diskimage.NewEphemeral and removed when the
+// virtual machine using it stops, after which the virtual machine cannot be
+// started again. Clones left behind by processes that exit before their
+// virtual machine stopped are removed by the next call to
+// NewDiskImageStorageDeviceAttachment with this option.
+func WithEphemeral() DiskImageStorageDeviceAttachmentOption {
+	return func(a *DiskImageStorageDeviceAttachment) {
+		a.discard = true
+	}
+}
+
+var errEphemeralReadOnly = errors.New("vz: ephemeral disk images cannot be read-only")
+
 // NewDiskImageStorageDeviceAttachment initialize the attachment from a local file path.
 // Returns error is not nil, assigned with the error if the initialization failed.
 //
 // - diskPath is local file URL to the disk image in RAW format.
 // - readOnly if YES, the device attachment is read-only, otherwise the device can write data to the disk image.
-func NewDiskImageStorageDeviceAttachment(diskPath string, readOnly bool) (*DiskImageStorageDeviceAttachment, error) {
+func NewDiskImageStorageDeviceAttachment(diskPath string, readOnly bool, opts ...DiskImageStorageDeviceAttachmentOption) (*DiskImageStorageDeviceAttachment, error) {
+	attachment := &DiskImageStorageDeviceAttachment{
+		diskPath: diskPath,
+		readOnly: readOnly,
+	}
+	for _, opt := range opts {
+		opt(attachment)
+	}
+	if attachment.discard {
+		if readOnly {
+			return nil, errEphemeralReadOnly
+		}
+		e, err := diskimage.NewEphemeral(diskPath, "")
+		if err != nil {
+			return nil, err
+		}
+		attachment.ephemeral = e
+		attachment.diskPath = e.Path()
+	}
+
 	nserr := newNSErrorAsNil()
 	nserrPtr := nserr.Ptr()
 
-	diskPathChar := charWithGoString(diskPath)
+	diskPathChar := charWithGoString(attachment.diskPath)
 	defer diskPathChar.Free()
-	attachment := &DiskImageStorageDeviceAttachment{
-		pointer: pointer{
-			ptr: C.newVZDiskImageStorageDeviceAttachment(
-				diskPathChar.CString(),
-				C.bool(readOnly),
-				&nserrPtr,
-			),
-		},
+	attachment.pointer = pointer{
+		ptr: C.newVZDiskImageStorageDeviceAttachment(
+			diskPathChar.CString(),
+			C.bool(readOnly),
+			&nserrPtr,
+		),
 	}
 	if err := newNSError(nserrPtr); err != nil {
+		attachment.ephemeral.Remove()
 		return nil, err
 	}
 	runtime.SetFinalizer(attachment, func(self *DiskImageStorageDeviceAttachment) {
+		self.ephemeral.Remove()
 		self.Release()
 	})
 	return attachment, nil
@@ -86,6 +136,7 @@ var _ StorageDeviceConfiguration = (*VirtioBlockDeviceConfiguration)(nil)
 // like VZDiskImageStorageDeviceAttachment.
 // see: https://developer.apple.com/documentation/virtualization/vzvirtioblockdeviceconfiguration?language=objc
 type VirtioBlockDeviceConfiguration struct {
+	attachment StorageDeviceAttachment
 	pointer
 
 	*baseStorageDeviceConfiguration
@@ -96,6 +147,7 @@ type VirtioBlockDeviceConfiguration struct {
 // - attachment The storage device attachment. This defines how the virtualized device operates on the host side.
 func NewVirtioBlockDeviceConfiguration(attachment StorageDeviceAttachment) *VirtioBlockDeviceConfiguration {
 	config := &VirtioBlockDeviceConfiguration{
+		attachment: attachment,
 		pointer: pointer{
 			ptr: C.newVZVirtioBlockDeviceConfiguration(
 				attachment.Ptr(),
@@ -107,3 +159,18 @@ func NewVirtioBlockDeviceConfiguration(attachment StorageDeviceAttachment) *Virt
 	})
 	return config
 }
+
+// diskImages returns the disk image attachments of the storage devices in cs.
+func diskImages(cs []StorageDeviceConfiguration) []*DiskImageStorageDeviceAttachment {
+	var ret []*DiskImageStorageDeviceAttachment
+	for _, c := range cs {
+		config, ok := c.(*VirtioBlockDeviceConfiguration)
+		if !ok {
+			continue
+		}
+		if attachment, ok := config.attachment.(*DiskImageStorageDeviceAttachment); ok {
+			ret = append(ret, attachment)
+		}
+	}
+	return ret
+}
@@ -7,10 +7,13 @@ package vz
 */
 import "C"
 import (
+	"errors"
+	"fmt"
 	"runtime"
 	"sync"
 	"unsafe"
 
+	"github.com/mac-vz/vz/diskimage"
 	"github.com/rs/xid"
 )
 
@@ -71,6 +74,9 @@ type VirtualMachine struct {
 	pointer
 	dispatchQueue unsafe.Pointer
 
+	// disk images attached to the virtual machine, locked while it is running.
+	diskImages []*DiskImageStorageDeviceAttachment
+
 	mu sync.Mutex
 }
 
@@ -78,6 +84,8 @@ type (
 	machineStatus struct {
 		state       VirtualMachineState
 		stateNotify chan VirtualMachineState
+		diskLocks   []*diskimage.Lock
+		ephemeral   []*diskimage.Ephemeral
 
 		mu sync.RWMutex
 	}
@@ -104,9 +112,17 @@ func NewVirtualMachine(config *VirtualMachineConfiguration) *VirtualMachine {
 	id := xid.New().String()
 	cs := charWithGoString(id)
 	defer cs.Free()
+	disks := diskImages(config.storageDevices)
+	var ephemeral []*diskimage.Ephemeral
+	for _, d := range disks {
+		if d.ephemeral != nil {
+			ephemeral = append(ephemeral, d.ephemeral)
+		}
+	}
 	statuses[id] = &machineStatus{
 		state:       VirtualMachineState(0),
 		stateNotify: make(chan VirtualMachineState),
+		ephemeral:   ephemeral,
 	}
 	handlers[id] = &machineHandlers{
 		start:  func(error) {},
@@ -124,6 +140,7 @@ func NewVirtualMachine(config *VirtualMachineConfiguration) *VirtualMachine {
 			),
 		},
 		dispatchQueue: dispatchQueue,
+		diskImages:    disks,
 	}
 	runtime.SetFinalizer(v, func(self *VirtualMachine) {
 		releaseDispatch(self.dispatchQueue)
@@ -161,6 +178,10 @@ func changeStateOnObserver(state C.int, cID *C.char) {
 	v.mu.Lock()
 	newState := VirtualMachineState(state)
 	v.state = newState
+	if newState == VirtualMachineStateStopped || newState == VirtualMachineStateError {
+		v.unlockDiskImages()
+		v.removeEphemeralDisks()
+	}
 	// for non-blocking
 	go func() { v.stateNotify <- newState }()
 	statuses[id.String()] = v
@@ -249,12 +270,95 @@ func makeHandler(fn func(error)) (func(error), chan struct{}) {
 	}, done
 }
 
+// lockDiskImages locks the disk images of the virtual machine so offline
+// tools in the diskimage package refuse to modify them while it is running.
+func (v *VirtualMachine) lockDiskImages() error {
+	val, _ := statuses[v.id]
+	val.mu.Lock()
+	defer val.mu.Unlock()
+	if len(val.diskLocks) > 0 {
+		return nil
+	}
+	locks := make([]*diskimage.Lock, 0, len(v.diskImages))
+	for _, d := range v.diskImages {
+		lock, err := diskimage.LockFile(d.diskPath, !d.readOnly)
+		if err != nil {
+			val.diskLocks = locks
+			val.unlockDiskImages()
+			return err
+		}
+		locks = append(locks, lock)
+	}
+	val.diskLocks = locks
+	return nil
+}
+
+// unlockDiskImages releases the disk image locks. The caller must hold s.mu.
+func (s *machineStatus) unlockDiskImages() {
+	for _, lock := range s.diskLocks {
+		lock.Unlock()
+	}
+	s.diskLocks = nil
+}
+
+// ErrNotPaused is returned by CloneDiskImage when the virtual machine is
+// not paused.
+var ErrNotPaused = errors.New("vz: virtual machine is not paused")
+
+// CloneDiskImage makes a copy-on-write clone of the disk image of attachment
+// at dst, using diskimage.CloneDisk, while the virtual machine is paused.
+// The clone is crash-consistent: it holds what the guest had written when
+// it was paused, but not data still cached by the guest, so guests should
+// sync their file systems before being paused.
+//
+// It allows backing up disk images of a running virtual machine by pausing
+// it briefly, cloning its disks, resuming it and backing up the clones.
+func (v *VirtualMachine) CloneDiskImage(attachment *DiskImageStorageDeviceAttachment, dst string) error {
+	val, _ := statuses[v.id]
+	val.mu.RLock()
+	defer val.mu.RUnlock()
+	if val.state != VirtualMachineStatePaused {
+		return ErrNotPaused
+	}
+	for i, d := range v.diskImages {
+		if d == attachment && i < len(val.diskLocks) {
+			return val.diskLocks[i].CloneDisk(dst)
+		}
+	}
+	return fmt.Errorf("vz: %s is not attached to the virtual machine", attachment.diskPath)
+}
+
+// removeEphemeralDisks discards the ephemeral disk images of a virtual
+// machine that stopped. The caller must hold s.mu.
+func (s *machineStatus) removeEphemeralDisks() {
+	for _, e := range s.ephemeral {
+		e.Remove()
+	}
+	s.ephemeral = nil
+}
+
 // Start a virtual machine that is in either Stopped or Error state.
 //
+// The disk images attached to the virtual machine are locked until it stops;
+// if one of them is in use by another virtual machine or maintenance operation
+// fn is called with the locking error and the virtual machine is not started.
+//
 // - fn parameter called after the virtual machine has been successfully started or on error.
 // The error parameter passed to the block is null if the start was successful.
 func (v *VirtualMachine) Start(fn func(error)) {
-	h, done := makeHandler(fn)
+	if err := v.lockDiskImages(); err != nil {
+		fn(err)
+		return
+	}
+	h, done := makeHandler(func(err error) {
+		if err != nil {
+			val, _ := statuses[v.id]
+			val.mu.Lock()
+			val.unlockDiskImages()
+			val.mu.Unlock()
+		}
+		fn(err)
+	})
 	handlers[v.id].start = h
 	cid := charWithGoString(v.id)
 	defer cid.Free()
@@ -574,6 +574,14 @@ void setNetworkDevicesVZMACAddress(void *config, void *macAddress)
     [(VZNetworkDeviceConfiguration *)config setMACAddress:[(VZMACAddress *)macAddress copy]];
 }
 
+/*!
+ @abstract Returns a copy of the media access control address of the device.
+ */
+void *getNetworkDevicesVZMACAddress(void *config)
+{
+    return [[(VZNetworkDeviceConfiguration *)config MACAddress] copy];
+}
+
 /*!
  @abstract The address represented as a string.
  @discussion
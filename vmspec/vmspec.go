@@ -0,0 +1,167 @@
+// Package vmspec describes ready-to-boot Linux virtual machines: a kernel,
+// an optional initial RAM disk, a command line and disk images, stored as
+// JSON next to the files they refer to.
+//
+// A spec is produced by the image tools of this module and turned into a
+// configuration with vz.NewVirtualMachineConfigurationFromSpec:
+//
+//	spec, _ := vmspec.Load("alpine.vm/spec.json")
+//	config, _ := vz.NewVirtualMachineConfigurationFromSpec(spec)
+//
+// The package does not depend on the Virtualization framework, so specs can
+// be written on any host.
+package vmspec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Defaults for the machine size of a spec.
+const (
+	DefaultCPUCount   = 2
+	DefaultMemorySize = 1 << 30
+)
+
+// VirtualMachineSpec is a Linux virtual machine booted with a
+// LinuxBootLoader from virtio block devices.
+type VirtualMachineSpec struct {
+	// Kernel is the path of the uncompressed kernel image.
+	Kernel string `json:"kernel"`
+
+	// Initrd is the path of the initial RAM disk, if any.
+	Initrd string `json:"initrd,omitempty"`
+
+	CommandLine string `json:"commandLine"`
+
+	// CPUCount and MemorySize default to DefaultCPUCount and
+	// DefaultMemorySize when zero.
+	CPUCount   uint   `json:"cpuCount,omitempty"`
+	MemorySize uint64 `json:"memorySize,omitempty"`
+
+	// Disks are attached in order, so the first disk is /dev/vda.
+	Disks []Disk `json:"disks,omitempty"`
+}
+
+// Disk is a raw disk image attached as a virtio block device.
+type Disk struct {
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// Validate reports the first missing or inconsistent field of s.
+func (s *VirtualMachineSpec) Validate() error {
+	if s.Kernel == "" {
+		return errors.New("vmspec: missing kernel")
+	}
+	if s.MemorySize%(1<<20) != 0 {
+		return fmt.Errorf("vmspec: memory size %d is not a multiple of 1 MiB", s.MemorySize)
+	}
+	for i, d := range s.Disks {
+		if d.Path == "" {
+			return fmt.Errorf("vmspec: disk %d has no path", i)
+		}
+	}
+	return nil
+}
+
+// CPUs returns the CPU count of s, or DefaultCPUCount.
+func (s *VirtualMachineSpec) CPUs() uint {
+	if s.CPUCount == 0 {
+		return DefaultCPUCount
+	}
+	return s.CPUCount
+}
+
+// Memory returns the memory size of s in bytes, or DefaultMemorySize.
+func (s *VirtualMachineSpec) Memory() uint64 {
+	if s.MemorySize == 0 {
+		return DefaultMemorySize
+	}
+	return s.MemorySize
+}
+
+// Load reads the spec at path. Relative file paths in the spec are
+// relative to the directory containing it and are returned as absolute
+// paths.
+func Load(path string) (*VirtualMachineSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &VirtualMachineSpec{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("vmspec: %s: %w", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, filepath.FromSlash(p))
+	}
+	s.Kernel = resolve(s.Kernel)
+	s.Initrd = resolve(s.Initrd)
+	for i := range s.Disks {
+		s.Disks[i].Path = resolve(s.Disks[i].Path)
+	}
+	return s, nil
+}
+
+// Save writes s to path, replacing any existing file. File paths inside
+// the directory containing path are stored relative to it, so the
+// directory can be moved as a whole.
+func (s *VirtualMachineSpec) Save(path string) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	relative := func(p string) string {
+		if p == "" {
+			return p
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return p
+		}
+		rel, err := filepath.Rel(dir, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return abs
+		}
+		return filepath.ToSlash(rel)
+	}
+	v := *s
+	v.Kernel = relative(s.Kernel)
+	v.Initrd = relative(s.Initrd)
+	v.Disks = make([]Disk, len(s.Disks))
+	for i, d := range s.Disks {
+		v.Disks[i] = Disk{Path: relative(d.Path), ReadOnly: d.ReadOnly}
+	}
+	data, err := json.MarshalIndent(&v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}